@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// auditor collects audit findings and prints them as it goes, as doctor
+// does for setup problems, or in batch mode all at once as JSON.
+type auditor struct {
+	Findings []auditFinding `json:"findings"`
+	Keys     []keyReport    `json:"keys"`
+	Risks    int            `json:"risks"`
+	Advices  int            `json:"recommendations"`
+
+	// section is the heading findings are currently filed under
+	section string
+}
+
+// auditFinding is one finding: ok, info, warn, or risk.
+type auditFinding struct {
+	Section   string `json:"section"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Recommend string `json:"recommend,omitempty"`
+}
+
+// startSection begins the findings under a heading.
+func (a *auditor) startSection(name string) {
+	if a.section != "" {
+		humanf("\n")
+	}
+	a.section = name
+	humanf("%s\n", name)
+}
+
+func (a *auditor) ok(format string, args ...any) {
+	a.record("ok", "", format, args...)
+}
+
+func (a *auditor) info(format string, args ...any) {
+	a.record("info", "", format, args...)
+}
+
+func (a *auditor) warn(advice, format string, args ...any) {
+	a.Advices++
+	a.record("warn", advice, format, args...)
+}
+
+func (a *auditor) risk(advice, format string, args ...any) {
+	a.Risks++
+	a.record("risk", advice, format, args...)
+}
+
+func (a *auditor) record(level, advice, format string, args ...any) {
+	finding := auditFinding{Section: a.section, Level: level, Message: fmt.Sprintf(format, args...), Recommend: advice}
+	a.Findings = append(a.Findings, finding)
+	label := map[string]string{"ok": "[ok]  ", "info": "[info]", "warn": "[warn]", "risk": "[RISK]"}[level]
+	humanf("%s %s\n", label, finding.Message)
+	if advice != "" {
+		humanf("       recommend: %s\n", advice)
+	}
+}
+
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	addBatchFlag(fs)
+	verbose := fs.Bool("v", false, "Enable verbose logging")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s audit [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reports who can reach the proxy, which keys it exposes, and which\n")
+		fmt.Fprintf(os.Stderr, "policies the running proxy enforces, with recommendations. Run it\n")
+		fmt.Fprintf(os.Stderr, "before serving the proxy on a shared host. Exits 1 if it finds risks.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+	status, listeners, running := auditStatus(proxySocket, logger)
+
+	a := &auditor{Keys: []keyReport{}}
+	a.startSection("Access")
+	a.auditSocket("Proxy socket", proxySocket)
+	a.auditSocket("Control socket", defaultControlSocket(proxySocket))
+	for _, listener := range listeners {
+		if addr, ok := strings.CutPrefix(listener, "tcp:"); ok {
+			a.auditTCP(addr)
+		} else if listener != proxySocket {
+			a.auditSocket("Extra socket", listener)
+		}
+	}
+	a.info("root, and any process running as you, can always use the proxy")
+	if os.Getenv("SSH_CONNECTION") != "" {
+		a.info("This is an SSH login, so keys may come from your forwarded agent; root here can use them while you're connected")
+	}
+
+	a.startSection("Keys")
+	a.auditKeys(proxySocket, status.Policies)
+
+	a.startSection("Policies")
+	if running {
+		a.auditPolicies(status.Policies)
+	} else {
+		a.warn("start the proxy, then audit again", "Couldn't read the running proxy's policies")
+	}
+
+	if batchMode {
+		printJSON(a)
+		if a.Risks > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Println()
+	switch {
+	case a.Risks > 0:
+		fmt.Printf("%d risk(s) found, %d recommendation(s)\n", a.Risks, a.Advices)
+		os.Exit(1)
+	case a.Advices > 0:
+		fmt.Printf("No risks found, %d recommendation(s)\n", a.Advices)
+	default:
+		fmt.Println("No risks found")
+	}
+}
+
+// auditStatus reads the running proxy's status and listeners from the
+// runtime state it publishes, or else its control socket, reporting false
+// if neither is available.
+func auditStatus(proxySocket string, logger *slog.Logger) (proxy.Status, []string, bool) {
+	if state, ok := readRuntimeState(proxySocket, logger); ok {
+		return state.Status, state.Listeners, true
+	}
+	var status proxy.Status
+	result, err := proxy.ControlRequest(defaultControlSocket(proxySocket), "status")
+	if err != nil {
+		logger.Debug("Control socket unavailable", "error", err)
+		return status, nil, false
+	}
+	return status, nil, json.Unmarshal(result, &status) == nil
+}
+
+// auditSocket reports who besides the current user can connect to the
+// socket at path, or replace it.
+func (a *auditor) auditSocket(what, path string) {
+	if proxy.IsAbstractSocket(path) {
+		a.info("%s %s is abstract, so file permissions don't apply; the proxy only admits your user", what, path)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if what == "Proxy socket" {
+			a.warn("start the proxy, then audit again", "%s %s doesn't exist", what, path)
+		}
+		return
+	}
+
+	perm := info.Mode().Perm()
+	if uid, ok := fileUID(info); ok && uid != os.Getuid() {
+		a.risk(fmt.Sprintf("remove %s and restart the proxy as yourself", path),
+			"%s %s is owned by uid %d, not you", what, path, uid)
+	}
+	switch {
+	case perm&0006 != 0:
+		if dir := closedDir(path, 0001); dir != "" {
+			a.warn(fmt.Sprintf("chmod 600 %s", path),
+				"%s %s is open to every user (mode %04o), though %s keeps them out for now", what, path, perm, dir)
+		} else {
+			a.risk(fmt.Sprintf("chmod 600 %s, or use --socket-mode", path),
+				"%s %s can be used by every user on this host (mode %04o)", what, path, perm)
+		}
+	case perm&0060 != 0:
+		group := "its group"
+		if gid, ok := fileGID(info); ok {
+			group = "group " + strconv.Itoa(gid)
+			if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+				group = "group " + g.Name
+				if u, err := user.Current(); err == nil && g.Name == u.Username {
+					a.ok("%s %s is shared only with your personal %s (mode %04o)", what, path, group, perm)
+					break
+				}
+			}
+		}
+		if dir := closedDir(path, 0010); dir != "" {
+			a.ok("%s %s is shared with %s, but %s keeps its members out (mode %04o)", what, path, group, dir, perm)
+			break
+		}
+		a.warn(fmt.Sprintf("chmod 600 %s unless every member of %s should use your keys", path, group),
+			"%s %s can be used by members of %s (mode %04o)", what, path, group, perm)
+	default:
+		a.ok("%s %s is only usable by you (mode %04o)", what, path, perm)
+	}
+
+	// Whoever can write to a directory on the way can swap in their own
+	// socket and see what clients ask to sign
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirInfo, err := os.Stat(dir)
+		if err != nil {
+			break
+		}
+		dirPerm := dirInfo.Mode().Perm()
+		sticky := dirInfo.Mode()&os.ModeSticky != 0
+		uid, hasUID := fileUID(dirInfo)
+		switch {
+		case hasUID && uid != 0 && uid != os.Getuid():
+			a.risk(fmt.Sprintf("move the socket to a directory you own, such as %s", defaultSocketArg()),
+				"Directory %s belongs to uid %d, who could replace %s", dir, uid, path)
+		case dirPerm&0002 != 0 && !sticky:
+			a.risk(fmt.Sprintf("chmod o-w %s, or move the socket", dir),
+				"Directory %s is writable by every user, who could replace %s", dir, path)
+		case dirPerm&0020 != 0 && !sticky:
+			a.warn(fmt.Sprintf("chmod g-w %s, or move the socket", dir),
+				"Directory %s is writable by its group, whose members could replace %s", dir, path)
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+}
+
+// closedDir returns the first directory above path without the execute
+// bit in mask, which keeps those users from reaching anything inside.
+func closedDir(path string, mask os.FileMode) string {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil && info.Mode().Perm()&mask == 0 {
+			return dir
+		}
+		if dir == filepath.Dir(dir) {
+			return ""
+		}
+	}
+}
+
+// auditTCP reports who can reach the proxy's TCP listener at addr.
+func (a *auditor) auditTCP(addr string) {
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		a.warn("prefer the unix socket, which file permissions protect",
+			"Also served on TCP %s, where any local user holding the token can connect", addr)
+		return
+	}
+	a.risk("listen on 127.0.0.1 and tunnel with ssh -L, or keep TLS client certificates required",
+		"Also served on TCP %s, reachable from other hosts", addr)
+}
+
+// auditKeys lists the keys the proxy exposes and flags weak ones, and keys
+// every server gets to see.
+func (a *auditor) auditKeys(proxySocket string, policies proxy.Policies) {
+	identities, err := proxy.ListIdentities(proxySocket)
+	if err != nil {
+		a.warn("", "Couldn't list keys through the proxy: %v", err)
+		return
+	}
+	if len(identities) == 0 {
+		a.ok("The proxy exposes no keys")
+		return
+	}
+
+	a.info("The proxy exposes %d key(s):", len(identities))
+	for _, id := range identities {
+		a.Keys = append(a.Keys, newKeyReport(id))
+		humanf("         %d %s %s (%s)\n", id.Bits(), id.Fingerprint(), id.Comment, displayKeyType(id.Type()))
+	}
+	for _, id := range identities {
+		switch {
+		case id.Type() == "ssh-dss":
+			a.risk("replace it with an Ed25519 key", "%s is a DSA key, which OpenSSH no longer accepts", id.Comment)
+		case id.Type() == "ssh-rsa" && id.Bits() < 2048:
+			a.risk("replace it with an Ed25519 key, or RSA of 3072 bits or more",
+				"%s is a %d-bit RSA key, too short to be safe", id.Comment, id.Bits())
+		}
+	}
+	if len(identities) > 1 && policies.KeyFilter == 0 && policies.HostRules == 0 {
+		a.warn("expose only the keys each host needs, with profile host rules or --socket ';key=' filters",
+			"Every server you log in to can see all %d key fingerprints, linking your identities across services", len(identities))
+	}
+}
+
+// auditPolicies reports the restrictions the running proxy enforces.
+func (a *auditor) auditPolicies(p proxy.Policies) {
+	switch {
+	case p.DestinationRules > 0 || p.HostRules > 0:
+		if p.DestinationRules > 0 {
+			a.ok("A destination policy limits %d key(s) to particular hosts", p.DestinationRules)
+		}
+		if p.HostRules > 0 {
+			a.ok("%d host rule(s) limit which keys each host sees", p.HostRules)
+		}
+	default:
+		a.warn("limit keys to the hosts they're for with --destination-policy or profile host rules",
+			"Keys can sign for any host a client is connected to")
+	}
+
+	if p.KeyFilter > 0 {
+		a.ok("Clients see only %d allowed key(s)", p.KeyFilter)
+	}
+	if p.ConfirmSign {
+		a.ok("Every signature must be confirmed")
+	} else {
+		a.warn("on shared hosts, require confirmation with ';confirm' or a profile's confirm",
+			"Signatures aren't confirmed, so anything that can reach the socket signs silently")
+	}
+
+	if p.BlockExtensions {
+		a.ok("Unknown agent extensions are refused")
+	} else {
+		a.warn("--block-unknown-extensions", "Unknown agent extensions are forwarded upstream")
+	}
+
+	if p.SignRate > 0 {
+		a.ok("Sign requests are limited to %g per second per client", p.SignRate)
+	} else {
+		a.info("Sign requests aren't rate limited (--sign-rate)")
+	}
+
+	if p.AddConfirm || p.AddMaxLifetime > 0 {
+		a.ok("Keys added through the proxy are constrained (confirm: %t, max lifetime: %v)", p.AddConfirm, p.AddMaxLifetime)
+	} else {
+		a.info("Keys added through the proxy keep the constraints their client asks for (--add-confirm, --add-max-lifetime)")
+	}
+}
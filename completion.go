@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completionHelpTimeout bounds each help invocation completion reads flags
+// from.
+const completionHelpTimeout = 5 * time.Second
+
+var (
+	// helpFlagLine matches a flag in help output, in either flag.PrintDefaults
+	// form ("  -name string") or the proxy's own ("  -v, --verbose").
+	helpFlagLine = regexp.MustCompile(`^\s+(-{1,2}[a-zA-Z][\w-]*)(?:,\s+(-{1,2}[a-zA-Z][\w-]*))?`)
+
+	// helpCommandLine matches an entry in the proxy's "Commands:" list.
+	helpCommandLine = regexp.MustCompile(`^  ([a-z][\w-]*)\s{2,}(.+)$`)
+)
+
+// commandCompletion is what completes after one subcommand, or after none
+// for the proxy itself.
+type commandCompletion struct {
+	name        string
+	description string
+	flags       []string // without dashes
+}
+
+func runCompletion(args []string) {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	addBatchFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s completion <bash|zsh|fish>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints a completion script for every subcommand and flag. Load it from\n")
+		fmt.Fprintf(os.Stderr, "shell init:\n\n")
+		fmt.Fprintf(os.Stderr, "  source <(%s completion bash)               # bash\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  source <(%s completion zsh)                # zsh\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s completion fish | source                # fish\n", os.Args[0])
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var generate func(proxyCmd commandCompletion, commands []commandCompletion) string
+	switch fs.Arg(0) {
+	case "bash":
+		generate = bashCompletion
+	case "zsh":
+		generate = zshCompletion
+	case "fish":
+		generate = fishCompletion
+	default:
+		exitError("unsupported shell %q (want bash, zsh, or fish)", fs.Arg(0))
+	}
+
+	proxyCmd, commands, err := collectCompletions()
+	if err != nil {
+		exitError("%v", err)
+	}
+	script := generate(proxyCmd, commands)
+	if batchMode {
+		printJSON(completionReport{Shell: fs.Arg(0), Script: script})
+		return
+	}
+	fmt.Print(script)
+}
+
+// completionReport is what completion prints in batch mode.
+type completionReport struct {
+	Shell  string `json:"shell"`
+	Script string `json:"script"`
+}
+
+// collectCompletions reads the proxy's flags, its subcommands, and their
+// flags from help output. Subcommands define their flags only when they
+// run, so asking for help is the one way to list them that can't drift.
+func collectCompletions() (commandCompletion, []commandCompletion, error) {
+	mainHelp, err := helpOutput()
+	if err != nil {
+		return commandCompletion{}, nil, err
+	}
+	proxyCmd := commandCompletion{flags: helpFlags(mainHelp)}
+
+	descriptions := helpCommands(mainHelp)
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	commands := make([]commandCompletion, 0, len(names))
+	for _, name := range names {
+		help, err := helpOutput(name)
+		if err != nil {
+			return commandCompletion{}, nil, err
+		}
+		commands = append(commands, commandCompletion{
+			name:        name,
+			description: descriptions[name],
+			flags:       helpFlags(help),
+		})
+	}
+	return proxyCmd, commands, nil
+}
+
+// helpOutput runs this executable with args and -h and returns what it
+// printed.
+func helpOutput(args ...string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find executable: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionHelpTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, append(args, "-h")...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Help exits 0, or 2 for flag sets that treat -h as an error
+	if err := cmd.Run(); err != nil && cmd.ProcessState == nil {
+		return "", fmt.Errorf("failed to read help for %q: %w", strings.Join(args, " "), err)
+	}
+	return out.String(), nil
+}
+
+// helpFlags lists the flags named in help output, without dashes.
+func helpFlags(help string) []string {
+	seen := make(map[string]bool)
+	var flags []string
+	for _, line := range strings.Split(help, "\n") {
+		m := helpFlagLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		for _, name := range m[1:] {
+			name = strings.TrimLeft(name, "-")
+			if name != "" && !seen[name] {
+				seen[name] = true
+				flags = append(flags, name)
+			}
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// helpCommands maps subcommand names to their descriptions in the proxy's
+// "Commands:" list.
+func helpCommands(help string) map[string]string {
+	commands := make(map[string]string)
+	inCommands := false
+	for _, line := range strings.Split(help, "\n") {
+		switch {
+		case line == "Commands:":
+			inCommands = true
+		case line == "":
+			inCommands = false
+		case inCommands:
+			if m := helpCommandLine.FindStringSubmatch(line); m != nil {
+				commands[m[1]] = strings.TrimSpace(m[2])
+			}
+		}
+	}
+	return commands
+}
+
+// dashed renders flag names as --name, or -n for single letters.
+func dashed(flags []string) string {
+	words := make([]string, len(flags))
+	for i, name := range flags {
+		if len(name) == 1 {
+			words[i] = "-" + name
+		} else {
+			words[i] = "--" + name
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func bashCompletion(proxyCmd commandCompletion, commands []commandCompletion) string {
+	var b strings.Builder
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+
+	b.WriteString("# bash completion for double-agent\n")
+	b.WriteString("_double_agent() {\n")
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" flags\n")
+	b.WriteString("    case \"${COMP_WORDS[1]}\" in\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "    %s) flags=%q ;;\n", c.name, dashed(c.flags))
+	}
+	b.WriteString("    *)\n")
+	b.WriteString("        if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n")
+	fmt.Fprintf(&b, "            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("            [[ ${#COMPREPLY[@]} -gt 0 ]] && return\n")
+	b.WriteString("        fi\n")
+	fmt.Fprintf(&b, "        flags=%q ;;\n", dashed(proxyCmd.flags))
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ $cur == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o default -F _double_agent double-agent\n")
+	return b.String()
+}
+
+func zshCompletion(proxyCmd commandCompletion, commands []commandCompletion) string {
+	var b strings.Builder
+	b.WriteString("#compdef double-agent\n")
+	b.WriteString("# zsh completion for double-agent\n")
+	b.WriteString("_double_agent() {\n")
+	b.WriteString("    local -a subcmds flags\n")
+	b.WriteString("    subcmds=(\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "        %s\n", zshQuote(c.name+":"+c.description))
+	}
+	b.WriteString("    )\n")
+	b.WriteString("    case $words[2] in\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "    %s) flags=(%s) ;;\n", c.name, dashed(c.flags))
+	}
+	b.WriteString("    *)\n")
+	b.WriteString("        if (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n")
+	b.WriteString("            _describe 'command' subcmds\n")
+	b.WriteString("            _files\n")
+	b.WriteString("            return\n")
+	b.WriteString("        fi\n")
+	fmt.Fprintf(&b, "        flags=(%s) ;;\n", dashed(proxyCmd.flags))
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ $PREFIX == -* ]]; then\n")
+	b.WriteString("        compadd -- $flags\n")
+	b.WriteString("    else\n")
+	b.WriteString("        _files\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	b.WriteString("compdef _double_agent double-agent\n")
+	return b.String()
+}
+
+func fishCompletion(proxyCmd commandCompletion, commands []commandCompletion) string {
+	var b strings.Builder
+	b.WriteString("# fish completion for double-agent\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c double-agent -n __fish_use_subcommand -f -a %s -d %s\n",
+			c.name, fishQuote(c.description))
+	}
+	for _, name := range proxyCmd.flags {
+		fmt.Fprintf(&b, "complete -c double-agent -n __fish_use_subcommand %s\n", fishFlag(name))
+	}
+	for _, c := range commands {
+		for _, name := range c.flags {
+			fmt.Fprintf(&b, "complete -c double-agent -n '__fish_seen_subcommand_from %s' %s\n", c.name, fishFlag(name))
+		}
+	}
+	return b.String()
+}
+
+// fishFlag renders a flag for fish's complete: -s for single letters,
+// -l otherwise.
+func fishFlag(name string) string {
+	if len(name) == 1 {
+		return "-s " + name
+	}
+	return "-l " + name
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
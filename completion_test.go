@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testCompletions describes every subcommand, with a description that
+// needs quoting, the way collectCompletions would from help output.
+func testCompletions() (commandCompletion, []commandCompletion) {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	commands := make([]commandCompletion, len(names))
+	for i, name := range names {
+		commands[i] = commandCompletion{
+			name:        name,
+			description: "Run " + name + " (it's a test)",
+			flags:       []string{"socket", "v"},
+		}
+	}
+	return commandCompletion{flags: []string{"verbose", "v"}}, commands
+}
+
+func TestCompletionScripts(t *testing.T) {
+	proxyCmd, commands := testCompletions()
+	for shell, generate := range map[string]func(commandCompletion, []commandCompletion) string{
+		"bash": bashCompletion,
+		"zsh":  zshCompletion,
+		"fish": fishCompletion,
+	} {
+		t.Run(shell, func(t *testing.T) {
+			script := generate(proxyCmd, commands)
+			for _, c := range commands {
+				if !strings.Contains(script, c.name) {
+					t.Errorf("Expected subcommand %s in the %s script", c.name, shell)
+				}
+			}
+
+			// Have the shell check the syntax where it's installed
+			path, err := exec.LookPath(shell)
+			if err != nil {
+				return
+			}
+			file := filepath.Join(t.TempDir(), "completion."+shell)
+			if err := os.WriteFile(file, []byte(script), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if out, err := exec.Command(path, "-n", file).CombinedOutput(); err != nil {
+				t.Errorf("%s -n rejected the script: %v\n%s\n%s", shell, err, out, script)
+			}
+		})
+	}
+}
+
+func TestZshCompletionArray(t *testing.T) {
+	proxyCmd, commands := testCompletions()
+	lines := strings.Split(zshCompletion(proxyCmd, commands), "\n")
+
+	start := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "subcmds=(" {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		t.Fatalf("Expected the script to open the subcmds array:\n%s", strings.Join(lines, "\n"))
+	}
+	// One quoted entry per subcommand, then the closing parenthesis
+	for i, c := range commands {
+		entry := strings.TrimSpace(lines[start+1+i])
+		if !strings.HasPrefix(entry, "'"+c.name+":") || !strings.HasSuffix(entry, "'") {
+			t.Errorf("Expected an entry for %s, got %q", c.name, entry)
+		}
+	}
+	if end := strings.TrimSpace(lines[start+1+len(commands)]); end != ")" {
+		t.Errorf("Expected the subcmds array closed after its entries, got %q", end)
+	}
+}
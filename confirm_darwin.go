@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// touchIDScript asks LocalAuthentication to confirm the reason in argv[0],
+// which takes Touch ID or an Apple Watch where the Mac has one and the
+// login password otherwise. It prints "unavailable" when the policy can't
+// be evaluated, such as outside a GUI session.
+const touchIDScript = `
+ObjC.import('LocalAuthentication');
+ObjC.import('Foundation');
+function run(argv) {
+	// LAPolicyDeviceOwnerAuthentication
+	const policy = 2;
+	const context = $.LAContext.alloc.init;
+	if (!context.canEvaluatePolicyError(policy, null)) {
+		return 'unavailable';
+	}
+	let result = null;
+	context.evaluatePolicyLocalizedReasonReply(policy, argv[0], function(ok) {
+		result = ok ? 'allow' : 'deny';
+	});
+	while (result === null) {
+		$.NSRunLoop.currentRunLoop.runUntilDate($.NSDate.dateWithTimeIntervalSinceNow(0.1));
+	}
+	return result;
+}
+`
+
+// dialogScript shows a plain Allow/Deny dialog for argv[0], giving up (and
+// so denying) after a minute.
+const dialogScript = `
+on run argv
+	display dialog (item 1 of argv) with title "double-agent" buttons {"Deny", "Allow"} default button "Deny" cancel button "Deny" with icon caution giving up after 60
+	if gave up of result then return "deny"
+	return "allow"
+end run
+`
+
+// nativeConfirm asks the user to allow a signature with the macOS system
+// prompt: Touch ID where LocalAuthentication is available, and an Allow or
+// Deny dialog otherwise. reason completes LocalAuthentication's "is trying
+// to" sentence; prompt is shown in the dialog. It reports false for ok if
+// osascript can't be run at all.
+func nativeConfirm(reason, prompt string) (allowed, ok bool) {
+	out, err := exec.Command("osascript", "-l", "JavaScript", "-e", touchIDScript, reason).Output()
+	if err == nil && strings.TrimSpace(string(out)) != "unavailable" {
+		return strings.TrimSpace(string(out)) == "allow", true
+	}
+
+	out, err = exec.Command("osascript", "-e", dialogScript, prompt).Output()
+	if err != nil {
+		// Deny is the cancel button, which makes osascript fail
+		var exitErr *exec.ExitError
+		return false, errors.As(err, &exitErr)
+	}
+	return strings.TrimSpace(string(out)) == "allow", true
+}
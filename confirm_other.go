@@ -0,0 +1,9 @@
+//go:build !darwin
+
+package main
+
+// nativeConfirm reports that there's no system confirmation prompt outside
+// macOS, so confirmation needs $SSH_ASKPASS.
+func nativeConfirm(reason, prompt string) (allowed, ok bool) {
+	return false, false
+}
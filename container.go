@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+const (
+	containerSocketName = "agent.sock"
+	defaultMountPath    = "/run/double-agent"
+)
+
+var validContainerName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func runContainer(args []string) {
+	fs := flag.NewFlagSet("container", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		dir       = fs.String("dir", "", "Directory to create the socket in (default: per-container runtime dir)")
+		mountPath = fs.String("mount-path", defaultMountPath, "Where the directory is mounted inside the container")
+		uid       = fs.Int("uid", -1, "Give the socket to this UID (the container user; requires privileges)")
+		gid       = fs.Int("gid", -1, "Give the socket to this GID (requires privileges)")
+		anyUID    = fs.Bool("any-uid", false, "Let any UID connect, for containers whose user can't be mapped")
+		daemon    = fs.Bool("d", false, "Run as daemon (detach from terminal)")
+		logFile   = fs.String("log-file", "", "Write logs to this file with rotation (daemon default: state dir)")
+		verbose   = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s container [options] <container-name>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Serves the proxy socket inside a dedicated directory meant to be\n")
+		fmt.Fprintf(os.Stderr, "bind-mounted into a container or devcontainer. Mounting the directory\n")
+		fmt.Fprintf(os.Stderr, "rather than the socket keeps the mount valid across proxy and container\n")
+		fmt.Fprintf(os.Stderr, "restarts.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	name := fs.Arg(0)
+	if !validContainerName.MatchString(name) {
+		exitError("invalid container name %q", name)
+	}
+	if *anyUID && (*uid != -1 || *gid != -1) {
+		exitError("--any-uid and --uid/--gid are mutually exclusive")
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketDir := *dir
+	if socketDir == "" {
+		socketDir = containerDir(name, logger)
+	}
+	socketDir = expandPath(socketDir, logger)
+	proxySocket := filepath.Join(socketDir, containerSocketName)
+
+	if *daemon {
+		var flags []string
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "d" || f.Name == "dir" || f.Name == "log-file" {
+				return
+			}
+			flags = append(flags, "--"+f.Name+"="+f.Value.String())
+		})
+		logPath := *logFile
+		if logPath == "" {
+			logPath = filepath.Join(stateDir(logger), "container-"+name+".log")
+		}
+		flags = append(flags, "--dir="+socketDir, "--log-file="+logPath)
+
+		pid, err := startDaemon(append(append([]string{"container"}, flags...), name))
+		if err != nil {
+			logger.Error("Failed to start daemon", "error", err)
+			os.Exit(1)
+		}
+		if batchMode {
+			printJSON(containerReport{PID: pid, Log: logPath, Dir: socketDir, MountPath: *mountPath,
+				Socket: filepath.Join(*mountPath, containerSocketName)})
+			return
+		}
+		fmt.Printf("Double Agent daemon started for %s (PID: %d)\n", name, pid)
+		fmt.Printf("Log: %s\n\n", logPath)
+		printContainerUsage(socketDir, *mountPath)
+		return
+	}
+
+	if *logFile != "" {
+		opts := defaultLogOptions(logger)
+		opts.file = expandPath(*logFile, logger)
+		logWriter, err := opts.open()
+		if err != nil {
+			logger.Error("Failed to open log file", "error", err)
+			os.Exit(1)
+		}
+		defer func() { _ = logWriter.Close() }()
+		logger = newLogger(logWriter, *verbose)
+	} else if batchMode {
+		printJSON(containerReport{Dir: socketDir, MountPath: *mountPath,
+			Socket: filepath.Join(*mountPath, containerSocketName)})
+	} else {
+		printContainerUsage(socketDir, *mountPath)
+	}
+
+	runOpts := runOptions{socketUID: *uid, socketGID: *gid, cacheTTL: proxy.DefaultCacheTTL,
+		resourceWarnings: proxy.ResourceWarnings{
+			Handlers:      proxy.DefaultHandlerWarning,
+			UpstreamConns: proxy.DefaultUpstreamConnWarning,
+		}}
+	if err := prepareContainerDir(socketDir, *uid, *gid, *anyUID); err != nil {
+		logger.Error("Failed to prepare socket directory", "dir", socketDir, "error", err)
+		if *uid != -1 || *gid != -1 {
+			logger.Error("Changing ownership needs root; with rootless or user-namespaced containers the default ownership already maps to the container user, otherwise consider --any-uid")
+		}
+		os.Exit(1)
+	}
+	if *anyUID {
+		logger.Warn("Container socket accepts any local UID", "socket", proxySocket)
+		runOpts.socketMode = 0666
+	}
+
+	runProxy(proxySocket, runOpts, logger)
+}
+
+// containerDir picks a per-container socket directory, preferring the
+// user's runtime dir so nothing stale survives a reboot.
+func containerDir(name string, logger *slog.Logger) string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "double-agent", "containers", name)
+	}
+	return filepath.Join(stateDir(logger), "containers", name)
+}
+
+// prepareContainerDir creates the bind-mount directory with permissions
+// that let the container user reach the socket inside it.
+func prepareContainerDir(dir string, uid, gid int, anyUID bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	if anyUID {
+		// Traversable but not listable by others
+		return os.Chmod(dir, 0711)
+	}
+	return os.Chmod(dir, 0700)
+}
+
+// containerReport is what container prints in batch mode: the directory
+// to mount, where, and the SSH_AUTH_SOCK to set inside the container.
+type containerReport struct {
+	PID       int    `json:"pid,omitempty"`
+	Log       string `json:"log,omitempty"`
+	Dir       string `json:"dir"`
+	MountPath string `json:"mount_path"`
+	Socket    string `json:"socket"`
+}
+
+func printContainerUsage(socketDir, mountPath string) {
+	containerSocket := filepath.Join(mountPath, containerSocketName)
+	fmt.Printf("Mount %s into the container and point SSH_AUTH_SOCK at it:\n\n", socketDir)
+	fmt.Printf("  docker run -v %s:%s -e SSH_AUTH_SOCK=%s ...\n\n", socketDir, mountPath, containerSocket)
+	fmt.Printf("For a devcontainer, add to devcontainer.json:\n\n")
+	fmt.Printf("  \"mounts\": [\"source=%s,target=%s,type=bind\"],\n", socketDir, mountPath)
+	fmt.Printf("  \"remoteEnv\": { \"SSH_AUTH_SOCK\": \"%s\" }\n\n", containerSocket)
+}
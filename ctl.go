@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// defaultControlSocket returns the control socket path that pairs with a
+// proxy socket.
+func defaultControlSocket(proxySocket string) string {
+	return proxySocket + ".ctl"
+}
+
+// listenControl creates the control socket, readable only by its owner
+// since it can redirect which agent the proxy uses.
+func listenControl(path string, logger *slog.Logger) (net.Listener, error) {
+	if proxy.IsAbstractSocket(path) {
+		listener := inheritedListener("unix:" + path)
+		if listener == nil {
+			var err error
+			if listener, err = net.Listen("unix", path); err != nil {
+				return nil, err
+			}
+			keepTransferable("unix:"+path, listener)
+		}
+		return proxy.NewPeerUIDListener(listener, logger, os.Getuid()), nil
+	}
+	if listener := inheritedListener("unix:" + path); listener != nil {
+		return listener, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// Created owner-only rather than chmodded after, as with the proxy
+	// socket
+	var listener net.Listener
+	err := withUmask(0177, func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	keepTransferable("unix:"+path, listener)
+	return listener, nil
+}
+
+// newControlServer wires up the proxy's control commands along with the
+// ones that act on process-wide state owned by main.
+func newControlServer(agentProxy *proxy.AgentProxy, logger *slog.Logger) *proxy.ControlServer {
+	control := proxy.NewControlServer(agentProxy, logger)
+	control.Handle("set-log-level", func(args []string) (any, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("usage: set-log-level <debug|info|warn|error> [duration]")
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(args[0])); err != nil {
+			return nil, err
+		}
+		var d time.Duration
+		if len(args) == 2 {
+			var err error
+			if d, err = time.ParseDuration(args[1]); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid duration %q", args[1])
+			}
+		}
+		setLogLevel(level, d, logger)
+		return level.String(), nil
+	})
+	return control
+}
+
+// ctlReport wraps a result that isn't JSON in batch mode.
+type ctlReport struct {
+	Result string `json:"result"`
+}
+
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	addBatchFlag(fs)
+	socket := fs.String("socket", "", "Control socket path (default: "+defaultControlSocket(defaultSocketArg())+")")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [options] <command> [args...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Sends a command to a running proxy's control socket and prints the\n")
+		fmt.Fprintf(os.Stderr, "JSON result.\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  status               Show the active upstream, pin, connections, and traffic\n")
+		fmt.Fprintf(os.Stderr, "  invalidate-cache     Forget the cached upstream socket\n")
+		fmt.Fprintf(os.Stderr, "  pin <socket>         Use <socket> regardless of discovery until it goes away\n")
+		fmt.Fprintf(os.Stderr, "  unpin                Return to discovery\n")
+		fmt.Fprintf(os.Stderr, "  set-log-level <lvl> [duration]\n")
+		fmt.Fprintf(os.Stderr, "                       Change the log level (debug, info, warn, error), for\n")
+		fmt.Fprintf(os.Stderr, "                       only the given duration if there is one\n")
+		fmt.Fprintf(os.Stderr, "  reload               Re-run discovery now\n")
+		fmt.Fprintf(os.Stderr, "  help                 List the commands the proxy supports\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, false)
+	ctlSocket := *socket
+	if ctlSocket == "" {
+		ctlSocket = defaultControlSocket(defaultSocketArg())
+	}
+	ctlSocket = expandPath(ctlSocket, logger)
+
+	command, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	if command == "pin" && len(cmdArgs) == 1 {
+		cmdArgs[0] = expandPath(cmdArgs[0], logger)
+	}
+
+	result, err := proxy.ControlRequest(ctlSocket, command, cmdArgs...)
+	if err != nil {
+		exitError("%v", err)
+	}
+	if len(result) == 0 {
+		if batchMode {
+			printJSON(struct{}{})
+			return
+		}
+		fmt.Println("ok")
+		return
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, result, "", "  "); err != nil {
+		if batchMode {
+			printJSON(ctlReport{Result: string(result)})
+			return
+		}
+		fmt.Println(string(result))
+		return
+	}
+	fmt.Println(pretty.String())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// doctor collects check results and prints them as it goes, or in batch
+// mode all at once as JSON.
+type doctor struct {
+	Checks   []doctorCheck `json:"checks"`
+	Failures int           `json:"failures"`
+	Warnings int           `json:"warnings"`
+}
+
+// doctorCheck is one check's result: ok, warn, or fail.
+type doctorCheck struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+func (d *doctor) ok(format string, args ...any) {
+	d.record("ok", "", format, args...)
+}
+
+func (d *doctor) warn(fix, format string, args ...any) {
+	d.Warnings++
+	d.record("warn", fix, format, args...)
+}
+
+func (d *doctor) fail(fix, format string, args ...any) {
+	d.Failures++
+	d.record("fail", fix, format, args...)
+}
+
+func (d *doctor) record(level, fix, format string, args ...any) {
+	check := doctorCheck{Level: level, Message: fmt.Sprintf(format, args...), Fix: fix}
+	d.Checks = append(d.Checks, check)
+	label := map[string]string{"ok": "[ok]  ", "warn": "[warn]", "fail": "[FAIL]"}[level]
+	humanf("%s %s\n", label, check.Message)
+	if fix != "" {
+		humanf("       fix: %s\n", fix)
+	}
+}
+
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	addBatchFlag(fs)
+	verbose := fs.Bool("v", false, "Enable verbose logging")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Checks the common reasons SSH can't reach an agent through the proxy\n")
+		fmt.Fprintf(os.Stderr, "and suggests fixes.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	d := &doctor{}
+	running := d.checkProxySocket(proxySocket)
+	if running {
+		d.checkProxyHealth(proxySocket)
+	}
+	d.checkAuthSock(proxySocket)
+	d.checkUpstreams(proxySocket)
+	d.checkTmux(proxySocket)
+
+	if batchMode {
+		printJSON(d)
+		if d.Failures > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Println()
+	switch {
+	case d.Failures > 0:
+		fmt.Printf("%d problem(s) found, %d warning(s)\n", d.Failures, d.Warnings)
+		os.Exit(1)
+	case d.Warnings > 0:
+		fmt.Printf("No problems found, %d warning(s)\n", d.Warnings)
+	default:
+		fmt.Println("No problems found")
+	}
+}
+
+// checkProxySocket verifies the proxy socket exists with safe permissions
+// and reports whether a proxy is listening on it.
+func (d *doctor) checkProxySocket(proxySocket string) bool {
+	start := fmt.Sprintf("%s -d %s", os.Args[0], proxySocket)
+
+	info, err := os.Stat(proxySocket)
+	if err != nil {
+		d.fail(start, "Proxy socket %s does not exist, so the proxy isn't running", proxySocket)
+		return false
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		d.fail("remove it and start the proxy: "+start, "%s exists but is not a socket", proxySocket)
+		return false
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		d.warn(fmt.Sprintf("chmod 600 %s", proxySocket),
+			"Proxy socket is accessible to other users (mode %04o)", perm)
+	} else {
+		d.ok("Proxy socket permissions are %04o", info.Mode().Perm())
+	}
+	if dirInfo, err := os.Stat(filepath.Dir(proxySocket)); err == nil && dirInfo.Mode().Perm()&0022 != 0 {
+		d.warn(fmt.Sprintf("chmod go-w %s", filepath.Dir(proxySocket)),
+			"Socket directory %s is writable by other users", filepath.Dir(proxySocket))
+	}
+
+	if !proxyListening(proxySocket) {
+		d.fail("remove the stale socket and start the proxy: "+start,
+			"Nothing is listening on %s (stale socket from a proxy that exited)", proxySocket)
+		return false
+	}
+	d.ok("Proxy is running at %s", proxySocket)
+	return true
+}
+
+func (d *doctor) checkProxyHealth(proxySocket string) {
+	result, err := proxy.ControlRequest(defaultControlSocket(proxySocket), "status")
+	if err == nil {
+		var status proxy.Status
+		if json.Unmarshal(result, &status) == nil && status.Pinned != "" {
+			d.warn(fmt.Sprintf("%s ctl unpin", os.Args[0]), "Proxy is pinned to %s", status.Pinned)
+		}
+	}
+
+	identities, err := proxy.ListIdentities(proxySocket)
+	switch {
+	case err != nil:
+		d.fail(fmt.Sprintf("run '%s --test-discovery' to see why no upstream agent is usable", os.Args[0]),
+			"Proxy can't reach an upstream agent: %v", err)
+	case len(identities) == 0:
+		d.warn("add keys to the upstream agent with ssh-add, or check that agent forwarding is enabled",
+			"Upstream agent holds no keys")
+	default:
+		d.ok("Proxy serves %d key(s)", len(identities))
+	}
+}
+
+func (d *doctor) checkAuthSock(proxySocket string) {
+	authSock := os.Getenv("SSH_AUTH_SOCK")
+	fix := fmt.Sprintf("eval \"$(%s env)\" in your shell profile", os.Args[0])
+	switch {
+	case authSock == "":
+		d.fail(fix, "SSH_AUTH_SOCK is not set in this shell")
+	case sameFile(authSock, proxySocket):
+		d.ok("SSH_AUTH_SOCK points at the proxy")
+	default:
+		d.warn(fix, "SSH_AUTH_SOCK is %s, not the proxy socket %s; this shell bypasses the proxy", authSock, proxySocket)
+	}
+}
+
+// checkUpstreams runs discovery the way the proxy does, flagging loops as
+// well as the absence of any usable agent.
+func (d *doctor) checkUpstreams(proxySocket string) {
+	if strings.HasPrefix(proxySocket, "/tmp/ssh-") {
+		d.warn("move the proxy socket outside /tmp/ssh-*, e.g. "+defaultSocketArg(),
+			"Proxy socket is inside the directories scanned for upstream agents")
+	}
+
+	discovery := &proxy.Discovery{Exclude: []string{proxySocket}}
+	sockets, err := discovery.DiscoverSockets()
+	if err != nil {
+		d.fail("", "Discovery failed: %v", err)
+		return
+	}
+
+	valid := 0
+	for _, socket := range sockets {
+		if socket.Valid {
+			valid++
+		}
+		if strings.HasPrefix(socket.Reason, "excluded:") && !sameFile(socket.Path, proxySocket) {
+			d.warn("run a single proxy, and keep its socket out of the discovery paths",
+				"Discovery found %s, which would loop back into double-agent", socket.Path)
+		}
+	}
+	if valid == 0 {
+		d.fail("connect with 'ssh -A', start a local ssh-agent, or check the reasons in --test-discovery",
+			"No valid upstream agent found (%d candidate(s))", len(sockets))
+		return
+	}
+	d.ok("%d valid upstream agent(s) found", valid)
+}
+
+// checkTmux looks for the tmux environment drift that strands panes on a
+// stale forwarded socket after reattaching.
+func (d *doctor) checkTmux(proxySocket string) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return
+	}
+	out, err := exec.Command("tmux", "show-environment", "-g", "SSH_AUTH_SOCK").Output()
+	if err != nil {
+		// No tmux server running
+		return
+	}
+
+	value, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "SSH_AUTH_SOCK=")
+	if !ok || !sameFile(value, proxySocket) {
+		d.warn("tmux set-environment -g SSH_AUTH_SOCK "+proxySocket,
+			"tmux's global SSH_AUTH_SOCK is %q, so new panes bypass the proxy", value)
+	} else {
+		d.ok("tmux's global SSH_AUTH_SOCK points at the proxy")
+	}
+
+	out, err = exec.Command("tmux", "show-options", "-gv", "update-environment").Output()
+	if err == nil && strings.Contains(string(out), "SSH_AUTH_SOCK") {
+		d.warn("remove SSH_AUTH_SOCK from update-environment in your tmux.conf",
+			"tmux update-environment includes SSH_AUTH_SOCK, so reattaching replaces the proxy with the new session's socket")
+	}
+}
+
+// sameFile reports whether a and b name the same file.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runEnv(args []string) {
+	fs := flag.NewFlagSet("env", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		shell   = fs.String("shell", "", "Shell syntax to emit: bash, zsh, or fish (default: from $SHELL)")
+		noStart = fs.Bool("no-start", false, "Don't start the daemon if it isn't running")
+		verbose = fs.Bool("v", false, "Start the daemon with verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s env [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints shell commands that point SSH_AUTH_SOCK at the proxy, starting\n")
+		fmt.Fprintf(os.Stderr, "the daemon first if it isn't running. Intended for shell init:\n\n")
+		fmt.Fprintf(os.Stderr, "  eval \"$(%s env)\"                       # bash/zsh\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s env --shell fish | source           # fish\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	shellName := *shell
+	if shellName == "" {
+		shellName = filepath.Base(os.Getenv("SHELL"))
+	}
+	if shellName != "fish" && shellName != "zsh" && shellName != "bash" {
+		if *shell != "" {
+			exitError("unsupported shell %q (want bash, zsh, or fish)", *shell)
+		}
+		// Fall back to POSIX syntax for sh, dash, ksh and friends
+		shellName = "bash"
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	// Everything on stdout gets eval'd, so status messages go to stderr.
+	report := envReport{Socket: proxySocket}
+	if !*noStart && !proxyListening(proxySocket) {
+		var flags []string
+		if *verbose {
+			flags = append(flags, "-v")
+		}
+		flags = append(flags, defaultLogOptions(logger).args()...)
+		pid, err := startDaemon(append(flags, proxySocket))
+		if err != nil {
+			exitError("failed to start daemon: %v", err)
+		}
+		report.PID = pid
+		if !waitForListening(proxySocket, 2*time.Second) {
+			fmt.Fprintf(os.Stderr, "Warning: daemon (PID: %d) has not created %s yet\n", pid, proxySocket)
+		} else {
+			fmt.Fprintf(os.Stderr, "Double Agent daemon started (PID: %d)\n", pid)
+		}
+	}
+
+	if batchMode {
+		printJSON(report)
+		return
+	}
+	fmt.Print(envExport(shellName, "SSH_AUTH_SOCK", proxySocket))
+}
+
+// envReport is what env prints in batch mode: the SSH_AUTH_SOCK to use,
+// and the daemon's PID if env started one.
+type envReport struct {
+	Socket string `json:"socket"`
+	PID    int    `json:"pid,omitempty"`
+}
+
+// envExport renders a variable export in the syntax of the given shell.
+func envExport(shell, name, value string) string {
+	if shell == "fish" {
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+		return fmt.Sprintf("set -gx %s '%s';\n", name, escaped)
+	}
+	escaped := strings.ReplaceAll(value, `'`, `'\''`)
+	return fmt.Sprintf("%s='%s'; export %s;\n", name, escaped, name)
+}
+
+// proxyListening reports whether something is accepting connections on
+// the proxy socket.
+func proxyListening(proxySocket string) bool {
+	conn, err := net.DialTimeout("unix", proxySocket, time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func waitForListening(proxySocket string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if proxyListening(proxySocket) {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// handoffEnv carries, as a JSON array, the names of the listeners a
+// replaced proxy handed to this one as file descriptors 3 onward. The
+// descriptor after them is a pipe on which the proxy reports that it's
+// serving.
+const handoffEnv = "DOUBLE_AGENT_HANDOFF"
+
+// supervisedEnv marks a proxy started by --supervise, whose supervisor
+// would stop once the proxy exited after handing over.
+const supervisedEnv = "DOUBLE_AGENT_SUPERVISED"
+
+// handoffReadyTimeout is how long an upgrade waits for the new proxy to
+// start serving before abandoning it and leaving the old one in place.
+const handoffReadyTimeout = 30 * time.Second
+
+// handoffDrainTimeout is how long a proxy that handed its listeners over
+// lets in-flight requests finish before exiting. It's longer than a
+// signal's shutdownTimeout since a request may be waiting on a touch or a
+// confirmation that nobody is rushing.
+const handoffDrainTimeout = time.Minute
+
+// handoffHeader is what a proxy sends an upgrade along with its
+// listeners: everything needed to start its replacement the same way.
+type handoffHeader struct {
+	PID       int      `json:"pid"`
+	Args      []string `json:"args"`
+	Env       []string `json:"env"`
+	Dir       string   `json:"dir"`
+	Listeners []string `json:"listeners"`
+}
+
+var (
+	handoffMu sync.Mutex
+
+	// inherited holds the listeners handed over by the proxy this one
+	// replaced and not yet taken up, by name
+	inherited = map[string]net.Listener{}
+
+	// transferable holds this proxy's listeners as they were before any
+	// wrapping, by name, for handing to the next one
+	transferable = map[string]net.Listener{}
+
+	// handoffReady is the pipe to report serving on, when started by an
+	// upgrade
+	handoffReady *os.File
+)
+
+// loadInheritedListeners takes up the listeners handed over by the proxy
+// this one replaces, if an upgrade started it.
+func loadInheritedListeners() error {
+	value := os.Getenv(handoffEnv)
+	if value == "" {
+		return nil
+	}
+	// Don't let the variable leak into processes we spawn later.
+	_ = os.Unsetenv(handoffEnv)
+
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return fmt.Errorf("invalid %s: %w", handoffEnv, err)
+	}
+	for i, name := range names {
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to use listener %s handed over: %w", name, err)
+		}
+		inherited[name] = listener
+	}
+	handoffReady = os.NewFile(uintptr(listenFDsStart+len(names)), "handoff-ready")
+	return nil
+}
+
+// inheritedListener returns the listener called name that the replaced
+// proxy handed over, or nil if there isn't one.
+func inheritedListener(name string) net.Listener {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	listener, ok := inherited[name]
+	if !ok {
+		return nil
+	}
+	delete(inherited, name)
+	transferable[name] = listener
+	return listener
+}
+
+// keepTransferable records a listener this proxy opened, so an upgrade
+// can hand it over as name.
+func keepTransferable(name string, listener net.Listener) {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	transferable[name] = listener
+}
+
+// signalHandoffReady tells the upgrade that started this proxy that it's
+// serving, and closes whatever it handed over that this proxy no longer
+// listens on.
+func signalHandoffReady(logger *slog.Logger) {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	if handoffReady == nil {
+		return
+	}
+	_, _ = handoffReady.Write([]byte{1})
+	_ = handoffReady.Close()
+	handoffReady = nil
+	for name, listener := range inherited {
+		logger.Warn("Closing a listener handed over that is no longer configured", "listener", name)
+		_ = listener.Close()
+		delete(inherited, name)
+	}
+}
+
+// handoffRefusal explains why this proxy mustn't hand its listeners over,
+// or returns nil if it may. A service manager or supervisor that started
+// it would act on it exiting: systemd starts a fresh instance that takes
+// the socket path from the upgraded proxy, now outside the unit, and
+// --supervise stops, leaving the upgraded proxy unsupervised.
+func handoffRefusal(activated bool) error {
+	switch {
+	case activated:
+		return errors.New("systemd owns the proxy socket; restart the service instead")
+	case os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != "":
+		return errors.New("systemd runs this proxy and would replace the upgraded one; restart it with 'systemctl --user restart double-agent' instead")
+	case os.Getenv(supervisedEnv) != "":
+		return errors.New("--supervise runs this proxy and would stop once it exits; restart the supervisor instead")
+	}
+	return nil
+}
+
+// handoff passes a running proxy's listeners to an upgrade, which starts
+// the new proxy on them. Both accept connections until the new one is
+// serving, when done is closed and this one stops accepting and finishes
+// what it has in flight.
+type handoff struct {
+	args   []string
+	logger *slog.Logger
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newHandoff(args []string, logger *slog.Logger) *handoff {
+	return &handoff{args: args, logger: logger, done: make(chan struct{})}
+}
+
+// send connects to the upgrade listening on path and sends it the
+// listeners. Until the upgrade reports the new proxy serving, nothing
+// changes here, so an upgrade that fails leaves this proxy as it was.
+func (h *handoff) send(path string) error {
+	if h.args == nil {
+		return errors.New("this proxy can't be restarted in place; restart it the way it was started")
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to reach upgrade: %w", err)
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		_ = conn.Close()
+		return errors.New("upgrade socket is not a unix socket")
+	}
+	_ = conn.SetDeadline(time.Now().Add(handoffReadyTimeout))
+
+	header, files, err := h.header()
+	if err == nil {
+		err = sendListeners(unixConn, files)
+	}
+	for _, file := range files {
+		_ = file.Close()
+	}
+	if err == nil {
+		err = json.NewEncoder(conn).Encode(header)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to hand over listeners: %w", err)
+	}
+
+	h.logger.Info("Handed listeners to an upgrade", "listeners", header.Listeners)
+	go h.awaitReady(conn)
+	return nil
+}
+
+// header describes this proxy and duplicates its listeners for sending.
+func (h *handoff) header() (handoffHeader, []*os.File, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return handoffHeader{}, nil, err
+	}
+	header := handoffHeader{PID: os.Getpid(), Args: h.args, Env: os.Environ(), Dir: dir}
+
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	for name := range transferable {
+		header.Listeners = append(header.Listeners, name)
+	}
+	sort.Strings(header.Listeners)
+	var files []*os.File
+	for _, name := range header.Listeners {
+		filer, ok := transferable[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			err = fmt.Errorf("listener %s can't be handed over", name)
+		} else {
+			var file *os.File
+			if file, err = filer.File(); err == nil {
+				files = append(files, file)
+			}
+		}
+		if err != nil {
+			for _, file := range files {
+				_ = file.Close()
+			}
+			return handoffHeader{}, nil, err
+		}
+	}
+	return header, files, nil
+}
+
+// awaitReady waits for the upgrade to report the new proxy serving, then
+// leaves the socket files to it and closes done.
+func (h *handoff) awaitReady(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	// The upgrade gives the new proxy handoffReadyTimeout from after it
+	// has the listeners, so allow for getting that far too
+	_ = conn.SetReadDeadline(time.Now().Add(2 * handoffReadyTimeout))
+	var ready [1]byte
+	if _, err := conn.Read(ready[:]); err != nil || ready[0] != 1 {
+		h.logger.Warn("Upgrade didn't complete; still serving", "error", err)
+		return
+	}
+
+	handoffMu.Lock()
+	for _, listener := range transferable {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	handoffMu.Unlock()
+	h.once.Do(func() { close(h.done) })
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// maxHandoffListeners bounds the descriptors one handoff may carry.
+const maxHandoffListeners = 64
+
+// sendListeners passes files over conn as SCM_RIGHTS, attached to a
+// single byte since a message can't be empty.
+func sendListeners(conn *net.UnixConn, files []*os.File) error {
+	if len(files) > maxHandoffListeners {
+		return fmt.Errorf("%d listeners is more than the %d a handoff carries", len(files), maxHandoffListeners)
+	}
+	fds := make([]int, len(files))
+	for i, file := range files {
+		fds[i] = int(file.Fd())
+	}
+	_, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// receiveListeners reads the descriptors sendListeners sent.
+func receiveListeners(conn *net.UnixConn) ([]*os.File, error) {
+	var buf [1]byte
+	oob := make([]byte, syscall.CmsgSpace(maxHandoffListeners*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no listeners in the handoff")
+	}
+	return files, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// errNoHandoff is returned on Windows, where sockets can't be passed
+// between processes over a unix socket.
+var errNoHandoff = errors.New("handing listeners to a new process is not supported on Windows")
+
+func sendListeners(conn *net.UnixConn, files []*os.File) error {
+	return errNoHandoff
+}
+
+func receiveListeners(conn *net.UnixConn) ([]*os.File, error) {
+	return nil, errNoHandoff
+}
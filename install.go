@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	serviceUnitName = "double-agent.service"
+	socketUnitName  = "double-agent.socket"
+)
+
+func runInstall(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		systemdUser = fs.Bool("systemd-user", false, "Install a systemd user service")
+		withSocket  = fs.Bool("socket", false, "Also install a .socket unit for socket activation")
+		noEnable    = fs.Bool("no-enable", false, "Write the unit files without enabling them")
+		verbose     = fs.Bool("v", false, "Run the installed proxy with verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s install --systemd-user [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes a systemd user unit that runs the proxy, enables it, and prints\n")
+		fmt.Fprintf(os.Stderr, "the SSH_AUTH_SOCK export to add to your shell. The socket path defaults\n")
+		fmt.Fprintf(os.Stderr, "to %s.\n\n", defaultSocketArg())
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if !*systemdUser {
+		exitUsage(fs.Usage, "an install target is required (currently only --systemd-user)")
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	executable, err := os.Executable()
+	if err != nil {
+		exitError("failed to find executable: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+
+	unitDir, err := systemdUserUnitDir()
+	if err != nil {
+		exitError("failed to locate systemd user unit directory: %v", err)
+	}
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		exitError("failed to create %s: %v", unitDir, err)
+	}
+
+	report := installReport{Socket: proxySocket}
+	units := map[string]string{
+		serviceUnitName: serviceUnit(executable, proxySocket, *verbose, *withSocket),
+	}
+	if *withSocket {
+		units[socketUnitName] = socketUnit(proxySocket)
+	}
+	for _, name := range []string{serviceUnitName, socketUnitName} {
+		content, ok := units[name]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(unitDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			exitError("failed to write %s: %v", path, err)
+		}
+		report.Units = append(report.Units, path)
+		humanf("Wrote %s\n", path)
+	}
+
+	if *noEnable {
+		humanf("Skipping enable; run 'systemctl --user daemon-reload' and enable the unit yourself.\n")
+	} else {
+		// With socket activation systemd owns the listening socket and starts
+		// the service on first connection, so only the .socket is enabled.
+		enableUnit := serviceUnitName
+		if *withSocket {
+			enableUnit = socketUnitName
+		}
+		if err := systemctlUser("daemon-reload"); err != nil {
+			exitError("failed to reload systemd: %v", err)
+		}
+		if err := systemctlUser("enable", "--now", enableUnit); err != nil {
+			exitError("failed to enable %s: %v", enableUnit, err)
+		}
+		report.Enabled = enableUnit
+		humanf("Enabled and started %s\n", enableUnit)
+	}
+
+	if batchMode {
+		printJSON(report)
+		return
+	}
+	fmt.Println()
+	fmt.Println("Add this to your shell configuration:")
+	fmt.Printf("  export SSH_AUTH_SOCK=%q\n", proxySocket)
+}
+
+// installReport is what install prints in batch mode.
+type installReport struct {
+	Units   []string `json:"units"`
+	Enabled string   `json:"enabled,omitempty"`
+	Socket  string   `json:"socket"`
+}
+
+func systemdUserUnitDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user"), nil
+}
+
+func serviceUnit(executable, proxySocket string, verbose, socketActivated bool) string {
+	execStart := []string{systemdQuote(executable)}
+	if verbose {
+		execStart = append(execStart, "-v")
+	}
+	execStart = append(execStart, systemdQuote(proxySocket))
+
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=Double Agent - SSH Agent Proxy\n")
+	b.WriteString("Documentation=https://github.com/phinze/double-agent\n")
+	if socketActivated {
+		b.WriteString("Requires=" + socketUnitName + "\n")
+		b.WriteString("After=" + socketUnitName + "\n")
+	}
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	b.WriteString("ExecStart=" + strings.Join(execStart, " ") + "\n")
+	b.WriteString("Restart=always\n")
+	b.WriteString("RestartSec=5\n")
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=default.target\n")
+	return b.String()
+}
+
+func socketUnit(proxySocket string) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=Double Agent - SSH Agent Proxy socket\n")
+	b.WriteString("Documentation=https://github.com/phinze/double-agent\n")
+	b.WriteString("\n[Socket]\n")
+	b.WriteString("ListenStream=" + proxySocket + "\n")
+	b.WriteString("SocketMode=0600\n")
+	b.WriteString("DirectoryMode=0700\n")
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=sockets.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes a word for an ExecStart= line when it contains
+// characters systemd would otherwise split on or interpret.
+func systemdQuote(word string) string {
+	if !strings.ContainsAny(word, " \t\"'\\$%") {
+		return word
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + replacer.Replace(word) + `"`
+}
+
+func systemctlUser(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
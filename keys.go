@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+func runKeys(args []string) {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	addBatchFlag(fs)
+	verbose := fs.Bool("v", false, "Enable verbose logging")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s keys [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Lists the keys clients see through the proxy, like 'ssh-add -l', along\n")
+		fmt.Fprintf(os.Stderr, "with the upstream agent currently serving them.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	identities, err := proxy.ListIdentities(proxySocket)
+	if err != nil {
+		exitError("%v", err)
+	}
+
+	// The control socket is optional, so attribution is best-effort
+	report := keysReport{Keys: []keyReport{}}
+	if result, err := proxy.ControlRequest(defaultControlSocket(proxySocket), "status"); err == nil {
+		var status proxy.Status
+		if json.Unmarshal(result, &status) == nil && status.ActiveSocket != "" {
+			report.Upstream = status.ActiveSocket
+		}
+	} else {
+		logger.Debug("Control socket unavailable", "error", err)
+	}
+
+	if batchMode {
+		for _, id := range identities {
+			report.Keys = append(report.Keys, newKeyReport(id))
+		}
+		printJSON(report)
+		return
+	}
+	if report.Upstream != "" {
+		fmt.Printf("Upstream: %s\n", report.Upstream)
+	}
+
+	if len(identities) == 0 {
+		fmt.Println("The agent has no identities.")
+		return
+	}
+	for _, id := range identities {
+		fmt.Printf("%d %s %s (%s)\n", id.Bits(), id.Fingerprint(), id.Comment, displayKeyType(id.Type()))
+	}
+}
+
+// keysReport is what keys prints in batch mode.
+type keysReport struct {
+	Upstream string      `json:"upstream,omitempty"`
+	Keys     []keyReport `json:"keys"`
+}
+
+// keyReport describes a key in batch mode output.
+type keyReport struct {
+	Type        string `json:"type"`
+	Bits        int    `json:"bits"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment"`
+}
+
+func newKeyReport(id proxy.Identity) keyReport {
+	return keyReport{Type: id.Type(), Bits: id.Bits(), Fingerprint: id.Fingerprint(), Comment: id.Comment}
+}
+
+// displayKeyType renders an SSH key type the way ssh-add -l does.
+func displayKeyType(keyType string) string {
+	if base, ok := strings.CutSuffix(keyType, "-cert-v01@openssh.com"); ok {
+		return displayKeyType(base) + "-CERT"
+	}
+	switch {
+	case keyType == "ssh-rsa":
+		return "RSA"
+	case keyType == "ssh-dss":
+		return "DSA"
+	case keyType == "ssh-ed25519":
+		return "ED25519"
+	case keyType == "sk-ssh-ed25519@openssh.com":
+		return "ED25519-SK"
+	case strings.HasPrefix(keyType, "sk-ecdsa-"):
+		return "ECDSA-SK"
+	case strings.HasPrefix(keyType, "ecdsa-"):
+		return "ECDSA"
+	}
+	return keyType
+}
@@ -0,0 +1,389 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsMetadataURL is the EC2 instance metadata service, the last place
+// credentials are looked for.
+var awsMetadataURL = "http://169.254.169.254"
+
+// awsSigner signs with an AWS KMS key through the KMS JSON API.
+type awsSigner struct {
+	keyID    string
+	region   string
+	endpoint string
+	public   crypto.PublicKey
+}
+
+// newAWSSigner fetches the public half of the AWS KMS key keyID. The
+// region comes from the key's ARN, or else $AWS_REGION.
+func newAWSSigner(ctx context.Context, keyID string) (*awsSigner, error) {
+	s := &awsSigner{keyID: keyID, region: awsRegion(keyID)}
+	if s.region == "" {
+		return nil, errors.New("no region: give the key's ARN or set AWS_REGION")
+	}
+	s.endpoint = "https://kms." + s.region + ".amazonaws.com/"
+	for _, env := range []string{"AWS_ENDPOINT_URL_KMS", "AWS_ENDPOINT_URL"} {
+		if endpoint := os.Getenv(env); endpoint != "" {
+			s.endpoint = endpoint
+			break
+		}
+	}
+
+	var out struct {
+		PublicKey []byte
+		KeyUsage  string
+	}
+	if err := s.call(ctx, "GetPublicKey", map[string]any{"KeyId": keyID}, &out); err != nil {
+		return nil, err
+	}
+	if out.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("key usage is %s, not SIGN_VERIFY", out.KeyUsage)
+	}
+	public, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	s.public = public
+	return s, nil
+}
+
+// awsRegion returns the region in a key ARN, or the configured default.
+func awsRegion(keyID string) string {
+	if parts := strings.Split(keyID, ":"); len(parts) >= 6 && parts[0] == "arn" {
+		return parts[3]
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// Public implements crypto.Signer
+func (s *awsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer, having KMS sign the digest.
+func (s *awsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := awsSigningAlgorithm(s.public, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	var out struct{ Signature []byte }
+	err = s.call(ctx, "Sign", map[string]any{
+		"KeyId":            s.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": algorithm,
+	}, &out)
+	return out.Signature, err
+}
+
+// awsSigningAlgorithm names the KMS signing algorithm for public keys of
+// this kind and the hash the SSH signature needs.
+func awsSigningAlgorithm(public crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	bits := map[crypto.Hash]string{crypto.SHA256: "256", crypto.SHA384: "384", crypto.SHA512: "512"}[opts.HashFunc()]
+	switch public.(type) {
+	case *ecdsa.PublicKey:
+		if bits != "" {
+			return "ECDSA_SHA_" + bits, nil
+		}
+	case *rsa.PublicKey:
+		if _, pss := opts.(*rsa.PSSOptions); !pss && bits != "" {
+			return "RSASSA_PKCS1_V1_5_SHA_" + bits, nil
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", public)
+	}
+	return "", fmt.Errorf("KMS can't sign %v digests with this key", opts.HashFunc())
+}
+
+// call invokes the KMS API action with the JSON request in, decoding the
+// response into out.
+func (s *awsSigner) call(ctx context.Context, action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	creds, err := loadAWSCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWSRequest(req, body, creds, s.region, "kms", time.Now())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %w", action, apiError(resp))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header to
+// req, signing its host, body, and every header already set.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCredentials are the keys AWS requests are signed with.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsCredentialCache keeps temporary credentials from the container or
+// instance metadata service until shortly before they expire.
+var awsCredentialCache struct {
+	sync.Mutex
+	creds awsCredentials
+}
+
+// loadAWSCredentials finds credentials the way the AWS CLI does, in
+// order: the AWS_ACCESS_KEY_ID environment variables, the shared
+// credentials file ($AWS_PROFILE or default), the ECS container
+// credentials endpoint, and the EC2 instance role.
+func loadAWSCredentials(ctx context.Context) (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if creds, ok := awsSharedCredentials(); ok {
+		return creds, nil
+	}
+
+	awsCredentialCache.Lock()
+	defer awsCredentialCache.Unlock()
+	if cached := awsCredentialCache.creds; cached.AccessKeyID != "" && time.Until(cached.Expiration) > 5*time.Minute {
+		return cached, nil
+	}
+	creds, err := awsContainerCredentials(ctx)
+	if errors.Is(err, errNoCredentials) {
+		creds, err = awsInstanceCredentials(ctx)
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: %w", err)
+	}
+	awsCredentialCache.creds = creds
+	return creds, nil
+}
+
+// errNoCredentials reports that a credential source isn't configured.
+var errNoCredentials = errors.New("not configured")
+
+// awsSharedCredentials reads the profile named by $AWS_PROFILE, or
+// default, from $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+func awsSharedCredentials() (awsCredentials, bool) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return awsCredentials{}, false
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	var creds awsCredentials
+	var section string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			section = strings.TrimSpace(strings.TrimSuffix(name, "]"))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != ""
+}
+
+// awsContainerCredentials fetches the task role's credentials on ECS and
+// EKS Pod Identity.
+func awsContainerCredentials(ctx context.Context) (awsCredentials, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); url == "" && relative != "" {
+		url = "http://169.254.170.2" + relative
+	}
+	if url == "" {
+		return awsCredentials{}, errNoCredentials
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var creds awsCredentials
+	return creds, fetchJSON(req, &creds)
+}
+
+// awsInstanceCredentials fetches the EC2 instance role's credentials with
+// IMDSv2.
+func awsInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+	// Off EC2 nothing answers, so don't wait long to find out
+	tokenCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(tokenCtx, http.MethodPut, awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := fetchText(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata unavailable: %w", err)
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		return req, err
+	}
+	req, err = get("")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	roles, err := fetchText(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no instance role: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if req, err = get(role); err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	return creds, fetchJSON(req, &creds)
+}
+
+// fetchText performs req and returns the body of a successful response.
+func fetchText(req *http.Request) (string, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", apiError(resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return string(body), err
+}
+
+// fetchJSON performs req and decodes a successful response into out.
+func fetchJSON(req *http.Request, out any) error {
+	body, err := fetchText(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), out)
+}
@@ -0,0 +1,281 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Cloud endpoints, variables so tests can point them elsewhere
+var (
+	gcpEndpoint      = "https://cloudkms.googleapis.com/v1/"
+	gcpMetadataURL   = "http://metadata.google.internal"
+	gcpTokenEndpoint = "https://oauth2.googleapis.com/token"
+)
+
+// gcpScope is the OAuth scope KMS requests are authorized with.
+const gcpScope = "https://www.googleapis.com/auth/cloudkms"
+
+// gcpSigner signs with a Cloud KMS key version. Each version signs
+// with one fixed digest algorithm, recorded in hash.
+type gcpSigner struct {
+	name   string
+	hash   crypto.Hash
+	public crypto.PublicKey
+}
+
+// newGCPSigner fetches the public half of the key version name, a
+// projects/.../cryptoKeyVersions/N resource name.
+func newGCPSigner(ctx context.Context, name string) (*gcpSigner, error) {
+	var out struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := gcpCall(ctx, http.MethodGet, name+"/publicKey", nil, &out); err != nil {
+		return nil, err
+	}
+
+	s := &gcpSigner{name: name}
+	switch {
+	case strings.Contains(out.Algorithm, "_PSS_"), !strings.Contains(out.Algorithm, "_SIGN_"):
+		return nil, fmt.Errorf("algorithm %s can't make SSH signatures", out.Algorithm)
+	case strings.HasSuffix(out.Algorithm, "_SHA256"):
+		s.hash = crypto.SHA256
+	case strings.HasSuffix(out.Algorithm, "_SHA384"):
+		s.hash = crypto.SHA384
+	case strings.HasSuffix(out.Algorithm, "_SHA512"):
+		s.hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", out.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(out.PEM))
+	if block == nil {
+		return nil, errors.New("public key isn't PEM encoded")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	s.public = public
+	return s, nil
+}
+
+// Public implements crypto.Signer
+func (s *gcpSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer, having Cloud KMS sign the digest.
+func (s *gcpSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != s.hash {
+		return nil, fmt.Errorf("this key version only signs %v digests, not %v", s.hash, opts.HashFunc())
+	}
+	field := strings.ToLower(strings.ReplaceAll(s.hash.String(), "-", ""))
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	var out struct {
+		Signature []byte `json:"signature"`
+	}
+	err := gcpCall(ctx, http.MethodPost, s.name+":asymmetricSign",
+		map[string]any{"digest": map[string][]byte{field: digest}}, &out)
+	return out.Signature, err
+}
+
+// gcpCall makes a Cloud KMS API request for path, sending in as JSON
+// when set and decoding the response into out.
+func gcpCall(ctx context.Context, method, path string, in, out any) error {
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gcpEndpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return fetchJSON(req, out)
+}
+
+// gcpToken is an OAuth access token and when it stops working.
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	expiry      time.Time
+}
+
+// gcpTokenCache keeps the access token until shortly before it expires.
+var gcpTokenCache struct {
+	sync.Mutex
+	token gcpToken
+}
+
+// gcpAccessToken finds an access token the way Google's client libraries
+// find application default credentials: $GOOGLE_OAUTH_ACCESS_TOKEN, the
+// credentials file in $GOOGLE_APPLICATION_CREDENTIALS or left by gcloud
+// auth application-default login, and the metadata server.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	gcpTokenCache.Lock()
+	defer gcpTokenCache.Unlock()
+	if cached := gcpTokenCache.token; cached.AccessToken != "" && time.Until(cached.expiry) > 5*time.Minute {
+		return cached.AccessToken, nil
+	}
+	token, err := gcpCredentialsFileToken(ctx)
+	if errors.Is(err, errNoCredentials) {
+		token, err = gcpMetadataToken(ctx)
+	}
+	if err != nil {
+		return "", fmt.Errorf("no Google Cloud credentials: %w", err)
+	}
+	token.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	gcpTokenCache.token = token
+	return token.AccessToken, nil
+}
+
+// gcpCredentialsFileToken exchanges a service account key or gcloud user
+// credentials for an access token.
+func gcpCredentialsFileToken(ctx context.Context) (gcpToken, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		dir := os.Getenv("CLOUDSDK_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return gcpToken{}, errNoCredentials
+			}
+			dir = filepath.Join(home, ".config", "gcloud")
+		}
+		path = filepath.Join(dir, "application_default_credentials.json")
+		if _, err := os.Stat(path); err != nil {
+			return gcpToken{}, errNoCredentials
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return gcpToken{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	form := url.Values{}
+	tokenURI := gcpTokenEndpoint
+	switch creds.Type {
+	case "service_account":
+		if creds.TokenURI != "" {
+			tokenURI = creds.TokenURI
+		}
+		assertion, err := gcpServiceAccountJWT(creds.ClientEmail, creds.PrivateKey, tokenURI)
+		if err != nil {
+			return gcpToken{}, fmt.Errorf("%s: %w", path, err)
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return gcpToken{}, fmt.Errorf("%s: unsupported credentials type %q", path, creds.Type)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return gcpToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token gcpToken
+	return token, fetchJSON(req, &token)
+}
+
+// gcpServiceAccountJWT builds the signed assertion a service account
+// trades for an access token.
+func gcpServiceAccountJWT(email, privateKey, audience string) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", errors.New("private_key isn't PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private_key isn't an RSA key")
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   email,
+		"scope": gcpScope,
+		"aud":   audience,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// gcpMetadataToken fetches the attached service account's token from the
+// metadata server on GCE, GKE, and Cloud Run.
+func gcpMetadataToken(ctx context.Context) (gcpToken, error) {
+	// Off Google Cloud nothing answers, so don't wait long to find out
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		gcpMetadataURL+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcpScope), nil)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token gcpToken
+	if err := fetchJSON(req, &token); err != nil {
+		return gcpToken{}, fmt.Errorf("metadata server unavailable: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,154 @@
+// Package kms serves SSH keys held by AWS KMS and Google Cloud KMS as an
+// agent, authenticating to each with the credentials its own tools use.
+package kms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KMS providers accepted in Key.Provider
+const (
+	ProviderAWS = "aws"
+	ProviderGCP = "gcp"
+)
+
+// callTimeout bounds each call to a KMS API, including fetching
+// credentials for it.
+const callTimeout = 10 * time.Second
+
+// httpClient is used for every KMS and credential request.
+var httpClient = &http.Client{Timeout: callTimeout}
+
+// Key names an asymmetric signing key held by a cloud key management
+// service, which signs on request but never hands out the private key.
+type Key struct {
+	Provider string // ProviderAWS or ProviderGCP
+	ID       string // AWS key ID, alias, or ARN; GCP CryptoKeyVersion name
+	Comment  string // listed with the key, defaulting to ID
+}
+
+// LoadKeys reads keys from path, one per line: the provider (aws or
+// gcp), the key's ID, and optionally a comment. Blank lines and lines
+// starting with # are ignored.
+func LoadKeys(path string) ([]Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || (fields[0] != ProviderAWS && fields[0] != ProviderGCP) {
+			return nil, fmt.Errorf("%s:%d: want aws or gcp, a key ID, and an optional comment", path, line)
+		}
+		key := Key{Provider: fields[0], ID: fields[1], Comment: strings.Join(fields[2:], " ")}
+		if key.Comment == "" {
+			key.Comment = key.ID
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// signer connects to the key, fetching its public half.
+func (k Key) signer(ctx context.Context) (crypto.Signer, error) {
+	switch k.Provider {
+	case ProviderAWS:
+		return newAWSSigner(ctx, k.ID)
+	case ProviderGCP:
+		return newGCPSigner(ctx, k.ID)
+	default:
+		return nil, fmt.Errorf("unknown KMS provider %q", k.Provider)
+	}
+}
+
+// Agent is a read-only agent holding keys that a cloud KMS signs with.
+// Served with proxy.WithOverlayAgent, its keys are listed after the
+// upstream agent's, and sign requests for them go to the KMS instead.
+type Agent struct {
+	keyring agent.ExtendedAgent
+}
+
+// NewAgent creates a KMS agent without keys.
+func NewAgent() *Agent {
+	return &Agent{keyring: agent.NewKeyring().(agent.ExtendedAgent)}
+}
+
+// AddKey fetches the public half of key from its KMS and adds the key.
+// Signing is authorized again on each use, so credentials only need to be
+// valid when clients sign.
+func (ka *Agent) AddKey(key Key) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	signer, err := key.signer(ctx)
+	if err != nil {
+		return fmt.Errorf("%s key %s: %w", key.Provider, key.ID, err)
+	}
+	return ka.keyring.Add(agent.AddedKey{PrivateKey: signer, Comment: key.Comment})
+}
+
+// errReadOnly is returned for attempts to change a Agent's keys.
+var errReadOnly = errors.New("KMS keys can't be changed through the agent")
+
+// List implements agent.Agent
+func (ka *Agent) List() ([]*agent.Key, error) {
+	return ka.keyring.List()
+}
+
+// Sign implements agent.Agent
+func (ka *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return ka.keyring.Sign(key, data)
+}
+
+// SignWithFlags implements agent.ExtendedAgent
+func (ka *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return ka.keyring.SignWithFlags(key, data, flags)
+}
+
+// Signers implements agent.Agent
+func (ka *Agent) Signers() ([]ssh.Signer, error) {
+	return ka.keyring.Signers()
+}
+
+// Add implements agent.Agent, refusing since KMS keys can't be imported.
+func (ka *Agent) Add(agent.AddedKey) error { return errReadOnly }
+
+// Remove implements agent.Agent
+func (ka *Agent) Remove(ssh.PublicKey) error { return errReadOnly }
+
+// RemoveAll implements agent.Agent
+func (ka *Agent) RemoveAll() error { return errReadOnly }
+
+// Lock implements agent.Agent
+func (ka *Agent) Lock([]byte) error { return errReadOnly }
+
+// Unlock implements agent.Agent
+func (ka *Agent) Unlock([]byte) error { return errReadOnly }
+
+// Extension implements agent.ExtendedAgent
+func (ka *Agent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// apiError describes a failed KMS API call from its response body.
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,209 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func writeKeys(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms-keys")
+	writeKeys(t, path, `# CI signing keys
+aws arn:aws:kms:us-east-1:111122223333:key/1234abcd deploy@ci
+gcp projects/acme/locations/global/keyRings/ci/cryptoKeys/release/cryptoKeyVersions/1
+`)
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatalf("LoadKeys failed: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].Provider != ProviderAWS || keys[0].Comment != "deploy@ci" {
+		t.Errorf("Unexpected first key: %+v", keys[0])
+	}
+	if keys[1].Provider != ProviderGCP || keys[1].Comment != keys[1].ID {
+		t.Errorf("Expected the second key's comment to default to its ID, got %+v", keys[1])
+	}
+
+	writeKeys(t, path, "azure some-key\n")
+	if _, err := LoadKeys(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("Expected an error naming the line, got %v", err)
+	}
+}
+
+// TestSignAWSRequest checks the example from AWS's Signature Version 4
+// documentation.
+func TestSignAWSRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
+
+// signAndVerify has ka sign with its only key, checking the signature
+// verifies.
+func signAndVerify(t *testing.T, ka *Agent, flags agent.SignatureFlags) (*agent.Key, error) {
+	t.Helper()
+	keys, err := ka.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected one key, got %v (%v)", keys, err)
+	}
+	data := []byte("signed through KMS")
+	signature, err := ka.SignWithFlags(keys[0], data, flags)
+	if err != nil {
+		return keys[0], err
+	}
+	if err := keys[0].Verify(data, signature); err != nil {
+		t.Errorf("Expected the KMS signature to verify, got %v", err)
+	}
+	return keys[0], nil
+}
+
+func TestAgentAWS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		var in struct {
+			KeyId            string
+			Message          []byte
+			SigningAlgorithm string
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			_ = json.NewEncoder(w).Encode(map[string]any{"PublicKey": der, "KeyUsage": "SIGN_VERIFY"})
+		case "TrentService.Sign":
+			if in.SigningAlgorithm != "ECDSA_SHA_256" {
+				http.Error(w, "wrong algorithm "+in.SigningAlgorithm, http.StatusBadRequest)
+				return
+			}
+			signature, _ := ecdsa.SignASN1(rand.Reader, key, in.Message)
+			_ = json.NewEncoder(w).Encode(map[string]any{"Signature": signature})
+		}
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_KMS", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	ka := NewAgent()
+	if err := ka.AddKey(Key{Provider: ProviderAWS, ID: "arn:aws:kms:eu-west-1:111122223333:key/test", Comment: "deploy@ci"}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	listed, err := signAndVerify(t, ka, 0)
+	if err != nil {
+		t.Fatalf("SignWithFlags failed: %v", err)
+	}
+	if listed.Comment != "deploy@ci" {
+		t.Errorf("Expected the key's comment, got %q", listed.Comment)
+	}
+	if err := ka.Add(agent.AddedKey{}); err == nil {
+		t.Error("Expected adding a key to be refused")
+	}
+}
+
+func TestAgentGCP(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	name := "projects/acme/locations/global/keyRings/ci/cryptoKeys/release/cryptoKeyVersions/1"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/" + name + "/publicKey":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": "RSA_SIGN_PKCS1_2048_SHA256",
+			})
+		case "/" + name + ":asymmetricSign":
+			var in struct {
+				Digest struct {
+					SHA256 []byte `json:"sha256"`
+				} `json:"digest"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if len(in.Digest.SHA256) != sha256.Size {
+				http.Error(w, "want a SHA-256 digest", http.StatusBadRequest)
+				return
+			}
+			signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, in.Digest.SHA256)
+			_ = json.NewEncoder(w).Encode(map[string]any{"signature": signature})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer func(endpoint string) { gcpEndpoint = endpoint }(gcpEndpoint)
+	gcpEndpoint = server.URL + "/"
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "test-token")
+
+	ka := NewAgent()
+	if err := ka.AddKey(Key{Provider: ProviderGCP, ID: name, Comment: "release"}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	listed, err := signAndVerify(t, ka, agent.SignatureFlagRsaSha256)
+	if err != nil {
+		t.Fatalf("rsa-sha2-256 SignWithFlags failed: %v", err)
+	}
+	if listed.Type() != ssh.KeyAlgoRSA {
+		t.Errorf("Expected an RSA key, got %s", listed.Type())
+	}
+	// The key version only signs SHA-256 digests
+	if _, err := ka.SignWithFlags(listed, []byte("data"), agent.SignatureFlagRsaSha512); err == nil {
+		t.Error("Expected an rsa-sha2-512 signature to be refused")
+	}
+}
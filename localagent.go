@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/phinze/double-agent/kms"
+	"github.com/phinze/double-agent/proxy"
+	"golang.org/x/term"
+)
+
+// loadLocalAgent loads keyFiles into a built-in agent that discovery falls
+// back to when no upstream agent is valid. With a passphraseTTL, encrypted
+// keys are decrypted on first use, through $SSH_ASKPASS, and forgotten
+// again passphraseTTL later.
+func loadLocalAgent(keyFiles []string, passphraseTTL time.Duration, discovery *proxy.Discovery, logger *slog.Logger) {
+	if passphraseTTL > 0 && os.Getenv("SSH_ASKPASS") == "" {
+		logger.Error("--key-passphrase-ttl asks for passphrases through $SSH_ASKPASS, which is not set")
+		os.Exit(1)
+	}
+	local := proxy.NewLocalAgent()
+	for _, path := range keyFiles {
+		path = expandPath(path, logger)
+		var err error
+		if passphraseTTL > 0 {
+			err = local.LoadKeyFileOnDemand(path, askpassPassphrase, passphraseTTL)
+		} else {
+			err = local.LoadKeyFile(path, promptPassphrase)
+		}
+		if err != nil {
+			logger.Error("Failed to load key", "error", err)
+			os.Exit(1)
+		}
+		logger.Debug("Loaded key into local agent", "path", path)
+	}
+	proxy.UseLocalAgent(local)
+	discovery.Fallback = append(discovery.Fallback, proxy.LocalAgentAddress)
+}
+
+// loadKMSAgent fetches the public halves of the KMS keys listed in path.
+// Unless --key already set up the built-in agent, an empty one stands in
+// as the fallback upstream, so KMS keys are served even on machines with
+// no agent at all, such as CI runners.
+func loadKMSAgent(path string, haveLocal bool, discovery *proxy.Discovery, logger *slog.Logger) *kms.Agent {
+	keys, err := kms.LoadKeys(path)
+	if err != nil {
+		logger.Error("Failed to load KMS keys", "error", err)
+		os.Exit(1)
+	}
+	ka := kms.NewAgent()
+	for _, key := range keys {
+		if err := ka.AddKey(key); err != nil {
+			logger.Error("Failed to load KMS key", "error", err)
+			os.Exit(1)
+		}
+		logger.Debug("Loaded KMS key", "provider", key.Provider, "key", key.ID)
+	}
+	if !haveLocal {
+		proxy.UseLocalAgent(proxy.NewLocalAgent())
+		discovery.Fallback = append(discovery.Fallback, proxy.LocalAgentAddress)
+	}
+	return ka
+}
+
+// newPKCS11Agent sets up a private agent for the PKCS#11 module at
+// provider, with its socket in the state directory so each run uses the
+// same path.
+func newPKCS11Agent(provider string, logger *slog.Logger) *proxy.PKCS11Agent {
+	if _, err := os.Stat(provider); err != nil {
+		logger.Error("PKCS#11 module unavailable", "error", err)
+		os.Exit(1)
+	}
+	dir := stateDir(logger)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Error("Failed to create state directory", "error", err)
+		os.Exit(1)
+	}
+	return &proxy.PKCS11Agent{
+		Provider: provider,
+		Socket:   filepath.Join(dir, "pkcs11-"+socketKey(provider)+".sock"),
+		PIN:      promptPIN,
+		Logger:   logger,
+	}
+}
+
+// promptPIN asks for a PKCS#11 token's PIN on the terminal, or through
+// $SSH_ASKPASS when there is none, like ssh-add -s.
+func promptPIN(provider string) ([]byte, error) {
+	if batchMode {
+		return nil, errBatchPrompt
+	}
+	prompt := fmt.Sprintf("Enter PIN for %s: ", provider)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return term.ReadPassword(fd)
+	}
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		return nil, errors.New("no terminal to prompt on and SSH_ASKPASS is not set")
+	}
+	out, err := exec.Command(askpass, prompt).Output()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// promptPassphrase asks for a key's passphrase on the terminal, or through
+// $SSH_ASKPASS when there is none (as under --daemon), like ssh-add.
+func promptPassphrase(path string) ([]byte, error) {
+	if batchMode {
+		return nil, errBatchPrompt
+	}
+	prompt := fmt.Sprintf("Enter passphrase for %s: ", path)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return term.ReadPassword(fd)
+	}
+	if os.Getenv("SSH_ASKPASS") != "" {
+		return askpassPassphrase(path)
+	}
+	return nil, errors.New("no terminal to prompt on and SSH_ASKPASS is not set")
+}
+
+// askpassPassphrase asks for a key's passphrase through $SSH_ASKPASS.
+func askpassPassphrase(path string) ([]byte, error) {
+	if batchMode {
+		return nil, errBatchPrompt
+	}
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		return nil, errors.New("SSH_ASKPASS is not set")
+	}
+	out, err := exec.Command(askpass, fmt.Sprintf("Enter passphrase for %s: ", path)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
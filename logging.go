@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+const (
+	defaultLogMaxSize    = 10 << 20 // 10 MiB
+	defaultLogMaxAge     = 7 * 24 * time.Hour
+	defaultLogMaxBackups = 3
+)
+
+// logLevel is shared by every logger newLogger builds, so the level can be
+// changed at runtime through the control socket or a signal.
+var logLevel = new(slog.LevelVar)
+
+// A temporary level change made by setLogLevel reverts to logLevelBase,
+// the level last set for good.
+var (
+	logLevelMu     sync.Mutex
+	logLevelBase   slog.Level
+	logLevelRevert *time.Timer
+)
+
+// setLogLevel changes the level of every logger newLogger builds. With a
+// positive d the change is temporary: the level reverts once d passes.
+func setLogLevel(level slog.Level, d time.Duration, logger *slog.Logger) {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	if logLevelRevert != nil {
+		logLevelRevert.Stop()
+		logLevelRevert = nil
+	}
+	logLevel.Set(level)
+	if d <= 0 {
+		logLevelBase = level
+		logger.Info("Log level changed", "level", level.String())
+		return
+	}
+	logger.Info("Log level changed", "level", level.String(), "for", d, "then", logLevelBase.String())
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		logLevelMu.Lock()
+		defer logLevelMu.Unlock()
+		if logLevelRevert != timer {
+			return
+		}
+		logLevelRevert = nil
+		logLevel.Set(logLevelBase)
+		logger.Info("Log level restored", "level", logLevelBase.String())
+	})
+	logLevelRevert = timer
+}
+
+// restoreLogLevel ends a temporary level change early.
+func restoreLogLevel(logger *slog.Logger) {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	if logLevelRevert != nil {
+		logLevelRevert.Stop()
+		logLevelRevert = nil
+	}
+	logLevel.Set(logLevelBase)
+	logger.Info("Log level restored", "level", logLevelBase.String())
+}
+
+// logSanitize is what every logger newLogger builds redacts.
+var logSanitize = proxy.DefaultSanitizeOptions()
+
+// sanitizeRuleFlag collects --sanitize-rule values. Patterns may contain
+// commas, so unlike listFlag it keeps each value whole and joins them with
+// newlines when handed to a daemon child.
+type sanitizeRuleFlag struct {
+	values []string
+	rules  []proxy.SanitizeRule
+}
+
+func (f *sanitizeRuleFlag) String() string {
+	return strings.Join(f.values, "\n")
+}
+
+func (f *sanitizeRuleFlag) Set(value string) error {
+	for _, item := range strings.Split(value, "\n") {
+		rule, err := proxy.ParseSanitizeRule(item)
+		if err != nil {
+			return err
+		}
+		f.values = append(f.values, item)
+		f.rules = append(f.rules, rule)
+	}
+	return nil
+}
+
+// logOptions describes where the proxy writes its logs when not logging to
+// stderr.
+type logOptions struct {
+	file    string
+	maxSize int64
+	maxAge  time.Duration
+}
+
+func defaultLogOptions(logger *slog.Logger) logOptions {
+	return logOptions{
+		file:    defaultLogFile(logger),
+		maxSize: defaultLogMaxSize,
+		maxAge:  defaultLogMaxAge,
+	}
+}
+
+func (o logOptions) open() (*proxy.RotatingFile, error) {
+	return proxy.NewRotatingFile(o.file, o.maxSize, o.maxAge, defaultLogMaxBackups)
+}
+
+// args renders the options as command line flags for a child process.
+func (o logOptions) args() []string {
+	if o.file == "" {
+		return nil
+	}
+	return []string{
+		"--log-file", o.file,
+		"--log-max-size", strconv.FormatInt(o.maxSize, 10),
+		"--log-max-age", o.maxAge.String(),
+	}
+}
+
+// stateDir returns the per-user directory for double-agent's runtime state,
+// following the XDG base directory spec.
+func stateDir(logger *slog.Logger) string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "double-agent")
+	}
+	return expandPath("~/.local/state/double-agent", logger)
+}
+
+func defaultLogFile(logger *slog.Logger) string {
+	return filepath.Join(stateDir(logger), "log")
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/phinze/double-agent/kms"
 	"github.com/phinze/double-agent/proxy"
 )
 
@@ -16,30 +28,297 @@ var (
 	version = "dev" // Can be overridden at build time
 )
 
+// shutdownTimeout bounds how long shutdown waits for in-flight connections.
+const shutdownTimeout = 5 * time.Second
+
+// defaultSocketArg returns the proxy socket used when no path is given:
+// $XDG_STATE_HOME/double-agent/agent.sock, or ~/.ssh/double-agent.sock
+// when XDG_STATE_HOME isn't set. It's left unexpanded so usage text shows
+// it the way a user would write it.
+func defaultSocketArg() string {
+	if os.Getenv("XDG_STATE_HOME") != "" {
+		return "$XDG_STATE_HOME/double-agent/agent.sock"
+	}
+	return "~/.ssh/double-agent.sock"
+}
+
+// subcommands maps subcommand names to their entry points. Anything not
+// listed here falls through to the classic flag-based proxy invocation.
+var subcommands = map[string]func(args []string){
+	"audit":        runAudit,
+	"completion":   runCompletion,
+	"container":    runContainer,
+	"ctl":          runCtl,
+	"doctor":       runDoctor,
+	"env":          runEnv,
+	"install":      runInstall,
+	"keys":         runKeys,
+	"pin":          runPin,
+	"remote":       runRemote,
+	"screen-setup": runScreenSetup,
+	"sign-test":    runSignTest,
+	"ssh-config":   runSSHConfig,
+	"status":       runStatus,
+	"system":       runSystem,
+	"tmux-setup":   runTmuxSetup,
+	"unpin":        runUnpin,
+	"upgrade":      runUpgrade,
+	"watch":        runWatch,
+}
+
 func main() {
+	// --batch may come before the command, as in "double-agent --batch keys"
+	for len(os.Args) > 1 && (os.Args[1] == "--batch" || os.Args[1] == "-batch") {
+		setBatchMode()
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// "start" names the classic invocation, as in "double-agent start
+	// --profile work"
+	if len(os.Args) > 1 && os.Args[1] == "start" {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		verbose       = flag.Bool("v", false, "Enable verbose logging")
 		verboseLong   = flag.Bool("verbose", false, "Enable verbose logging")
 		daemon        = flag.Bool("d", false, "Run as daemon (detach from terminal)")
 		daemonLong    = flag.Bool("daemon", false, "Run as daemon (detach from terminal)")
+		superviseFlag = flag.Bool("supervise", false, "Run the proxy as a child process and restart it if it crashes")
 		testDiscovery = flag.Bool("test-discovery", false, "Test socket discovery and exit")
+		jsonOutput    = flag.Bool("json", false, "With --test-discovery, --health, or --version, print results as JSON")
+		discoverCmd   = flag.String("discover-cmd", "", "Command that prints extra candidate socket paths")
+		probeTimeout  = flag.Duration("probe-timeout", proxy.DefaultProbeTimeout, "How long each candidate socket has to answer during discovery")
+		cacheTTL      = flag.Duration("cache-ttl", proxy.DefaultCacheTTL, "How long to reuse the discovered socket before discovering again (0 for every connection)")
+		negativeTTL   = flag.Duration("negative-cache-ttl", proxy.DefaultNegativeCacheTTL, "How long to answer clients straight away after discovery finds no agent (0 to scan every time)")
+		validateCache = flag.Bool("validate-cached", false, "Check the cached socket still answers before each reuse, instead of trusting it until an error")
+		upTimeout     = flag.Duration("upstream-timeout", 0, "How long the upstream agent has to answer each request (0 to wait forever)")
+		discTimeout   = flag.Duration("discovery-timeout", proxy.DefaultDiscoveryTimeout, "Overall deadline for validating discovered sockets")
+		controlSocket = flag.String("control-socket", "", "Path for the control socket (default: <proxy-socket-path>.ctl, \"none\" to disable)")
+		strategy      = flag.String("selection-strategy", proxy.StrategyNewest, "How to choose among valid sockets: newest, most-keys, or pinned:<path>")
+		skipEmpty     = flag.Bool("skip-empty", false, "Pass over agents holding no keys unless no valid agent has any")
+		hotStandby    = flag.Bool("hot-standby", false, "Keep connections ready to the active and next-best upstreams for instant failover")
 		healthCheck   = flag.Bool("health", false, "Check if proxy is healthy and exit")
+		healthTimeout = flag.Duration("health-timeout", proxy.DefaultHealthTimeout, "How long each --health attempt waits for the proxy")
+		healthSign    = flag.Bool("health-sign", false, "With --health, also sign a test challenge with the first key")
+		logFile       = flag.String("log-file", "", "Write logs to this file with rotation")
+		logMaxSize    = flag.Int64("log-max-size", defaultLogMaxSize, "Rotate the log file after this many bytes")
+		logMaxAge     = flag.Duration("log-max-age", defaultLogMaxAge, "Rotate the log file after this age")
+		noSanitize    = flag.Bool("no-sanitize", false, "Log paths and fingerprints unredacted, for local debugging (key material stays redacted)")
+		sanitizePaths = flag.Bool("sanitize-paths", true, "Hide user names in home directory paths in logs")
+		sanitizeFPs   = flag.Bool("sanitize-fingerprints", true, "Hide key fingerprints in logs")
+		maxConns      = flag.Int("max-connections", 0, "Maximum concurrent client connections (0 for no limit)")
+		overloadWait  = flag.Duration("overload-wait", 0, "How long a connection over --max-connections waits for a slot before being rejected")
+		warnHandlers  = flag.Int("warn-handlers", proxy.DefaultHandlerWarning, "Warn when more goroutines than this are serving clients (0 to disable)")
+		warnUpstreams = flag.Int("warn-upstream-conns", proxy.DefaultUpstreamConnWarning, "Warn when more connections than this are open to upstream agents (0 to disable)")
+		maxMsgSize    = flag.Int("max-message-size", 0, "Refuse client requests larger than this many bytes (0 for the 16MiB limit)")
+		signRate      = flag.Float64("sign-rate", 0, "Sign requests allowed per second for each client (0 for no limit)")
+		signBurst     = flag.Int("sign-burst", 10, "Sign requests a client may make at once before --sign-rate applies")
+		keyPassTTL    = flag.Duration("key-passphrase-ttl", 0, "Decrypt encrypted --key files on first use via $SSH_ASKPASS, and forget them after this long")
+		addLifetime   = flag.Duration("add-max-lifetime", 0, "Longest lifetime allowed for keys added through the proxy (0 for no limit)")
+		addConfirm    = flag.Bool("add-confirm", false, "Require confirmation on every use of keys added through the proxy")
+		lockMode      = flag.String("lock-mode", proxy.LockUpstream, "How ssh-add -x locks apply: upstream, follow, or local")
+		blockExts     = flag.Bool("block-unknown-extensions", false, "Refuse agent extension requests that aren't known to be safe or allowed with --allow-extension")
+		destPolicy    = flag.String("destination-policy", "", "File limiting which hosts each key may sign for")
+		failDetails   = flag.Bool("failure-details", false, "Log a refusal ID for each request the proxy refuses, and send it to extension clients")
+		kmsKeys       = flag.String("kms-keys", "", "File listing AWS and GCP KMS keys to serve alongside upstream keys")
+		otlpEndpoint  = flag.String("otlp-endpoint", "", "Send tracing spans to this OTLP/HTTP traces URL (default: $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)")
+		originTags    = flag.Bool("origin-tags", false, "Append each key's upstream agent to its comment")
+		tracePackets  = flag.Bool("trace-packets", false, "Log each message exchanged with the upstream agent, redacted, at debug level")
+		socketModeArg = flag.String("socket-mode", "", "Permissions for the proxy socket, in octal (default: 0600)")
+		socketDirArg  = flag.String("socket-dir-mode", "", "Permissions to set on the proxy socket's directory, in octal")
+		socketOwner   = flag.String("socket-owner", "", "Give the proxy socket to USER[:GROUP] (requires privileges)")
+		tcpListen     = flag.String("tcp-listen", "", "Also serve the agent on this TCP address (e.g., 127.0.0.1:7777)")
+		tcpTokenFile  = flag.String("tcp-token-file", "", "File containing the shared token TCP clients must send")
+		tcpTLSCert    = flag.String("tcp-tls-cert", "", "TLS certificate for the TCP listener")
+		tcpTLSKey     = flag.String("tcp-tls-key", "", "TLS private key for the TCP listener")
+		tcpTLSCA      = flag.String("tcp-tls-client-ca", "", "CA that TCP client certificates must chain to")
+		tmuxEnv       = flag.Bool("tmux-env", false, "Keep SSH_AUTH_SOCK in a running tmux server pointed at the proxy")
+		socketLink    = flag.String("socket-link", "", "Keep this path a symlink to the proxy socket, swapped atomically on each start")
+		profilesFile  = flag.String("profiles-file", defaultProfilesFile, "File defining the profiles --profile selects")
+		httpListen    = flag.String("http-listen", "", "Serve a status page, /livez, and /readyz over HTTP on this address (e.g., 127.0.0.1:9090)")
+		runAs         = flag.String("user", "", "When started as root, switch to this user before doing anything else")
+		allowRoot     = flag.Bool("allow-root", false, "Run as root without --user")
 		showVersion   = flag.Bool("version", false, "Show version and exit")
 		showHelp      = flag.Bool("h", false, "Show help")
 		showHelpLong  = flag.Bool("help", false, "Show help")
 	)
 
+	addBatchFlag(flag.CommandLine)
+	var prefer listFlag
+	flag.Var(&prefer, "prefer", "Preferred upstream classes or socket paths, most preferred first")
+	var keyFiles listFlag
+	var certFiles listFlag
+	var allowExts listFlag
+	var notify listFlag
+	var sockets listFlag
+	var sessionSockets listFlag
+	var ignore listFlag
+	var upstreams listFlag
+	var profiles listFlag
+	var pkcs11Providers listFlag
+	flag.Var(&pkcs11Providers, "pkcs11", "PKCS#11 module whose token keys to serve from a private ssh-agent (repeatable)")
+	flag.Var(&profiles, "profile", "Serve the named profile from --profiles-file, or \"all\" of them (repeatable)")
+	var sanitizeRules sanitizeRuleFlag
+	flag.Var(&sanitizeRules, "sanitize-rule", "Also rewrite log text matching REGEX, given as REGEX=>REPLACEMENT (repeatable)")
+	var expectKeys listFlag
+	flag.Var(&expectKeys, "expect-key", "Key fingerprint (SHA256:...) a discovered agent must hold to be used")
+	flag.Var(&upstreams, "upstream", "Also use the socket named by env:NAME, env:NAME@FILE, or file:PATH, reread on each scan")
+	flag.Var(&ignore, "discovery-ignore", "Socket path or glob discovery must never use; a directory ignores everything in it")
+	flag.Var(&sessionSockets, "session-socket", "Socket forwarded into this login, preferred over other logins' (default: detected; \"none\" to disable)")
+	flag.Var(&sockets, "socket", "Extra proxy socket to serve, as PATH[=UPSTREAM[:UPSTREAM...]][;key=KEY...][;confirm]")
+	flag.Var(&notify, "notify", "Desktop notifications to show: failover, no-agent, sign, failures, touch, or all")
+	flag.Var(&allowExts, "allow-extension", "Agent extension to forward despite --block-unknown-extensions")
+	flag.Var(&certFiles, "cert", "SSH certificate file to offer alongside the upstream key it certifies")
+	flag.Var(&keyFiles, "key", "Private key file to serve from a built-in agent when no upstream is available")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Double Agent - SSH Agent Proxy v%s\n\n", version)
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <proxy-socket-path>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [proxy-socket-path]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [--batch] <command> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  audit                Report who can reach the proxy, exposed keys, and policies\n")
+		fmt.Fprintf(os.Stderr, "  completion           Print a shell completion script (bash, zsh, or fish)\n")
+		fmt.Fprintf(os.Stderr, "  container            Serve the proxy in a directory to bind-mount into containers\n")
+		fmt.Fprintf(os.Stderr, "  ctl                  Send a command to a running proxy's control socket\n")
+		fmt.Fprintf(os.Stderr, "  doctor               Diagnose common setup problems and suggest fixes\n")
+		fmt.Fprintf(os.Stderr, "  env                  Print shell commands that point SSH_AUTH_SOCK at the proxy\n")
+		fmt.Fprintf(os.Stderr, "  install              Install a service unit that runs the proxy\n")
+		fmt.Fprintf(os.Stderr, "  keys                 List the keys visible through the proxy\n")
+		fmt.Fprintf(os.Stderr, "  pin                  Make the running proxy use one upstream socket\n")
+		fmt.Fprintf(os.Stderr, "  remote               Publish the proxy socket on a remote host over ssh -R\n")
+		fmt.Fprintf(os.Stderr, "  screen-setup         Point running GNU screen sessions at the proxy\n")
+		fmt.Fprintf(os.Stderr, "  sign-test            Sign and verify a challenge through the proxy\n")
+		fmt.Fprintf(os.Stderr, "  ssh-config           Print or install an IdentityAgent snippet for ssh_config\n")
+		fmt.Fprintf(os.Stderr, "  start                Start the proxy, as when no command is given\n")
+		fmt.Fprintf(os.Stderr, "  status               Report proxy health, compactly with --short for prompts\n")
+		fmt.Fprintf(os.Stderr, "  system               Serve a proxy for every logged-in user (run as root)\n")
+		fmt.Fprintf(os.Stderr, "  tmux-setup           Point the running tmux server at the proxy\n")
+		fmt.Fprintf(os.Stderr, "  unpin                Return the running proxy to discovery\n")
+		fmt.Fprintf(os.Stderr, "  upgrade              Replace the running proxy with this version without\n")
+		fmt.Fprintf(os.Stderr, "                       closing its sockets\n")
+		fmt.Fprintf(os.Stderr, "  watch                Print agent sockets as they appear, vanish, or change\n\n")
 		fmt.Fprintf(os.Stderr, "Arguments:\n")
-		fmt.Fprintf(os.Stderr, "  proxy-socket-path    Path to create the proxy socket (e.g., ~/.ssh/agent)\n\n")
+		fmt.Fprintf(os.Stderr, "  proxy-socket-path    Path to create the proxy socket (default: %s); ~user,\n", defaultSocketArg())
+		fmt.Fprintf(os.Stderr, "                       %%d, %%u, %%i, %%l, and $VAR expand as in ssh_config, %%h and\n")
+		fmt.Fprintf(os.Stderr, "                       %%t as in systemd, and a leading @ names a Linux abstract\n")
+		fmt.Fprintf(os.Stderr, "                       socket\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fmt.Fprintf(os.Stderr, "  -v, --verbose        Enable verbose logging\n")
 		fmt.Fprintf(os.Stderr, "  -d, --daemon         Run as daemon (detach from terminal)\n")
+		fmt.Fprintf(os.Stderr, "  --supervise          Restart the proxy with backoff if it crashes\n")
+		fmt.Fprintf(os.Stderr, "  --log-file PATH      Write logs to PATH with rotation (daemon default:\n")
+		fmt.Fprintf(os.Stderr, "                       ~/.local/state/double-agent/log)\n")
+		fmt.Fprintf(os.Stderr, "  --log-max-size N     Rotate the log file after N bytes (default: 10MiB)\n")
+		fmt.Fprintf(os.Stderr, "  --log-max-age DUR    Rotate the log file after DUR (default: 168h)\n")
+		fmt.Fprintf(os.Stderr, "  --sanitize-rule R    Also rewrite log text, with R as REGEX=>REPLACEMENT (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --sanitize-paths=false  Log the user names in home directory paths\n")
+		fmt.Fprintf(os.Stderr, "  --sanitize-fingerprints=false  Log key fingerprints\n")
+		fmt.Fprintf(os.Stderr, "  --no-sanitize        Redact only key material in logs, for local debugging\n")
+		fmt.Fprintf(os.Stderr, "  --max-connections N  Serve at most N clients at once; others get SSH_AGENT_FAILURE\n")
+		fmt.Fprintf(os.Stderr, "  --overload-wait DUR  Let clients over the limit queue for up to DUR first (default: 0)\n")
+		fmt.Fprintf(os.Stderr, "  --warn-handlers N    Warn of a possible leak past N goroutines serving clients\n")
+		fmt.Fprintf(os.Stderr, "                       (default: %d, 0 to disable)\n", proxy.DefaultHandlerWarning)
+		fmt.Fprintf(os.Stderr, "  --warn-upstream-conns N  Warn past N open upstream connections (default: %d)\n", proxy.DefaultUpstreamConnWarning)
+		fmt.Fprintf(os.Stderr, "  --max-message-size N Refuse client requests larger than N bytes\n")
+		fmt.Fprintf(os.Stderr, "  --sign-rate R        Allow each client R sign requests per second on average\n")
+		fmt.Fprintf(os.Stderr, "  --sign-burst N       Let clients sign N times at once before --sign-rate applies\n")
+		fmt.Fprintf(os.Stderr, "                       (default: 10)\n")
+		fmt.Fprintf(os.Stderr, "  --socket SPEC        Also serve the proxy at another path (repeatable); append\n")
+		fmt.Fprintf(os.Stderr, "                       =UPSTREAM[:UPSTREAM...] to use only those classes or paths,\n")
+		fmt.Fprintf(os.Stderr, "                       ;key=KEY to expose only that key, ;confirm to ask first\n")
+		fmt.Fprintf(os.Stderr, "  --profile NAME       Serve the named profile's socket (repeatable, or \"all\");\n")
+		fmt.Fprintf(os.Stderr, "                       the first is the main socket unless a path is given\n")
+		fmt.Fprintf(os.Stderr, "  --profiles-file PATH Where profiles are defined (default:\n")
+		fmt.Fprintf(os.Stderr, "                       %s)\n", defaultProfilesFile)
+		fmt.Fprintf(os.Stderr, "  --socket-mode MODE   Proxy socket permissions in octal (default: 0600)\n")
+		fmt.Fprintf(os.Stderr, "  --socket-dir-mode MODE  Set the socket directory's permissions in octal\n")
+		fmt.Fprintf(os.Stderr, "  --socket-owner USER[:GROUP]  Give the proxy socket to USER (requires privileges)\n")
+		fmt.Fprintf(os.Stderr, "  --tcp-listen ADDR    Also serve the agent on TCP ADDR (requires auth below)\n")
+		fmt.Fprintf(os.Stderr, "  --tcp-token-file F   Require TCP clients to send the token in F first\n")
+		fmt.Fprintf(os.Stderr, "  --tcp-tls-cert F     Serve TCP over TLS with certificate F\n")
+		fmt.Fprintf(os.Stderr, "  --tcp-tls-key F      Private key for --tcp-tls-cert\n")
+		fmt.Fprintf(os.Stderr, "  --tcp-tls-client-ca F  Require TCP client certificates signed by CA F\n")
+		fmt.Fprintf(os.Stderr, "  --tmux-env           Keep SSH_AUTH_SOCK in a running tmux server pointed at the\n")
+		fmt.Fprintf(os.Stderr, "                       proxy, so new panes use it whatever the shell init does\n")
+		fmt.Fprintf(os.Stderr, "  --socket-link PATH   Keep PATH a symlink to the proxy socket, swapped atomically\n")
+		fmt.Fprintf(os.Stderr, "                       on each start, so SSH_AUTH_SOCK=PATH survives socket moves\n")
+		fmt.Fprintf(os.Stderr, "  --http-listen ADDR   Serve a status page, /livez, and /readyz over HTTP on ADDR\n")
+		fmt.Fprintf(os.Stderr, "  --discover-cmd CMD   Also use socket paths printed by CMD (one per line or JSON)\n")
+		fmt.Fprintf(os.Stderr, "  --upstream SOURCE    Also use the socket named by env:NAME, env:NAME@FILE (NAME\n")
+		fmt.Fprintf(os.Stderr, "                       set in FILE or the environment), or file:PATH; reread on\n")
+		fmt.Fprintf(os.Stderr, "                       each scan and when the file changes (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --key FILE           Serve FILE's key from a built-in agent when no upstream\n")
+		fmt.Fprintf(os.Stderr, "                       agent is valid (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --key-passphrase-ttl DUR  Ask for encrypted --key passphrases on first use,\n")
+		fmt.Fprintf(os.Stderr, "                       via $SSH_ASKPASS, and forget the key after DUR\n")
+		fmt.Fprintf(os.Stderr, "  --cert FILE          Offer certificate FILE with the upstream key it certifies\n")
+		fmt.Fprintf(os.Stderr, "                       (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --kms-keys FILE      Serve the AWS and GCP KMS keys listed in FILE alongside\n")
+		fmt.Fprintf(os.Stderr, "                       upstream keys\n")
+		fmt.Fprintf(os.Stderr, "  --pkcs11 MODULE      Serve the keys on MODULE's token (YubiKey PIV, smartcards)\n")
+		fmt.Fprintf(os.Stderr, "                       from a private ssh-agent, kept running (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --add-max-lifetime DUR  Cap the lifetime of keys added through the proxy\n")
+		fmt.Fprintf(os.Stderr, "  --add-confirm        Require confirmation for keys added through the proxy\n")
+		fmt.Fprintf(os.Stderr, "  --lock-mode MODE     Lock only the active upstream (upstream, default), every\n")
+		fmt.Fprintf(os.Stderr, "                       upstream used while locked (follow), or the proxy (local)\n")
+		fmt.Fprintf(os.Stderr, "  --block-unknown-extensions  Refuse agent extensions not known to be safe\n")
+		fmt.Fprintf(os.Stderr, "  --allow-extension NAME  Forward extension NAME anyway (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --destination-policy F  Limit which hosts each key signs for, per rules in F\n")
+		fmt.Fprintf(os.Stderr, "  --failure-details    Log an ID with each refusal made by the proxy, and tell it\n")
+		fmt.Fprintf(os.Stderr, "                       to clients in extension failure replies\n")
+		fmt.Fprintf(os.Stderr, "  --otlp-endpoint URL  Send a tracing span per request and discovery scan to an\n")
+		fmt.Fprintf(os.Stderr, "                       OpenTelemetry collector (e.g., http://localhost:4318/v1/traces)\n")
+		fmt.Fprintf(os.Stderr, "  --notify LIST        Show desktop notifications for failover, no-agent, sign,\n")
+		fmt.Fprintf(os.Stderr, "                       failures, touch, or all\n")
+		fmt.Fprintf(os.Stderr, "  --origin-tags        Show each key's upstream agent in its comment\n")
+		fmt.Fprintf(os.Stderr, "  --trace-packets      Log every upstream message's type, length, and a redacted\n")
+		fmt.Fprintf(os.Stderr, "                       preview at debug level (with -v or ctl set-log-level debug)\n")
+		fmt.Fprintf(os.Stderr, "  --prefer LIST        Upstream preference order: classes (forwarded, teleport,\n")
+		fmt.Fprintf(os.Stderr, "                       ssh-agent, secure-enclave, 1password, gpg-agent, gnome-keyring,\n")
+		fmt.Fprintf(os.Stderr, "                       pkcs11, custom) or socket path globs\n")
+		fmt.Fprintf(os.Stderr, "  --discovery-ignore GLOB  Never use sockets matching GLOB, or inside a matching\n")
+		fmt.Fprintf(os.Stderr, "                       directory (repeatable)\n")
+		fmt.Fprintf(os.Stderr, "  --session-socket PATH  Prefer PATH as this login's forwarded agent over other\n")
+		fmt.Fprintf(os.Stderr, "                       logins' (default: detected in SSH sessions; none to disable)\n")
+		fmt.Fprintf(os.Stderr, "  --selection-strategy S  Choose among valid sockets by newest (default),\n")
+		fmt.Fprintf(os.Stderr, "                       most-keys, or pinned:<path>\n")
+		fmt.Fprintf(os.Stderr, "  --expect-key FP      Only use agents holding the key with fingerprint FP\n")
+		fmt.Fprintf(os.Stderr, "                       (repeatable; any one of them will do)\n")
+		fmt.Fprintf(os.Stderr, "  --skip-empty         Pass over agents holding no keys, using one only if no\n")
+		fmt.Fprintf(os.Stderr, "                       valid agent has keys\n")
+		fmt.Fprintf(os.Stderr, "  --hot-standby        Keep connections ready to the active and next-best\n")
+		fmt.Fprintf(os.Stderr, "                       upstreams, failing over without a rescan\n")
+		fmt.Fprintf(os.Stderr, "  --probe-timeout DUR  How long each candidate socket has to answer (default: 5s)\n")
+		fmt.Fprintf(os.Stderr, "  --upstream-timeout DUR  Fail requests the upstream agent hasn't answered\n")
+		fmt.Fprintf(os.Stderr, "                       within DUR (default: wait forever)\n")
+		fmt.Fprintf(os.Stderr, "  --cache-ttl DUR      Reuse the discovered socket this long (default: 5s)\n")
+		fmt.Fprintf(os.Stderr, "  --negative-cache-ttl DUR  Fail clients without a scan for DUR after one\n")
+		fmt.Fprintf(os.Stderr, "                       finds no agent (default: 2s)\n")
+		fmt.Fprintf(os.Stderr, "  --validate-cached    Probe the cached socket before each reuse instead of\n")
+		fmt.Fprintf(os.Stderr, "                       trusting it until connecting fails\n")
+		fmt.Fprintf(os.Stderr, "  --discovery-timeout DUR  Deadline for validating all candidates, which are\n")
+		fmt.Fprintf(os.Stderr, "                       probed concurrently (default: 5s)\n")
+		fmt.Fprintf(os.Stderr, "  --control-socket P   Serve the control socket at P (default: <proxy-socket-path>.ctl,\n")
+		fmt.Fprintf(os.Stderr, "                       \"none\" to disable)\n")
 		fmt.Fprintf(os.Stderr, "  --test-discovery     Test socket discovery and exit\n")
+		fmt.Fprintf(os.Stderr, "  --json               With --test-discovery, --health, or --version, print results\n")
+		fmt.Fprintf(os.Stderr, "                       as JSON\n")
+		fmt.Fprintf(os.Stderr, "  --batch              For scripts: never prompt or notify, refuse signatures\n")
+		fmt.Fprintf(os.Stderr, "                       that need confirmation, and print JSON, errors included\n")
+		fmt.Fprintf(os.Stderr, "                       (also DOUBLE_AGENT_BATCH=1; accepted by every command)\n")
 		fmt.Fprintf(os.Stderr, "  --health             Check if proxy is healthy and exit\n")
-		fmt.Fprintf(os.Stderr, "  --version            Show version and exit\n")
+		fmt.Fprintf(os.Stderr, "  --health-timeout DUR How long each --health attempt waits (default: 2s)\n")
+		fmt.Fprintf(os.Stderr, "  --health-sign        With --health, also sign a test challenge with the first key\n")
+		fmt.Fprintf(os.Stderr, "  --user NAME          When started as root, switch to NAME before creating the\n")
+		fmt.Fprintf(os.Stderr, "                       socket or scanning for agents\n")
+		fmt.Fprintf(os.Stderr, "  --allow-root         Run as root without --user (refused by default)\n")
+		fmt.Fprintf(os.Stderr, "  --version            Show version, commit, build date, and platform, and exit\n")
 		fmt.Fprintf(os.Stderr, "  -h, --help           Show this help message\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  # Start proxy in foreground\n")
@@ -59,7 +338,13 @@ func main() {
 
 	// Handle version flag
 	if *showVersion {
-		fmt.Printf("double-agent version %s\n", version)
+		info := buildVersion()
+		if *jsonOutput || batchMode {
+			data, _ := json.MarshalIndent(info, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			fmt.Print(info)
+		}
 		os.Exit(0)
 	}
 
@@ -69,104 +354,709 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Agent sockets are per-user, so root must either hand off to a user
+	// first or say it really means to serve root's own agents.
+	if *runAs != "" {
+		if err := dropPrivileges(*runAs); err != nil {
+			exitError("failed to switch to user %s: %v", *runAs, err)
+		}
+	} else if os.Geteuid() == 0 && !*allowRoot {
+		exitError("refusing to run as root, since agent sockets belong to a user; use --user NAME to serve that user's agents, or --allow-root to serve root's")
+	}
+
 	// Combine verbose flags
 	verbose = boolPtr(*verbose || *verboseLong)
 	daemon = boolPtr(*daemon || *daemonLong)
 
-	// Configure logging
-	logLevel := slog.LevelInfo
-	if *verbose {
-		logLevel = slog.LevelDebug
+	logOpts := logOptions{
+		file:    *logFile,
+		maxSize: *logMaxSize,
+		maxAge:  *logMaxAge,
+	}
+	tcpOpts := tcpOptions{
+		addr:      *tcpListen,
+		tokenFile: *tcpTokenFile,
+		tlsCert:   *tcpTLSCert,
+		tlsKey:    *tcpTLSKey,
+		tlsCA:     *tcpTLSCA,
+	}
+	if *noSanitize {
+		// Key material stays redacted: verbose logs must never leak it
+		logSanitize = proxy.SanitizeOptions{KeyMaterial: true}
+	} else {
+		logSanitize = proxy.SanitizeOptions{
+			HomePaths:    *sanitizePaths,
+			Fingerprints: *sanitizeFPs,
+			KeyMaterial:  true,
+			Rules:        sanitizeRules.rules,
+		}
+	}
+	var logOutput io.Writer = os.Stderr
+	logger := newLogger(logOutput, *verbose)
+	if logOpts.file != "" {
+		logOpts.file = expandPath(logOpts.file, logger)
+		logWriter, err := logOpts.open()
+		if err != nil {
+			logger.Error("Failed to open log file", "error", err)
+			os.Exit(1)
+		}
+		defer func() { _ = logWriter.Close() }()
+		logOutput = logWriter
+		logger = newLogger(logOutput, *verbose)
 	}
 
-	opts := &slog.HandlerOptions{
-		Level: logLevel,
+	for i, entry := range prefer {
+		prefer[i] = expandPath(entry, logger)
+	}
+	for _, fingerprint := range expectKeys {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			exitUsage(flag.Usage, "--expect-key %q is not a SHA256: fingerprint as shown by ssh-add -l", fingerprint)
+		}
+	}
+	for i, entry := range ignore {
+		ignore[i] = expandPath(entry, logger)
+	}
+	var upstreamSources []proxy.UpstreamSource
+	for _, entry := range upstreams {
+		source, err := proxy.ParseUpstreamSource(entry)
+		if err != nil {
+			exitUsage(flag.Usage, "--upstream: %v", err)
+		}
+		if source.File != "" {
+			source.File = expandPath(source.File, logger)
+		}
+		upstreamSources = append(upstreamSources, source)
+	}
+	for i, path := range certFiles {
+		certFiles[i] = expandPath(path, logger)
+	}
+	var destinations *proxy.DestinationPolicy
+	if *destPolicy != "" {
+		var err error
+		destinations, err = proxy.LoadDestinationPolicy(expandPath(*destPolicy, logger),
+			knownHostsFiles(logger)...)
+		if err != nil {
+			exitError("failed to load destination policy: %v", err)
+		}
+	}
+	if pinned, ok := strings.CutPrefix(*strategy, "pinned:"); ok {
+		*strategy = "pinned:" + expandPath(pinned, logger)
+	}
+	if err := proxy.ValidateStrategy(*strategy); err != nil {
+		exitUsage(flag.Usage, "%v", err)
+	}
+	notifyEvents, err := validateNotifyKinds(notify)
+	if err != nil {
+		exitUsage(flag.Usage, "%v", err)
+	}
+	if err := proxy.ValidateLockMode(*lockMode); err != nil {
+		exitUsage(flag.Usage, "%v", err)
+	}
+	var profileSpecs []socketSpec
+	if len(profiles) > 0 {
+		profileSpecs, err = selectProfiles(expandPath(*profilesFile, logger), profiles)
+		if err != nil {
+			exitError("%v", err)
+		}
+	}
+	// Detected once, here: a daemon has left the session's process tree
+	// by the time it runs, so it's handed the result as flags
+	if len(sessionSockets) == 0 {
+		for _, socket := range proxy.SessionSockets() {
+			_ = flag.Set("session-socket", socket)
+		}
+	} else if len(sessionSockets) == 1 && sessionSockets[0] == "none" {
+		sessionSockets = nil
+	}
+	for i, socket := range sessionSockets {
+		sessionSockets[i] = expandPath(socket, logger)
+	}
+	discovery := &proxy.Discovery{
+		Command:      *discoverCmd,
+		Upstreams:    upstreamSources,
+		Prefer:       prefer,
+		Session:      sessionSockets,
+		Ignore:       ignore,
+		ExpectKeys:   expectKeys,
+		Strategy:     *strategy,
+		SkipEmpty:    *skipEmpty,
+		ProbeTimeout: *probeTimeout,
+		Timeout:      *discTimeout,
+		Logger:       logger,
+	}
+
+	// A daemon or supervised child re-reads --key itself, so only the
+	// process that serves loads keys and prompts for passphrases.
+	if len(keyFiles) > 0 && !*daemon && !*superviseFlag {
+		loadLocalAgent(keyFiles, *keyPassTTL, discovery, logger)
+	}
+	var kmsAgent *kms.Agent
+	if *kmsKeys != "" && !*daemon && !*superviseFlag {
+		kmsAgent = loadKMSAgent(expandPath(*kmsKeys, logger), len(keyFiles) > 0, discovery, logger)
+	}
+	var pkcs11Agents []*proxy.PKCS11Agent
+	for _, provider := range pkcs11Providers {
+		pa := newPKCS11Agent(expandPath(provider, logger), logger)
+		discovery.PKCS11 = append(discovery.PKCS11, pa.Socket)
+		pkcs11Agents = append(pkcs11Agents, pa)
 	}
-	handler := slog.NewTextHandler(os.Stderr, opts)
-	sanitized := proxy.NewSanitizingHandler(handler)
-	logger := slog.New(sanitized)
 
 	// Handle test discovery mode
 	if *testDiscovery {
-		testSocketDiscovery()
+		if *jsonOutput || batchMode {
+			testSocketDiscoveryJSON(discovery)
+			return
+		}
+		testSocketDiscovery(discovery)
 		return
 	}
 
 	// Handle health check mode
 	if *healthCheck {
-		if len(flag.Args()) != 1 {
-			fmt.Fprintf(os.Stderr, "Error: proxy socket path is required for health check\n\n")
-			flag.Usage()
-			os.Exit(1)
+		socketArg, err := proxySocketArg(flag.Args(), profileSpecs)
+		if err != nil {
+			exitUsage(flag.Usage, "%v", err)
 		}
-		proxySocket := expandPath(flag.Args()[0], logger)
-		if err := proxy.HealthCheck(proxySocket, logger); err != nil {
-			fmt.Printf("Proxy unhealthy: %v\n", err)
+		proxySocket, err := expandTokens(socketArg)
+		if err != nil {
+			exitError("%v", err)
+		}
+		opts := proxy.HealthOptions{Timeout: *healthTimeout, Sign: *healthSign}
+		if *jsonOutput || batchMode {
+			healthCheckJSON(proxySocket, opts, logger)
+			return
+		}
+		status := proxy.Health(proxySocket, opts, logger)
+		switch status.State {
+		case proxy.DegradedNoUpstream:
+			fmt.Printf("Proxy degraded: %v\n", status.Err)
+			fmt.Printf("The proxy is running; reattach an SSH session with agent forwarding, or run\n")
+			fmt.Printf("'%s --test-discovery' to see why no upstream agent is usable\n", os.Args[0])
 			os.Exit(1)
+		case proxy.Down:
+			fmt.Printf("Proxy down: %v\n", status.Err)
+			if errors.Is(status.Err, proxy.ErrUpstreamDial) {
+				fmt.Printf("Is the proxy running? Start it with: %s -d %s\n", os.Args[0], proxySocket)
+			} else {
+				fmt.Printf("Restart the proxy\n")
+			}
+			os.Exit(1)
+		}
+		report := status.Report
+		fmt.Printf("Proxy is healthy at %s (%d keys", proxySocket, report.Keys)
+		if report.Signed {
+			fmt.Printf(", test signature verified")
 		}
-		fmt.Printf("Proxy is healthy at %s\n", proxySocket)
+		fmt.Printf(")\n")
 		os.Exit(0)
 	}
 
-	// Check for required argument
-	if len(flag.Args()) != 1 {
-		fmt.Fprintf(os.Stderr, "Error: proxy socket path is required\n\n")
-		flag.Usage()
-		os.Exit(1)
+	socketMode, err := parseFileMode(*socketModeArg)
+	if err != nil {
+		exitUsage(flag.Usage, "invalid --socket-mode: %v", err)
+	}
+	socketDirMode, err := parseFileMode(*socketDirArg)
+	if err != nil {
+		exitUsage(flag.Usage, "invalid --socket-dir-mode: %v", err)
+	}
+	socketUID, socketGID, err := lookupOwner(*socketOwner)
+	if err != nil {
+		exitUsage(flag.Usage, "invalid --socket-owner: %v", err)
 	}
 
-	proxySocket := expandPath(flag.Args()[0], logger)
+	socketArg, err := proxySocketArg(flag.Args(), profileSpecs)
+	if err != nil {
+		exitUsage(flag.Usage, "%v", err)
+	}
+	proxySocket, err := expandTokens(socketArg)
+	if err != nil {
+		exitUsage(flag.Usage, "%v", err)
+	}
+	var extraSockets []socketSpec
+	for _, spec := range sockets {
+		extra, err := parseSocketSpec(spec, logger)
+		if err != nil {
+			exitUsage(flag.Usage, "%v", err)
+		}
+		extraSockets = append(extraSockets, extra)
+	}
+	// The profile serving the main socket shapes the main proxy, and the
+	// others are served alongside it with their own
+	var keyPolicy *proxy.KeyPolicy
+	for _, profile := range profileSpecs {
+		if len(profile.prefer) > 0 {
+			profile.prefer = append(slices.Clone(profile.prefer), prefer...)
+		}
+		if profile.path != proxySocket {
+			extraSockets = append(extraSockets, profile)
+			continue
+		}
+		logger.Debug("Serving profile on the main socket", "profile", profile.profile)
+		if len(profile.prefer) > 0 {
+			discovery.Prefer = profile.prefer
+		}
+		discovery.Only = profile.upstreams
+		keyPolicy = profile.keyPolicy(logger)
+	}
 
 	// Daemonize if requested
 	if *daemon {
-		daemonize(proxySocket, *verbose, logger)
+		// A detached daemon has no stderr, so log to a file unless told
+		// otherwise.
+		if logOpts.file == "" {
+			logOpts.file = defaultLogFile(logger)
+		}
+		daemonize(proxySocket, logOpts, logger)
+		return
+	}
+
+	if *superviseFlag {
+		supervise(proxySocket, logOutput, logger)
 		return
 	}
 
+	var link string
+	if *socketLink != "" {
+		link = expandPath(*socketLink, logger)
+		if err := checkSocketLink(link, proxySocket); err != nil {
+			exitUsage(flag.Usage, "--socket-link: %v", err)
+		}
+	}
+
+	ctlSocket := defaultControlSocket(proxySocket)
+	switch *controlSocket {
+	case "":
+	case "none":
+		ctlSocket = ""
+	default:
+		ctlSocket = expandPath(*controlSocket, logger)
+	}
+
+	// An upgrade restarts the proxy as a daemon would be, logging to a
+	// file since it has no terminal
+	if logOpts.file == "" {
+		logOpts.file = defaultLogFile(logger)
+	}
+
 	// Run the proxy
-	runProxy(proxySocket, logger)
+	runProxy(proxySocket, runOptions{
+		upgradeArgs:   childArgs(proxySocket, logOpts),
+		tcp:           tcpOpts,
+		httpListen:    *httpListen,
+		tmuxEnv:       *tmuxEnv,
+		socketLink:    link,
+		discovery:     discovery,
+		keyPolicy:     keyPolicy,
+		controlSocket: ctlSocket,
+		certFiles:     certFiles,
+		kmsAgent:      kmsAgent,
+		pkcs11Agents:  pkcs11Agents,
+		addConstraints: proxy.AddConstraints{
+			MaxLifetime: *addLifetime,
+			Confirm:     *addConfirm,
+		},
+		lockMode: *lockMode,
+		extensions: proxy.ExtensionPolicy{
+			BlockUnknown: *blockExts,
+			Allow:        allowExts,
+		},
+		destinations:  destinations,
+		failDetails:   *failDetails,
+		otlpEndpoint:  otlpTracesEndpoint(*otlpEndpoint),
+		notify:        notifyEvents,
+		originTags:    *originTags,
+		tracePackets:  *tracePackets,
+		hotStandby:    *hotStandby,
+		cacheTTL:      *cacheTTL,
+		negativeTTL:   *negativeTTL,
+		validateCache: *validateCache,
+		probeTimeout:  *probeTimeout,
+		upTimeout:     *upTimeout,
+		extraSockets:  extraSockets,
+		maxConns:      *maxConns,
+		resourceWarnings: proxy.ResourceWarnings{
+			Handlers:      *warnHandlers,
+			UpstreamConns: *warnUpstreams,
+		},
+		overloadWait:  *overloadWait,
+		maxMsgSize:    *maxMsgSize,
+		signRate:      *signRate,
+		signBurst:     *signBurst,
+		socketMode:    socketMode,
+		socketDirMode: socketDirMode,
+		socketUID:     socketUID,
+		socketGID:     socketGID,
+	}, logger)
 }
 
-func runProxy(proxySocket string, logger *slog.Logger) {
-	// Remove existing socket if it exists
-	if err := os.Remove(proxySocket); err != nil && !os.IsNotExist(err) {
-		logger.Debug("Warning: failed to remove existing socket", "error", err)
-	}
+// runOptions controls how runProxy exposes the proxy beyond its defaults.
+type runOptions struct {
+	tcp       tcpOptions
+	discovery *proxy.Discovery
+
+	// upgradeArgs are the arguments an upgrade starts the new proxy with
+	upgradeArgs []string
+
+	// keyPolicy, when set, restricts what the main socket's clients may do
+	// with upstream keys
+	keyPolicy *proxy.KeyPolicy
+
+	// httpListen, when set, is the address of the HTTP status page and
+	// health endpoints
+	httpListen string
+
+	// tmuxEnv keeps a running tmux server's SSH_AUTH_SOCK on the proxy
+	tmuxEnv bool
+
+	// socketLink, when set, is kept a symlink to the proxy socket
+	socketLink string
+
+	// controlSocket, when set, is where the control socket is served
+	controlSocket string
+
+	// certFiles are certificates offered alongside upstream keys
+	certFiles []string
+
+	// kmsAgent, when set, holds KMS keys offered alongside upstream keys
+	kmsAgent *kms.Agent
+
+	// pkcs11Agents are run for as long as the proxy serves
+	pkcs11Agents []*proxy.PKCS11Agent
 
-	// Create directory if it doesn't exist
-	socketDir := filepath.Dir(proxySocket)
-	if err := os.MkdirAll(socketDir, 0700); err != nil {
-		logger.Error("Failed to create socket directory", "error", err)
+	// addConstraints is the policy applied to keys clients add
+	addConstraints proxy.AddConstraints
+
+	// lockMode is how ssh-add -x locks are handled
+	lockMode string
+
+	// extensions decides which agent extensions are forwarded
+	extensions proxy.ExtensionPolicy
+
+	// destinations, when set, limits which hosts keys sign for
+	destinations *proxy.DestinationPolicy
+
+	// failDetails gives the proxy's own refusals IDs to match them by
+	failDetails bool
+
+	// otlpEndpoint, when set, is where tracing spans are sent
+	otlpEndpoint string
+
+	// notify lists the desktop notifications to show
+	notify []string
+
+	// originTags shows each key's upstream in its comment
+	originTags bool
+
+	// tracePackets logs upstream messages at debug level
+	tracePackets bool
+
+	// hotStandby keeps warm connections for instant failover
+	hotStandby bool
+
+	// cacheTTL is how long the discovered socket is reused, and
+	// negativeTTL how long finding none is; validateCache probes a cached
+	// socket before each reuse, within probeTimeout.
+	cacheTTL      time.Duration
+	negativeTTL   time.Duration
+	validateCache bool
+	probeTimeout  time.Duration
+
+	// upTimeout, when positive, is how long the upstream has to answer
+	// each request
+	upTimeout time.Duration
+
+	// maxConns limits concurrent clients when positive; overloadWait is
+	// how long a client over the limit may queue before it's rejected.
+	maxConns     int
+	overloadWait time.Duration
+
+	// resourceWarnings are the counts past which leaks are warned of;
+	// runProxy adds a threshold for open files from the file limit.
+	resourceWarnings proxy.ResourceWarnings
+
+	// maxMsgSize caps client requests when positive, and signRate and
+	// signBurst rate limit each client's sign requests when signRate is.
+	maxMsgSize int
+	signRate   float64
+	signBurst  int
+
+	// extraSockets are served alongside the main proxy socket
+	extraSockets []socketSpec
+
+	// socketMode, when non-zero, is the socket's mode in place of 0600;
+	// socketUID and socketGID change its owner unless -1.
+	socketMode os.FileMode
+	socketUID  int
+	socketGID  int
+
+	// socketDirMode, when non-zero, is applied to the socket's directory
+	socketDirMode os.FileMode
+}
+
+func runProxy(proxySocket string, opts runOptions, logger *slog.Logger) {
+	// After an upgrade the old proxy's listeners are already open
+	if err := loadInheritedListeners(); err != nil {
+		logger.Error("Failed to take over listeners", "error", err)
 		os.Exit(1)
 	}
 
-	// Set appropriate permissions
-	if err := os.Chmod(proxySocket, 0600); err != nil && !os.IsNotExist(err) {
-		logger.Error("Failed to set socket permissions", "error", err)
+	// Under systemd socket activation the socket already exists and belongs
+	// to the .socket unit, so serve it as-is and leave cleanup to systemd.
+	listener, err := activationListener()
+	if err != nil {
+		logger.Error("Failed to use activated socket", "error", err)
 		os.Exit(1)
 	}
+	activated := listener != nil
+
+	if limit, ok := raiseFileLimit(); ok {
+		logger.Debug("Open file limit", "limit", limit)
+		// Warn while there's still room to find out why
+		opts.resourceWarnings.OpenFiles = int(min(limit, math.MaxInt32) * 8 / 10)
+	}
+
+	if !activated {
+		listener, err = listenProxySocket(proxySocket, opts, logger)
+		if err != nil {
+			logger.Error("Failed to create proxy socket", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Listen on the extra sockets up front so a bad path fails at startup
+	extraListeners := make([]net.Listener, len(opts.extraSockets))
+	for i, extra := range opts.extraSockets {
+		extraListeners[i], err = listenProxySocket(extra.path, opts, logger)
+		if err != nil {
+			logger.Error("Failed to create proxy socket", "socket", extra.path, "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Create the proxy
-	agentProxy := proxy.NewAgentProxy(proxySocket, logger)
+	discovery := opts.discovery
+	if discovery == nil {
+		discovery = &proxy.Discovery{Logger: logger}
+	}
+	discovery.Exclude = append(discovery.Exclude, proxySocket)
+	for _, extra := range opts.extraSockets {
+		discovery.Exclude = append(discovery.Exclude, extra.path)
+	}
+	if opts.socketLink != "" {
+		// Through the link, a proxy replacing this one is never an upstream
+		discovery.Exclude = append(discovery.Exclude, opts.socketLink)
+	}
+	var notifier func(proxy.Notification)
+	switch {
+	case len(opts.notify) > 0 && batchMode:
+		logger.Info("Desktop notifications are off in batch mode")
+	case len(opts.notify) > 0:
+		notifier = desktopNotifier(logger)
+	}
+	var exporter *proxy.OTLPExporter
+	var tracer proxy.SpanExporter
+	if opts.otlpEndpoint != "" {
+		exporter = proxy.NewOTLPExporter(opts.otlpEndpoint, logger)
+		tracer = exporter
+	}
+	proxyOpts := []proxy.Option{
+		proxy.WithLogger(logger),
+		proxy.WithMaxConnections(opts.maxConns, opts.overloadWait),
+		proxy.WithResourceWarnings(opts.resourceWarnings),
+		proxy.WithMaxMessageSize(opts.maxMsgSize),
+		proxy.WithSignRateLimit(opts.signRate, opts.signBurst),
+		proxy.WithCertificateFiles(opts.certFiles...),
+		proxy.WithAddConstraints(opts.addConstraints),
+		proxy.WithOriginTags(opts.originTags),
+		proxy.WithPacketTrace(opts.tracePackets),
+		proxy.WithHotStandby(opts.hotStandby),
+		proxy.WithCacheTTL(opts.cacheTTL),
+		proxy.WithNegativeCacheTTL(opts.negativeTTL),
+		proxy.WithValidateCached(opts.validateCache),
+		proxy.WithProbeTimeout(opts.probeTimeout),
+		proxy.WithUpstreamTimeout(opts.upTimeout),
+		proxy.WithLockMode(opts.lockMode),
+		proxy.WithExtensionPolicy(opts.extensions),
+		proxy.WithDestinationPolicy(opts.destinations),
+		proxy.WithFailureDetails(opts.failDetails),
+		proxy.WithTracing(tracer),
+		proxy.WithNotifier(notifier, opts.notify...),
+	}
+	if opts.kmsAgent != nil {
+		proxyOpts = append(proxyOpts, proxy.WithOverlayAgent(opts.kmsAgent))
+	}
+	stateFile := filepath.Join(stateDir(logger), "upstream-"+socketKey(proxySocket)+".json")
+	agentProxy := proxy.New(proxySocket, append(proxyOpts,
+		proxy.WithDiscoverer(discovery),
+		proxy.WithKeyPolicy(opts.keyPolicy),
+		proxy.WithStateFile(stateFile))...)
+
+	// Extra sockets share the main proxy unless bound to their own
+	// upstream set or key policy. Giving those a proxy of their own means
+	// a connection's policy is decided by the listener that accepted it.
+	extraProxies := make([]*proxy.AgentProxy, len(opts.extraSockets))
+	for i, extra := range opts.extraSockets {
+		if !extra.ownProxy() {
+			extraProxies[i] = agentProxy
+			continue
+		}
+		bound := *discovery
+		bound.Only = extra.upstreams
+		if len(extra.prefer) > 0 {
+			bound.Prefer = extra.prefer
+		}
+		extraProxies[i] = proxy.New(extra.path, append(proxyOpts,
+			proxy.WithDiscoverer(&bound),
+			proxy.WithKeyPolicy(extra.keyPolicy(logger)))...)
+	}
+
+	// Start the opt-in TCP listener alongside the unix socket
+	var tcpListener net.Listener
+	if opts.tcp.enabled() {
+		tcpListener, err = listenTCP(opts.tcp, logger)
+		if err != nil {
+			logger.Error("Failed to start TCP listener", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var httpListener net.Listener
+	if opts.httpListen != "" {
+		httpListener = inheritedListener("http:" + opts.httpListen)
+		if httpListener == nil {
+			httpListener, err = net.Listen("tcp", opts.httpListen)
+			if err != nil {
+				logger.Error("Failed to start HTTP listener", "error", err)
+				os.Exit(1)
+			}
+			keepTransferable("http:"+opts.httpListen, httpListener)
+		}
+	}
+
+	var controlListener net.Listener
+	if opts.controlSocket != "" {
+		controlListener, err = listenControl(opts.controlSocket, logger)
+		if err != nil {
+			logger.Error("Failed to create control socket", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Start proxy in a goroutine
-	proxyDone := make(chan error, 1)
+	ctx := context.Background()
+	proxyDone := make(chan error, 2+len(extraListeners))
 	go func() {
-		proxyDone <- agentProxy.Start()
+		proxyDone <- agentProxy.Serve(ctx, listener)
 	}()
+	for i, extraListener := range extraListeners {
+		go func() {
+			proxyDone <- extraProxies[i].Serve(ctx, extraListener)
+		}()
+	}
+	if tcpListener != nil {
+		go func() {
+			proxyDone <- agentProxy.Serve(ctx, tcpListener)
+		}()
+	}
+	controlCtx, stopControl := context.WithCancel(ctx)
+	defer stopControl()
+	handoff := newHandoff(opts.upgradeArgs, logger)
+	handoffBlocked := handoffRefusal(activated)
+	if controlListener != nil {
+		control := newControlServer(agentProxy, logger)
+		control.Handle("handoff", func(args []string) (any, error) {
+			if len(args) != 1 {
+				return nil, errors.New("usage: handoff <upgrade-socket>")
+			}
+			if handoffBlocked != nil {
+				return nil, handoffBlocked
+			}
+			return nil, handoff.send(args[0])
+		})
+		go func() {
+			if err := control.Serve(controlCtx, controlListener); err != nil {
+				logger.Error("Control socket error", "error", err)
+			}
+		}()
+	}
+
+	var httpServer *http.Server
+	if httpListener != nil {
+		httpServer = &http.Server{
+			Handler:           proxy.NewHTTPHandler(agentProxy),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			if err := httpServer.Serve(httpListener); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("HTTP listener error", "error", err)
+			}
+		}()
+		logger.Info("Serving HTTP status page", "addr", httpListener.Addr().String())
+	}
+
+	if opts.socketLink != "" {
+		if _, err := syncSocketLink(opts.socketLink, proxySocket); err != nil {
+			logger.Error("Failed to link socket", "link", opts.socketLink, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Linked socket to the proxy", "link", opts.socketLink)
+	}
 
 	// Print startup message
-	logger.Info("Double Agent proxy started", "socket", proxySocket)
+	logger.Info("Double Agent proxy started", "socket", proxySocket, "socket_activated", activated)
+	for _, extra := range opts.extraSockets {
+		logger.Info("Serving extra proxy socket", "socket", extra.path, "profile", extra.profile,
+			"upstreams", extra.upstreams, "keys", extra.keys, "confirm", extra.confirm)
+	}
 	logger.Debug("Process started", "pid", os.Getpid())
+	signalHandoffReady(logger)
+
+	// Publish state for status --json, which needs no control socket
+	listeners := []string{proxySocket}
+	for _, extra := range opts.extraSockets {
+		listeners = append(listeners, extra.path)
+	}
+	if tcpListener != nil {
+		listeners = append(listeners, "tcp:"+tcpListener.Addr().String())
+	}
+	stateCtx, stopState := context.WithCancel(ctx)
+	stateDone := make(chan struct{})
+	go func() {
+		defer close(stateDone)
+		publishRuntimeState(stateCtx, agentProxy, runtimeStateFile(proxySocket, logger), listeners, logger)
+	}()
+	go handleRuntimeSignals(stateCtx, agentProxy, logger)
+	if opts.tmuxEnv {
+		go exportToTmux(stateCtx, proxySocket, logger)
+	}
+	if opts.socketLink != "" {
+		go maintainSocketLink(stateCtx, opts.socketLink, proxySocket, logger)
+	}
+	go agentProxy.WatchUpstreamSources(stateCtx, discovery.Upstreams)
+	var pkcs11Running sync.WaitGroup
+	for _, pa := range opts.pkcs11Agents {
+		pkcs11Running.Add(1)
+		go func() {
+			defer pkcs11Running.Done()
+			pa.Run(stateCtx)
+		}()
+	}
 
-	// Wait for shutdown signal or proxy error
+	// Wait for shutdown signal, an upgrade, or proxy error
+	drainTimeout := shutdownTimeout
+	handedOff := false
 	select {
 	case sig := <-sigChan:
 		logger.Info("Received signal, shutting down", "signal", sig)
+	case <-handoff.done:
+		logger.Info("New proxy is serving; finishing in-flight requests before exiting")
+		drainTimeout, handedOff = handoffDrainTimeout, true
+		// Control commands are for the new proxy now
+		stopControl()
 	case err := <-proxyDone:
 		if err != nil {
 			logger.Error("Proxy error", "error", err)
@@ -174,24 +1064,99 @@ func runProxy(proxySocket string, logger *slog.Logger) {
 		}
 	}
 
-	// Clean up socket
-	_ = os.Remove(proxySocket)
+	// Give in-flight agent requests (e.g., a pending signature) a moment
+	// to complete before tearing down
+	shutdownCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+	if httpServer != nil {
+		_ = httpServer.Shutdown(shutdownCtx)
+	}
+	if err := agentProxy.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Closed connections still in flight at shutdown", "error", err)
+	}
+	for _, extraProxy := range extraProxies {
+		if extraProxy == agentProxy {
+			continue
+		}
+		if err := extraProxy.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Closed connections still in flight at shutdown", "error", err)
+		}
+	}
+	if exporter != nil {
+		if err := exporter.Shutdown(shutdownCtx); err != nil {
+			logger.Debug("Tracing spans dropped at shutdown", "error", err)
+		}
+	}
+
+	stopState()
+	<-stateDone
+	pkcs11Running.Wait()
+
+	// Clean up sockets, unless they're the new proxy's now
+	stopControl()
+	if handedOff {
+		return
+	}
+	if controlListener != nil {
+		removeSocket(opts.controlSocket)
+	}
+	if !activated {
+		removeSocket(proxySocket)
+	}
+	for _, extra := range opts.extraSockets {
+		removeSocket(extra.path)
+	}
+}
+
+func daemonize(proxySocket string, logOpts logOptions, logger *slog.Logger) {
+	pid, err := startDaemon(childArgs(proxySocket, logOpts))
+	if err != nil {
+		logger.Error("Failed to start daemon", "error", err)
+		os.Exit(1)
+	}
+
+	if batchMode {
+		printJSON(daemonReport{PID: pid, Socket: proxySocket, Log: logOpts.file})
+		return
+	}
+	fmt.Printf("Double Agent daemon started (PID: %d)\n", pid)
+	fmt.Printf("Socket: %s\n", proxySocket)
+	fmt.Printf("Log: %s\n", logOpts.file)
+}
+
+// childArgs returns the arguments that start a detached proxy configured
+// as this one is: every flag we were given except the daemon switch,
+// logging to logOpts.
+func childArgs(proxySocket string, logOpts logOptions) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "d" || f.Name == "daemon" || strings.HasPrefix(f.Name, "log-") {
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	args = append(args, logOpts.args()...)
+	return append(args, proxySocket)
+}
+
+// daemonReport is what starting a daemon prints in batch mode.
+type daemonReport struct {
+	PID    int    `json:"pid"`
+	Socket string `json:"socket"`
+	Log    string `json:"log"`
 }
 
-func daemonize(proxySocket string, verbose bool, logger *slog.Logger) {
+// startDaemon re-executes double-agent detached with the given arguments
+// and returns its PID.
+func startDaemon(cmdArgs []string) (int, error) {
 	// Find the executable path
 	executable, err := os.Executable()
 	if err != nil {
-		logger.Error("Failed to find executable", "error", err)
-		os.Exit(1)
+		return 0, fmt.Errorf("failed to find executable: %w", err)
 	}
 
 	// Build arguments for the child process
-	args := []string{executable}
-	if verbose {
-		args = append(args, "-v")
-	}
-	args = append(args, proxySocket)
+	args := append([]string{executable}, cmdArgs...)
 
 	// Start the process detached
 	process, err := os.StartProcess(
@@ -199,28 +1164,41 @@ func daemonize(proxySocket string, verbose bool, logger *slog.Logger) {
 		args,
 		&os.ProcAttr{
 			Dir:   ".",
-			Env:   os.Environ(),
+			Env:   daemonEnv(),
 			Files: []*os.File{nil, nil, nil}, // Detach from stdin/stdout/stderr
 		},
 	)
-
 	if err != nil {
-		logger.Error("Failed to start daemon", "error", err)
-		os.Exit(1)
+		return 0, err
 	}
 
-	fmt.Printf("Double Agent daemon started (PID: %d)\n", process.Pid)
-	fmt.Printf("Socket: %s\n", proxySocket)
+	pid := process.Pid
 
 	// Release the process so it continues running
 	_ = process.Release()
+	return pid, nil
 }
 
-func testSocketDiscovery() {
+// daemonEnv is the environment for a detached proxy: ours, without the
+// variables systemd sets for a service's own processes. Started from a
+// shell in, say, a terminal running as a user service, the daemon isn't
+// that service, and mustn't refuse upgrades as if systemd ran it.
+func daemonEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "INVOCATION_ID=") || strings.HasPrefix(kv, "NOTIFY_SOCKET=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+func testSocketDiscovery(discovery *proxy.Discovery) {
 	fmt.Println("Testing SSH agent socket discovery...")
 	fmt.Println()
 
-	sockets, err := proxy.DiscoverSockets()
+	sockets, err := discovery.DiscoverSockets()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Discovery failed: %v\n", err)
 		os.Exit(1)
@@ -237,15 +1215,22 @@ func testSocketDiscovery() {
 		if socket.Valid {
 			status = "VALID"
 		}
-		fmt.Printf("  %s [%s]\n", socket.Path, status)
+		class := socket.Class
+		if socket.Session {
+			class += ", this session"
+		}
+		fmt.Printf("  %s [%s] (%s)\n", socket.Path, status, class)
 		fmt.Printf("    Modified: %s\n", socket.ModTime.Format("2006-01-02 15:04:05"))
+		if socket.Valid {
+			fmt.Printf("    Keys: %d\n", socket.Keys)
+		}
 		if !socket.Valid && socket.Reason != "" {
 			fmt.Printf("    Reason: %s\n", socket.Reason)
 		}
 	}
 
 	fmt.Println()
-	activeSocket, err := proxy.FindActiveSocket()
+	activeSocket, err := discovery.FindActiveSocket()
 	if err != nil {
 		fmt.Printf("No active socket found: %v\n", err)
 	} else {
@@ -253,19 +1238,167 @@ func testSocketDiscovery() {
 	}
 }
 
+// discoveryReport is the --test-discovery --json output.
+type discoveryReport struct {
+	Sockets []discoveredSocket `json:"sockets"`
+	Active  string             `json:"active,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+type discoveredSocket struct {
+	Path      string    `json:"path"`
+	Class     string    `json:"class"`
+	ModTime   time.Time `json:"mtime"`
+	Valid     bool      `json:"valid"`
+	OwnerUID  string    `json:"owner_uid,omitempty"`
+	Keys      int       `json:"keys"`
+	LatencyMS float64   `json:"latency_ms"`
+	Reason    string    `json:"reason,omitempty"`
+	Fallback  bool      `json:"fallback,omitempty"`
+	Session   bool      `json:"session,omitempty"`
+}
+
+func newDiscoveredSocket(socket proxy.SocketInfo) discoveredSocket {
+	return discoveredSocket{
+		Path:      socket.Path,
+		Class:     socket.Class,
+		ModTime:   socket.ModTime,
+		Valid:     socket.Valid,
+		OwnerUID:  socket.Owner,
+		Keys:      socket.Keys,
+		LatencyMS: float64(socket.Latency.Microseconds()) / 1000,
+		Reason:    socket.Reason,
+		Fallback:  socket.Fallback,
+		Session:   socket.Session,
+	}
+}
+
+func testSocketDiscoveryJSON(discovery *proxy.Discovery) {
+	report := discoveryReport{Sockets: []discoveredSocket{}}
+
+	sockets, err := discovery.DiscoverSockets()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	for _, socket := range sockets {
+		report.Sockets = append(report.Sockets, newDiscoveredSocket(socket))
+	}
+	if err == nil {
+		if active, err := discovery.FindActiveSocket(); err == nil {
+			report.Active = active
+		} else {
+			report.Error = err.Error()
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+	if report.Error != "" {
+		os.Exit(1)
+	}
+}
+
+// healthReport is the --health --json output.
+type healthReport struct {
+	Socket    string            `json:"socket"`
+	State     proxy.HealthState `json:"state"`
+	Healthy   bool              `json:"healthy"`
+	Keys      int               `json:"keys"`
+	Signed    bool              `json:"signed"`
+	LatencyMS float64           `json:"latency_ms"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func healthCheckJSON(proxySocket string, opts proxy.HealthOptions, logger *slog.Logger) {
+	status := proxy.Health(proxySocket, opts, logger)
+	report := healthReport{
+		Socket:    proxySocket,
+		State:     status.State,
+		Healthy:   status.State == proxy.Healthy,
+		Keys:      status.Report.Keys,
+		Signed:    status.Report.Signed,
+		LatencyMS: float64(status.Report.Latency.Microseconds()) / 1000,
+	}
+	if status.Err != nil {
+		report.Error = status.Err.Error()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
+
+// knownHostsFiles returns the known_hosts files ssh reads by default, which
+// name the hosts clients bind connections to.
+func knownHostsFiles(logger *slog.Logger) []string {
+	return []string{expandPath("~/.ssh/known_hosts", logger), "/etc/ssh/ssh_known_hosts"}
+}
+
+// proxySocketArg returns the proxy socket path given on the command line,
+// else the first selected profile's, else the default the subcommands use,
+// so a bare double-agent serves the socket that env, status, and the rest
+// expect.
+func proxySocketArg(args []string, profiles []socketSpec) (string, error) {
+	switch len(args) {
+	case 0:
+		if len(profiles) > 0 {
+			return profiles[0].path, nil
+		}
+		return defaultSocketArg(), nil
+	case 1:
+		return args[0], nil
+	default:
+		return "", fmt.Errorf("expected at most one proxy socket path, got %d arguments", len(args))
+	}
+}
+
+func newLogger(w io.Writer, verbose bool) *slog.Logger {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logLevelMu.Lock()
+	logLevelBase = level
+	logLevel.Set(level)
+	logLevelMu.Unlock()
+
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+	handler := slog.NewTextHandler(w, opts)
+	sanitized := proxy.NewSanitizingHandlerWithOptions(handler, logSanitize)
+	return slog.New(sanitized)
+}
+
 func boolPtr(b bool) *bool {
 	return &b
 }
 
+// expandPath expands path as expandTokens does, exiting if it can't.
 func expandPath(path string, logger *slog.Logger) string {
-	// Expand ~ to home directory
-	if len(path) >= 2 && path[:2] == "~/" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			logger.Error("Failed to get home directory", "error", err)
-			os.Exit(1)
-		}
-		return filepath.Join(home, path[2:])
+	expanded, err := expandTokens(path)
+	if err != nil {
+		logger.Error("Failed to expand path", "path", path, "error", err)
+		os.Exit(1)
+	}
+	return expanded
+}
+
+// otlpTracesEndpoint returns the traces URL from --otlp-endpoint or, when
+// that's unset, the standard OpenTelemetry environment variables.
+func otlpTracesEndpoint(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
 	}
-	return path
+	return ""
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProxySocketArg(t *testing.T) {
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+
+	got, err := proxySocketArg(nil, nil)
+	if err != nil {
+		t.Fatalf("proxySocketArg failed: %v", err)
+	}
+	expanded, err := expandTokens(got)
+	if err != nil {
+		t.Fatalf("expanding %q failed: %v", got, err)
+	}
+	if want := filepath.Join(state, "double-agent", "agent.sock"); expanded != want {
+		t.Errorf("Expected the default socket %s, got %s", want, expanded)
+	}
+
+	os.Unsetenv("XDG_STATE_HOME")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	got, _ = proxySocketArg(nil, nil)
+	if expanded, err = expandTokens(got); err != nil {
+		t.Fatalf("expanding %q failed: %v", got, err)
+	}
+	if want := filepath.Join(home, ".ssh", "double-agent.sock"); expanded != want {
+		t.Errorf("Expected the default socket %s without XDG_STATE_HOME, got %s", want, expanded)
+	}
+
+	if got, _ := proxySocketArg(nil, []socketSpec{{path: "/run/profile.sock"}}); got != "/run/profile.sock" {
+		t.Errorf("Expected the first profile's socket, got %s", got)
+	}
+	if got, _ := proxySocketArg([]string{"/run/given.sock"}, []socketSpec{{path: "/run/profile.sock"}}); got != "/run/given.sock" {
+		t.Errorf("Expected the socket given on the command line, got %s", got)
+	}
+	if _, err := proxySocketArg([]string{"a", "b"}, nil); err == nil {
+		t.Error("Expected an error for two socket paths")
+	}
+}
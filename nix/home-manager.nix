@@ -17,8 +17,16 @@ in
 
     socketPath = mkOption {
       type = types.str;
-      default = "$HOME/.ssh/agent";
-      description = "Path where the proxy socket will be created.";
+      default =
+        if config.xdg.enable
+        then "${config.xdg.stateHome}/double-agent/agent.sock"
+        else "$HOME/.ssh/double-agent.sock";
+      defaultText = literalExpression ''
+        if config.xdg.enable
+        then "''${config.xdg.stateHome}/double-agent/agent.sock"
+        else "$HOME/.ssh/double-agent.sock"
+      '';
+      description = "Path where the proxy socket will be created, by default the one double-agent uses when given no path.";
     };
 
     verbose = mkOption {
@@ -1,4 +1,4 @@
-{ lib, buildGoModule }:
+{ lib, stdenv, buildGoModule, installShellFiles }:
 
 buildGoModule {
   pname = "double-agent";
@@ -9,7 +9,16 @@ buildGoModule {
     name = "double-agent-source";
   };
 
-  vendorHash = null; # No external dependencies
+  vendorHash = "sha256-NYS6VZC5+xswfdyIHmwgqht+uOAwmO2ecPO6SKqGK1I=";
+
+  nativeBuildInputs = [ installShellFiles ];
+
+  postInstall = lib.optionalString (stdenv.buildPlatform.canExecute stdenv.hostPlatform) ''
+    installShellCompletion --cmd double-agent \
+      --bash <($out/bin/double-agent completion bash) \
+      --zsh <($out/bin/double-agent completion zsh) \
+      --fish <($out/bin/double-agent completion fish)
+  '';
 
   meta = with lib; {
     description = "A self-healing SSH agent proxy for tmux and long-running sessions";
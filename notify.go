@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// notifyKinds are the event kinds --notify accepts, besides "all".
+var notifyKinds = []string{proxy.NotifyFailover, proxy.NotifyNoAgent, proxy.NotifySign, proxy.NotifyFailures, proxy.NotifyTouch}
+
+// validateNotifyKinds checks --notify values, expanding "all".
+func validateNotifyKinds(kinds []string) ([]string, error) {
+	var valid []string
+	for _, kind := range kinds {
+		switch {
+		case kind == "all":
+			valid = append(valid, notifyKinds...)
+		case slices.Contains(notifyKinds, kind):
+			valid = append(valid, kind)
+		default:
+			return nil, fmt.Errorf("unknown notification %q (want failover, no-agent, sign, failures, or all)", kind)
+		}
+	}
+	return valid, nil
+}
+
+// desktopNotifier shows proxy notifications with the desktop's
+// notification tool, or returns nil if there isn't one.
+func desktopNotifier(logger *slog.Logger) func(proxy.Notification) {
+	command := notificationCommand()
+	if command == nil {
+		logger.Warn("No desktop notification tool found, notifications are off",
+			"hint", "install notify-send (libnotify) or terminal-notifier")
+		return nil
+	}
+	return func(n proxy.Notification) {
+		cmd := command("Double Agent", n.Message)
+		if err := cmd.Start(); err != nil {
+			logger.Debug("Failed to show notification", "kind", n.Kind, "error", err)
+			return
+		}
+		go func() { _ = cmd.Wait() }()
+	}
+}
+
+// notificationCommand picks notify-send on Linux desktops, and
+// terminal-notifier or AppleScript on macOS.
+func notificationCommand() func(title, message string) *exec.Cmd {
+	if path, err := exec.LookPath("notify-send"); err == nil {
+		return func(title, message string) *exec.Cmd {
+			return exec.Command(path, "--app-name=double-agent", title, message)
+		}
+	}
+	if path, err := exec.LookPath("terminal-notifier"); err == nil {
+		return func(title, message string) *exec.Cmd {
+			return exec.Command(path, "-title", title, "-message", message)
+		}
+	}
+	if path, err := exec.LookPath("osascript"); err == nil {
+		return func(title, message string) *exec.Cmd {
+			script := fmt.Sprintf("display notification %q with title %q", message, title)
+			return exec.Command(path, "-e", script)
+		}
+	}
+	return nil
+}
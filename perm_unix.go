@@ -0,0 +1,135 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// withUmask runs f with the process umask set to mask, so files f creates
+// never start out with more permissions than intended.
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
+
+// fileUID returns the UID owning the file described by info.
+func fileUID(info os.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
+
+// fileGID returns the GID owning the file described by info.
+func fileGID(info os.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Gid), true
+}
+
+// dropPrivileges switches the process to the named user, with that user's
+// groups, and points HOME and the runtime dir at theirs so paths and
+// discovery resolve as if they had started the proxy.
+func dropPrivileges(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric UID", name)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric GID", name)
+	}
+	if uid == os.Getuid() {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("switching to %s requires starting as root", name)
+	}
+
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, g)
+			}
+		}
+	}
+	// Groups and GID must change while we're still root
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set GID: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set UID: %w", err)
+	}
+
+	_ = os.Setenv("HOME", u.HomeDir)
+	_ = os.Setenv("USER", u.Username)
+	_ = os.Setenv("LOGNAME", u.Username)
+	runtimeDir := filepath.Join("/run/user", u.Uid)
+	if _, err := os.Stat(runtimeDir); err == nil {
+		_ = os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	} else {
+		_ = os.Unsetenv("XDG_RUNTIME_DIR")
+	}
+	// Root's state and config locations don't belong to the new user
+	for _, name := range []string{"XDG_STATE_HOME", "XDG_CONFIG_HOME", "XDG_CACHE_HOME"} {
+		_ = os.Unsetenv(name)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// runtimeSignals maps the signals handleRuntimeSignals acts on to what
+// each one asks the running proxy to do.
+var runtimeSignals = map[os.Signal]signalAction{
+	syscall.SIGUSR1: signalStatus,
+	syscall.SIGUSR2: signalRediscover,
+	syscall.SIGTTIN: signalDebug,
+	syscall.SIGTTOU: signalRestoreLevel,
+}
+
+// raiseFileLimit lifts the soft open file limit to the hard limit, so a
+// burst of clients doesn't run the proxy out of descriptors, and returns
+// the resulting soft limit. The Go runtime does the same at startup on most
+// systems, in which case there's nothing left to raise.
+func raiseFileLimit() (uint64, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, false
+	}
+	if limit.Cur < limit.Max {
+		raised := limit
+		raised.Cur = limit.Max
+		// macOS refuses limits above kern.maxfilesperproc; keep what we have
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			limit = raised
+		}
+	}
+	return uint64(limit.Cur), true
+}
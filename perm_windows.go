@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// withUmask runs f; Windows has no umask.
+func withUmask(mask int, f func() error) error {
+	return f()
+}
+
+// fileUID is unavailable on Windows, where files aren't owned by UIDs.
+func fileUID(info os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+// fileGID is unavailable on Windows, where files aren't owned by GIDs.
+func fileGID(info os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+// dropPrivileges isn't supported on Windows.
+func dropPrivileges(name string) error {
+	return errors.New("--user is not supported on Windows")
+}
+
+// processAlive reports whether a process with pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+	return true
+}
+
+// runtimeSignals is empty: Windows has no SIGUSR1, SIGUSR2, SIGTTIN, or
+// SIGTTOU.
+var runtimeSignals map[os.Signal]signalAction
+
+// raiseFileLimit does nothing on Windows, which has no open file limit to
+// raise.
+func raiseFileLimit() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+func runPin(args []string) {
+	runPinCommand("pin", args)
+}
+
+func runUnpin(args []string) {
+	runPinCommand("unpin", args)
+}
+
+// runPinCommand pins a running proxy to an upstream socket, or unpins it,
+// through its control socket. It's shorthand for ctl pin and ctl unpin.
+func runPinCommand(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	addBatchFlag(fs)
+	socket := fs.String("socket", "", "Control socket path (default: "+defaultControlSocket(defaultSocketArg())+")")
+	fs.Usage = func() {
+		if command == "pin" {
+			fmt.Fprintf(os.Stderr, "Usage: %s pin [options] <upstream-socket>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Makes a running proxy use <upstream-socket> regardless of discovery, until\n")
+			fmt.Fprintf(os.Stderr, "'%s unpin' or the socket goes away.\n\n", os.Args[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: %s unpin [options]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Returns a pinned proxy to choosing its upstream by discovery.\n\n")
+		}
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	want := 0
+	if command == "pin" {
+		want = 1
+	}
+	if fs.NArg() != want {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, false)
+	ctlSocket := *socket
+	if ctlSocket == "" {
+		ctlSocket = defaultControlSocket(defaultSocketArg())
+	}
+	ctlSocket = expandPath(ctlSocket, logger)
+
+	var cmdArgs []string
+	if command == "pin" {
+		cmdArgs = []string{expandPath(fs.Arg(0), logger)}
+	}
+	result, err := proxy.ControlRequest(ctlSocket, command, cmdArgs...)
+	if err != nil {
+		exitError("%v", err)
+	}
+
+	if command == "unpin" {
+		if batchMode {
+			printJSON(pinReport{})
+			return
+		}
+		fmt.Println("Unpinned; the proxy is back to discovery")
+		return
+	}
+	pinned := cmdArgs[0]
+	var status proxy.Status
+	if json.Unmarshal(result, &status) == nil && status.Pinned != "" {
+		pinned = status.Pinned
+	}
+	if batchMode {
+		printJSON(pinReport{Pinned: pinned})
+		return
+	}
+	fmt.Printf("Pinned to %s\n", pinned)
+}
+
+// pinReport is what pin and unpin print in batch mode: the socket the
+// proxy is pinned to, "" once unpinned.
+type pinReport struct {
+	Pinned string `json:"pinned"`
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// defaultProfilesFile is where --profile looks profiles up.
+const defaultProfilesFile = "~/.config/double-agent/profiles"
+
+// profileAll selects every profile in the file, in file order.
+const profileAll = "all"
+
+// loadProfiles reads a profiles file, returning each profile as the socket
+// it serves and the profile names in file order. A "[name]" line starts a
+// profile, and the lines after it set its options:
+//
+//	socket PATH         where the profile's proxy socket is (required)
+//	prefer ENTRY...     classes or socket path globs, most preferred first
+//	upstream ENTRY...   the only agents the profile may use, as for --socket
+//	key KEY...          the only keys it exposes, by fingerprint or comment
+//	host PATTERN KEY... the only keys hosts matching PATTERN see, when the
+//	                    client binds its connection to one (the first
+//	                    matching host line applies)
+//	confirm             ask through $SSH_ASKPASS (or on macOS, Touch ID)
+//	                    before every signature
+//
+// Entries may also be separated by commas. Blank lines and # comments are
+// ignored, and paths expand tokens as socket paths do.
+func loadProfiles(path string) (map[string]socketSpec, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profiles := make(map[string]socketSpec)
+	var names []string
+	var current *socketSpec
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		if current.path == "" {
+			return fmt.Errorf("%s: profile %q has no socket", path, current.profile)
+		}
+		profiles[current.profile] = *current
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(text, "["); ok {
+			name, ok = strings.CutSuffix(name, "]")
+			name = strings.TrimSpace(name)
+			switch {
+			case !ok || name == "" || strings.ContainsAny(name, " ,"):
+				return nil, nil, fmt.Errorf("%s:%d: want a profile name like [work]", path, line)
+			case name == profileAll:
+				return nil, nil, fmt.Errorf("%s:%d: %q is reserved for selecting every profile", path, line, name)
+			case slices.Contains(names, name):
+				return nil, nil, fmt.Errorf("%s:%d: profile %q is defined twice", path, line, name)
+			}
+			if err := finish(); err != nil {
+				return nil, nil, err
+			}
+			names = append(names, name)
+			current = &socketSpec{profile: name}
+			continue
+		}
+		if current == nil {
+			return nil, nil, fmt.Errorf("%s:%d: option outside a profile; start one with [name]", path, line)
+		}
+
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		option, values := fields[0], fields[1:]
+		switch option {
+		case "socket":
+			if len(values) != 1 {
+				return nil, nil, fmt.Errorf("%s:%d: want one socket path", path, line)
+			}
+			if current.path, err = expandTokens(values[0]); err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		case "prefer", "upstream":
+			for _, value := range values {
+				if value, err = expandTokens(value); err != nil {
+					return nil, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+				}
+				if option == "prefer" {
+					current.prefer = append(current.prefer, value)
+				} else {
+					current.upstreams = append(current.upstreams, value)
+				}
+			}
+		case "key":
+			current.keys = append(current.keys, values...)
+		case "host":
+			if len(values) < 2 {
+				return nil, nil, fmt.Errorf("%s:%d: want a host pattern and the keys it may see", path, line)
+			}
+			current.hosts = append(current.hosts, proxy.HostKeys{Pattern: values[0], Keys: values[1:]})
+		case "confirm":
+			if len(values) != 0 {
+				return nil, nil, fmt.Errorf("%s:%d: confirm takes no value", path, line)
+			}
+			current.confirm = true
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown option %q", path, line, option)
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, nil, err
+	}
+	return profiles, names, nil
+}
+
+// selectProfiles returns the named profiles from the profiles file at
+// path, in the order given; "all" selects every profile.
+func selectProfiles(path string, selected []string) ([]socketSpec, error) {
+	profiles, names, err := loadProfiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profiles: %w", err)
+	}
+	if slices.Contains(selected, profileAll) {
+		selected = names
+	}
+
+	var specs []socketSpec
+	for _, name := range selected {
+		spec, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("no profile %q in %s (have: %s)", name, path, strings.Join(names, ", "))
+		}
+		if slices.ContainsFunc(specs, func(other socketSpec) bool { return other.profile == name }) {
+			continue
+		}
+		for _, other := range specs {
+			if other.path == spec.path {
+				return nil, fmt.Errorf("profiles %q and %q both use socket %s", other.profile, name, spec.path)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+)
+
+// IsAbstractSocket reports whether address names a socket in Linux's
+// abstract namespace, written with a leading @ as in ss(8). Abstract
+// sockets have no file, so there's nothing to clean up when they're
+// closed, but also no permissions: anyone in the network namespace can
+// connect, so both ends check who is on the other side.
+func IsAbstractSocket(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// peerUIDListener hands out only connections from processes running as one
+// of uids, standing in for file permissions on abstract sockets.
+type peerUIDListener struct {
+	net.Listener
+	uids   []int
+	logger *slog.Logger
+}
+
+// NewPeerUIDListener wraps l so that only clients running as one of uids
+// are accepted. Others are logged and closed.
+func NewPeerUIDListener(l net.Listener, logger *slog.Logger, uids ...int) net.Listener {
+	return &peerUIDListener{Listener: l, uids: uids, logger: logger}
+}
+
+// Accept implements net.Listener
+func (pl *peerUIDListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, ok := peerUID(conn)
+		if ok && slices.Contains(pl.uids, uid) {
+			return conn, nil
+		}
+		pl.logger.Warn("Rejected client running as another user", "socket", pl.Addr().String(), "uid", uid)
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,153 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// abstractName returns an abstract socket name unique to this test run.
+func abstractName(t *testing.T, suffix string) string {
+	return fmt.Sprintf("@double-agent-test-%d-%s-%s", os.Getpid(), t.Name(), suffix)
+}
+
+func TestAbstractUpstream(t *testing.T) {
+	answer := []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0}
+	name := abstractName(t, "agent")
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		t.Fatalf("Failed to listen on abstract socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(c, buf); err != nil {
+					return
+				}
+				_, _ = c.Write(answer)
+			}(conn)
+		}
+	}()
+
+	if valid, reason := TestSocketWithReason(name); !valid {
+		t.Fatalf("Expected abstract agent to be valid: %s", reason)
+	}
+
+	d := &Discovery{Command: "echo " + name, Only: []string{name}}
+	active, err := d.FindActiveSocket()
+	if err != nil {
+		t.Fatalf("FindActiveSocket failed: %v", err)
+	}
+	if active != name {
+		t.Errorf("Expected %s, got %s", name, active)
+	}
+
+	d.Exclude = []string{name}
+	if _, err := d.FindActiveSocket(); err == nil {
+		t.Error("Expected an excluded abstract socket to be skipped")
+	}
+
+	// Ownership is checked against the user discovery works for, not the
+	// user running it, as when a root proxy serves someone else
+	current, err := user.Current()
+	if err != nil {
+		t.Fatalf("Failed to get current user: %v", err)
+	}
+	other := *current
+	other.Uid = strconv.Itoa(os.Getuid() + 1)
+	other.HomeDir = t.TempDir()
+	d = &Discovery{Command: "echo " + name, Only: []string{name}, User: &other}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("DiscoverSockets failed: %v", err)
+	}
+	if len(sockets) != 1 || sockets[0].Valid || !strings.HasPrefix(sockets[0].Reason, "wrong owner") {
+		t.Errorf("Expected the abstract socket to be rejected for another user, got %+v", sockets)
+	}
+}
+
+func TestPeerUIDListener(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	answer := []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}
+	ap := New("@proxy",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return createRespondingAgent(t, answer), nil
+		})))
+
+	serve := func(suffix string, uids ...int) string {
+		name := abstractName(t, suffix)
+		listener, err := net.Listen("unix", name)
+		if err != nil {
+			t.Fatalf("Failed to listen on abstract socket: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go func() { _ = ap.Serve(ctx, NewPeerUIDListener(listener, logger, uids...)) }()
+		return name
+	}
+
+	request := func(name string) error {
+		conn, err := net.Dial("unix", name)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := writeMessage(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+			return err
+		}
+		_, err = readMessage(conn, maxAgentMessage)
+		return err
+	}
+
+	if err := request(serve("mine", os.Getuid())); err != nil {
+		t.Errorf("Expected a client running as this user to be served: %v", err)
+	}
+	if err := request(serve("theirs", os.Getuid()+1)); err == nil {
+		t.Error("Expected a client running as another user to be rejected")
+	}
+}
+
+func TestUpstreamOwner(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	answer := []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0}
+	upstream := createRespondingAgent(t, answer)
+
+	for _, tt := range []struct {
+		name  string
+		owner int
+		want  bool
+	}{
+		{"same user", os.Getuid(), true},
+		{"other user", os.Getuid() + 1, false},
+	} {
+		ap := New("/tmp/test.sock",
+			WithLogger(logger),
+			WithUpstreamOwner(tt.owner),
+			WithDiscoverer(DiscovererFunc(func() (string, error) {
+				return upstream, nil
+			})))
+		_, err := ListIdentities(serveProxy(t, ap))
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: served = %v, want %v (%v)", tt.name, got, tt.want, err)
+		}
+	}
+}
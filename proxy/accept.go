@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Accept retries start at minAcceptDelay and double up to maxAcceptDelay,
+// as net/http's server does. Errors like EMFILE don't clear on their own
+// within microseconds, and retrying at once just spins a CPU.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// acceptBackoff spaces out retries after failed Accept calls.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// next returns how long to wait before the next Accept.
+func (b *acceptBackoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = minAcceptDelay
+	} else {
+		b.delay = min(b.delay*2, maxAcceptDelay)
+	}
+	return b.delay
+}
+
+// reset starts the next run of failures from minAcceptDelay.
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
+
+// wait sleeps for d, reporting false if ctx is done first.
+func (b *acceptBackoff) wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acceptErrorHint suggests a fix for Accept errors with a known cause.
+func acceptErrorHint(err error) string {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return "out of file descriptors; raise the open file limit (ulimit -n) or lower --max-connections"
+	}
+	return ""
+}
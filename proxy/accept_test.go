@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingListener fails its first failures Accept calls with err, then
+// blocks until closed, recording when each call was made.
+type failingListener struct {
+	net.Listener
+	err      error
+	failures int
+
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	n := len(l.calls)
+	l.mu.Unlock()
+	if n <= l.failures {
+		return nil, l.err
+	}
+	return l.Listener.Accept()
+}
+
+func (l *failingListener) callTimes() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.calls...)
+}
+
+func TestAcceptErrorBackoff(t *testing.T) {
+	inner, err := net.Listen("unix", t.TempDir()+"/proxy.sock")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	listener := &failingListener{Listener: inner, err: syscall.EMFILE, failures: 4}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", WithLogger(logger))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ap.Serve(ctx, listener) }()
+
+	waitFor(t, "accept retries", func() bool { return len(listener.callTimes()) > 4 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve returned %v", err)
+	}
+
+	if got := ap.Metrics().AcceptErrors; got != 4 {
+		t.Errorf("Expected 4 accept errors, got %d", got)
+	}
+	// Retries wait 5, 10, 20, then 40ms rather than spinning
+	calls := listener.callTimes()
+	want := minAcceptDelay
+	for i := 1; i <= 4; i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < want {
+			t.Errorf("Retry %d came after %v, want at least %v", i, gap, want)
+		}
+		want *= 2
+	}
+}
+
+func TestAcceptErrorBackoffStopsOnCancel(t *testing.T) {
+	inner, err := net.Listen("unix", t.TempDir()+"/proxy.sock")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// Fail forever, so the backoff reaches its cap
+	listener := &failingListener{Listener: inner, err: syscall.ENFILE, failures: 1 << 30}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", WithLogger(logger))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ap.Serve(ctx, listener) }()
+
+	waitFor(t, "accept retries", func() bool { return len(listener.callTimes()) >= 8 })
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serve returned %v", err)
+		}
+	case <-time.After(maxAcceptDelay / 2):
+		t.Fatal("Serve kept waiting out its backoff after cancellation")
+	}
+}
+
+func TestAcceptBackoffCaps(t *testing.T) {
+	var b acceptBackoff
+	var last time.Duration
+	for range 20 {
+		last = b.next()
+	}
+	if last != maxAcceptDelay {
+		t.Errorf("Expected backoff to cap at %v, got %v", maxAcceptDelay, last)
+	}
+	b.reset()
+	if got := b.next(); got != minAcceptDelay {
+		t.Errorf("Expected %v after reset, got %v", minAcceptDelay, got)
+	}
+}
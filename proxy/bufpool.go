@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize matches the buffer io.Copy would otherwise allocate for
+// every call.
+const copyBufferSize = 32 * 1024
+
+// copyBuffers recycles copy buffers between connections. Every connection
+// copies in both directions, so without pooling each one costs two fresh
+// 32KiB allocations.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyPooled is io.Copy using a buffer from copyBuffers.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// messageBufferSize fits the requests and responses agents usually
+// exchange, signatures and identity lists alike, without growing.
+const messageBufferSize = 4 * 1024
+
+// messageBuffers recycles the buffers message mode reads messages into and
+// frames them in. Buffers grown past maxPooledMessageBuffer for an unusual
+// message are dropped rather than kept around.
+var messageBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, messageBufferSize)
+		return &buf
+	},
+}
+
+// maxPooledMessageBuffer is the largest buffer returned to messageBuffers.
+const maxPooledMessageBuffer = 64 * 1024
+
+func getMessageBuffer() *[]byte {
+	return messageBuffers.Get().(*[]byte)
+}
+
+func putMessageBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledMessageBuffer {
+		messageBuffers.Put(buf)
+	}
+}
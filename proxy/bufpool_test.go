@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// readerOnly hides bytes.Reader's WriteTo so copies go through the buffer.
+type readerOnly struct {
+	io.Reader
+}
+
+func TestCopyPooledAllocs(t *testing.T) {
+	request := []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}
+	r := bytes.NewReader(request)
+	src := &readerOnly{r}
+	dst := newCountingWriter(io.Discard)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(request)
+		if _, err := copyPooled(dst, src); err != nil {
+			t.Fatalf("copyPooled failed: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations per request, got %v", allocs)
+	}
+	if got := dst.messages.Load(); got != 101 {
+		t.Errorf("Expected 101 messages counted, got %d", got)
+	}
+}
+
+func TestMessageRoundTripAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers under the race detector")
+	}
+	var request, response bytes.Buffer
+	sign := signRequest{Blob: []byte("key"), Data: bytes.Repeat([]byte{1}, 64)}.marshal()
+	if err := writeMessage(&request, sign); err != nil {
+		t.Fatalf("writeMessage failed: %v", err)
+	}
+	signature := appendWireString([]byte{SSH_AGENT_SIGN_RESPONSE}, bytes.Repeat([]byte{2}, 83))
+	if err := writeMessage(&response, signature); err != nil {
+		t.Fatalf("writeMessage failed: %v", err)
+	}
+	client, agent := bytes.NewReader(request.Bytes()), bytes.NewReader(response.Bytes())
+	upstream, reply := newCountingWriter(io.Discard), newCountingWriter(io.Discard)
+
+	requestBuf := getMessageBuffer()
+	defer putMessageBuffer(requestBuf)
+	var responseBufs []*[]byte
+	allocs := testing.AllocsPerRun(100, func() {
+		client.Reset(request.Bytes())
+		agent.Reset(response.Bytes())
+		message, err := readMessageInto(client, maxAgentMessage, requestBuf)
+		if err != nil {
+			t.Fatalf("reading the request failed: %v", err)
+		}
+		if err := writeMessage(upstream, message); err != nil {
+			t.Fatalf("forwarding the request failed: %v", err)
+		}
+		buf := getMessageBuffer()
+		responseBufs = append(responseBufs, buf)
+		answer, err := readMessageInto(agent, maxAgentMessage, buf)
+		if err != nil {
+			t.Fatalf("reading the response failed: %v", err)
+		}
+		if err := writeMessage(reply, answer); err != nil {
+			t.Fatalf("replying failed: %v", err)
+		}
+		responseBufs = releaseMessageBuffers(responseBufs)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations per sign round trip, got %v", allocs)
+	}
+	if got := reply.messages.Load(); got != 101 {
+		t.Errorf("Expected 101 responses counted, got %d", got)
+	}
+}
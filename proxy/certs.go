@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certStore holds SSH certificates configured with WithCertificateFiles.
+// Each file is re-read when its modification time changes, so reissued
+// short-lived certificates are picked up without a restart.
+type certStore struct {
+	paths []string
+
+	mu     sync.Mutex
+	loaded map[string]*loadedCert
+}
+
+// loadedCert is one certificate file as of modTime.
+type loadedCert struct {
+	modTime time.Time
+	err     error
+
+	cert    *ssh.Certificate
+	blob    []byte // the certificate, as clients will present it
+	keyBlob []byte // the certified public key, as the upstream knows it
+	comment string
+}
+
+func newCertStore(paths []string) *certStore {
+	return &certStore{paths: paths, loaded: make(map[string]*loadedCert)}
+}
+
+// current returns the certificates that are valid right now.
+func (cs *certStore) current(logger *slog.Logger) []*loadedCert {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := uint64(time.Now().Unix())
+	var certs []*loadedCert
+	for _, path := range cs.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Debug("Certificate file unavailable", "path", path, "error", err)
+			continue
+		}
+		lc, ok := cs.loaded[path]
+		if !ok || !lc.modTime.Equal(info.ModTime()) {
+			lc = loadCertFile(path, info.ModTime())
+			cs.loaded[path] = lc
+			if lc.err != nil {
+				logger.Warn("Failed to load certificate", "path", path, "error", lc.err)
+			}
+		}
+		if lc.err != nil {
+			continue
+		}
+		if now < lc.cert.ValidAfter || now >= lc.cert.ValidBefore {
+			logger.Debug("Skipping certificate outside its validity period", "path", path)
+			continue
+		}
+		certs = append(certs, lc)
+	}
+	return certs
+}
+
+func loadCertFile(path string, modTime time.Time) *loadedCert {
+	lc := &loadedCert{modTime: modTime}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		lc.err = err
+		return lc
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		lc.err = err
+		return lc
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		lc.err = fmt.Errorf("%s is a plain public key, not a certificate", path)
+		return lc
+	}
+	if comment == "" {
+		comment = path
+	}
+	lc.cert = cert
+	lc.blob = cert.Marshal()
+	lc.keyBlob = cert.Key.Marshal()
+	lc.comment = comment
+	return lc
+}
+
+// middleware lists certificates alongside their keys and signs with the
+// key when a client presents a certificate.
+func (cs *certStore) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			switch req.Type() {
+			case SSH_AGENTC_SIGN_REQUEST:
+				req.Message = cs.rewriteSignRequest(req.Message, logger)
+			case SSH_AGENTC_REQUEST_IDENTITIES:
+				response, err := next(req)
+				if err != nil || responseType(response) != SSH_AGENT_IDENTITIES_ANSWER {
+					return response, err
+				}
+				return cs.addToIdentities(response, logger), nil
+			}
+			return next(req)
+		}
+	}
+}
+
+// addToIdentities lists each certificate right after the upstream key it
+// certifies, leaving certificates the upstream already holds alone.
+func (cs *certStore) addToIdentities(answer []byte, logger *slog.Logger) []byte {
+	identities, err := parseIdentities(answer)
+	if err != nil {
+		return answer
+	}
+	certs := cs.current(logger)
+	if len(certs) == 0 {
+		return answer
+	}
+
+	listed := make(map[string]bool, len(identities))
+	for _, id := range identities {
+		listed[string(id.Blob)] = true
+	}
+	var merged []Identity
+	for _, id := range identities {
+		merged = append(merged, id)
+		for _, lc := range certs {
+			if bytes.Equal(lc.keyBlob, id.Blob) && !listed[string(lc.blob)] {
+				merged = append(merged, Identity{Blob: lc.blob, Comment: lc.comment})
+				listed[string(lc.blob)] = true
+			}
+		}
+	}
+	return marshalIdentities(merged)
+}
+
+// rewriteSignRequest swaps an injected certificate for the key it
+// certifies, since the upstream agent only knows the plain key. The
+// signature is the same either way.
+func (cs *certStore) rewriteSignRequest(request []byte, logger *slog.Logger) []byte {
+	sr, ok := parseSignRequest(request)
+	if !ok {
+		return request
+	}
+	for _, lc := range cs.current(logger) {
+		if bytes.Equal(sr.Blob, lc.blob) {
+			sr.Blob = lc.keyBlob
+			return sr.marshal()
+		}
+	}
+	return request
+}
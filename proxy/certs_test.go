@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestCert certifies the public half of keyPath's key and writes the
+// certificate next to it.
+func writeTestCert(t *testing.T, keyPath string, validBefore time.Time) (string, *ssh.Certificate) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA signer: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		CertType:    ssh.UserCert,
+		KeyId:       "test",
+		ValidAfter:  uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	path := keyPath + "-cert.pub"
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	return path, cert
+}
+
+// serveProxy serves ap on a temporary socket for the duration of the test.
+// Cleanup shuts the proxy down and waits for Serve to return, so no
+// handler outlives the test to race with cleanups registered before it.
+func serveProxy(t *testing.T, ap *AgentProxy) string {
+	proxySocket := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = ap.Serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		_ = ap.Shutdown(shutdownCtx)
+		<-done
+	})
+	return proxySocket
+}
+
+func TestCertificateInjection(t *testing.T) {
+	keyPath := writeTestKey(t, "")
+	certPath, cert := writeTestCert(t, keyPath, time.Now().Add(time.Hour))
+
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(keyPath, nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCertificateFiles(certPath),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 2 {
+		t.Fatalf("Expected the key and its certificate, got %d identities", len(identities))
+	}
+	if string(identities[1].Blob) != string(cert.Marshal()) {
+		t.Fatal("Expected the certificate to follow its key")
+	}
+
+	// The upstream only knows the plain key, so this fails unless the
+	// proxy rewrites the request
+	if _, err := Sign(proxySocket, identities[1], []byte("challenge"), 0); err != nil {
+		t.Errorf("Expected signing with the certificate to succeed, got %v", err)
+	}
+}
+
+func TestCertificateInjectionSkipsExpired(t *testing.T) {
+	keyPath := writeTestKey(t, "")
+	certPath, _ := writeTestCert(t, keyPath, time.Now().Add(-time.Second))
+	answer := marshalIdentities([]Identity{{Blob: []byte("unrelated"), Comment: "other"}})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := newCertStore([]string{certPath})
+	if len(store.current(logger)) != 0 {
+		t.Error("Expected an expired certificate to be skipped")
+	}
+	if got := store.addToIdentities(answer, logger); string(got) != string(answer) {
+		t.Error("Expected the answer to be left alone")
+	}
+}
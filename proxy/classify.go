@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upstream classes reported in SocketInfo.Class and accepted by
+// Discovery.Prefer.
+const (
+	ClassForwarded = "forwarded" // sshd agent forwarding socket
+	ClassSSHAgent  = "ssh-agent" // local OpenSSH ssh-agent
+	ClassTeleport  = "teleport"  // Teleport node's agent forwarding socket
+	Class1Password = "1password"
+	ClassGPGAgent  = "gpg-agent"
+	ClassKeyring   = "gnome-keyring"
+	ClassEnclave   = "secure-enclave" // keys held in the Mac's Secure Enclave
+	ClassCustom    = "custom"         // reported by Discovery.Command or Upstreams
+	ClassPageant   = "pageant"
+	ClassPKCS11    = "pkcs11" // a PKCS11Agent's private ssh-agent
+	ClassLocal     = "local"  // the built-in LocalAgent
+)
+
+// knownLocation is a well-known agent socket outside /tmp/ssh-*.
+type knownLocation struct {
+	class   string
+	pattern string // glob; ~, {uid}, and {runtime} are expanded
+}
+
+var knownLocations = []knownLocation{
+	{ClassTeleport, "/tmp/teleport-*/teleport-*.socket"},
+	{ClassEnclave, "~/Library/Containers/com.maxgoedjen.Secretive.SecretAgent/Data/socket.ssh"},
+	{ClassEnclave, "~/.sekey/ssh-agent.ssh"},
+	{Class1Password, "~/.1password/agent.sock"},
+	{Class1Password, "~/Library/Group Containers/2BUA8C4S2C.com.1password/t/agent.sock"},
+	{ClassGPGAgent, "~/.gnupg/S.gpg-agent.ssh"},
+	{ClassGPGAgent, "{runtime}/gnupg/S.gpg-agent.ssh"},
+	{ClassGPGAgent, "{runtime}/gnupg/d.*/S.gpg-agent.ssh"},
+	{ClassSSHAgent, "{runtime}/ssh-agent.socket"}, // systemd user ssh-agent.service
+	{ClassSSHAgent, "{runtime}/openssh_agent"},
+	{ClassKeyring, "{runtime}/keyring/ssh"},
+	{ClassKeyring, "{runtime}/gcr/ssh"},
+}
+
+// runtimeDirs returns the user's runtime directories: $XDG_RUNTIME_DIR and
+// the conventional /run/user/<uid>, which usually coincide.
+func runtimeDirs(uid string) []string {
+	dirs := []string{filepath.Join("/run/user", uid)}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && filepath.Clean(dir) != dirs[0] {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// knownLocationMatches expands the well-known locations for the user with
+// uid and home and returns the paths that exist, keyed by path with their
+// class.
+func knownLocationMatches(uid, home string) map[string]string {
+	matches := make(map[string]string)
+	for _, loc := range knownLocations {
+		pattern := strings.ReplaceAll(loc.pattern, "{uid}", uid)
+		if strings.HasPrefix(pattern, "~/") {
+			if home == "" {
+				continue
+			}
+			pattern = filepath.Join(home, pattern[2:])
+		}
+		patterns := []string{pattern}
+		if strings.Contains(pattern, "{runtime}") {
+			patterns = nil
+			for _, dir := range runtimeDirs(uid) {
+				patterns = append(patterns, strings.ReplaceAll(pattern, "{runtime}", dir))
+			}
+		}
+		for _, pattern := range patterns {
+			paths, _ := filepath.Glob(pattern)
+			for _, path := range paths {
+				matches[path] = loc.class
+			}
+		}
+	}
+	return matches
+}
+
+// classifyTmpSocket tells a forwarded agent from a local ssh-agent. Both
+// live at /tmp/ssh-*/agent.<pid>, but sshd names forwarded sockets after its
+// own PID while ssh-agent uses its parent's. Where the process can't be
+// inspected the socket is assumed to be forwarded, the common case on the
+// remote hosts double-agent is built for.
+func classifyTmpSocket(path string) string {
+	ext := filepath.Ext(path)
+	if len(ext) < 2 {
+		return ClassForwarded
+	}
+	comm, err := os.ReadFile(filepath.Join("/proc", ext[1:], "comm"))
+	if err != nil {
+		return ClassForwarded
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(comm)), "sshd") {
+		return ClassForwarded
+	}
+	return ClassSSHAgent
+}
+
+// preferenceRank orders a socket by the first entry of prefer it matches.
+// Entries are class names or socket paths (globs allowed), including
+// abstract @names. Sockets matching nothing rank after all preferences.
+// With no preferences, /tmp agents keep precedence and well-known
+// locations act as fallbacks, Secure Enclave agents first: their keys
+// can't leave the machine, so someone running one means to use it.
+func preferenceRank(socket SocketInfo, prefer []string) int {
+	if len(prefer) == 0 {
+		switch socket.Class {
+		case ClassForwarded, ClassTeleport, ClassSSHAgent, ClassCustom, ClassPageant, ClassPKCS11:
+			return 0
+		case ClassEnclave:
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	for i, entry := range prefer {
+		if strings.ContainsRune(entry, '/') || IsAbstractSocket(entry) {
+			if ok, _ := filepath.Match(entry, socket.Path); ok || entry == socket.Path {
+				return i
+			}
+			continue
+		}
+		if entry == socket.Class {
+			return i
+		}
+	}
+	return len(prefer)
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// requestError records which stage of an agent request failed, "write" or
+// "read", so probes can explain the failure.
+type requestError struct {
+	stage string
+	op    string
+	err   error
+}
+
+func (e *requestError) Error() string {
+	return e.op + ": " + e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// agentRequest sends one agent message (type byte and payload, without the
+// length prefix) and returns the response body in the same form. Responses
+// are read in full, however the peer splits them across writes.
+func agentRequest(conn net.Conn, message []byte, timeout time.Duration) ([]byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	framed := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(framed, uint32(len(message)))
+	copy(framed[4:], message)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, &requestError{stage: "write", op: "failed to send request", err: err}
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, &requestError{stage: "read", op: "failed to read response", err: err}
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > maxAgentMessage {
+		return nil, errorOfKind(ErrProtocol, "invalid response length: %d", length)
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, &requestError{stage: "read", op: "failed to read response body", err: err}
+	}
+	return response, nil
+}
+
+// requestIdentities asks the agent on conn for its identities, returning
+// the response type and, for an identities answer, the number of keys.
+func requestIdentities(conn net.Conn, timeout time.Duration) (byte, int, error) {
+	response, err := agentRequest(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}, timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	keys := 0
+	if response[0] == SSH_AGENT_IDENTITIES_ANSWER && len(response) >= 5 {
+		keys = int(binary.BigEndian.Uint32(response[1:5]))
+	}
+	return response[0], keys, nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// AddConstraints is a policy for keys that clients add through the proxy,
+// applied before the request reaches the upstream agent.
+type AddConstraints struct {
+	// MaxLifetime, when positive, caps how long an added key lives. Keys
+	// added without a lifetime, or with a longer one, get MaxLifetime.
+	MaxLifetime time.Duration
+
+	// Confirm requires the agent to confirm every use of an added key.
+	Confirm bool
+}
+
+func (c AddConstraints) enabled() bool {
+	return c.MaxLifetime > 0 || c.Confirm
+}
+
+// keyFieldCounts is how many wire strings follow the key type in an add
+// request, including the trailing comment. Constraints come after them.
+// Security key types are missing because their private fields aren't all
+// strings, so their constraints can't be located.
+var keyFieldCounts = map[string]int{
+	"ssh-rsa":                                  7, // n, e, d, iqmp, p, q, comment
+	"ssh-dss":                                  6, // p, q, g, y, x, comment
+	"ecdsa-sha2-nistp256":                      4, // curve, Q, d, comment
+	"ecdsa-sha2-nistp384":                      4,
+	"ecdsa-sha2-nistp521":                      4,
+	"ssh-ed25519":                              3, // public, private, comment
+	"ssh-rsa-cert-v01@openssh.com":             6, // cert, d, iqmp, p, q, comment
+	"ssh-dss-cert-v01@openssh.com":             3, // cert, x, comment
+	"ecdsa-sha2-nistp256-cert-v01@openssh.com": 3, // cert, d, comment
+	"ecdsa-sha2-nistp384-cert-v01@openssh.com": 3,
+	"ecdsa-sha2-nistp521-cert-v01@openssh.com": 3,
+	"ssh-ed25519-cert-v01@openssh.com":         4, // cert, public, private, comment
+}
+
+// middleware applies the constraints to every key added through it,
+// refusing keys it can't constrain.
+func (c AddConstraints) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			switch req.Type() {
+			case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED,
+				SSH_AGENTC_ADD_SMARTCARD_KEY, SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED:
+				constrained, err := c.apply(req.Message)
+				if err != nil {
+					logger.Warn("Refusing to add key without the configured constraints", "error", err)
+					return failure(), nil
+				}
+				req.Message = constrained
+			}
+			return next(req)
+		}
+	}
+}
+
+// apply rewrites an add request (SSH_AGENTC_ADD_IDENTITY, smartcard, or
+// their constrained forms) to carry the policy's constraints, keeping any
+// the client asked for that are stricter. It fails if the request can't be
+// parsed, since the policy then can't be enforced.
+func (c AddConstraints) apply(request []byte) ([]byte, error) {
+	body := request[1:]
+	var fields int
+	var constrainedType byte
+	switch request[0] {
+	case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED:
+		keyType, _, ok := readWireString(body)
+		if !ok {
+			return nil, errors.New("truncated add request")
+		}
+		if fields, ok = keyFieldCounts[string(keyType)]; !ok {
+			return nil, fmt.Errorf("can't apply constraints to %s keys", keyType)
+		}
+		fields++ // the key type itself
+		constrainedType = SSH_AGENTC_ADD_ID_CONSTRAINED
+	case SSH_AGENTC_ADD_SMARTCARD_KEY, SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED:
+		fields = 2 // reader id, PIN
+		constrainedType = SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED
+	default:
+		return request, nil
+	}
+
+	rest := body
+	for i := 0; i < fields; i++ {
+		var ok bool
+		if _, rest, ok = readWireString(rest); !ok {
+			return nil, errors.New("truncated add request")
+		}
+	}
+	key := body[:len(body)-len(rest)]
+
+	lifetime, confirm, other, err := parseConstraints(rest)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxLifetime > 0 {
+		maxLifetime := uint32(max(c.MaxLifetime/time.Second, 1))
+		if lifetime == 0 || lifetime > maxLifetime {
+			lifetime = maxLifetime
+		}
+	}
+	confirm = confirm || c.Confirm
+
+	rewritten := append([]byte{constrainedType}, key...)
+	if lifetime > 0 {
+		rewritten = append(rewritten, SSH_AGENT_CONSTRAIN_LIFETIME)
+		rewritten = binary.BigEndian.AppendUint32(rewritten, lifetime)
+	}
+	if confirm {
+		rewritten = append(rewritten, SSH_AGENT_CONSTRAIN_CONFIRM)
+	}
+	return append(rewritten, other...), nil
+}
+
+// parseConstraints pulls the lifetime and confirm constraints out of a
+// constraint list, returning everything else verbatim. Extension
+// constraints have no generic length, so parsing stops at the first one;
+// clients such as ssh-add send them last.
+func parseConstraints(b []byte) (lifetime uint32, confirm bool, other []byte, err error) {
+	for len(b) > 0 {
+		switch b[0] {
+		case SSH_AGENT_CONSTRAIN_LIFETIME:
+			if len(b) < 5 {
+				return 0, false, nil, errors.New("truncated lifetime constraint")
+			}
+			lifetime = binary.BigEndian.Uint32(b[1:5])
+			b = b[5:]
+		case SSH_AGENT_CONSTRAIN_CONFIRM:
+			confirm = true
+			b = b[1:]
+		case SSH_AGENT_CONSTRAIN_MAXSIGN:
+			if len(b) < 5 {
+				return 0, false, nil, errors.New("truncated maxsign constraint")
+			}
+			other = append(other, b[:5]...)
+			b = b[5:]
+		case SSH_AGENT_CONSTRAIN_EXTENSION:
+			return lifetime, confirm, append(other, b...), nil
+		default:
+			return 0, false, nil, fmt.Errorf("unknown constraint %d", b[0])
+		}
+	}
+	return lifetime, confirm, other, nil
+}
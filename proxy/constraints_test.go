@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func addIdentityRequest(msgType byte, keyType string, fields int, constraints []byte) []byte {
+	request := appendWireString([]byte{msgType}, []byte(keyType))
+	for i := 0; i < fields; i++ {
+		request = appendWireString(request, []byte{byte(i)})
+	}
+	return append(request, constraints...)
+}
+
+func lifetimeConstraint(seconds uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{SSH_AGENT_CONSTRAIN_LIFETIME}, seconds)
+}
+
+func TestAddConstraintsApply(t *testing.T) {
+	policy := AddConstraints{MaxLifetime: time.Hour, Confirm: true}
+	extension := appendWireString([]byte{SSH_AGENT_CONSTRAIN_EXTENSION}, []byte("sk-provider@openssh.com"))
+
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+	}{
+		{
+			name:    "unconstrained key gets the policy",
+			request: addIdentityRequest(SSH_AGENTC_ADD_IDENTITY, "ssh-ed25519", 3, nil),
+			want: addIdentityRequest(SSH_AGENTC_ADD_ID_CONSTRAINED, "ssh-ed25519", 3,
+				append(lifetimeConstraint(3600), SSH_AGENT_CONSTRAIN_CONFIRM)),
+		},
+		{
+			name:    "shorter client lifetime is kept",
+			request: addIdentityRequest(SSH_AGENTC_ADD_ID_CONSTRAINED, "ssh-rsa", 7, lifetimeConstraint(60)),
+			want: addIdentityRequest(SSH_AGENTC_ADD_ID_CONSTRAINED, "ssh-rsa", 7,
+				append(lifetimeConstraint(60), SSH_AGENT_CONSTRAIN_CONFIRM)),
+		},
+		{
+			name:    "longer client lifetime is capped, extensions kept",
+			request: addIdentityRequest(SSH_AGENTC_ADD_ID_CONSTRAINED, "ecdsa-sha2-nistp256", 4, append(lifetimeConstraint(7200), extension...)),
+			want: addIdentityRequest(SSH_AGENTC_ADD_ID_CONSTRAINED, "ecdsa-sha2-nistp256", 4,
+				append(append(lifetimeConstraint(3600), SSH_AGENT_CONSTRAIN_CONFIRM), extension...)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.apply(tt.request)
+			if err != nil {
+				t.Fatalf("apply failed: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Expected %x, got %x", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAddConstraintsSmartcard(t *testing.T) {
+	request := appendWireString([]byte{SSH_AGENTC_ADD_SMARTCARD_KEY}, []byte("/usr/lib/opensc-pkcs11.so"))
+	request = appendWireString(request, []byte("1234"))
+
+	got, err := AddConstraints{Confirm: true}.apply(request)
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if got[0] != SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED || got[len(got)-1] != SSH_AGENT_CONSTRAIN_CONFIRM {
+		t.Errorf("Expected a constrained smartcard request with confirm, got %x", got)
+	}
+}
+
+func TestAddConstraintsUnsupported(t *testing.T) {
+	request := addIdentityRequest(SSH_AGENTC_ADD_IDENTITY, "sk-ssh-ed25519@openssh.com", 4, nil)
+	if _, err := (AddConstraints{Confirm: true}).apply(request); err == nil {
+		t.Error("Expected security keys to be refused rather than added unconstrained")
+	}
+	truncated := addIdentityRequest(SSH_AGENTC_ADD_IDENTITY, "ssh-ed25519", 1, nil)
+	if _, err := (AddConstraints{Confirm: true}).apply(truncated); err == nil {
+		t.Error("Expected a truncated request to fail")
+	}
+}
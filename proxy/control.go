@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// controlTimeout bounds how long a control client may take to send a
+// request and how long ControlRequest waits for the reply.
+const controlTimeout = 5 * time.Second
+
+// ControlRequestMessage is a single command sent to the control socket.
+type ControlRequestMessage struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlResponse is the reply to a ControlRequestMessage.
+type ControlResponse struct {
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ControlHandler implements one control socket command. Its result is
+// encoded as JSON in the response.
+type ControlHandler func(args []string) (any, error)
+
+// ControlServer answers newline-delimited JSON commands on a local socket,
+// letting the CLI and scripts inspect and steer a running proxy.
+type ControlServer struct {
+	logger *slog.Logger
+
+	mu       sync.RWMutex
+	handlers map[string]ControlHandler
+}
+
+// NewControlServer creates a control server for ap with the built-in
+// status, invalidate-cache, pin, unpin, and reload commands registered.
+func NewControlServer(ap *AgentProxy, logger *slog.Logger) *ControlServer {
+	cs := &ControlServer{
+		logger:   logger,
+		handlers: make(map[string]ControlHandler),
+	}
+
+	cs.Handle("status", func(args []string) (any, error) {
+		return ap.Status(), nil
+	})
+	cs.Handle("invalidate-cache", func(args []string) (any, error) {
+		ap.InvalidateCache()
+		return nil, nil
+	})
+	cs.Handle("pin", func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: pin <socket>")
+		}
+		if err := ap.Pin(args[0]); err != nil {
+			return nil, err
+		}
+		return ap.Status(), nil
+	})
+	cs.Handle("unpin", func(args []string) (any, error) {
+		ap.Unpin()
+		return nil, nil
+	})
+	cs.Handle("reload", func(args []string) (any, error) {
+		ap.InvalidateCache()
+		ap.FindActiveSocketCached()
+		return ap.Status(), nil
+	})
+	cs.Handle("help", func(args []string) (any, error) {
+		return cs.commands(), nil
+	})
+	return cs
+}
+
+// Handle registers (or replaces) the handler for a command.
+func (cs *ControlServer) Handle(command string, handler ControlHandler) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.handlers[command] = handler
+}
+
+func (cs *ControlServer) commands() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	names := make([]string, 0, len(cs.handlers))
+	for name := range cs.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serve accepts control connections on listener until ctx is cancelled or
+// the listener is closed.
+func (cs *ControlServer) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+
+	var backoff acceptBackoff
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			// Keep the control socket up through transient failures such
+			// as EMFILE, when it's most useful for finding out why
+			delay := backoff.next()
+			args := []any{"error", err, "retry_in", delay}
+			if hint := acceptErrorHint(err); hint != "" {
+				args = append(args, "hint", hint)
+			}
+			cs.logger.Warn("Control accept error", args...)
+			if !backoff.wait(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+		backoff.reset()
+		go cs.handleConn(conn)
+	}
+}
+
+func (cs *ControlServer) handleConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(controlTimeout))
+		if !scanner.Scan() {
+			return
+		}
+
+		var req ControlRequestMessage
+		var resp ControlResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			resp = cs.dispatch(req)
+		}
+
+		data, err := json.Marshal(resp)
+		if err != nil {
+			data, _ = json.Marshal(ControlResponse{Error: err.Error()})
+		}
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+func (cs *ControlServer) dispatch(req ControlRequestMessage) ControlResponse {
+	cs.mu.RLock()
+	handler, ok := cs.handlers[req.Command]
+	cs.mu.RUnlock()
+	if !ok {
+		return ControlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+
+	cs.logger.Debug("Control command", "command", req.Command, "args", req.Args)
+	result, err := handler(req.Args)
+	if err != nil {
+		return ControlResponse{Error: err.Error()}
+	}
+	resp := ControlResponse{OK: true}
+	if result != nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return ControlResponse{Error: fmt.Sprintf("failed to encode result: %v", err)}
+		}
+		resp.Result = encoded
+	}
+	return resp
+}
+
+// ControlRequest sends a single command to the control socket at socketPath
+// and returns the raw JSON result.
+func ControlRequest(socketPath, command string, args ...string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	data, err := json.Marshal(ControlRequestMessage{Command: command, Args: args})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send control request: %w", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read control response: %w", err)
+		}
+		return nil, errors.New("control socket closed without a response")
+	}
+	var resp ControlResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("invalid control response: %w", err)
+	}
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func startControlServer(t *testing.T, ap *AgentProxy) (*ControlServer, string) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cs := NewControlServer(ap, logger)
+
+	socketPath := filepath.Join(t.TempDir(), "ctl.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cs.Serve(ctx, listener) }()
+	return cs, socketPath
+}
+
+func TestControlPinAndStatus(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return "", errors.New("no agent")
+		})))
+	_, ctl := startControlServer(t, ap)
+
+	agent := createMockAgentWithKeys(t, 1)
+	if _, err := ControlRequest(ctl, "pin", agent); err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+	if got := ap.FindActiveSocketCached(); got != agent {
+		t.Errorf("Expected pinned socket %s, got %s", agent, got)
+	}
+
+	// Invalidating the cache must not drop the pin
+	if _, err := ControlRequest(ctl, "invalidate-cache"); err != nil {
+		t.Fatalf("invalidate-cache failed: %v", err)
+	}
+
+	result, err := ControlRequest(ctl, "status")
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	var status Status
+	if err := json.Unmarshal(result, &status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Pinned != agent || status.ActiveSocket != agent {
+		t.Errorf("Expected status to report pinned socket, got %+v", status)
+	}
+
+	if _, err := ControlRequest(ctl, "unpin"); err != nil {
+		t.Fatalf("unpin failed: %v", err)
+	}
+	if got := ap.FindActiveSocketCached(); got != "" {
+		t.Errorf("Expected discovery to resume after unpin, got %s", got)
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := NewAgentProxy("/tmp/test.sock", logger)
+	cs, ctl := startControlServer(t, ap)
+
+	if _, err := ControlRequest(ctl, "no-such-command"); err == nil {
+		t.Error("Expected unknown command to fail")
+	}
+	if _, err := ControlRequest(ctl, "pin", "/nonexistent/agent.sock"); err == nil {
+		t.Error("Expected pinning a dead socket to fail")
+	}
+
+	cs.Handle("echo", func(args []string) (any, error) {
+		return args, nil
+	})
+	result, err := ControlRequest(ctl, "echo", "a", "b")
+	if err != nil {
+		t.Fatalf("echo failed: %v", err)
+	}
+	if string(result) != `["a","b"]` {
+		t.Errorf("Expected echoed args, got %s", result)
+	}
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DestinationPolicy limits keys to signing for particular hosts, which
+// clients identify with the session-bind@openssh.com extension. Modern
+// OpenSSH binds every agent connection to the host key of the server it's
+// authenticating to, and that key is looked up in KnownHosts to find the
+// host's names.
+type DestinationPolicy struct {
+	// Rules maps key fingerprints (SHA256:...) to the host patterns they
+	// may sign for. Patterns use * and ? wildcards. Keys without a rule
+	// sign for any host.
+	Rules map[string][]string
+
+	// KnownHosts are known_hosts files naming the hosts keys are bound to
+	KnownHosts []string
+}
+
+// LoadDestinationPolicy reads rules from path, one key per line: a key
+// fingerprint followed by comma-separated host patterns. Blank lines and
+// lines starting with # are ignored.
+func LoadDestinationPolicy(path string, knownHosts ...string) (*DestinationPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &DestinationPolicy{Rules: make(map[string][]string), KnownHosts: knownHosts}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "SHA256:") {
+			return nil, fmt.Errorf("%s:%d: want a SHA256 key fingerprint and host patterns", path, line)
+		}
+		policy.Rules[fields[0]] = append(policy.Rules[fields[0]], strings.Split(fields[1], ",")...)
+	}
+	return policy, nil
+}
+
+// middleware records the host each session is bound to and refuses sign
+// requests the policy doesn't allow for it.
+func (p *DestinationPolicy) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			switch req.Type() {
+			case SSH_AGENTC_EXTENSION:
+				if name, _ := extensionName(req.Message); name == ExtensionSessionBind {
+					hostKey, err := parseSessionBind(req.Message)
+					if err != nil {
+						logger.Warn("Rejecting session-bind", "client", req.Session.Client, "error", err)
+						return failure(), nil
+					}
+					req.Session.HostKey = hostKey
+				}
+			case SSH_AGENTC_SIGN_REQUEST:
+				blob, _, ok := readWireString(req.Message[1:])
+				if !ok {
+					return failure(), nil
+				}
+				if allowed, reason := p.allows(blob, req.Session.HostKey); !allowed {
+					logger.Warn("Refusing to sign for this destination",
+						"client", req.Session.Client,
+						"key", Identity{Blob: blob}.Fingerprint(),
+						"reason", reason)
+					return failure(), nil
+				}
+			}
+			return next(req)
+		}
+	}
+}
+
+// allows reports whether the key with blob may sign for the host bound
+// with hostKey, which is nil if the client never sent a session-bind.
+func (p *DestinationPolicy) allows(blob, hostKey []byte) (bool, string) {
+	patterns, ok := p.Rules[Identity{Blob: blob}.Fingerprint()]
+	if !ok {
+		return true, ""
+	}
+	if hostKey == nil {
+		return false, "the client didn't say which host it's connected to"
+	}
+	names := p.hostNames(hostKey)
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if name.matches(pattern) {
+				return true, ""
+			}
+		}
+	}
+	if len(names) == 0 {
+		return false, "the host key isn't in known_hosts"
+	}
+	return false, "the host isn't allowed for this key"
+}
+
+// knownHostName is a host name from known_hosts, which may be hashed.
+type knownHostName struct {
+	name       string
+	salt, hash []byte
+}
+
+// matches reports whether the name matches pattern. Hashed names can only
+// match patterns without wildcards.
+func (n knownHostName) matches(pattern string) bool {
+	if n.hash == nil {
+		host := n.name
+		if h, _, ok := strings.Cut(strings.TrimPrefix(host, "["), "]:"); ok {
+			host = h
+		}
+		ok, _ := filepath.Match(pattern, host)
+		return ok
+	}
+	if strings.ContainsAny(pattern, "*?") {
+		return false
+	}
+	mac := hmac.New(sha1.New, n.salt)
+	mac.Write([]byte(pattern))
+	return hmac.Equal(mac.Sum(nil), n.hash)
+}
+
+// hostNames returns the names known_hosts lists for hostKey.
+func (p *DestinationPolicy) hostNames(hostKey []byte) []knownHostName {
+	return knownHostNames(p.KnownHosts, hostKey)
+}
+
+// knownHostNames returns the names the known_hosts files list for hostKey.
+func knownHostNames(files []string, hostKey []byte) []knownHostName {
+	var names []knownHostName
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for len(data) > 0 {
+			marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+			if err != nil {
+				break
+			}
+			data = rest
+			if marker != "" || !bytes.Equal(key.Marshal(), hostKey) {
+				continue
+			}
+			for _, host := range hosts {
+				names = append(names, parseKnownHostName(host))
+			}
+		}
+	}
+	return names
+}
+
+func parseKnownHostName(host string) knownHostName {
+	parts := strings.Split(host, "|")
+	if len(parts) == 4 && parts[0] == "" && parts[1] == "1" {
+		salt, saltErr := base64.StdEncoding.DecodeString(parts[2])
+		hash, hashErr := base64.StdEncoding.DecodeString(parts[3])
+		if saltErr == nil && hashErr == nil {
+			return knownHostName{salt: salt, hash: hash}
+		}
+	}
+	return knownHostName{name: host}
+}
+
+// parseSessionBind verifies a session-bind@openssh.com request and returns
+// the host key it binds the connection to. The host's signature over the
+// session identifier proves the client really is connected to that host.
+// The host key is copied, since sessions keep it beyond the request.
+func parseSessionBind(request []byte) ([]byte, error) {
+	_, body, ok := readWireString(request[1:])
+	if !ok {
+		return nil, errors.New("truncated session-bind")
+	}
+	hostKey, body, ok := readWireString(body)
+	if !ok {
+		return nil, errors.New("truncated session-bind")
+	}
+	sessionID, body, ok := readWireString(body)
+	if !ok {
+		return nil, errors.New("truncated session-bind")
+	}
+	sigBlob, _, ok := readWireString(body)
+	if !ok {
+		return nil, errors.New("truncated session-bind")
+	}
+
+	key, err := ssh.ParsePublicKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %w", err)
+	}
+	format, rest, ok := readWireString(sigBlob)
+	if !ok {
+		return nil, errors.New("truncated session-bind signature")
+	}
+	blob, _, ok := readWireString(rest)
+	if !ok {
+		return nil, errors.New("truncated session-bind signature")
+	}
+	if err := key.Verify(sessionID, &ssh.Signature{Format: string(format), Blob: blob}); err != nil {
+		return nil, fmt.Errorf("host signature doesn't verify: %w", err)
+	}
+	return bytes.Clone(hostKey), nil
+}
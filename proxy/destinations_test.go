@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+	return signer
+}
+
+// sessionBind builds a session-bind request signed by host.
+func sessionBind(t *testing.T, host ssh.Signer) []byte {
+	sessionID := []byte("session identifier")
+	sig, err := host.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatalf("Failed to sign session: %v", err)
+	}
+	request := appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte(ExtensionSessionBind))
+	request = appendWireString(request, host.PublicKey().Marshal())
+	request = appendWireString(request, sessionID)
+	request = appendWireString(request, ssh.Marshal(sig))
+	return append(request, 0) // not forwarding
+}
+
+// knownHostsLine formats a known_hosts entry for host, hashing the name
+// like ssh-keygen -H when hashed is set.
+func knownHostsLine(host string, key ssh.PublicKey, hashed bool) string {
+	if hashed {
+		salt := make([]byte, sha1.Size)
+		_, _ = rand.Read(salt)
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		host = "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return host + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line...)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	return path
+}
+
+func TestDestinationPolicyAllows(t *testing.T) {
+	work, hashed, other := newHostKey(t), newHostKey(t), newHostKey(t)
+	knownHosts := writeKnownHosts(t,
+		knownHostsLine("build.example.com", work.PublicKey(), false),
+		knownHostsLine("git.example.org", hashed.PublicKey(), true),
+		knownHostsLine("elsewhere.net", other.PublicKey(), false))
+
+	key := Identity{Blob: newHostKey(t).PublicKey().Marshal()}
+	policy := &DestinationPolicy{
+		Rules:      map[string][]string{key.Fingerprint(): {"*.example.com", "git.example.org"}},
+		KnownHosts: []string{knownHosts},
+	}
+
+	tests := []struct {
+		name    string
+		blob    []byte
+		hostKey []byte
+		want    bool
+	}{
+		{"wildcard match", key.Blob, work.PublicKey().Marshal(), true},
+		{"hashed name", key.Blob, hashed.PublicKey().Marshal(), true},
+		{"other host", key.Blob, other.PublicKey().Marshal(), false},
+		{"unknown host", key.Blob, newHostKey(t).PublicKey().Marshal(), false},
+		{"no session-bind", key.Blob, nil, false},
+		{"unrestricted key", newHostKey(t).PublicKey().Marshal(), other.PublicKey().Marshal(), true},
+	}
+	for _, tt := range tests {
+		if got, _ := policy.allows(tt.blob, tt.hostKey); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDestinationPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	data := "# work key\nSHA256:abc *.example.com,github.com\n\nSHA256:abc gitlab.com\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	policy, err := LoadDestinationPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadDestinationPolicy failed: %v", err)
+	}
+	if got := policy.Rules["SHA256:abc"]; len(got) != 3 {
+		t.Errorf("Expected 3 patterns, got %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("github.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	if _, err := LoadDestinationPolicy(path); err == nil {
+		t.Error("Expected a line without a fingerprint to be rejected")
+	}
+}
+
+func TestDestinationPolicyThroughProxy(t *testing.T) {
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	allowed, denied := newHostKey(t), newHostKey(t)
+	knownHosts := writeKnownHosts(t,
+		knownHostsLine("allowed.example.com", allowed.PublicKey(), false),
+		knownHostsLine("denied.example.com", denied.PublicKey(), false))
+
+	keys, err := local.keyring.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected one key, got %v (%v)", keys, err)
+	}
+	key := Identity{Blob: keys[0].Marshal()}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDestinationPolicy(&DestinationPolicy{
+			Rules:      map[string][]string{key.Fingerprint(): {"allowed.example.com"}},
+			KnownHosts: []string{knownHosts},
+		}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	signFor := func(host ssh.Signer) byte {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		if host != nil {
+			if err := writeMessage(conn, sessionBind(t, host)); err != nil {
+				t.Fatalf("Failed to write session-bind: %v", err)
+			}
+			// The local agent doesn't support extensions, so its answer
+			// doesn't matter
+			if _, err := readMessage(conn, maxAgentMessage); err != nil {
+				t.Fatalf("Failed to read session-bind response: %v", err)
+			}
+		}
+		request := appendWireString([]byte{SSH_AGENTC_SIGN_REQUEST}, key.Blob)
+		request = appendWireString(request, []byte("challenge"))
+		request = binary.BigEndian.AppendUint32(request, 0)
+		if err := writeMessage(conn, request); err != nil {
+			t.Fatalf("Failed to write sign request: %v", err)
+		}
+		response, err := readMessage(conn, maxAgentMessage)
+		if err != nil {
+			t.Fatalf("Failed to read sign response: %v", err)
+		}
+		return response[0]
+	}
+
+	if got := signFor(allowed); got != SSH_AGENT_SIGN_RESPONSE {
+		t.Errorf("Expected signing for an allowed host to succeed, got response type %d", got)
+	}
+	if got := signFor(denied); got != SSH_AGENT_FAILURE {
+		t.Errorf("Expected signing for another host to be refused, got response type %d", got)
+	}
+	if got := signFor(nil); got != SSH_AGENT_FAILURE {
+		t.Errorf("Expected signing without a session-bind to be refused, got response type %d", got)
+	}
+}
@@ -1,78 +1,536 @@
 package proxy
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Selection strategies for Discovery.Strategy
+const (
+	StrategyNewest   = "newest"
+	StrategyMostKeys = "most-keys"
+
+	strategyPinnedPrefix = "pinned:"
+)
+
+const (
+	// DefaultProbeTimeout bounds how long a single candidate socket has to
+	// answer during validation.
+	DefaultProbeTimeout = 5 * time.Second
+	// DefaultDiscoveryTimeout bounds validation of all candidates, which
+	// run concurrently.
+	DefaultDiscoveryTimeout = 5 * time.Second
+
+	// maxProbeWorkers bounds how many candidates are validated at once
+	maxProbeWorkers = 8
+)
+
+// ValidateStrategy reports whether strategy is a recognized selection
+// strategy.
+func ValidateStrategy(strategy string) error {
+	switch {
+	case strategy == "", strategy == StrategyNewest, strategy == StrategyMostKeys:
+		return nil
+	case strings.HasPrefix(strategy, strategyPinnedPrefix) && len(strategy) > len(strategyPinnedPrefix):
+		return nil
+	}
+	return fmt.Errorf("unknown selection strategy %q (want newest, most-keys, or pinned:<path>)", strategy)
+}
+
 type SocketInfo struct {
 	Path    string
+	Class   string // Kind of upstream, e.g. ClassForwarded
 	ModTime time.Time
 	Valid   bool
+	Keys    int    // Number of identities the agent reported
 	Reason  string // Reason for invalidity (empty if valid)
+	Owner   string // Numeric owner UID, where the platform reports one
+
+	// Fallback marks an upstream from Discovery.Fallback, used only when
+	// no other socket is valid
+	Fallback bool
+
+	// Latency is how long validation took, zero if the socket wasn't
+	// probed or validation didn't finish
+	Latency time.Duration
+
+	// Session marks a socket listed in Discovery.Session
+	Session bool
+
+	// conn is the connection that validated the socket, kept open only
+	// for FindActiveConn
+	conn net.Conn
 }
 
+// Discovery scans for upstream agent sockets. The zero value scans the
+// default /tmp/ssh-*/agent.* locations.
+type Discovery struct {
+	// Command, when set, is run through the shell to report additional
+	// candidate sockets, merged with the built-in scan. See
+	// parseDiscoverOutput for the accepted formats.
+	Command string
+
+	// Upstreams lists environment variables and files that name further
+	// candidate sockets, read again on every scan. Like the command's
+	// sockets, they're reported as ClassCustom.
+	Upstreams []UpstreamSource
+
+	// PKCS11 lists the sockets of PKCS11Agents, reported as ClassPKCS11.
+	PKCS11 []string
+
+	// Prefer orders candidates by class name (e.g. ClassForwarded) or
+	// socket path glob, most preferred first. Within the same preference,
+	// and when Prefer is empty, the newest socket wins.
+	Prefer []string
+
+	// Strategy selects among valid sockets: StrategyNewest (the default)
+	// takes the first in preference order, StrategyMostKeys the one holding
+	// the most identities, and "pinned:<path>" always uses path.
+	Strategy string
+
+	// Session lists the sockets forwarded into the SSH login the proxy
+	// serves, usually from SessionSockets. Among sockets of equal
+	// preference they're chosen first, so a newer socket from someone's
+	// other login doesn't win.
+	Session []string
+
+	// ExpectKeys, when set, lists key fingerprints (SHA256:...) a
+	// discovered agent must hold at least one of to be valid, so the proxy
+	// never attaches to some other process's agent that happens to speak
+	// the protocol. Fallbacks and pinned sockets aren't checked.
+	ExpectKeys []string
+
+	// SkipEmpty passes over agents that hold no keys, such as an empty
+	// local ssh-agent shadowing a loaded forwarded one, using them only
+	// when no valid agent has keys.
+	SkipEmpty bool
+
+	// Only, when set, restricts selection to sockets matching one of its
+	// entries, which take the same form as Prefer's. Other candidates,
+	// fallbacks included, are reported but never probed.
+	Only []string
+
+	// Ignore lists sockets discovery must never select, as paths or globs.
+	// An entry matching a directory ignores every socket under it.
+	// Ignored candidates are reported, with the entry, but never probed.
+	Ignore []string
+
+	// Fallback lists upstream addresses, such as LocalAgentAddress, that
+	// are used only when no discovered socket is valid. They're reported
+	// after every discovered socket, in the order given.
+	Fallback []string
+
+	// Exclude lists sockets that must never be selected, such as the
+	// proxy's own socket. Paths are compared by file identity, so symlinks
+	// and hard links to an excluded socket are caught too.
+	Exclude []string
+
+	// ProbeTimeout bounds validation of each candidate, and Timeout the
+	// whole concurrent validation pass. Candidates still unanswered when
+	// Timeout expires are reported invalid. Zero means
+	// DefaultProbeTimeout and DefaultDiscoveryTimeout.
+	ProbeTimeout time.Duration
+	Timeout      time.Duration
+
+	// User, when set, is whose agents to find instead of the current
+	// user's, for a proxy serving someone else: sockets must belong to
+	// them, and well-known locations are under their home directory.
+	User *user.User
+
+	// Logger receives warnings about discovery sources that fail. A nil
+	// Logger discards them.
+	Logger *slog.Logger
+}
+
+// DiscoverSockets scans the default locations for agent sockets.
 func DiscoverSockets() ([]SocketInfo, error) {
+	return (&Discovery{}).DiscoverSockets()
+}
+
+// DiscoverSockets finds candidate sockets owned by the current user and
+// validates each, returning them in order of preference.
+func (d *Discovery) DiscoverSockets() ([]SocketInfo, error) {
+	return d.discoverSockets(false)
+}
+
+// discoverSockets is DiscoverSockets that, when keep is set, leaves each
+// valid socket's probe connection open in its conn for the caller to use
+// or close.
+func (d *Discovery) discoverSockets(keep bool) ([]SocketInfo, error) {
 	var sockets []SocketInfo
 
-	currentUser, err := user.Current()
+	currentUser, home, err := d.user()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current user: %w", err)
+		return nil, err
 	}
 
 	// Look for SSH agent sockets in /tmp
-	pattern := "/tmp/ssh-*/agent.*"
-	matches, err := filepath.Glob(pattern)
+	matches, err := filepath.Glob(tmpSocketPattern)
 	if err != nil {
 		return nil, fmt.Errorf("failed to glob for sockets: %w", err)
 	}
-
+	classes := make(map[string]string)
 	for _, match := range matches {
-		info, err := os.Stat(match)
+		classes[match] = classifyTmpSocket(match)
+	}
+
+	// Well-known agent locations such as 1Password and gpg-agent
+	for path, class := range knownLocationMatches(currentUser.Uid, home) {
+		if _, ok := classes[path]; !ok {
+			matches = append(matches, path)
+			classes[path] = class
+		}
+	}
+
+	if d.Command != "" {
+		commandMatches, err := runDiscoverCommand(d.Command)
 		if err != nil {
-			continue
+			d.warn("Discovery command failed", "command", d.Command, "error", err)
+		}
+		for _, path := range commandMatches {
+			if _, ok := classes[path]; !ok {
+				matches = append(matches, path)
+				classes[path] = ClassCustom
+			}
 		}
+	}
 
-		// Check if it's actually a socket
-		if info.Mode()&os.ModeSocket == 0 {
+	for _, source := range d.Upstreams {
+		path, err := source.Resolve()
+		if err != nil {
+			d.warn("Upstream source unavailable", "source", source.String(), "error", err)
 			continue
 		}
+		if _, ok := classes[path]; !ok {
+			matches = append(matches, path)
+			classes[path] = ClassCustom
+		}
+	}
 
-		// Check if socket is owned by current user
-		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
-			if fmt.Sprintf("%d", stat.Uid) != currentUser.Uid {
-				continue
-			}
+	for _, path := range d.PKCS11 {
+		if _, ok := classes[path]; !ok {
+			matches = append(matches, path)
+			classes[path] = ClassPKCS11
+		}
+	}
 
-			socketInfo := SocketInfo{
-				Path:    match,
-				ModTime: info.ModTime(),
-				Valid:   false, // Will be validated later
-			}
+	for _, match := range matches {
+		if socketInfo, ok := d.candidate(match, classes[match], currentUser.Uid); ok {
 			sockets = append(sockets, socketInfo)
 		}
 	}
 
-	// Sort by modification time (newest first)
-	sort.Slice(sockets, func(i, j int) bool {
+	// Agents that aren't unix sockets in /tmp, such as Pageant on Windows
+	sockets = append(sockets, platformSockets()...)
+
+	for i := range sockets {
+		sockets[i].Session = containsPath(d.Session, sockets[i].Path)
+	}
+
+	// Sort by preference, then this login's sockets, then modification
+	// time (newest first)
+	sort.SliceStable(sockets, func(i, j int) bool {
+		ri, rj := preferenceRank(sockets[i], d.Prefer), preferenceRank(sockets[j], d.Prefer)
+		if ri != rj {
+			return ri < rj
+		}
+		if sockets[i].Session != sockets[j].Session {
+			return sockets[i].Session
+		}
 		return sockets[i].ModTime.After(sockets[j].ModTime)
 	})
 
-	// Validate each socket
+	for _, address := range d.Fallback {
+		sockets = append(sockets, fallbackSocket(address))
+	}
+
 	for i := range sockets {
-		sockets[i].Valid, sockets[i].Reason = TestSocketWithReason(sockets[i].Path)
+		d.restrict(&sockets[i])
 	}
 
+	d.validate(sockets, keep)
 	return sockets, nil
 }
 
+// ValidateSocket checks one socket the way DiscoverSockets checks its
+// candidates, for an upstream remembered from an earlier run.
+func (d *Discovery) ValidateSocket(path string) (bool, string) {
+	currentUser, home, err := d.user()
+	if err != nil {
+		return false, err.Error()
+	}
+
+	var socket SocketInfo
+	if slices.Contains(d.Fallback, path) {
+		socket = fallbackSocket(path)
+	} else {
+		class := ClassCustom
+		if ok, _ := filepath.Match(tmpSocketPattern, path); ok {
+			class = classifyTmpSocket(path)
+		} else if slices.Contains(d.PKCS11, path) {
+			class = ClassPKCS11
+		} else if known, ok := knownLocationMatches(currentUser.Uid, home)[path]; ok {
+			class = known
+		}
+		var found bool
+		if socket, found = d.candidate(path, class, currentUser.Uid); !found {
+			return false, "no longer exists"
+		}
+	}
+	d.restrict(&socket)
+
+	sockets := []SocketInfo{socket}
+	d.validate(sockets, false)
+	return sockets[0].Valid, sockets[0].Reason
+}
+
+// tmpSocketPattern matches the sockets sshd and ssh-agent create in /tmp.
+const tmpSocketPattern = "/tmp/ssh-*/agent.*"
+
+// user returns whose agents to find and their home directory.
+func (d *Discovery) user() (*user.User, string, error) {
+	if d.User != nil {
+		return d.User, d.User.HomeDir, nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get current user: %w", err)
+	}
+	home, _ := os.UserHomeDir()
+	return currentUser, home, nil
+}
+
+// ownerUID returns the uid that must serve abstract sockets: User's when
+// set, as for socket files, or the current user's. A User whose uid isn't
+// numeric can't serve one, so -1 matches nobody.
+func (d *Discovery) ownerUID() int {
+	if d.User == nil {
+		return os.Getuid()
+	}
+	uid, err := strconv.Atoi(d.User.Uid)
+	if err != nil {
+		return -1
+	}
+	return uid
+}
+
+// candidate describes the socket at path for the user with uid, or
+// reports false if there's nothing there. Candidates that can't be used
+// are still described, with the reason, so --test-discovery can explain
+// why they were skipped.
+func (d *Discovery) candidate(path, class, uid string) (SocketInfo, bool) {
+	// Abstract sockets from the discovery command have no file to check;
+	// probing verifies their owner instead
+	if IsAbstractSocket(path) {
+		socketInfo := SocketInfo{Path: path, Class: class}
+		if slices.Contains(d.Exclude, path) {
+			socketInfo.Reason = "excluded: this is the proxy's own socket"
+		}
+		return socketInfo, true
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return SocketInfo{}, false
+	}
+
+	socketInfo := SocketInfo{
+		Path:    path,
+		Class:   class,
+		ModTime: info.ModTime(),
+		Valid:   false, // Will be validated later
+	}
+	socketInfo.Owner, _ = fileOwner(info)
+
+	switch {
+	case info.Mode()&os.ModeSocket == 0:
+		socketInfo.Reason = fmt.Sprintf("not a socket (%s)", describeFileMode(info.Mode()))
+	case !ownedByUser(info, uid):
+		socketInfo.Reason = fmt.Sprintf("wrong owner: owned by uid %s, not the proxy's user (uid %s)", socketInfo.Owner, uid)
+	case d.excluded(info):
+		socketInfo.Reason = "excluded: this is the proxy's own socket"
+	}
+	return socketInfo, true
+}
+
+// restrict marks a usable socket that Ignore or Only rules out.
+func (d *Discovery) restrict(socket *SocketInfo) {
+	if socket.Reason != "" {
+		return
+	}
+	if entry := d.ignoredBy(socket.Path); entry != "" {
+		socket.Reason = "ignored: matches " + entry
+	} else if len(d.Only) > 0 && preferenceRank(*socket, d.Only) == len(d.Only) {
+		socket.Reason = "not in this proxy's upstream set"
+	}
+}
+
+// fallbackSocket describes an address from Discovery.Fallback, which may
+// be an upstream adapter rather than a file.
+func fallbackSocket(address string) SocketInfo {
+	socket := SocketInfo{Path: address, Class: ClassCustom, Fallback: true}
+	if address == LocalAgentAddress {
+		socket.Class = ClassLocal
+	}
+	if info, err := os.Stat(address); err == nil {
+		socket.ModTime = info.ModTime()
+	}
+	return socket
+}
+
+// probeResult is the outcome of validating sockets[index]
+type probeResult struct {
+	index   int
+	valid   bool
+	keys    int
+	reason  string
+	latency time.Duration
+	conn    net.Conn
+}
+
+// validate probes the candidates concurrently with a bounded worker pool so
+// a host full of stale sockets can't stall a client request for long. With
+// keep set, valid sockets keep their probe connection open in conn.
+func (d *Discovery) validate(sockets []SocketInfo, keep bool) {
+	probeTimeout := d.probeTimeout()
+	owner := d.ownerUID()
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDiscoveryTimeout
+	}
+
+	var pending []int
+	for i := range sockets {
+		if sockets[i].Reason == "" {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	// Both channels are buffered so workers never block on a collector
+	// that has given up, and workers only see paths, not the slice the
+	// caller keeps using.
+	type job struct {
+		index  int
+		path   string
+		expect []string
+	}
+	work := make(chan job, len(pending))
+	results := make(chan probeResult, len(pending))
+	for _, i := range pending {
+		j := job{index: i, path: sockets[i].Path}
+		if !sockets[i].Fallback {
+			j.expect = d.ExpectKeys
+		}
+		work <- j
+	}
+	close(work)
+
+	for w := 0; w < min(maxProbeWorkers, len(pending)); w++ {
+		go func() {
+			for j := range work {
+				start := time.Now()
+				conn, valid, keys, reason := probeAgentConn(j.path, owner, probeTimeout, j.expect)
+				if conn != nil && !keep {
+					_ = conn.Close()
+					conn = nil
+				}
+				results <- probeResult{index: j.index, valid: valid, keys: keys, reason: reason, latency: time.Since(start), conn: conn}
+			}
+		}()
+	}
+
+	done := make(map[int]bool, len(pending))
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for len(done) < len(pending) {
+		select {
+		case r := <-results:
+			sockets[r.index].Valid, sockets[r.index].Keys, sockets[r.index].Reason = r.valid, r.keys, r.reason
+			sockets[r.index].Latency, sockets[r.index].conn = r.latency, r.conn
+			done[r.index] = true
+		case <-deadline.C:
+			for _, i := range pending {
+				if !done[i] {
+					sockets[i].Reason = fmt.Sprintf("validation did not finish within %s", timeout)
+				}
+			}
+			if keep {
+				// Probes that finish late would leave their connections
+				// open with nobody to close them
+				go func(late int) {
+					for ; late > 0; late-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(len(pending) - len(done))
+			}
+			return
+		}
+	}
+}
+
+// ignoredBy returns the Ignore entry that matches path or one of its
+// parent directories, or "" if none does.
+func (d *Discovery) ignoredBy(path string) string {
+	for _, entry := range d.Ignore {
+		for p := path; ; p = filepath.Dir(p) {
+			if ok, _ := filepath.Match(entry, p); ok || entry == p {
+				return entry
+			}
+			if parent := filepath.Dir(p); parent == p {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+func (d *Discovery) probeTimeout() time.Duration {
+	if d.ProbeTimeout <= 0 {
+		return DefaultProbeTimeout
+	}
+	return d.ProbeTimeout
+}
+
+// testPinned validates the socket named by a pinned strategy.
+func (d *Discovery) testPinned(pinned string) (bool, string) {
+	valid, _, reason := probeAgent(pinned, d.ownerUID(), d.probeTimeout(), nil)
+	return valid, reason
+}
+
+// excluded reports whether info is the same file as any socket in Exclude.
+func (d *Discovery) excluded(info os.FileInfo) bool {
+	for _, path := range d.Exclude {
+		if other, err := os.Stat(path); err == nil && os.SameFile(info, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Discovery) warn(msg string, args ...any) {
+	if d.Logger != nil {
+		d.Logger.Warn(msg, args...)
+	}
+}
+
 // TestSocket tests if a socket is valid (backwards compatible)
 func TestSocket(socketPath string) bool {
 	valid, _ := TestSocketWithReason(socketPath)
@@ -81,53 +539,255 @@ func TestSocket(socketPath string) bool {
 
 // TestSocketWithReason tests if a socket is valid and returns the reason if not
 func TestSocketWithReason(socketPath string) (bool, string) {
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return false, fmt.Sprintf("connection failed: %v", err)
-	}
-	defer func() { _ = conn.Close() }()
+	valid, _, reason := probeSocket(socketPath, DefaultProbeTimeout)
+	return valid, reason
+}
+
+// probeSocket validates a socket by requesting its identities, also
+// reporting how many keys it holds. Agents that answer SSH_AGENT_FAILURE
+// are valid with zero keys.
+func probeSocket(socketPath string, timeout time.Duration) (bool, int, string) {
+	return probeAgent(socketPath, os.Getuid(), timeout, nil)
+}
 
-	// Send SSH_AGENTC_REQUEST_IDENTITIES message
-	// Format: [length (4 bytes)][type (1 byte)]
-	msg := []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}
+// probeAgent is probeSocket that requires an abstract socket to be served
+// by owner rather than the current user and, when expect is set, the agent
+// to hold a key with one of those fingerprints.
+func probeAgent(socketPath string, owner int, timeout time.Duration, expect []string) (bool, int, string) {
+	conn, valid, keys, reason := probeAgentConn(socketPath, owner, timeout, expect)
+	if conn != nil {
+		_ = conn.Close()
+	}
+	return valid, keys, reason
+}
 
-	_, err = conn.Write(msg)
+// probeAgentConn is probeAgent that returns the connection it probed
+// with, still open, when the probe passes.
+func probeAgentConn(socketPath string, owner int, timeout time.Duration, expect []string) (net.Conn, bool, int, string) {
+	conn, err := dialUpstream(socketPath)
 	if err != nil {
-		return false, fmt.Sprintf("write failed: %v", err)
+		return nil, false, 0, describeProbeError("connect", err, timeout)
 	}
+	valid, keys, reason := probeConn(conn, socketPath, owner, timeout, expect)
+	if !valid {
+		_ = conn.Close()
+		return nil, false, keys, reason
+	}
+	return conn, true, keys, ""
+}
 
-	// Try to read response header (5 bytes: 4 for length, 1 for type)
-	header := make([]byte, 5)
-	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := io.ReadFull(conn, header)
+// probeConn is probeAgent on a connection already made to socketPath,
+// which stays open, and usable for more requests, when the probe passes.
+func probeConn(conn net.Conn, socketPath string, owner int, timeout time.Duration, expect []string) (bool, int, string) {
+	if IsAbstractSocket(socketPath) {
+		uid, ok := peerUID(conn)
+		if !ok {
+			return false, 0, "wrong owner: can't tell which user serves this abstract socket"
+		}
+		if uid != owner {
+			return false, 0, fmt.Sprintf("wrong owner: served by uid %d, not the proxy's user (uid %d)", uid, owner)
+		}
+	}
+	if reason := loopReason(conn); reason != "" {
+		return false, 0, reason
+	}
 
-	// Check if we got a valid response
+	response, err := agentRequest(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}, timeout)
 	if err != nil {
-		return false, fmt.Sprintf("read timeout/error after 5s: %v", err)
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			return false, 0, describeProbeError(reqErr.stage, reqErr.err, timeout)
+		}
+		return false, 0, fmt.Sprintf("bad response: %v", err)
 	}
-	if n != 5 {
-		return false, fmt.Sprintf("incomplete response: got %d bytes, expected 5", n)
+
+	switch response[0] {
+	case SSH_AGENT_FAILURE:
+		if len(expect) > 0 {
+			return false, 0, "unexpected agent: it holds none of the expected keys"
+		}
+		return true, 0, ""
+	case SSH_AGENT_IDENTITIES_ANSWER:
+		if len(expect) == 0 {
+			keys := 0
+			if len(response) >= 5 {
+				keys = int(binary.BigEndian.Uint32(response[1:5]))
+			}
+			return true, keys, ""
+		}
+		identities, err := parseIdentities(response)
+		if err != nil {
+			return false, 0, fmt.Sprintf("bad response: %v", err)
+		}
+		for _, id := range identities {
+			if slices.Contains(expect, id.Fingerprint()) {
+				return true, len(identities), ""
+			}
+		}
+		return false, len(identities), "unexpected agent: it holds none of the expected keys"
 	}
+	return false, 0, fmt.Sprintf("bad response type %d: not an SSH agent, or a broken one", response[0])
+}
 
-	// Check if response type is SSH_AGENT_IDENTITIES_ANSWER or SSH_AGENT_FAILURE
-	responseType := header[4]
-	if responseType == SSH_AGENT_IDENTITIES_ANSWER || responseType == SSH_AGENT_FAILURE {
-		return true, ""
+// describeProbeError turns a failure during a probe stage (connect, write,
+// or read) into a reason that points at the likely cause.
+func describeProbeError(stage string, err error, timeout time.Duration) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused: nothing is listening, likely a stale socket left by an agent or ssh session that exited"
+	case errors.Is(err, syscall.ENOENT):
+		return "socket disappeared before it could be probed"
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("permission denied on %s: %v", stage, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Sprintf("timeout: no answer within %s (agent hung, or a slow forwarded connection)", timeout)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		return fmt.Sprintf("agent closed the connection during %s without answering", stage)
 	}
-	return false, fmt.Sprintf("unexpected response type: %d", responseType)
+	return fmt.Sprintf("%s failed: %v", stage, err)
 }
 
+// describeFileMode names the kind of file a non-socket candidate is.
+func describeFileMode(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode.IsRegular():
+		return "regular file"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	}
+	return mode.Type().String()
+}
+
+// FindActiveSocket returns the most preferred valid socket in the default
+// locations.
 func FindActiveSocket() (string, error) {
-	sockets, err := DiscoverSockets()
+	return (&Discovery{}).FindActiveSocket()
+}
+
+// FindActiveSocket implements Discoverer, returning the valid socket
+// chosen by the selection strategy.
+func (d *Discovery) FindActiveSocket() (string, error) {
+	if pinned, ok := strings.CutPrefix(d.Strategy, strategyPinnedPrefix); ok {
+		if valid, reason := d.testPinned(pinned); !valid {
+			return "", errorOfKind(ErrNoActiveAgent, "pinned socket %s is not usable: %s", pinned, reason)
+		}
+		return pinned, nil
+	}
+
+	sockets, err := d.DiscoverSockets()
 	if err != nil {
 		return "", err
 	}
+	return d.selectSocket(sockets)
+}
+
+// FindActiveConn implements ConnDiscoverer, returning the socket
+// FindActiveSocket would choose along with the connection that validated
+// it. The connection is nil for a pinned strategy.
+func (d *Discovery) FindActiveConn() (string, net.Conn, error) {
+	if _, ok := strings.CutPrefix(d.Strategy, strategyPinnedPrefix); ok {
+		socket, err := d.FindActiveSocket()
+		return socket, nil, err
+	}
+
+	sockets, err := d.discoverSockets(true)
+	if err != nil {
+		return "", nil, err
+	}
+	socket, err := d.selectSocket(sockets)
+	var conn net.Conn
+	for _, candidate := range sockets {
+		if candidate.conn == nil {
+			continue
+		}
+		if err == nil && conn == nil && candidate.Path == socket {
+			conn = candidate.conn
+			continue
+		}
+		_ = candidate.conn.Close()
+	}
+	return socket, conn, err
+}
+
+// FindUpstreams implements StandbyDiscoverer, returning the socket
+// FindActiveSocket would choose and the next valid one in preference
+// order, fallbacks last, and under SkipEmpty agents with keys first. A
+// pinned strategy has no standby.
+func (d *Discovery) FindUpstreams() (string, string, error) {
+	if _, ok := strings.CutPrefix(d.Strategy, strategyPinnedPrefix); ok {
+		primary, err := d.FindActiveSocket()
+		return primary, "", err
+	}
+
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		return "", "", err
+	}
+	primary, err := d.selectSocket(sockets)
+	if err != nil {
+		return "", "", err
+	}
+	candidates := sockets
+	if d.SkipEmpty {
+		candidates = append(stocked(sockets), sockets...)
+	}
+	for _, socket := range candidates {
+		if socket.Valid && socket.Path != primary {
+			return primary, socket.Path, nil
+		}
+	}
+	return primary, "", nil
+}
+
+// selectSocket applies the selection strategy to already validated sockets
+// in preference order, falling back to the first valid fallback. Under
+// SkipEmpty, agents holding no keys are only chosen if no agent, fallbacks
+// included, holds any. The pinned strategy is handled by the caller.
+func (d *Discovery) selectSocket(sockets []SocketInfo) (string, error) {
+	if d.SkipEmpty {
+		if path, err := d.selectFrom(stocked(sockets)); err == nil {
+			return path, nil
+		}
+	}
+	return d.selectFrom(sockets)
+}
 
+// stocked returns the sockets whose agents reported at least one key.
+func stocked(sockets []SocketInfo) []SocketInfo {
+	var withKeys []SocketInfo
+	for _, socket := range sockets {
+		if socket.Keys > 0 {
+			withKeys = append(withKeys, socket)
+		}
+	}
+	return withKeys
+}
+
+func (d *Discovery) selectFrom(sockets []SocketInfo) (string, error) {
+	best := -1
+	for i, socket := range sockets {
+		if !socket.Valid || socket.Fallback {
+			continue
+		}
+		if d.Strategy != StrategyMostKeys {
+			return socket.Path, nil
+		}
+		// Earlier sockets win ties, keeping preference order
+		if best == -1 || socket.Keys > sockets[best].Keys {
+			best = i
+		}
+	}
+	if best != -1 {
+		return sockets[best].Path, nil
+	}
 	for _, socket := range sockets {
-		if socket.Valid {
+		if socket.Valid && socket.Fallback {
 			return socket.Path, nil
 		}
 	}
 
-	return "", fmt.Errorf("no active SSH agent socket found")
+	return "", ErrNoActiveAgent
 }
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// discoverCommandTimeout bounds how long an external discovery command may
+// run, since discovery can happen inside a client's request.
+const discoverCommandTimeout = 3 * time.Second
+
+// runDiscoverCommand runs command through the shell and returns the socket
+// paths it reports.
+func runDiscoverCommand(command string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return parseDiscoverOutput(out)
+}
+
+// parseDiscoverOutput accepts either plain text with one socket path per
+// line (blank lines and # comments ignored), or JSON: an array of path
+// strings or of objects with a "path" field.
+func parseDiscoverOutput(out []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(out)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+
+	if trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON from discovery command: %w", err)
+		}
+
+		paths := make([]string, 0, len(raw))
+		for _, item := range raw {
+			var path string
+			if err := json.Unmarshal(item, &path); err == nil {
+				paths = append(paths, path)
+				continue
+			}
+			var entry struct {
+				Path string `json:"path"`
+			}
+			if err := json.Unmarshal(item, &entry); err != nil || entry.Path == "" {
+				return nil, fmt.Errorf("discovery command entry has no path: %s", item)
+			}
+			paths = append(paths, entry.Path)
+		}
+		return paths, nil
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, nil
+}
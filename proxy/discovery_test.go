@@ -1,9 +1,14 @@
 package proxy
 
 import (
+	"io"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -189,3 +194,606 @@ func handleMockAgentConnection(conn net.Conn) {
 	}
 }
 
+
+func TestParseDiscoverOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"lines", "/a/sock\n\n# comment\n  /b/sock  \n", []string{"/a/sock", "/b/sock"}},
+		{"json strings", `["/a/sock", "/b/sock"]`, []string{"/a/sock", "/b/sock"}},
+		{"json objects", `[{"path": "/a/sock", "label": "teleport"}, "/b/sock"]`, []string{"/a/sock", "/b/sock"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDiscoverOutput([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+
+	if _, err := parseDiscoverOutput([]byte(`[{"label": "no path"}]`)); err == nil {
+		t.Error("Expected error for JSON entry without a path")
+	}
+}
+
+func TestDiscoveryCommand(t *testing.T) {
+	agentSocket := createMockAgent(t)
+
+	d := &Discovery{Command: "echo " + agentSocket + "; echo /nonexistent/agent.sock"}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+
+	found := false
+	for _, socket := range sockets {
+		if socket.Path == "/nonexistent/agent.sock" {
+			t.Error("Expected missing command-reported socket to be skipped")
+		}
+		if socket.Path == agentSocket {
+			found = true
+			if !socket.Valid {
+				t.Errorf("Expected command-reported socket to be valid: %s", socket.Reason)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected command-reported socket %s in results", agentSocket)
+	}
+
+	// A failing command doesn't break the built-in scan
+	d = &Discovery{Command: "exit 3"}
+	if _, err := d.DiscoverSockets(); err != nil {
+		t.Errorf("Expected failing command to be tolerated, got %v", err)
+	}
+}
+
+func TestPreferenceRank(t *testing.T) {
+	forwarded := SocketInfo{Path: "/tmp/ssh-abc/agent.1", Class: ClassForwarded}
+	onePassword := SocketInfo{Path: "/home/me/.1password/agent.sock", Class: Class1Password}
+	gpg := SocketInfo{Path: "/run/user/1000/gnupg/S.gpg-agent.ssh", Class: ClassGPGAgent}
+
+	// Without preferences, /tmp agents outrank well-known fallbacks
+	if preferenceRank(forwarded, nil) >= preferenceRank(onePassword, nil) {
+		t.Error("Expected forwarded agent to outrank 1Password by default")
+	}
+	secretive := SocketInfo{Path: "/Users/me/Library/Containers/com.maxgoedjen.Secretive.SecretAgent/Data/socket.ssh", Class: ClassEnclave}
+	if rank := preferenceRank(secretive, nil); rank <= preferenceRank(forwarded, nil) || rank >= preferenceRank(onePassword, nil) {
+		t.Errorf("Expected Secure Enclave agent to rank between forwarded and 1Password by default, got %d", rank)
+	}
+
+	prefer := []string{Class1Password, "/run/user/*/gnupg/*", ClassForwarded}
+	if got := preferenceRank(onePassword, prefer); got != 0 {
+		t.Errorf("Expected 1Password rank 0, got %d", got)
+	}
+	if got := preferenceRank(gpg, prefer); got != 1 {
+		t.Errorf("Expected gpg-agent to match path glob at rank 1, got %d", got)
+	}
+	if got := preferenceRank(forwarded, prefer); got != 2 {
+		t.Errorf("Expected forwarded rank 2, got %d", got)
+	}
+	if got := preferenceRank(SocketInfo{Class: ClassSSHAgent}, prefer); got != len(prefer) {
+		t.Errorf("Expected unmatched socket to rank last, got %d", got)
+	}
+}
+
+func TestDiscoveryPrefer(t *testing.T) {
+	older := createMockAgent(t)
+	newer := createMockAgent(t)
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(older, past, past); err != nil {
+		t.Fatalf("Failed to age socket: %v", err)
+	}
+
+	d := &Discovery{Command: "echo " + older + "; echo " + newer}
+	if active, _ := d.FindActiveSocket(); active != newer {
+		t.Skipf("Another agent on this system outranks the mock agents (%s)", active)
+	}
+
+	d.Prefer = []string{older}
+	active, err := d.FindActiveSocket()
+	if err != nil {
+		t.Fatalf("FindActiveSocket failed: %v", err)
+	}
+	if active != older {
+		t.Errorf("Expected preferred socket %s, got %s", older, active)
+	}
+}
+
+// createRespondingAgent serves a fixed framed response to every request,
+// the canned agent the other mock agents are built on.
+func createRespondingAgent(t *testing.T, response []byte) string {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create mock agent: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(c, buf); err != nil {
+					return
+				}
+				_, _ = c.Write(response)
+			}(conn)
+		}
+	}()
+	return socketPath
+}
+
+// createMockAgentWithKeys starts an agent whose identities answer claims
+// the given number of keys.
+func createMockAgentWithKeys(t *testing.T, keys byte) string {
+	return createRespondingAgent(t, []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, keys})
+}
+
+func TestSelectionStrategy(t *testing.T) {
+	loaded := createMockAgentWithKeys(t, 3)
+	empty := createMockAgentWithKeys(t, 0)
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(loaded, past, past); err != nil {
+		t.Fatalf("Failed to age socket: %v", err)
+	}
+
+	d := &Discovery{
+		Command: "echo " + loaded + "; echo " + empty,
+		// Prefer the empty agent so newest and most-keys disagree
+		Prefer: []string{filepath.Dir(empty) + "/*", filepath.Dir(loaded) + "/*"},
+	}
+
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path == loaded && socket.Keys != 3 {
+			t.Errorf("Expected 3 keys for loaded agent, got %d", socket.Keys)
+		}
+	}
+
+	if active, _ := d.FindActiveSocket(); active != empty {
+		t.Errorf("Expected newest strategy to take the preferred empty agent, got %s", active)
+	}
+
+	d.Strategy = StrategyMostKeys
+	if active, _ := d.FindActiveSocket(); active != loaded {
+		t.Errorf("Expected most-keys strategy to pick %s, got %s", loaded, active)
+	}
+
+	d.Strategy = "pinned:" + empty
+	if active, _ := d.FindActiveSocket(); active != empty {
+		t.Errorf("Expected pinned strategy to pick %s, got %s", empty, active)
+	}
+
+	d.Strategy = "pinned:/nonexistent/agent.sock"
+	if _, err := d.FindActiveSocket(); err == nil {
+		t.Error("Expected error for unusable pinned socket")
+	}
+}
+
+func TestValidateStrategy(t *testing.T) {
+	for _, valid := range []string{"", StrategyNewest, StrategyMostKeys, "pinned:/tmp/agent"} {
+		if err := ValidateStrategy(valid); err != nil {
+			t.Errorf("Expected %q to be valid: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"oldest", "pinned:"} {
+		if err := ValidateStrategy(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestDiscoveryExclude(t *testing.T) {
+	agentSocket := createMockAgent(t)
+	link := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.Symlink(agentSocket, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	d := &Discovery{Command: "echo " + agentSocket, Exclude: []string{link}}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path == agentSocket && socket.Valid {
+			t.Error("Expected socket reached through an excluded symlink to be rejected")
+		}
+	}
+}
+
+func TestKnownLocationsRuntimeDir(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	for _, dir := range []string{"keyring", "gcr"} {
+		if err := os.MkdirAll(filepath.Join(runtimeDir, dir), 0700); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	want := map[string]string{
+		filepath.Join(runtimeDir, "ssh-agent.socket"): ClassSSHAgent,
+		filepath.Join(runtimeDir, "keyring", "ssh"):   ClassKeyring,
+		filepath.Join(runtimeDir, "gcr", "ssh"):       ClassKeyring,
+	}
+	for path := range want {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Failed to create socket: %v", err)
+		}
+		defer listener.Close()
+	}
+
+	matches := knownLocationMatches("99999", "")
+	for path, class := range want {
+		if matches[path] != class {
+			t.Errorf("Expected %s to be found as %s, got %q", path, class, matches[path])
+		}
+	}
+}
+
+func TestKnownLocationsSecureEnclave(t *testing.T) {
+	home := t.TempDir()
+	secretive := filepath.Join(home, "Library", "Containers", "com.maxgoedjen.Secretive.SecretAgent", "Data", "socket.ssh")
+	want := map[string]string{
+		secretive: ClassEnclave,
+		filepath.Join(home, ".sekey", "ssh-agent.ssh"): ClassEnclave,
+	}
+	// The paths are too long for a unix socket here; discovery only
+	// needs them to exist
+	for path := range want {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeFile(t, path, "")
+	}
+
+	matches := knownLocationMatches("99999", home)
+	for path, class := range want {
+		if matches[path] != class {
+			t.Errorf("Expected %s to be found as %s, got %q", path, class, matches[path])
+		}
+	}
+}
+
+func TestKnownLocationsTeleport(t *testing.T) {
+	// Teleport nodes put forwarded agents in /tmp itself, not TMPDIR
+	dir, err := os.MkdirTemp("/tmp", "teleport-")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teleport-1234.socket")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer listener.Close()
+
+	if class := knownLocationMatches("99999", "")[path]; class != ClassTeleport {
+		t.Errorf("Expected %s to be found as %s, got %q", path, ClassTeleport, class)
+	}
+	if preferenceRank(SocketInfo{Path: path, Class: ClassTeleport}, nil) != 0 {
+		t.Error("Expected Teleport's forwarded agent to rank with forwarded agents by default")
+	}
+}
+
+// createSilentSocket returns the socket of an agent that reads requests
+// but never answers, like one waiting on a touch that never comes.
+func createSilentSocket(t *testing.T) string {
+	socketPath := filepath.Join(t.TempDir(), "silent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	// Connections are closed here rather than registered with t.Cleanup
+	// as they're accepted, which could happen after the test has finished
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			// Never answer
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+	return socketPath
+}
+
+func TestDiscoveryParallelTimeout(t *testing.T) {
+	var silent []string
+	for i := 0; i < 4; i++ {
+		silent = append(silent, createSilentSocket(t))
+	}
+	good := createMockAgent(t)
+
+	d := &Discovery{
+		Command:      "printf '%s\\n' " + strings.Join(append(silent, good), " "),
+		ProbeTimeout: 200 * time.Millisecond,
+		Timeout:      time.Second,
+	}
+	start := time.Now()
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("Expected silent sockets to be probed concurrently, took %s", elapsed)
+	}
+
+	for _, socket := range sockets {
+		switch {
+		case socket.Path == good && !socket.Valid:
+			t.Errorf("Expected %s to be valid: %s", socket.Path, socket.Reason)
+		case socket.Path != good && socket.Class == ClassCustom && (socket.Valid || socket.Reason == ""):
+			t.Errorf("Expected silent socket %s to be invalid with a reason", socket.Path)
+		}
+	}
+
+	// An overall deadline shorter than the probes cuts validation short
+	d.ProbeTimeout = 5 * time.Second
+	d.Timeout = 200 * time.Millisecond
+	start = time.Now()
+	if _, err := d.DiscoverSockets(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected overall deadline to bound discovery, took %s", elapsed)
+	}
+}
+
+func TestProbeReasons(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket file whose listener is gone, as left behind by a dead agent
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	silent := createSilentSocket(t)
+
+	d := &Discovery{
+		Command:      "printf '%s\\n' " + strings.Join([]string{stale, regular, silent}, " "),
+		ProbeTimeout: 200 * time.Millisecond,
+	}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+
+	want := map[string]string{
+		stale:   "connection refused",
+		regular: "not a socket",
+		silent:  "timeout",
+	}
+	for _, socket := range sockets {
+		prefix, ok := want[socket.Path]
+		if !ok {
+			continue
+		}
+		delete(want, socket.Path)
+		if socket.Valid || !strings.HasPrefix(socket.Reason, prefix) {
+			t.Errorf("Expected %s to be invalid with reason %q, got %q", socket.Path, prefix, socket.Reason)
+		}
+	}
+	for path := range want {
+		t.Errorf("Expected %s in discovery results", path)
+	}
+}
+
+func TestDiscoveryReportsOwnerAndLatency(t *testing.T) {
+	agentSocket := createMockAgent(t)
+
+	d := &Discovery{Command: "echo " + agentSocket}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path != agentSocket {
+			continue
+		}
+		if socket.Owner != strconv.Itoa(os.Getuid()) {
+			t.Errorf("Expected owner %d, got %q", os.Getuid(), socket.Owner)
+		}
+		if socket.Latency <= 0 {
+			t.Error("Expected probe latency to be recorded")
+		}
+		return
+	}
+	t.Errorf("Expected %s in discovery results", agentSocket)
+}
+
+func TestDiscoveryOnly(t *testing.T) {
+	included := createMockAgent(t)
+	other := createMockAgent(t)
+
+	d := &Discovery{
+		Command: "echo " + included + "; echo " + other,
+		Only:    []string{included},
+	}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("DiscoverSockets failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path != included && socket.Valid {
+			t.Errorf("Expected %s outside the upstream set to be skipped", socket.Path)
+		}
+	}
+
+	active, err := d.FindActiveSocket()
+	if err != nil {
+		t.Fatalf("FindActiveSocket failed: %v", err)
+	}
+	if active != included {
+		t.Errorf("Expected %s, got %s", included, active)
+	}
+
+	d.Only = []string{ClassGPGAgent}
+	if active, err := d.FindActiveSocket(); err == nil && (active == included || active == other) {
+		t.Errorf("Expected custom sockets to be excluded, got %s", active)
+	}
+}
+
+func TestDiscoveryUser(t *testing.T) {
+	agentSocket := createMockAgent(t)
+	current, err := user.Current()
+	if err != nil {
+		t.Fatalf("Failed to get current user: %v", err)
+	}
+	other := *current
+	other.Uid = "99999"
+	other.HomeDir = t.TempDir()
+
+	find := func(u *user.User) SocketInfo {
+		d := &Discovery{Command: "echo " + agentSocket, User: u}
+		sockets, err := d.DiscoverSockets()
+		if err != nil {
+			t.Fatalf("DiscoverSockets failed: %v", err)
+		}
+		for _, socket := range sockets {
+			if socket.Path == agentSocket {
+				return socket
+			}
+		}
+		t.Fatalf("Expected %s to be reported", agentSocket)
+		return SocketInfo{}
+	}
+
+	if socket := find(current); !socket.Valid {
+		t.Errorf("Expected the socket to be valid for its owner: %s", socket.Reason)
+	}
+	if socket := find(&other); socket.Valid || !strings.HasPrefix(socket.Reason, "wrong owner") {
+		t.Errorf("Expected the socket to be rejected for another user, got valid=%v reason=%q", socket.Valid, socket.Reason)
+	}
+}
+
+func TestDiscoveryIgnore(t *testing.T) {
+	ignored := createMockAgent(t)
+	kept := createMockAgent(t)
+
+	for _, entry := range []string{ignored, filepath.Dir(ignored), filepath.Dir(ignored) + "/*.sock"} {
+		d := &Discovery{
+			Command: "echo " + ignored + "; echo " + kept,
+			Only:    []string{ignored, kept},
+			Ignore:  []string{entry},
+		}
+		sockets, err := d.DiscoverSockets()
+		if err != nil {
+			t.Fatalf("DiscoverSockets failed: %v", err)
+		}
+		for _, socket := range sockets {
+			if socket.Path == ignored && (socket.Valid || !strings.Contains(socket.Reason, entry)) {
+				t.Errorf("Expected %s to be ignored by %s, got %+v", ignored, entry, socket)
+			}
+		}
+		if active, err := d.FindActiveSocket(); err != nil || active != kept {
+			t.Errorf("Ignoring %s: expected %s, got %s (%v)", entry, kept, active, err)
+		}
+	}
+}
+
+func TestDiscoverySkipEmpty(t *testing.T) {
+	loaded := createMockAgentWithKeys(t, 2)
+	time.Sleep(10 * time.Millisecond)
+	empty := createMockAgentWithKeys(t, 0)
+
+	d := &Discovery{Command: "echo " + loaded + "; echo " + empty, Only: []string{loaded, empty}}
+	if active, err := d.FindActiveSocket(); err != nil || active != empty {
+		t.Fatalf("Expected the newest socket %s by default, got %s (%v)", empty, active, err)
+	}
+
+	d.SkipEmpty = true
+	if active, err := d.FindActiveSocket(); err != nil || active != loaded {
+		t.Errorf("Expected the agent with keys %s, got %s (%v)", loaded, active, err)
+	}
+	if primary, standby, err := d.FindUpstreams(); err != nil || primary != loaded || standby != empty {
+		t.Errorf("Expected %s with standby %s, got %s and %s (%v)", loaded, empty, primary, standby, err)
+	}
+
+	d.Only = []string{empty}
+	if active, err := d.FindActiveSocket(); err != nil || active != empty {
+		t.Errorf("Expected the empty agent when it's the only one, got %s (%v)", active, err)
+	}
+}
+
+func TestDiscoveryExpectKeys(t *testing.T) {
+	trusted, _ := startKeyringAgent(t, "trusted")
+	time.Sleep(10 * time.Millisecond)
+	stranger, _ := startKeyringAgent(t, "stranger")
+
+	identities, err := ListIdentities(trusted)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one key in the trusted agent, got %v (%v)", identities, err)
+	}
+
+	d := &Discovery{
+		Command:    "echo " + trusted + "; echo " + stranger,
+		Only:       []string{trusted, stranger},
+		ExpectKeys: []string{identities[0].Fingerprint()},
+	}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("DiscoverSockets failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path == stranger && (socket.Valid || !strings.Contains(socket.Reason, "unexpected agent")) {
+			t.Errorf("Expected the agent without an expected key to be invalid, got %+v", socket)
+		}
+	}
+	if active, err := d.FindActiveSocket(); err != nil || active != trusted {
+		t.Errorf("Expected %s, got %s (%v)", trusted, active, err)
+	}
+
+	d.ExpectKeys = []string{"SHA256:nothing"}
+	if active, err := d.FindActiveSocket(); err == nil {
+		t.Errorf("Expected no agent to hold an unknown key, got %s", active)
+	}
+}
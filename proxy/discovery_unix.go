@@ -0,0 +1,30 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ownedByUser reports whether the file described by info belongs to uid
+func ownedByUser(info os.FileInfo, uid string) bool {
+	owner, ok := fileOwner(info)
+	return ok && owner == uid
+}
+
+// fileOwner returns the numeric owner of the file described by info
+func fileOwner(info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(stat.Uid), 10), true
+}
+
+// platformSockets returns agents found outside the /tmp scan. Unix agents
+// are all plain sockets, so there's nothing extra to report.
+func platformSockets() []SocketInfo {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package proxy
+
+import (
+	"os"
+	"time"
+)
+
+// ownedByUser reports whether the file described by info belongs to uid.
+// Windows has no numeric owner on the stat result and per-user temp
+// directories already isolate agent sockets, so every socket qualifies.
+func ownedByUser(info os.FileInfo, uid string) bool {
+	return true
+}
+
+// fileOwner is unavailable on Windows, see ownedByUser.
+func fileOwner(info os.FileInfo) (string, bool) {
+	return "", false
+}
+
+// platformSockets reports a running Pageant as a discoverable upstream.
+func platformSockets() []SocketInfo {
+	if !pageantRunning() {
+		return nil
+	}
+	return []SocketInfo{{
+		Path:    PageantAddress,
+		Class:   ClassPageant,
+		ModTime: time.Now(),
+	}}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds returned by the proxy package. Errors wrap them, so callers
+// should match with errors.Is rather than comparing directly.
+var (
+	// ErrNoActiveAgent means no usable upstream agent socket was found.
+	ErrNoActiveAgent = errors.New("no active SSH agent socket found")
+
+	// ErrUpstreamDial means connecting to an agent (or proxy) socket failed.
+	ErrUpstreamDial = errors.New("failed to connect to agent socket")
+
+	// ErrUpstreamTimeout means the upstream agent didn't answer a request
+	// within the deadline set with WithUpstreamTimeout.
+	ErrUpstreamTimeout = errors.New("upstream agent did not answer in time")
+
+	// ErrProtocol means a peer answered with a malformed or unexpected
+	// agent protocol message.
+	ErrProtocol = errors.New("agent protocol error")
+)
+
+// ErrUnhealthy is returned by HealthCheck when the proxy is reachable but
+// can't serve requests. Reason describes what went wrong; Err, when set, is
+// the underlying cause.
+type ErrUnhealthy struct {
+	Reason string
+	Err    error
+}
+
+func (e *ErrUnhealthy) Error() string {
+	return e.Reason
+}
+
+func (e *ErrUnhealthy) Unwrap() error {
+	return e.Err
+}
+
+// kindError tags a descriptive error with one of the error kinds above, so
+// errors.Is matches the kind while the message stays specific.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// errorOfKind formats an error like fmt.Errorf and tags it with kind.
+func errorOfKind(kind error, format string, args ...any) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
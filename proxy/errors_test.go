@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheckErrorKinds(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	err := HealthCheck(filepath.Join(t.TempDir(), "missing.sock"), logger)
+	if !errors.Is(err, ErrUpstreamDial) {
+		t.Errorf("Expected ErrUpstreamDial for a missing socket, got %v", err)
+	}
+
+	err = HealthCheck(createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}), logger)
+	var unhealthy *ErrUnhealthy
+	if !errors.As(err, &unhealthy) || !errors.Is(err, ErrNoActiveAgent) {
+		t.Errorf("Expected ErrUnhealthy wrapping ErrNoActiveAgent, got %v", err)
+	}
+
+	err = HealthCheck(createRespondingAgent(t, []byte{0, 0, 0, 1, 99}), logger)
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected ErrProtocol for an unknown response type, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "unknown type tag 99") {
+		t.Errorf("Expected the message to name the response type, got %q", err.Error())
+	}
+}
+
+func TestFindActiveSocketNoAgent(t *testing.T) {
+	d := &Discovery{Strategy: "pinned:" + filepath.Join(t.TempDir(), "missing.sock")}
+	if _, err := d.FindActiveSocket(); !errors.Is(err, ErrNoActiveAgent) {
+		t.Errorf("Expected ErrNoActiveAgent for an unusable pin, got %v", err)
+	}
+
+	if _, err := d.selectSocket([]SocketInfo{{Path: "/tmp/stale", Reason: "stale"}}); !errors.Is(err, ErrNoActiveAgent) {
+		t.Errorf("Expected ErrNoActiveAgent with no valid sockets, got %v", err)
+	}
+}
+
+func TestListIdentitiesProtocolError(t *testing.T) {
+	socket := createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_IDENTITIES_ANSWER})
+	if _, err := ListIdentities(socket); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected ErrProtocol for a truncated answer, got %v", err)
+	}
+}
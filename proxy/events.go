@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRecentEvents is how many failovers and connection errors Status keeps.
+const maxRecentEvents = 20
+
+// Failover is a switch from one upstream agent to another.
+type Failover struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// ConnError is a client connection that ended in an error.
+type ConnError struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Error    string    `json:"error"`
+}
+
+// recentEvents keeps the latest failovers and connection errors, oldest
+// first, dropping the oldest past maxRecentEvents.
+type recentEvents struct {
+	mu           sync.Mutex
+	lastUpstream string
+	failovers    []Failover
+	errors       []ConnError
+}
+
+// upstreamFound records the socket discovery picked, noting a failover
+// when it replaces a different one. The cache is cleared between the two,
+// so the previous upstream is remembered here rather than read from it.
+func (r *recentEvents) upstreamFound(socket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastUpstream != "" && socket != r.lastUpstream {
+		r.failovers = appendRecent(r.failovers, Failover{Time: time.Now(), From: r.lastUpstream, To: socket})
+	}
+	r.lastUpstream = socket
+}
+
+func (r *recentEvents) connFailed(stats *connStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = appendRecent(r.errors, ConnError{
+		Time:     time.Now(),
+		Client:   stats.client,
+		Upstream: stats.upstream,
+		Error:    stats.err.Error(),
+	})
+}
+
+// snapshot returns copies of the recorded events.
+func (r *recentEvents) snapshot() ([]Failover, []ConnError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Failover(nil), r.failovers...), append([]ConnError(nil), r.errors...)
+}
+
+func appendRecent[T any](events []T, event T) []T {
+	if len(events) >= maxRecentEvents {
+		events = append(events[:0], events[len(events)-maxRecentEvents+1:]...)
+	}
+	return append(events, event)
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"log/slog"
+	"slices"
+)
+
+// Agent extensions the proxy knows how to treat
+const (
+	ExtensionSessionBind = "session-bind@openssh.com"
+	ExtensionQuery       = "query"
+)
+
+// safeExtensions only inform the agent or describe it, so they're always
+// forwarded.
+var safeExtensions = []string{ExtensionSessionBind, ExtensionQuery}
+
+// ExtensionPolicy decides which SSH_AGENTC_EXTENSION requests reach the
+// upstream agent. Refused extensions get SSH_AGENT_FAILURE, as from an
+// agent that doesn't support them.
+type ExtensionPolicy struct {
+	// BlockUnknown refuses extensions that are neither known to be safe
+	// nor listed in Allow.
+	BlockUnknown bool
+
+	// Allow lists extension names to forward alongside the safe ones.
+	Allow []string
+}
+
+func (p ExtensionPolicy) enabled() bool {
+	return p.BlockUnknown
+}
+
+// allows reports whether the extension called name may be forwarded.
+func (p ExtensionPolicy) allows(name string) bool {
+	return !p.BlockUnknown || slices.Contains(safeExtensions, name) || slices.Contains(p.Allow, name)
+}
+
+// middleware refuses extension requests the policy doesn't allow.
+func (p ExtensionPolicy) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			if req.Type() != SSH_AGENTC_EXTENSION {
+				return next(req)
+			}
+			name, ok := extensionName(req.Message)
+			if !ok {
+				return failure(), nil
+			}
+			if !p.allows(name) {
+				logger.Warn("Blocked agent extension", "client", req.Session.Client, "extension", name)
+				return failure(), nil
+			}
+			logger.Debug("Forwarding agent extension", "client", req.Session.Client, "extension", name)
+			return next(req)
+		}
+	}
+}
+
+// extensionName returns the name an SSH_AGENTC_EXTENSION request starts
+// with.
+func extensionName(request []byte) (string, bool) {
+	name, _, ok := readWireString(request[1:])
+	return string(name), ok
+}
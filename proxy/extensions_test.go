@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExtensionPolicyAllows(t *testing.T) {
+	tests := []struct {
+		policy ExtensionPolicy
+		name   string
+		want   bool
+	}{
+		{ExtensionPolicy{}, "anything@example.com", true},
+		{ExtensionPolicy{BlockUnknown: true}, ExtensionSessionBind, true},
+		{ExtensionPolicy{BlockUnknown: true}, "anything@example.com", false},
+		{ExtensionPolicy{BlockUnknown: true, Allow: []string{"anything@example.com"}}, "anything@example.com", true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.allows(tt.name); got != tt.want {
+			t.Errorf("%+v allows(%q) = %v, want %v", tt.policy, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtensionPassthrough(t *testing.T) {
+	agentSocket := createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_SUCCESS})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithExtensionPolicy(ExtensionPolicy{BlockUnknown: true}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	extension := func(name string) byte {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		request := appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte(name))
+		if err := writeMessage(conn, request); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		response, err := readMessage(conn, maxAgentMessage)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return response[0]
+	}
+
+	if got := extension(ExtensionSessionBind); got != SSH_AGENT_SUCCESS {
+		t.Errorf("Expected session-bind to reach the upstream, got response type %d", got)
+	}
+	if got := extension("unknown@example.com"); got != SSH_AGENT_FAILURE {
+		t.Errorf("Expected an unknown extension to be blocked, got response type %d", got)
+	}
+}
@@ -1,73 +1,216 @@
 package proxy
 
 import (
-	"encoding/binary"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-// HealthCheck performs a health check on the proxy socket
+// DefaultHealthTimeout bounds each health check attempt.
+const DefaultHealthTimeout = 2 * time.Second
+
+// healthRetryDelay is the pause before the single retry of a failed check,
+// long enough for a proxy that was just restarted to start listening.
+const healthRetryDelay = 100 * time.Millisecond
+
+// HealthOptions tunes CheckHealth.
+type HealthOptions struct {
+	// Timeout bounds each attempt; zero means DefaultHealthTimeout
+	Timeout time.Duration
+
+	// Sign also has the first listed key sign a random challenge, which is
+	// verified locally. Signing may wait on a PIN or a security key touch,
+	// so it gets signRequestTimeout rather than Timeout.
+	Sign bool
+}
+
+// HealthReport describes a proxy that passed a health check.
+type HealthReport struct {
+	Keys    int           // identities the proxy listed
+	Signed  bool          // a test signature was made and verified
+	Latency time.Duration // of the attempt that passed
+}
+
+// HealthCheck performs a health check on the proxy socket. Errors match
+// ErrUpstreamDial if the proxy can't be reached, ErrProtocol for a garbled
+// answer, and *ErrUnhealthy otherwise; a proxy with no upstream agent also
+// matches ErrNoActiveAgent.
 func HealthCheck(socketPath string, logger *slog.Logger) error {
-	// Try to connect to the socket
-	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	return HealthCheckWithTimeout(socketPath, DefaultHealthTimeout, logger)
+}
+
+// HealthCheckWithTimeout is HealthCheck with a per-attempt timeout. A
+// failed check is retried once, so a single dropped or slow request doesn't
+// report a working proxy as down.
+func HealthCheckWithTimeout(socketPath string, timeout time.Duration, logger *slog.Logger) error {
+	_, err := CheckHealth(socketPath, HealthOptions{Timeout: timeout}, logger)
+	return err
+}
+
+// CheckHealth is HealthCheckWithTimeout with options, reporting what the
+// check found.
+func CheckHealth(socketPath string, opts HealthOptions, logger *slog.Logger) (HealthReport, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHealthTimeout
+	}
+	report, err := healthCheckOnce(socketPath, opts)
+	if err == nil || errors.Is(err, ErrProtocol) {
+		return report, err
+	}
+	logger.Debug("Health check failed, retrying", "error", err)
+	time.Sleep(healthRetryDelay)
+	return healthCheckOnce(socketPath, opts)
+}
+
+func healthCheckOnce(socketPath string, opts HealthOptions) (HealthReport, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("unix", socketPath, opts.Timeout)
 	if err != nil {
-		return fmt.Errorf("failed to connect to proxy socket: %v", err)
+		return HealthReport{}, errorOfKind(ErrUpstreamDial, "failed to connect to proxy socket: %w", err)
 	}
 	defer func() { _ = conn.Close() }()
+	ioConn := &ioErrConn{Conn: conn}
+	client := agent.NewClient(ioConn)
 
-	// Send SSH_AGENTC_REQUEST_IDENTITIES request
-	request := []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}
-	if _, err := conn.Write(request); err != nil {
-		return fmt.Errorf("failed to send health check request: %v", err)
+	_ = conn.SetDeadline(time.Now().Add(opts.Timeout))
+	keys, err := client.List()
+	if err != nil {
+		// The proxy answers SSH_AGENT_FAILURE when it has no upstream agent
+		return HealthReport{}, healthError(ioConn, err,
+			"proxy is running but no active SSH agent found", ErrNoActiveAgent)
 	}
+	report := HealthReport{Keys: len(keys)}
 
-	// Set read timeout
-	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if opts.Sign && len(keys) > 0 {
+		_ = conn.SetDeadline(time.Now().Add(signRequestTimeout))
+		if err := signChallenge(ioConn, client, keys[0]); err != nil {
+			return HealthReport{}, err
+		}
+		report.Signed = true
+	}
+	report.Latency = time.Since(start)
+	return report, nil
+}
 
-	// Read response header (4 bytes for length)
-	header := make([]byte, 4)
-	if _, err := conn.Read(header); err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
+// signChallenge has key sign a random challenge through client, which talks
+// over conn, and verifies the signature.
+func signChallenge(conn *ioErrConn, client agent.ExtendedAgent, key *agent.Key) error {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return fmt.Errorf("failed to generate challenge: %w", err)
 	}
+	var flags agent.SignatureFlags
+	if key.Type() == ssh.KeyAlgoRSA {
+		flags = agent.SignatureFlagRsaSha256
+	}
+	signature, err := client.SignWithFlags(key, challenge, flags)
+	if err != nil {
+		return healthError(conn, err, "agent refused to sign with "+key.Comment, nil)
+	}
+	if err := key.Verify(challenge, signature); err != nil {
+		return &ErrUnhealthy{Reason: "signature did not verify: " + err.Error(), Err: err}
+	}
+	return nil
+}
+
+// ioErrConn remembers the last read or write error on its connection, and
+// the start of the latest reply. The agent client reports errors only as
+// text, and this is how a health check tells a dropped or slow connection,
+// worth a retry, from a refusal or a bad reply.
+type ioErrConn struct {
+	net.Conn
+	err error
+
+	// reply holds the length prefix and type of the reply to the latest
+	// request, as far as they've been read
+	reply []byte
+}
 
-	// Parse response length
-	respLen := binary.BigEndian.Uint32(header)
-	if respLen > 1024*1024 { // Sanity check: response shouldn't be larger than 1MB
-		return fmt.Errorf("invalid response length: %d", respLen)
+func (c *ioErrConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.err = err
+	}
+	if missing := 5 - len(c.reply); missing > 0 {
+		c.reply = append(c.reply, p[:min(n, missing)]...)
 	}
+	return n, err
+}
 
-	// Read response body
-	response := make([]byte, respLen)
-	if _, err := conn.Read(response); err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+func (c *ioErrConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.err = err
 	}
+	c.reply = c.reply[:0]
+	return n, err
+}
 
-	// Check if we got a valid response type
-	if len(response) > 0 {
-		responseType := response[0]
-		switch responseType {
-		case SSH_AGENT_IDENTITIES_ANSWER:
-			// Success - the proxy forwarded our request and got a valid response
-			return nil
-		case SSH_AGENT_FAILURE:
-			// The proxy is working but no agent is available
-			return fmt.Errorf("proxy is running but no active SSH agent found")
-		default:
-			return fmt.Errorf("unexpected response type: %d", responseType)
+// replyType returns the message type of the latest reply, or 0 if none
+// was read.
+func (c *ioErrConn) replyType() byte {
+	if len(c.reply) < 5 {
+		return 0
+	}
+	return c.reply[4]
+}
+
+// healthError sorts an error from the agent client talking over conn into
+// the kinds HealthCheck documents. A reply of SSH_AGENT_FAILURE is
+// reported as reason wrapping cause.
+func healthError(conn *ioErrConn, err error, reason string, cause error) error {
+	switch {
+	case conn.err != nil:
+		return &ErrUnhealthy{Reason: err.Error(), Err: conn.err}
+	case conn.replyType() == SSH_AGENT_FAILURE:
+		if cause == nil {
+			cause = err
 		}
+		return &ErrUnhealthy{Reason: reason, Err: cause}
 	}
+	return errorOfKind(ErrProtocol, "unexpected response: %w", err)
+}
+
+// HealthState is a proxy's condition as a health check sees it, and what to
+// do about it.
+type HealthState string
 
-	return fmt.Errorf("empty response from proxy")
+const (
+	// Healthy means the proxy answered with keys from an upstream agent.
+	Healthy HealthState = "healthy"
+
+	// DegradedNoUpstream means the proxy is running but found no upstream
+	// agent. Restarting it won't help; reattaching an SSH session with
+	// agent forwarding, or starting a local agent, will.
+	DegradedNoUpstream HealthState = "degraded"
+
+	// Down means the proxy can't be reached or can't serve requests, and
+	// needs restarting.
+	Down HealthState = "down"
+)
+
+// HealthStatus is the outcome of Health.
+type HealthStatus struct {
+	State  HealthState
+	Report HealthReport // what a passing check found
+	Err    error        // why State isn't Healthy
 }
 
-// IsHealthy checks if the proxy is healthy (convenience wrapper)
-func IsHealthy(socketPath string, logger *slog.Logger) bool {
-	err := HealthCheck(socketPath, logger)
-	if err != nil {
-		logger.Debug("Health check failed", "error", err)
-		return false
+// Health checks the proxy as CheckHealth does and sorts the result into a
+// HealthState.
+func Health(socketPath string, opts HealthOptions, logger *slog.Logger) HealthStatus {
+	report, err := CheckHealth(socketPath, opts, logger)
+	switch {
+	case err == nil:
+		return HealthStatus{State: Healthy, Report: report}
+	case errors.Is(err, ErrNoActiveAgent):
+		return HealthStatus{State: DegradedNoUpstream, Err: err}
 	}
-	return true
+	return HealthStatus{State: Down, Err: err}
 }
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckShortReads(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		// Dribble the answer out so no single read sees all of it
+		for _, b := range []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0} {
+			_, _ = conn.Write([]byte{b})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := HealthCheck(socketPath, logger); err != nil {
+		t.Errorf("Expected a split response to pass, got %v", err)
+	}
+}
+
+func TestHealthCheckRetriesOnce(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var attempts atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Drop the first connection without answering
+			if attempts.Add(1) == 1 {
+				conn.Close()
+				continue
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				_, _ = conn.Write([]byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0})
+			}
+			conn.Close()
+		}
+	}()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := HealthCheckWithTimeout(socketPath, time.Second, logger); err != nil {
+		t.Errorf("Expected the retry to succeed, got %v", err)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+}
+
+func TestCheckHealthReport(t *testing.T) {
+	socket, _ := startKeyringAgent(t, "health")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := CheckHealth(socket, HealthOptions{}, logger)
+	if err != nil {
+		t.Fatalf("CheckHealth failed: %v", err)
+	}
+	if report.Keys != 1 || report.Signed {
+		t.Errorf("Expected 1 key and no signature, got %+v", report)
+	}
+
+	report, err = CheckHealth(socket, HealthOptions{Sign: true}, logger)
+	if err != nil {
+		t.Fatalf("CheckHealth with Sign failed: %v", err)
+	}
+	if report.Keys != 1 || !report.Signed {
+		t.Errorf("Expected 1 key and a verified signature, got %+v", report)
+	}
+}
+
+func TestHealthStates(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	socket, _ := startKeyringAgent(t, "health")
+
+	tests := []struct {
+		name   string
+		socket string
+		want   HealthState
+	}{
+		{"serving keys", socket, Healthy},
+		{"no upstream", createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}), DegradedNoUpstream},
+		{"not listening", filepath.Join(t.TempDir(), "missing.sock"), Down},
+		{"garbled", createRespondingAgent(t, []byte{0, 0, 0, 1, 99}), Down},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := Health(tt.socket, HealthOptions{}, logger)
+			if status.State != tt.want {
+				t.Errorf("Expected %s, got %s (%v)", tt.want, status.State, status.Err)
+			}
+			if (status.Err == nil) != (tt.want == Healthy) {
+				t.Errorf("Expected an error only when not healthy, got %v", status.Err)
+			}
+		})
+	}
+}
+
+func TestHealthErrorFromReply(t *testing.T) {
+	// The agent client's wording doesn't matter, only what the proxy sent
+	reworded := errors.New("agent: some other wording")
+
+	refused := &ioErrConn{reply: []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}}
+	if err := healthError(refused, reworded, "no upstream", ErrNoActiveAgent); !errors.Is(err, ErrNoActiveAgent) {
+		t.Errorf("Expected a failure reply to mean no upstream, got %v", err)
+	}
+
+	garbled := &ioErrConn{reply: []byte{0, 0, 0, 1, 99}}
+	if err := healthError(garbled, reworded, "no upstream", ErrNoActiveAgent); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected an unexpected reply to be a protocol error, got %v", err)
+	}
+}
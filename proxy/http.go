@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// readyProbeInterval is how long a successful probe of the upstream counts
+// toward readiness before Ready probes again.
+const readyProbeInterval = 10 * time.Second
+
+// Readiness is whether the proxy can serve agent requests right now.
+type Readiness struct {
+	Ready     bool      `json:"ready"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LastProbe time.Time `json:"last_probe,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Live reports whether the proxy is accepting connections on at least one
+// listener.
+func (ap *AgentProxy) Live() bool {
+	ap.serveMu.Lock()
+	defer ap.serveMu.Unlock()
+	return !ap.shutdown && len(ap.listeners) > 0
+}
+
+// Ready reports whether the proxy has an upstream agent that answered a
+// probe within readyProbeInterval. When the last probe is older, it probes
+// the active socket again, and runs discovery if there's none or it has
+// stopped answering.
+func (ap *AgentProxy) Ready() Readiness {
+	ap.mu.RLock()
+	socket, pinned := ap.activeSocket, ap.pinned
+	lastProbe := ap.lastProbe
+	if ap.lastCheck.After(lastProbe) {
+		lastProbe = ap.lastCheck
+	}
+	ap.mu.RUnlock()
+
+	if socket != "" {
+		if time.Since(lastProbe) < readyProbeInterval {
+			return Readiness{Ready: true, Upstream: socket, LastProbe: lastProbe}
+		}
+		conn, reason := ap.validatedConn(socket)
+		if conn != nil {
+			_ = conn.Close()
+			now := time.Now()
+			ap.mu.Lock()
+			ap.lastProbe = now
+			ap.mu.Unlock()
+			return Readiness{Ready: true, Upstream: socket, LastProbe: now}
+		}
+		if pinned != "" {
+			return Readiness{Upstream: socket, LastProbe: lastProbe, Reason: "pinned upstream did not answer: " + reason}
+		}
+		ap.logger.Debug("Active socket failed readiness probe, rediscovering",
+			"socket", socket, "reason", reason)
+		ap.InvalidateCache()
+	}
+
+	// Discovery only settles on sockets that answer
+	socket = ap.FindActiveSocketCached()
+	if socket == "" {
+		return Readiness{Reason: "no upstream agent found"}
+	}
+	ap.mu.RLock()
+	lastProbe = ap.lastCheck
+	ap.mu.RUnlock()
+	return Readiness{Ready: true, Upstream: socket, LastProbe: lastProbe}
+}
+
+// NewHTTPHandler serves the proxy's HTTP endpoints: /livez answers 200
+// while the proxy is accepting connections, and /readyz while it also has
+// an upstream agent that answers (see Ready). Both answer 503 otherwise.
+// The root is a status page for people.
+func NewHTTPHandler(ap *AgentProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		page := statusPage{Status: ap.Status()}
+		if page.ActiveSocket != "" {
+			page.Keys, page.KeysErr = ListIdentities(page.ActiveSocket)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, page); err != nil {
+			ap.logger.Debug("Failed to render status page", "error", err)
+		}
+	})
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		if !ap.Live() {
+			http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		readiness := ap.Ready()
+		code := http.StatusOK
+		if !readiness.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, readiness)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// statusPage is what the status page template renders.
+type statusPage struct {
+	Status
+	Keys    []Identity
+	KeysErr error
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>double-agent</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+td.mono, code { font-family: ui-monospace, monospace; font-size: 0.9em; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>double-agent</h1>
+<table>
+<tr><th>Proxy socket</th><td class="mono">{{.ProxySocket}}</td></tr>
+<tr><th>Upstream</th><td class="mono">{{with .ActiveSocket}}{{.}}{{else}}<span class="bad">none</span>{{end}}{{with .Pinned}} (pinned){{end}}</td></tr>
+{{- with .Standby}}
+<tr><th>Standby</th><td class="mono">{{.}}</td></tr>
+{{- end}}
+<tr><th>Last discovery</th><td>{{ago .LastCheck}}</td></tr>
+<tr><th>Active connections</th><td>{{.ActiveConnections}}</td></tr>
+<tr><th>Connections served</th><td>{{.Metrics.Connections}}</td></tr>
+{{- with .Metrics.Requests}}
+<tr><th>Requests</th><td>{{range $kind, $n := .}}{{$kind}} {{$n}}<br>{{end}}</td></tr>
+{{- end}}
+<tr><th>Handlers / upstream connections</th><td>{{.Resources.Handlers}} / {{.Resources.UpstreamConns}}</td></tr>
+<tr><th>Goroutines / open files</th><td>{{.Resources.Goroutines}} / {{with .Resources.OpenFiles}}{{.}}{{else}}unknown{{end}}</td></tr>
+<tr><th>Started</th><td>{{ago .Started}}</td></tr>
+</table>
+
+<h2>Keys</h2>
+{{- if .KeysErr}}
+<p class="bad">Failed to list keys: {{.KeysErr}}</p>
+{{- else if .Keys}}
+<table>
+{{- range .Keys}}
+<tr><td>{{.Type}}</td><td class="mono">{{.Fingerprint}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No keys.</p>
+{{- end}}
+
+<h2>Recent failovers</h2>
+{{- if .RecentFailovers}}
+<table>
+<tr><th>When</th><th>From</th><th>To</th></tr>
+{{- range .RecentFailovers}}
+<tr><td>{{ago .Time}}</td><td class="mono">{{.From}}</td><td class="mono">{{.To}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>None.</p>
+{{- end}}
+
+<h2>Recent errors</h2>
+{{- if .RecentErrors}}
+<table>
+<tr><th>When</th><th>Client</th><th>Upstream</th><th>Error</th></tr>
+{{- range .RecentErrors}}
+<tr><td>{{ago .Time}}</td><td class="mono">{{.Client}}</td><td class="mono">{{.Upstream}}</td><td>{{.Error}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>None.</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getReadiness(t *testing.T, server *httptest.Server) (int, Readiness) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("GET /readyz failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var readiness Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		t.Fatalf("Failed to decode /readyz: %v", err)
+	}
+	return resp.StatusCode, readiness
+}
+
+func TestLivez(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", WithLogger(logger))
+	server := httptest.NewServer(NewHTTPHandler(ap))
+	defer server.Close()
+
+	livez := func() int {
+		resp, err := http.Get(server.URL + "/livez")
+		if err != nil {
+			t.Fatalf("GET /livez failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := livez(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before serving, got %d", code)
+	}
+	serveProxy(t, ap)
+	waitFor(t, "the proxy to listen", ap.Live)
+	if code := livez(); code != http.StatusOK {
+		t.Errorf("Expected 200 while serving, got %d", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	upstream, kill := startKeyringAgent(t, "ready")
+	var found string
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNegativeCacheTTL(0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			if found == "" {
+				return "", ErrNoActiveAgent
+			}
+			return found, nil
+		})))
+	server := httptest.NewServer(NewHTTPHandler(ap))
+	defer server.Close()
+
+	if code, readiness := getReadiness(t, server); code != http.StatusServiceUnavailable || readiness.Ready {
+		t.Errorf("Expected 503 with no upstream, got %d %+v", code, readiness)
+	}
+
+	found = upstream
+	code, readiness := getReadiness(t, server)
+	if code != http.StatusOK || readiness.Upstream != upstream {
+		t.Errorf("Expected 200 with upstream %s, got %d %+v", upstream, code, readiness)
+	}
+
+	// Once the last probe is stale, a dead upstream is noticed
+	kill()
+	found = ""
+	ap.mu.Lock()
+	ap.lastCheck = time.Now().Add(-readyProbeInterval)
+	ap.mu.Unlock()
+	code, readiness = getReadiness(t, server)
+	if code != http.StatusServiceUnavailable || readiness.Ready {
+		t.Errorf("Expected 503 after the upstream died, got %d %+v", code, readiness)
+	}
+	if ap.Status().ActiveSocket != "" {
+		t.Errorf("Expected the dead upstream to be dropped from the cache")
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	first, _ := startKeyringAgent(t, "first@example.com")
+	second, _ := startKeyringAgent(t, "second@example.com")
+
+	var mu sync.Mutex
+	upstream := first
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNegativeCacheTTL(0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if upstream == "" {
+				return "", ErrNoActiveAgent
+			}
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+	setUpstream := func(socket string) {
+		mu.Lock()
+		upstream = socket
+		mu.Unlock()
+		ap.InvalidateCache()
+	}
+
+	// Fail over from first to second, then lose both
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	setUpstream(second)
+	identities, err := ListIdentities(proxySocket)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	setUpstream("")
+	_, _ = ListIdentities(proxySocket)
+	waitFor(t, "the failed connection", func() bool { return len(ap.Status().RecentErrors) == 1 })
+
+	status := ap.Status()
+	if len(status.RecentFailovers) != 1 || status.RecentFailovers[0].From != first || status.RecentFailovers[0].To != second {
+		t.Errorf("Expected one failover from %s to %s, got %+v", first, second, status.RecentFailovers)
+	}
+
+	setUpstream(second)
+	ap.FindActiveSocketCached()
+	server := httptest.NewServer(NewHTTPHandler(ap))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET / failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	page := html.UnescapeString(string(body))
+
+	for _, want := range []string{second, identities[0].Fingerprint(), first, ErrNoActiveAgent.Error()} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected the status page to show %q", want)
+		}
+	}
+	if strings.Contains(page, "second@example.com") {
+		t.Error("Expected the status page to leave out key comments")
+	}
+}
+
+func TestRecentEventsBounded(t *testing.T) {
+	var r recentEvents
+	for i := range maxRecentEvents + 5 {
+		r.upstreamFound(string(rune('a' + i%2)))
+	}
+	failovers, _ := r.snapshot()
+	if len(failovers) != maxRecentEvents {
+		t.Fatalf("Expected %d failovers kept, got %d", maxRecentEvents, len(failovers))
+	}
+}
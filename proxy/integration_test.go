@@ -189,9 +189,9 @@ func TestProxyHealthCheck(t *testing.T) {
 		t.Errorf("Health check failed: %v", err)
 	}
 	
-	// Test IsHealthy wrapper
-	if !IsHealthy(proxySocket, logger) {
-		t.Error("IsHealthy returned false for healthy proxy")
+	// Test the typed status
+	if status := Health(proxySocket, HealthOptions{}, logger); status.State != Healthy {
+		t.Errorf("Health reported %s for healthy proxy: %v", status.State, status.Err)
 	}
 	
 	// Test health check on non-existent socket
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// KeyPolicy limits which upstream keys clients of a proxy see and how they
+// may use them, such as a socket mounted into containers that exposes only
+// a deploy key.
+type KeyPolicy struct {
+	// Keys lists the fingerprints (SHA256:...) or comments of the keys
+	// clients may list and sign with. Empty allows every key. Certificates
+	// from WithCertificateFiles follow the key they certify.
+	Keys []string
+
+	// Confirm, when set, is asked before every signature and the request
+	// is refused unless it returns true. It runs on the request path, so
+	// the client waits while it prompts.
+	Confirm func(key Identity, client string) bool
+
+	// Hosts narrows Keys for connections bound to particular hosts with
+	// session-bind@openssh.com, so that, say, github.com never learns of
+	// a work key. The first rule matching one of the host's names in
+	// KnownHosts applies. Connections to other hosts, and clients that
+	// never bind, see every key Keys allows.
+	Hosts []HostKeys
+
+	// KnownHosts are known_hosts files naming the hosts bound to
+	KnownHosts []string
+}
+
+// HostKeys is a KeyPolicy rule limiting the keys a host sees.
+type HostKeys struct {
+	// Pattern matches host names, with * and ? wildcards
+	Pattern string
+
+	// Keys lists fingerprints or comments, as KeyPolicy.Keys does
+	Keys []string
+}
+
+// restricted reports whether some keys are hidden from a connection held
+// to hostKeys.
+func (p *KeyPolicy) restricted(hostKeys []string) bool {
+	return len(p.Keys) > 0 || len(hostKeys) > 0
+}
+
+// allows reports whether id is one of the policy's keys and, when the
+// connection's host has a rule, one of its hostKeys. Comments are compared
+// without the tag WithOriginTags adds for upstream.
+func (p *KeyPolicy) allows(id Identity, upstream string, hostKeys []string) bool {
+	return keyListed(p.Keys, id, upstream) && keyListed(hostKeys, id, upstream)
+}
+
+// keyListed reports whether id is named in keys, which when empty names
+// every key.
+func keyListed(keys []string, id Identity, upstream string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	fingerprint := id.Fingerprint()
+	comment := id.Comment
+	if tag := originTag(upstream); comment == tag {
+		comment = ""
+	} else {
+		comment = strings.TrimSuffix(comment, " "+tag)
+	}
+	for _, key := range keys {
+		if key == fingerprint || (comment != "" && key == comment) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostKeys returns the keys of the first Hosts rule matching the host
+// bound with hostKey, or nil if no rule does.
+func (p *KeyPolicy) hostKeys(hostKey []byte) []string {
+	if len(p.Hosts) == 0 || hostKey == nil {
+		return nil
+	}
+	names := knownHostNames(p.KnownHosts, hostKey)
+	for _, rule := range p.Hosts {
+		for _, name := range names {
+			if name.matches(rule.Pattern) {
+				return rule.Keys
+			}
+		}
+	}
+	return nil
+}
+
+// middleware hides keys outside the policy, refuses to sign with them or
+// remove them, and asks Confirm before signing with the rest.
+func (p *KeyPolicy) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			hostKeys := p.hostKeys(req.Session.HostKey)
+			switch req.Type() {
+			case SSH_AGENTC_EXTENSION:
+				if len(p.Hosts) == 0 {
+					break
+				}
+				if name, _ := extensionName(req.Message); name == ExtensionSessionBind {
+					hostKey, err := parseSessionBind(req.Message)
+					if err != nil {
+						logger.Warn("Rejecting session-bind", "client", req.Session.Client, "error", err)
+						return failure(), nil
+					}
+					req.Session.HostKey = hostKey
+				}
+
+			case SSH_AGENTC_REQUEST_IDENTITIES:
+				response, err := next(req)
+				if err != nil || !p.restricted(hostKeys) || responseType(response) != SSH_AGENT_IDENTITIES_ANSWER {
+					return response, err
+				}
+				identities, err := parseIdentities(response)
+				if err != nil {
+					return failure(), nil
+				}
+				var allowed []Identity
+				for _, id := range identities {
+					if p.allows(id, req.Session.Upstream, hostKeys) {
+						allowed = append(allowed, id)
+					}
+				}
+				return marshalIdentities(allowed), nil
+
+			case SSH_AGENTC_SIGN_REQUEST:
+				blob, _, ok := readWireString(req.Message[1:])
+				if !ok {
+					return failure(), nil
+				}
+				key, found := p.lookup(next, req, blob, hostKeys)
+				if !found || !p.allows(key, req.Session.Upstream, hostKeys) {
+					logger.Warn("Refusing to sign with a key outside this socket's policy",
+						"client", req.Session.Client, "key", key.Fingerprint())
+					return failure(), nil
+				}
+				if p.Confirm != nil && !p.Confirm(key, req.Session.Client) {
+					logger.Info("Signature not confirmed", "client", req.Session.Client, "key", key.Fingerprint())
+					return failure(), nil
+				}
+
+			case SSH_AGENTC_REMOVE_IDENTITY:
+				blob, _, ok := readWireString(req.Message[1:])
+				if !ok {
+					return failure(), nil
+				}
+				if key, found := p.lookup(next, req, blob, hostKeys); !found || !p.allows(key, req.Session.Upstream, hostKeys) {
+					return failure(), nil
+				}
+
+			case SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+				// Clients that can only see some keys mustn't remove the rest
+				if p.restricted(hostKeys) {
+					return failure(), nil
+				}
+			}
+			return next(req)
+		}
+	}
+}
+
+// lookup finds the identity for blob, with its comment, by listing the
+// upstream's keys through next. Policies made only of fingerprints without
+// Confirm don't need the comment, so they skip the extra round trip.
+func (p *KeyPolicy) lookup(next Handler, req *Request, blob []byte, hostKeys []string) (Identity, bool) {
+	key := Identity{Blob: blob}
+	if p.Confirm == nil && fingerprintsOnly(p.Keys) && fingerprintsOnly(hostKeys) {
+		return key, true
+	}
+	response, err := next(&Request{Message: []byte{SSH_AGENTC_REQUEST_IDENTITIES}, Session: req.Session})
+	if err != nil || responseType(response) != SSH_AGENT_IDENTITIES_ANSWER {
+		return key, false
+	}
+	identities, err := parseIdentities(response)
+	if err != nil {
+		return key, false
+	}
+	for _, id := range identities {
+		if string(id.Blob) == string(blob) {
+			return id, true
+		}
+	}
+	return key, false
+}
+
+func fingerprintsOnly(keys []string) bool {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "SHA256:") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestKeyPolicyAllows(t *testing.T) {
+	deploy := Identity{Blob: newHostKey(t).PublicKey().Marshal(), Comment: "deploy@ci"}
+	other := Identity{Blob: newHostKey(t).PublicKey().Marshal(), Comment: "me@laptop"}
+	tagged := Identity{Blob: deploy.Blob, Comment: "deploy@ci " + originTag("/tmp/ssh-abc/agent.1")}
+
+	tests := []struct {
+		name     string
+		policy   KeyPolicy
+		id       Identity
+		upstream string
+		want     bool
+	}{
+		{"unrestricted", KeyPolicy{}, other, "", true},
+		{"fingerprint", KeyPolicy{Keys: []string{deploy.Fingerprint()}}, deploy, "", true},
+		{"comment", KeyPolicy{Keys: []string{"deploy@ci"}}, deploy, "", true},
+		{"comment with origin tag", KeyPolicy{Keys: []string{"deploy@ci"}}, tagged, "/tmp/ssh-abc/agent.1", true},
+		{"other key", KeyPolicy{Keys: []string{"deploy@ci", deploy.Fingerprint()}}, other, "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.allows(tt.id, tt.upstream, nil); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPolicyThroughProxy(t *testing.T) {
+	local := NewLocalAgent()
+	for range 2 {
+		if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+			t.Fatalf("LoadKeyFile failed: %v", err)
+		}
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	keys, err := local.keyring.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Expected two keys, got %v (%v)", keys, err)
+	}
+	deploy, other := keys[0], keys[1]
+
+	var confirmed atomic.Int32
+	var approve atomic.Bool
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithKeyPolicy(&KeyPolicy{
+			Keys: []string{deploy.Comment},
+			Confirm: func(key Identity, client string) bool {
+				confirmed.Add(1)
+				if key.Comment != deploy.Comment {
+					t.Errorf("Expected confirmation for %s, got %s", deploy.Comment, key.Comment)
+				}
+				return approve.Load()
+			},
+		}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		listed, err := client.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		if len(listed) != 1 || listed[0].Comment != deploy.Comment {
+			t.Errorf("Expected only the deploy key to be listed, got %v", listed)
+		}
+
+		approve.Store(true)
+		if _, err := client.Sign(deploy, []byte("challenge")); err != nil {
+			t.Errorf("Expected a confirmed signature to succeed: %v", err)
+		}
+		approve.Store(false)
+		if _, err := client.Sign(deploy, []byte("challenge")); err == nil {
+			t.Error("Expected an unconfirmed signature to be refused")
+		}
+		if got := confirmed.Load(); got != 2 {
+			t.Errorf("Expected 2 confirmations, got %d", got)
+		}
+
+		if _, err := client.Sign(other, []byte("challenge")); err == nil {
+			t.Error("Expected signing with a hidden key to be refused")
+		}
+		if got := confirmed.Load(); got != 2 {
+			t.Error("Expected no confirmation prompt for a hidden key")
+		}
+
+		if err := client.Remove(other); err == nil {
+			t.Error("Expected removing a hidden key to be refused")
+		}
+		if err := client.RemoveAll(); err == nil {
+			t.Error("Expected removing all keys to be refused")
+		}
+	})
+
+	if keys, _ := local.keyring.List(); len(keys) != 2 {
+		t.Errorf("Expected the upstream to keep both keys, has %d", len(keys))
+	}
+}
+
+func TestKeyPolicyHosts(t *testing.T) {
+	local := NewLocalAgent()
+	for range 2 {
+		if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+			t.Fatalf("LoadKeyFile failed: %v", err)
+		}
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	keys, err := local.keyring.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Expected two keys, got %v (%v)", keys, err)
+	}
+	public, corp := keys[0], keys[1]
+
+	github, bastion, elsewhere := newHostKey(t), newHostKey(t), newHostKey(t)
+	knownHosts := writeKnownHosts(t,
+		knownHostsLine("github.com", github.PublicKey(), true),
+		knownHostsLine("bastion.corp.example", bastion.PublicKey(), false),
+		knownHostsLine("elsewhere.net", elsewhere.PublicKey(), false))
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithKeyPolicy(&KeyPolicy{
+			Hosts: []HostKeys{
+				{Pattern: "github.com", Keys: []string{public.Comment}},
+				{Pattern: "*.corp.example", Keys: []string{Identity{Blob: corp.Marshal()}.Fingerprint()}},
+			},
+			KnownHosts: []string{knownHosts},
+		}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	// listFor lists keys and tries signing with both over a connection
+	// bound to host, returning the comments of those listed and of those
+	// that signed
+	listFor := func(host ssh.Signer) (listed, signed []string) {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		if host != nil {
+			if err := writeMessage(conn, sessionBind(t, host)); err != nil {
+				t.Fatalf("Failed to write session-bind: %v", err)
+			}
+			if _, err := readMessage(conn, maxAgentMessage); err != nil {
+				t.Fatalf("Failed to read session-bind response: %v", err)
+			}
+		}
+		client := agent.NewClient(conn)
+		ids, err := client.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		for _, id := range ids {
+			listed = append(listed, id.Comment)
+		}
+		for _, key := range keys {
+			if _, err := client.Sign(key, []byte("challenge")); err == nil {
+				signed = append(signed, key.Comment)
+			}
+		}
+		return listed, signed
+	}
+
+	tests := []struct {
+		name string
+		host ssh.Signer
+		want []string
+	}{
+		{"github.com, hashed in known_hosts", github, []string{public.Comment}},
+		{"corporate bastion", bastion, []string{corp.Comment}},
+		{"host without a rule", elsewhere, []string{public.Comment, corp.Comment}},
+		{"no session-bind", nil, []string{public.Comment, corp.Comment}},
+	}
+	for _, tt := range tests {
+		listed, signed := listFor(tt.host)
+		if !slices.Equal(listed, tt.want) {
+			t.Errorf("%s: listed %v, want %v", tt.name, listed, tt.want)
+		}
+		if !slices.Equal(signed, tt.want) {
+			t.Errorf("%s: signed with %v, want %v", tt.name, signed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// agentRequestTimeout bounds a single request made by ListIdentities and
+// similar client helpers.
+const agentRequestTimeout = 5 * time.Second
+
+// signRequestTimeout is longer since signing may wait on a PIN prompt or a
+// hardware token touch.
+const signRequestTimeout = time.Minute
+
+// Identity is a public key held by an agent.
+type Identity struct {
+	Blob    []byte
+	Comment string
+}
+
+// Type returns the key's SSH algorithm name, such as "ssh-ed25519".
+func (id Identity) Type() string {
+	keyType, _, ok := readWireString(id.Blob)
+	if !ok {
+		return "unknown"
+	}
+	return string(keyType)
+}
+
+// Bits returns the key size in bits, or 0 if it can't be determined.
+func (id Identity) Bits() int {
+	keyType := id.Type()
+	switch {
+	case keyType == "ssh-rsa":
+		_, rest, _ := readWireString(id.Blob)
+		_, rest, ok := readWireString(rest) // e
+		if !ok {
+			return 0
+		}
+		n, _, ok := readWireString(rest)
+		if !ok {
+			return 0
+		}
+		return new(big.Int).SetBytes(n).BitLen()
+	case keyType == "ssh-ed25519", keyType == "sk-ssh-ed25519@openssh.com":
+		return 256
+	case strings.Contains(keyType, "nistp256"):
+		return 256
+	case strings.Contains(keyType, "nistp384"):
+		return 384
+	case strings.Contains(keyType, "nistp521"):
+		return 521
+	case keyType == "ssh-dss":
+		_, rest, _ := readWireString(id.Blob)
+		p, _, ok := readWireString(rest)
+		if !ok {
+			return 0
+		}
+		return new(big.Int).SetBytes(p).BitLen()
+	}
+	return 0
+}
+
+// Fingerprint returns the key's SHA256 fingerprint in OpenSSH's format.
+func (id Identity) Fingerprint() string {
+	sum := sha256.Sum256(id.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ListIdentities asks the agent at socketPath for the keys it holds.
+func ListIdentities(socketPath string) ([]Identity, error) {
+	conn, err := dialUpstream(socketPath)
+	if err != nil {
+		return nil, errorOfKind(ErrUpstreamDial, "failed to connect to %s: %w", socketPath, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	response, err := agentRequest(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}, agentRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	switch response[0] {
+	case SSH_AGENT_IDENTITIES_ANSWER:
+	case SSH_AGENT_FAILURE:
+		return nil, errors.New("agent refused to list identities")
+	default:
+		return nil, errorOfKind(ErrProtocol, "unexpected response type: %d", response[0])
+	}
+
+	return parseIdentities(response)
+}
+
+// parseIdentities decodes an SSH_AGENT_IDENTITIES_ANSWER message.
+func parseIdentities(answer []byte) ([]Identity, error) {
+	body := answer[1:]
+	if len(body) < 4 {
+		return nil, errorOfKind(ErrProtocol, "truncated identities answer")
+	}
+	count := binary.BigEndian.Uint32(body)
+	body = body[4:]
+
+	var identities []Identity
+	for i := uint32(0); i < count; i++ {
+		blob, rest, ok := readWireString(body)
+		if !ok {
+			return nil, errorOfKind(ErrProtocol, "truncated identities answer")
+		}
+		comment, rest, ok := readWireString(rest)
+		if !ok {
+			return nil, errorOfKind(ErrProtocol, "truncated identities answer")
+		}
+		identities = append(identities, Identity{Blob: blob, Comment: string(comment)})
+		body = rest
+	}
+	return identities, nil
+}
+
+// marshalIdentities encodes identities as an SSH_AGENT_IDENTITIES_ANSWER
+// message.
+func marshalIdentities(identities []Identity) []byte {
+	answer := []byte{SSH_AGENT_IDENTITIES_ANSWER}
+	answer = binary.BigEndian.AppendUint32(answer, uint32(len(identities)))
+	for _, id := range identities {
+		answer = appendWireString(answer, id.Blob)
+		answer = appendWireString(answer, []byte(id.Comment))
+	}
+	return answer
+}
+
+// readWireString splits an SSH wire-format string off the front of b.
+func readWireString(b []byte) (value, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, b, false
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(length) {
+		return nil, b, false
+	}
+	return b[4 : 4+length], b[4+length:], true
+}
+
+// appendWireString appends value to b as an SSH wire-format string.
+func appendWireString(b, value []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(value)))
+	return append(b, value...)
+}
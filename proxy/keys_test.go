@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+func wireString(s []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// createMockAgentWithIdentities serves a fixed identities answer.
+func createMockAgentWithIdentities(t *testing.T, identities []Identity) string {
+	body := []byte{SSH_AGENT_IDENTITIES_ANSWER}
+	body = binary.BigEndian.AppendUint32(body, uint32(len(identities)))
+	for _, id := range identities {
+		body = append(body, wireString(id.Blob)...)
+		body = append(body, wireString([]byte(id.Comment))...)
+	}
+	return createRespondingAgent(t, wireString(body))
+}
+
+func TestListIdentities(t *testing.T) {
+	edBlob := append(wireString([]byte("ssh-ed25519")), wireString(make([]byte, 32))...)
+	modulus := append([]byte{0x00, 0x80}, make([]byte, 255)...) // 2048-bit
+	rsaBlob := append(wireString([]byte("ssh-rsa")), wireString([]byte{1, 0, 1})...)
+	rsaBlob = append(rsaBlob, wireString(modulus)...)
+
+	socket := createMockAgentWithIdentities(t, []Identity{
+		{Blob: edBlob, Comment: "laptop"},
+		{Blob: rsaBlob, Comment: "legacy"},
+	})
+
+	identities, err := ListIdentities(socket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 2 {
+		t.Fatalf("Expected 2 identities, got %d", len(identities))
+	}
+
+	ed := identities[0]
+	if ed.Type() != "ssh-ed25519" || ed.Bits() != 256 || ed.Comment != "laptop" {
+		t.Errorf("Unexpected ed25519 identity: %s %d %s", ed.Type(), ed.Bits(), ed.Comment)
+	}
+	sum := sha256.Sum256(edBlob)
+	if want := "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]); ed.Fingerprint() != want {
+		t.Errorf("Expected fingerprint %s, got %s", want, ed.Fingerprint())
+	}
+
+	rsa := identities[1]
+	if rsa.Type() != "ssh-rsa" || rsa.Bits() != 2048 {
+		t.Errorf("Unexpected RSA identity: %s %d", rsa.Type(), rsa.Bits())
+	}
+}
+
+func TestListIdentitiesEmpty(t *testing.T) {
+	socket := createMockAgentWithIdentities(t, nil)
+
+	identities, err := ListIdentities(socket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 0 {
+		t.Errorf("Expected no identities, got %d", len(identities))
+	}
+}
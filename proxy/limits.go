@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is how many clients the sign rate limiter tracks before it
+// forgets those whose buckets have refilled.
+const maxRateBuckets = 1024
+
+// messageTooLargeError reports a client message over the size limit.
+type messageTooLargeError struct {
+	length, limit uint32
+}
+
+func (e *messageTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the %d byte limit", e.length, e.limit)
+}
+
+func (e *messageTooLargeError) Unwrap() error {
+	return ErrProtocol
+}
+
+// signLimiter is a token bucket per client: each sign request spends a
+// token, and tokens refill at rate per second up to burst.
+type signLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newSignLimiter(rate float64, burst int) *signLimiter {
+	return &signLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow spends one of client's tokens, reporting false if it has none.
+func (l *signLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = l.refilled(bucket, now)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *signLimiter) refilled(bucket *tokenBucket, now time.Time) float64 {
+	return min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+}
+
+// prune forgets clients whose buckets are full again, since a new bucket
+// would start out the same.
+func (l *signLimiter) prune(now time.Time) {
+	for client, bucket := range l.buckets {
+		if l.refilled(bucket, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitMiddleware refuses sign requests from clients that have spent
+// their tokens.
+func (ap *AgentProxy) rateLimitMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		if req.Type() == SSH_AGENTC_SIGN_REQUEST && !ap.signLimiter.allow(req.Session.rateKey, time.Now()) {
+			ap.serveMu.Lock()
+			ap.metrics.RateLimited++
+			ap.serveMu.Unlock()
+			ap.logger.Warn("Sign request over the rate limit", "client", req.Session.Client)
+			return failure(), nil
+		}
+		return next(req)
+	}
+}
+
+// clientKey identifies the client on conn for rate limiting: the peer
+// process for unix sockets where it can be found, or the remote host for
+// TCP. Clients that can't be told apart share the "" bucket.
+func clientKey(conn net.Conn) string {
+	if pid := peerPID(conn); pid > 0 {
+		return fmt.Sprintf("pid:%d", pid)
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// rateKey identifies the client on conn for the sign rate limit. It has to
+// hold across processes, since a script hammering the agent starts a new
+// ssh or git for every signature: on Linux it's the peer's UID and
+// executable, or the UID alone where the executable can't be read, and
+// over TCP it's the remote host. Elsewhere local clients can't be told
+// apart, so they share the "" bucket.
+func rateKey(conn net.Conn, exe string) string {
+	if uid, ok := peerUID(conn); ok {
+		if exe != "" {
+			return fmt.Sprintf("uid:%d:%s", uid, exe)
+		}
+		return fmt.Sprintf("uid:%d", uid)
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
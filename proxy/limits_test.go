@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSignLimiter(t *testing.T) {
+	limiter := newSignLimiter(1, 2)
+	now := time.Now()
+
+	if !limiter.allow("a", now) || !limiter.allow("a", now) {
+		t.Fatal("Expected a burst of 2 to be allowed")
+	}
+	if limiter.allow("a", now) {
+		t.Error("Expected the third request in the burst to be refused")
+	}
+	if !limiter.allow("b", now) {
+		t.Error("Expected another client to have its own bucket")
+	}
+	if !limiter.allow("a", now.Add(time.Second)) {
+		t.Error("Expected a token to refill after a second")
+	}
+}
+
+func limitedProxy(t *testing.T, opts ...Option) (*AgentProxy, string, Identity) {
+	keyPath := writeTestKey(t, "")
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(keyPath, nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	// Registered before serveProxy's cleanup, so it runs once the proxy
+	// has shut down and no handler can still be dialing the adapter
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", append([]Option{
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})),
+	}, opts...)...)
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one identity, got %v (%v)", identities, err)
+	}
+	return ap, proxySocket, identities[0]
+}
+
+func TestSignRateLimit(t *testing.T) {
+	ap, proxySocket, id := limitedProxy(t, WithSignRateLimit(0.001, 1))
+
+	if _, err := Sign(proxySocket, id, []byte("challenge"), 0); err != nil {
+		t.Fatalf("Expected the first signature to succeed, got %v", err)
+	}
+	if _, err := Sign(proxySocket, id, []byte("challenge"), 0); err == nil {
+		t.Error("Expected the second signature to be rate limited")
+	}
+	if got := ap.Metrics().RateLimited; got != 1 {
+		t.Errorf("Expected 1 rate-limited request, got %d", got)
+	}
+
+	// Listing keys isn't limited
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Errorf("Expected listing to succeed, got %v", err)
+	}
+}
+
+func TestSignRateLimitAcrossProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("clients are only told apart by executable on Linux")
+	}
+	_, proxySocket, _ := limitedProxy(t, WithSignRateLimit(0.001, 1))
+
+	// Each signature comes from a new process, as from a script running
+	// ssh in a loop, and they share one bucket
+	sign := func() error {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperSignOnce$")
+		cmd.Env = append(os.Environ(), "SIGN_ONCE_SOCKET="+proxySocket)
+		return cmd.Run()
+	}
+	if err := sign(); err != nil {
+		t.Fatalf("Expected the first process's signature to succeed, got %v", err)
+	}
+	if err := sign(); err == nil {
+		t.Error("Expected a second process to find the bucket spent")
+	}
+}
+
+// TestHelperSignOnce signs with the first key at $SIGN_ONCE_SOCKET, for
+// TestSignRateLimitAcrossProcesses.
+func TestHelperSignOnce(t *testing.T) {
+	socket := os.Getenv("SIGN_ONCE_SOCKET")
+	if socket == "" {
+		t.Skip("helper process")
+	}
+	identities, err := ListIdentities(socket)
+	if err != nil || len(identities) == 0 {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+	if _, err := Sign(socket, identities[0], []byte("challenge"), 0); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	_, proxySocket, _ := limitedProxy(t, WithMaxMessageSize(64))
+
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	request := make([]byte, 4+100)
+	request[3] = 100
+	request[4] = SSH_AGENTC_SIGN_REQUEST
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	response := make([]byte, 5)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response[4] != SSH_AGENT_FAILURE {
+		t.Errorf("Expected SSH_AGENT_FAILURE, got %d", response[4])
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the proxy to close the connection")
+	}
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// LocalAgentAddress is the upstream address of the in-memory key store
+// registered with UseLocalAgent.
+const LocalAgentAddress = "local"
+
+// PassphraseFunc returns the passphrase for the encrypted key at path.
+type PassphraseFunc func(path string) ([]byte, error)
+
+// LocalAgent is an in-memory agent holding private keys loaded from disk,
+// like a built-in ssh-agent. Listed in Discovery.Fallback, it serves
+// requests only when no other upstream agent is valid.
+type LocalAgent struct {
+	keyring agent.ExtendedAgent
+
+	mu       sync.Mutex // serializes unlocking, so one use prompts once
+	onDemand []*onDemandKey
+}
+
+// onDemandKey is an encrypted key listed by its public half until a
+// signature needs it decrypted.
+type onDemandKey struct {
+	path       string
+	publicKey  ssh.PublicKey
+	comment    string
+	passphrase PassphraseFunc
+	lifetime   time.Duration
+}
+
+// NewLocalAgent creates an empty local agent.
+func NewLocalAgent() *LocalAgent {
+	return &LocalAgent{keyring: agent.NewKeyring().(agent.ExtendedAgent)}
+}
+
+// LoadKeyFile parses the private key at path and adds it to the agent,
+// calling passphrase if the key is encrypted. The key's comment comes from
+// the matching .pub file when there is one, and is the path otherwise.
+func (la *LocalAgent) LoadKeyFile(path string, passphrase PassphraseFunc) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return fmt.Errorf("%s is encrypted and no passphrase is available", path)
+		}
+		pass, passErr := passphrase(path)
+		if passErr != nil {
+			return fmt.Errorf("failed to read passphrase for %s: %w", path, passErr)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return la.keyring.Add(agent.AddedKey{PrivateKey: key, Comment: keyComment(path)})
+}
+
+// LoadKeyFileOnDemand adds the key at path like LoadKeyFile, except that
+// an encrypted key isn't decrypted until a client asks it to sign. Only
+// then is passphrase called, and the decrypted key is kept for lifetime
+// before being dropped again, so the next use after that prompts anew.
+// Its public half comes from the key file itself or its .pub file.
+func (la *LocalAgent) LoadKeyFileOnDemand(path string, passphrase PassphraseFunc, lifetime time.Duration) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return la.keyring.Add(agent.AddedKey{PrivateKey: key, Comment: keyComment(path)})
+	}
+	if passphrase == nil {
+		return fmt.Errorf("%s is encrypted and no passphrase is available", path)
+	}
+
+	publicKey := missing.PublicKey
+	if publicKey == nil {
+		// Older PEM keys encrypt the public half too
+		pub, readErr := os.ReadFile(path + ".pub")
+		if readErr != nil {
+			return fmt.Errorf("%s is encrypted and has no readable .pub file to list it by: %w", path, readErr)
+		}
+		if publicKey, _, _, _, err = ssh.ParseAuthorizedKey(pub); err != nil {
+			return fmt.Errorf("failed to parse %s.pub: %w", path, err)
+		}
+	}
+
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.onDemand = append(la.onDemand, &onDemandKey{
+		path:       path,
+		publicKey:  publicKey,
+		comment:    keyComment(path),
+		passphrase: passphrase,
+		lifetime:   lifetime,
+	})
+	return nil
+}
+
+// unlock decrypts k and adds it to the keyring for its lifetime.
+func (la *LocalAgent) unlock(k *onDemandKey) error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	pass, err := k.passphrase(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read passphrase for %s: %w", k.path, err)
+	}
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", k.path, err)
+	}
+	added := agent.AddedKey{PrivateKey: key, Comment: k.comment}
+	if k.lifetime > 0 {
+		added.LifetimeSecs = uint32(max(k.lifetime/time.Second, 1))
+	}
+	return la.keyring.Add(added)
+}
+
+// loaded reports whether the keyring currently holds key.
+func (la *LocalAgent) loaded(key ssh.PublicKey) bool {
+	keys, err := la.keyring.List()
+	if err != nil {
+		return false
+	}
+	blob := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, blob) {
+			return true
+		}
+	}
+	return false
+}
+
+// localKeyring is what a LocalAgent serves: its keyring, plus the
+// on-demand keys not currently decrypted into it.
+type localKeyring struct {
+	agent.ExtendedAgent
+	la *LocalAgent
+}
+
+// List implements agent.Agent
+func (k localKeyring) List() ([]*agent.Key, error) {
+	keys, err := k.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+	k.la.mu.Lock()
+	defer k.la.mu.Unlock()
+	for _, od := range k.la.onDemand {
+		blob := od.publicKey.Marshal()
+		listed := false
+		for _, key := range keys {
+			if bytes.Equal(key.Blob, blob) {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			keys = append(keys, &agent.Key{Format: od.publicKey.Type(), Blob: blob, Comment: od.comment})
+		}
+	}
+	return keys, nil
+}
+
+// Sign implements agent.Agent
+func (k localKeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return k.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags implements agent.ExtendedAgent, decrypting an on-demand
+// key first if it isn't already.
+func (k localKeyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	k.la.mu.Lock()
+	blob := key.Marshal()
+	for _, od := range k.la.onDemand {
+		if !bytes.Equal(od.publicKey.Marshal(), blob) || k.la.loaded(key) {
+			continue
+		}
+		if err := k.la.unlock(od); err != nil {
+			k.la.mu.Unlock()
+			return nil, err
+		}
+		break
+	}
+	k.la.mu.Unlock()
+	return k.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+// keyComment reads the comment from path's .pub file, falling back to path.
+func keyComment(path string) string {
+	data, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return path
+	}
+	_, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil || strings.TrimSpace(comment) == "" {
+		return path
+	}
+	return comment
+}
+
+// Dial connects to the local agent over an in-process pipe.
+func (la *LocalAgent) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer func() { _ = server.Close() }()
+		_ = agent.ServeAgent(localKeyring{ExtendedAgent: la.keyring, la: la}, server)
+	}()
+	return client, nil
+}
+
+// UseLocalAgent makes la reachable as the upstream at LocalAgentAddress.
+// Call it before serving, alongside adding LocalAgentAddress to
+// Discovery.Fallback.
+func UseLocalAgent(la *LocalAgent) {
+	registerAdapter(LocalAgentAddress, la.Dial)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writeTestKey(t *testing.T, passphrase string) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "test@example")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "test@example", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func TestLocalAgentServesKeys(t *testing.T) {
+	local := NewLocalAgent()
+	path := writeTestKey(t, "")
+	if err := local.LoadKeyFile(path, nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	identities, err := ListIdentities(LocalAgentAddress)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Comment != path {
+		t.Fatalf("Expected one key commented %s, got %+v", path, identities)
+	}
+	if err := SignTest(LocalAgentAddress, identities[0]); err != nil {
+		t.Errorf("Expected the local agent to sign, got %v", err)
+	}
+}
+
+func TestLocalAgentEncryptedKey(t *testing.T) {
+	path := writeTestKey(t, "hunter2")
+
+	if err := NewLocalAgent().LoadKeyFile(path, nil); err == nil {
+		t.Error("Expected an encrypted key without a passphrase prompt to fail")
+	}
+
+	prompted := ""
+	err := NewLocalAgent().LoadKeyFile(path, func(p string) ([]byte, error) {
+		prompted = p
+		return []byte("hunter2"), nil
+	})
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	if prompted != path {
+		t.Errorf("Expected a prompt for %s, got %q", path, prompted)
+	}
+}
+
+func TestSelectSocketFallback(t *testing.T) {
+	d := &Discovery{}
+	local := SocketInfo{Path: LocalAgentAddress, Class: ClassLocal, Valid: true, Keys: 5, Fallback: true}
+
+	got, err := d.selectSocket([]SocketInfo{{Path: "/tmp/stale", Reason: "stale"}, local})
+	if err != nil || got != LocalAgentAddress {
+		t.Errorf("Expected the fallback with no valid socket, got %q, %v", got, err)
+	}
+
+	d.Strategy = StrategyMostKeys
+	got, _ = d.selectSocket([]SocketInfo{{Path: "/tmp/agent", Valid: true, Keys: 1}, local})
+	if got != "/tmp/agent" {
+		t.Errorf("Expected a valid upstream to beat the fallback, got %q", got)
+	}
+}
+
+func TestLocalAgentOnDemandKey(t *testing.T) {
+	local := NewLocalAgent()
+	path := writeTestKey(t, "hunter2")
+	prompts := 0
+	err := local.LoadKeyFileOnDemand(path, func(string) ([]byte, error) {
+		prompts++
+		return []byte("hunter2"), nil
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("LoadKeyFileOnDemand failed: %v", err)
+	}
+
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	identities, err := ListIdentities(LocalAgentAddress)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("Expected the encrypted key to be listed, got %+v", identities)
+	}
+	if prompts != 0 {
+		t.Fatalf("Expected no prompt before the key is used, got %d", prompts)
+	}
+
+	for range 2 {
+		if err := SignTest(LocalAgentAddress, identities[0]); err != nil {
+			t.Fatalf("Expected the on-demand key to sign, got %v", err)
+		}
+	}
+	if prompts != 1 {
+		t.Errorf("Expected one prompt while the key is decrypted, got %d", prompts)
+	}
+
+	// The keyring drops the key once its lifetime is up
+	time.Sleep(2100 * time.Millisecond)
+	if identities, _ = ListIdentities(LocalAgentAddress); len(identities) != 1 {
+		t.Fatalf("Expected the expired key to stay listed, got %+v", identities)
+	}
+	if err := SignTest(LocalAgentAddress, identities[0]); err != nil {
+		t.Fatalf("Expected the key to sign after expiry, got %v", err)
+	}
+	if prompts != 2 {
+		t.Errorf("Expected a fresh prompt after expiry, got %d", prompts)
+	}
+}
+
+func TestLocalAgentOnDemandWrongPassphrase(t *testing.T) {
+	local := NewLocalAgent()
+	path := writeTestKey(t, "hunter2")
+	err := local.LoadKeyFileOnDemand(path, func(string) ([]byte, error) {
+		return []byte("wrong"), nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("LoadKeyFileOnDemand failed: %v", err)
+	}
+
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	identities, err := ListIdentities(LocalAgentAddress)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one listed key, got %+v, %v", identities, err)
+	}
+	if err := SignTest(LocalAgentAddress, identities[0]); err == nil {
+		t.Error("Expected signing with a wrong passphrase to fail")
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Lock modes for WithLockMode, deciding what ssh-add -x and -X lock
+const (
+	// LockUpstream passes lock requests to whichever upstream is active,
+	// so a lock doesn't carry over when the proxy switches agents
+	LockUpstream = "upstream"
+	// LockFollow passes lock requests upstream and re-applies the lock to
+	// each agent the proxy switches to while locked
+	LockFollow = "follow"
+	// LockLocal locks the proxy itself, leaving upstreams alone
+	LockLocal = "local"
+)
+
+// ValidateLockMode reports whether mode is a recognized lock mode.
+func ValidateLockMode(mode string) error {
+	switch mode {
+	case "", LockUpstream, LockFollow, LockLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown lock mode %q (want upstream, follow, or local)", mode)
+}
+
+// lockState is the proxy's view of the agent lock under LockFollow or
+// LockLocal. The passphrase is kept while anything is locked, since
+// LockFollow needs it to lock and unlock upstreams on the client's behalf.
+type lockState struct {
+	mode string
+
+	mu         sync.Mutex
+	locked     bool
+	passphrase []byte
+
+	// upstreams records which upstreams LockFollow has left locked
+	upstreams map[string]bool
+}
+
+func newLockState(mode string) *lockState {
+	return &lockState{mode: mode, upstreams: make(map[string]bool)}
+}
+
+func (ls *lockState) isLocked() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.locked
+}
+
+// middleware answers lock requests, and every request while the proxy
+// stands in for a locked agent, keeping upstreams in step as it goes.
+func (ls *lockState) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			synced := ls.sync(next, req.Session, logger)
+			if reply := ls.intercept(req.Message, synced); reply != nil {
+				return reply, nil
+			}
+			message := req.Message
+			response, err := next(req)
+			if err == nil {
+				ls.observe(message, response, req.Session.Upstream)
+			}
+			return response, err
+		}
+	}
+}
+
+// sync brings the session's upstream in line with the proxy's lock state
+// before a request is passed to next. It reports false if the upstream
+// should be locked but couldn't be, in which case the proxy answers as a
+// locked agent itself.
+func (ls *lockState) sync(next Handler, session *Session, logger *slog.Logger) bool {
+	if ls.mode != LockFollow {
+		return true
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	upstream := session.Upstream
+	if ls.upstreams[upstream] == ls.locked {
+		return true
+	}
+
+	msgType := byte(SSH_AGENTC_UNLOCK)
+	if ls.locked {
+		msgType = SSH_AGENTC_LOCK
+	}
+	response, err := next(&Request{Message: appendWireString([]byte{msgType}, ls.passphrase), Session: session})
+	if err == nil && responseType(response) != SSH_AGENT_SUCCESS {
+		err = fmt.Errorf("agent answered with message type %d", responseType(response))
+	}
+	if err != nil {
+		logger.Warn("Failed to carry lock state to upstream",
+			"socket", upstream, "locked", ls.locked, "error", err)
+		if ls.locked {
+			return false
+		}
+	} else {
+		logger.Info("Carried lock state to upstream", "socket", upstream, "locked", ls.locked)
+	}
+	ls.upstreams[upstream] = ls.locked
+	ls.forget()
+	return true
+}
+
+// intercept answers lock-related requests the proxy handles itself, and
+// every request while the proxy stands in for a locked agent. It returns
+// nil for requests that should be forwarded.
+func (ls *lockState) intercept(request []byte, synced bool) []byte {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	forward := ls.mode == LockFollow && synced
+
+	switch request[0] {
+	case SSH_AGENTC_LOCK:
+		if forward {
+			return nil
+		}
+		passphrase, _, ok := readWireString(request[1:])
+		if !ok || ls.locked {
+			return []byte{SSH_AGENT_FAILURE}
+		}
+		ls.locked = true
+		ls.passphrase = append([]byte(nil), passphrase...)
+		return []byte{SSH_AGENT_SUCCESS}
+	case SSH_AGENTC_UNLOCK:
+		if !ls.locked {
+			if forward {
+				return nil
+			}
+			return []byte{SSH_AGENT_FAILURE}
+		}
+		passphrase, _, ok := readWireString(request[1:])
+		if !ok || subtle.ConstantTimeCompare(passphrase, ls.passphrase) != 1 {
+			return []byte{SSH_AGENT_FAILURE}
+		}
+		if forward {
+			return nil
+		}
+		ls.locked = false
+		ls.forget()
+		return []byte{SSH_AGENT_SUCCESS}
+	}
+
+	if ls.locked && !forward {
+		// A locked agent lists no keys and refuses everything else
+		if request[0] == SSH_AGENTC_REQUEST_IDENTITIES {
+			return []byte{SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0}
+		}
+		return []byte{SSH_AGENT_FAILURE}
+	}
+	return nil
+}
+
+// observe records the outcome of a lock request forwarded to upstream.
+func (ls *lockState) observe(request, response []byte, upstream string) {
+	if responseType(response) != SSH_AGENT_SUCCESS {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	switch request[0] {
+	case SSH_AGENTC_LOCK:
+		passphrase, _, ok := readWireString(request[1:])
+		if !ok {
+			return
+		}
+		ls.locked = true
+		ls.passphrase = append([]byte(nil), passphrase...)
+		ls.upstreams[upstream] = true
+	case SSH_AGENTC_UNLOCK:
+		ls.locked = false
+		ls.upstreams[upstream] = false
+		ls.forget()
+	}
+}
+
+// forget drops the passphrase once neither the proxy nor any upstream it
+// locked is still locked.
+func (ls *lockState) forget() {
+	if ls.locked {
+		return
+	}
+	for _, locked := range ls.upstreams {
+		if locked {
+			return
+		}
+	}
+	ls.passphrase = nil
+	clear(ls.upstreams)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// lockTestAgent registers a local agent holding one key as upstream address.
+func lockTestAgent(t *testing.T, address string) *LocalAgent {
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	registerAdapter(address, local.Dial)
+	t.Cleanup(func() { unregisterAdapter(address) })
+	return local
+}
+
+// withAgentClient runs f against a fresh connection to the proxy.
+func withAgentClient(t *testing.T, proxySocket string, f func(agent.ExtendedAgent)) {
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	f(agent.NewClient(conn))
+}
+
+func keyCount(t *testing.T, proxySocket string) int {
+	identities, err := ListIdentities(proxySocket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	return len(identities)
+}
+
+func upstreamLocked(t *testing.T, la *LocalAgent) bool {
+	keys, err := la.keyring.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	return len(keys) == 0
+}
+
+func TestLockLocal(t *testing.T) {
+	upstream := lockTestAgent(t, "lock-upstream")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithLockMode(LockLocal),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return "lock-upstream", nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		if err := client.Lock([]byte("secret")); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+	})
+	if keyCount(t, proxySocket) != 0 {
+		t.Error("Expected a locked proxy to list no keys")
+	}
+	if upstreamLocked(t, upstream) {
+		t.Error("Expected the upstream to stay unlocked")
+	}
+	if !ap.Status().Locked {
+		t.Error("Expected status to report the lock")
+	}
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		if err := client.Unlock([]byte("wrong")); err == nil {
+			t.Error("Expected unlocking with the wrong passphrase to fail")
+		}
+		if err := client.Unlock([]byte("secret")); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+	})
+	if keyCount(t, proxySocket) != 1 {
+		t.Error("Expected keys to be listed after unlocking")
+	}
+}
+
+func TestLockFollow(t *testing.T) {
+	agentA := lockTestAgent(t, "lock-a")
+	agentB := lockTestAgent(t, "lock-b")
+
+	var mu sync.Mutex
+	active := "lock-a"
+	use := func(address string) {
+		mu.Lock()
+		defer mu.Unlock()
+		active = address
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithLockMode(LockFollow),
+		WithCacheTTL(0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return active, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		if err := client.Lock([]byte("secret")); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+	})
+	if !upstreamLocked(t, agentA) {
+		t.Fatal("Expected the lock to reach the active upstream")
+	}
+
+	// Switching upstreams carries the lock over
+	use("lock-b")
+	if keyCount(t, proxySocket) != 0 {
+		t.Error("Expected no keys from the new upstream while locked")
+	}
+	if !upstreamLocked(t, agentB) {
+		t.Error("Expected the new upstream to be locked")
+	}
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		if err := client.Unlock([]byte("secret")); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+	})
+	if upstreamLocked(t, agentB) {
+		t.Error("Expected unlocking to reach the active upstream")
+	}
+
+	// The first upstream is unlocked once it's used again
+	use("lock-a")
+	if keyCount(t, proxySocket) != 1 {
+		t.Error("Expected keys from the first upstream after unlocking")
+	}
+	if upstreamLocked(t, agentA) {
+		t.Error("Expected the first upstream to be unlocked")
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "double-agent.log")
+
+	rf, err := NewRotatingFile(path, 20, 0, 2)
+	if err != nil {
+		t.Fatalf("Failed to open rotating file: %v", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if string(current) != "fourth line\n" {
+		t.Errorf("Expected current log to hold the last line, got %q", current)
+	}
+
+	newest, _ := os.ReadFile(path + ".1")
+	if string(newest) != "third line\n" {
+		t.Errorf("Expected .1 to hold the previous line, got %q", newest)
+	}
+
+	oldest, _ := os.ReadFile(path + ".2")
+	if string(oldest) != "second line\n" {
+		t.Errorf("Expected .2 to hold the oldest kept line, got %q", oldest)
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected backups beyond maxBackups to be dropped")
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "double-agent.log")
+
+	rf, err := NewRotatingFile(path, 0, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("Failed to open rotating file: %v", err)
+	}
+	defer rf.Close()
+
+	_, _ = rf.Write([]byte("old entry\n"))
+
+	// Pretend the file was started long ago
+	rf.created = time.Now().Add(-2 * time.Hour)
+
+	_, _ = rf.Write([]byte("new entry\n"))
+
+	current, _ := os.ReadFile(path)
+	if strings.Contains(string(current), "old entry") {
+		t.Error("Expected old entry to be rotated out of the current log")
+	}
+	rotated, _ := os.ReadFile(path + ".1")
+	if string(rotated) != "old entry\n" {
+		t.Errorf("Expected rotated log to contain old entry, got %q", rotated)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loopReason explains why proxying to the agent on the other end of conn
+// could loop back into double-agent, or returns "" if it can't. Another
+// double-agent may in turn discover this proxy, forwarding requests in a
+// circle that hangs clients. The proxy's own socket is caught separately
+// through Discovery.Exclude, since a process can serve genuine agents too.
+func loopReason(conn net.Conn) string {
+	pid := peerPID(conn)
+	if pid <= 0 || pid == os.Getpid() {
+		return ""
+	}
+	comm, err := os.ReadFile(filepath.Join("/proc", fmt.Sprint(pid), "comm"))
+	if err == nil && strings.TrimSpace(string(comm)) == "double-agent" {
+		return fmt.Sprintf("excluded: served by another double-agent proxy (pid %d), using it could create a loop", pid)
+	}
+	return ""
+}
+
+// sameSocket reports whether a and b name the same socket file, or the
+// same abstract socket.
+func sameSocket(a, b string) bool {
+	if IsAbstractSocket(a) || IsAbstractSocket(b) {
+		return a == b
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
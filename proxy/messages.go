@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// readMessage reads one framed agent message of at most limit bytes and
+// returns its body (type byte and payload) without the length prefix. A
+// longer message is left unread and reported as *messageTooLargeError.
+func readMessage(r io.Reader, limit uint32) ([]byte, error) {
+	var buf []byte
+	return readMessageInto(r, limit, &buf)
+}
+
+// readMessageInto is readMessage reading into *buf, which grows if the
+// message doesn't fit. The message is only good until *buf is reused.
+func readMessageInto(r io.Reader, limit uint32, buf *[]byte) ([]byte, error) {
+	// The header goes in *buf too, as an array would escape to the heap
+	if cap(*buf) < 4 {
+		*buf = make([]byte, 4)
+	}
+	header := (*buf)[:4]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return nil, errorOfKind(ErrProtocol, "invalid message length: %d", length)
+	}
+	if length > limit {
+		return nil, &messageTooLargeError{length: length, limit: limit}
+	}
+	if uint32(cap(*buf)) < length {
+		*buf = make([]byte, length)
+	}
+	message := (*buf)[:length]
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeMessage frames message with its length prefix and writes it in a
+// single call.
+func writeMessage(w io.Writer, message []byte) error {
+	buf := getMessageBuffer()
+	defer putMessageBuffer(buf)
+	framed := binary.BigEndian.AppendUint32((*buf)[:0], uint32(len(message)))
+	framed = append(framed, message...)
+	*buf = framed
+	_, err := w.Write(framed)
+	return err
+}
+
+// messageMode reports whether connections must be proxied message by
+// message because middleware needs to see requests or responses.
+func (ap *AgentProxy) messageMode() bool {
+	return ap.maxMessageSize > 0 || ap.upstreamTimeout > 0 || len(ap.middleware()) > 0
+}
+
+// proxyMessages relays requests and responses one at a time through the
+// middleware chain, which the agent protocol allows since every request
+// gets exactly one response. It returns nil when the client closes
+// between requests, or is cut off for sending a message over the size
+// limit.
+func (ap *AgentProxy) proxyMessages(clientConn, agentConn net.Conn, stats *connStats) error {
+	limit := uint32(maxAgentMessage)
+	if ap.maxMessageSize > 0 {
+		limit = uint32(min(ap.maxMessageSize, maxAgentMessage))
+	}
+	session := &Session{Client: stats.client, Upstream: stats.upstream, rateKey: rateKey(clientConn, stats.exe)}
+	if ap.tracer != nil {
+		span := newSpan("agent connection", nil)
+		span.Attributes["agent.upstream"] = session.Upstream
+		span.Attributes["agent.client"] = session.Client
+		session.span = &span
+		defer func() {
+			span.End = time.Now()
+			ap.tracer.ExportSpan(span)
+		}()
+	}
+
+	// Requests are read into one buffer for the connection. Responses
+	// each get their own, since middleware may call upstream more than
+	// once per request, and go back to the pool once the reply is written.
+	requestBuf := getMessageBuffer()
+	defer putMessageBuffer(requestBuf)
+	var responseBufs []*[]byte
+	defer func() { releaseMessageBuffers(responseBufs) }()
+
+	forward := func(req *Request) ([]byte, error) {
+		if ap.upstreamTimeout > 0 {
+			_ = agentConn.SetDeadline(time.Now().Add(ap.upstreamTimeout))
+			defer func() { _ = agentConn.SetDeadline(time.Time{}) }()
+		}
+		if err := writeMessage(stats.in, req.Message); err != nil {
+			return nil, ap.upstreamError(req, err)
+		}
+		buf := getMessageBuffer()
+		responseBufs = append(responseBufs, buf)
+		response, err := readMessageInto(agentConn, maxAgentMessage, buf)
+		if err != nil {
+			return nil, ap.upstreamError(req, err)
+		}
+		t := responseType(response)
+		req.Session.upstreamFailed = t == SSH_AGENT_FAILURE || t == SSH_AGENT_EXTENSION_FAILURE
+		return response, nil
+	}
+	handler := chain(forward, ap.middleware())
+
+	for {
+		message, err := readMessageInto(clientConn, limit, requestBuf)
+		if err != nil {
+			var tooLarge *messageTooLargeError
+			if errors.As(err, &tooLarge) {
+				// The rest of the message is never read, so the
+				// connection can't continue past the failure
+				ap.logger.Warn("Rejecting oversized request", "client", session.Client, "error", err)
+				response := failure()
+				if ap.failureDetails {
+					response = ap.refusal(oversizedType(clientConn), "", session, err.Error())
+				}
+				return writeMessage(stats.out, response)
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		response, err := handler(&Request{Message: message, Session: session})
+		if errors.Is(err, ErrUpstreamTimeout) {
+			// The upstream connection is out of step now, so this is
+			// the last request it serves
+			_ = writeMessage(stats.out, failure())
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if len(response) == 0 {
+			response = failure()
+		}
+		err = writeMessage(stats.out, response)
+		responseBufs = releaseMessageBuffers(responseBufs)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// releaseMessageBuffers returns bufs to the pool and empties the slice for
+// reuse.
+func releaseMessageBuffers(bufs []*[]byte) []*[]byte {
+	for _, buf := range bufs {
+		putMessageBuffer(buf)
+	}
+	return bufs[:0]
+}
+
+// upstreamError tags a deadline expiring while exchanging req with the
+// upstream agent as ErrUpstreamTimeout, counting and logging it.
+func (ap *AgentProxy) upstreamError(req *Request, err error) error {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	ap.serveMu.Lock()
+	ap.metrics.UpstreamTimeouts++
+	ap.serveMu.Unlock()
+	ap.logger.Warn("Upstream agent did not answer in time",
+		"upstream", req.Session.Upstream,
+		"client", req.Session.Client,
+		"type", messageTypeName(req.Type()),
+		"timeout", ap.upstreamTimeout)
+	if ap.notifier != nil {
+		ap.notifier.connectionDone(true)
+	}
+	return errorOfKind(ErrUpstreamTimeout, "%s request to %s: no answer within %s",
+		messageTypeName(req.Type()), req.Session.Upstream, ap.upstreamTimeout)
+}
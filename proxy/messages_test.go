@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	agentSocket := createSilentSocket(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithUpstreamTimeout(100*time.Millisecond),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := writeMessage(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	response, err := readMessage(conn, maxAgentMessage)
+	if err != nil {
+		t.Fatalf("Expected a response once the deadline passed, got %v", err)
+	}
+	if response[0] != SSH_AGENT_FAILURE {
+		t.Errorf("Expected SSH_AGENT_FAILURE, got message type %d", response[0])
+	}
+	if _, err := readMessage(conn, maxAgentMessage); err != io.EOF {
+		t.Errorf("Expected the connection to close after a timeout, got %v", err)
+	}
+
+	if got := ap.Status().Metrics.UpstreamTimeouts; got != 1 {
+		t.Errorf("Expected one upstream timeout counted, got %d", got)
+	}
+}
+
+func TestUpstreamTimeoutAnswered(t *testing.T) {
+	agentSocket := createMockAgent(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithUpstreamTimeout(200*time.Millisecond),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	// The deadline is per request: a client idle between requests for
+	// longer than it keeps its connection
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		for range 2 {
+			if _, err := client.List(); err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+	if got := ap.Status().Metrics.UpstreamTimeouts; got != 0 {
+		t.Errorf("Expected no upstream timeouts, got %d", got)
+	}
+}
+
+func TestLargeCertificateMessages(t *testing.T) {
+	agentSocket, _ := startKeyringAgent(t, "upstream")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithExtensionPolicy(ExtensionPolicy{BlockUnknown: true}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	// Teleport issues certificates listing every login and role, which
+	// can run well past OpenSSH's 256KiB message limit
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	caSigner := newHostKey(t)
+	cert := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		CertType:    ssh.UserCert,
+		KeyId:       "teleport",
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	for i := 0; i < 10000; i++ {
+		cert.ValidPrincipals = append(cert.ValidPrincipals, fmt.Sprintf("principal-%05d-%s", i, strings.Repeat("x", 24)))
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	if len(cert.Marshal()) <= 256*1024 {
+		t.Fatalf("Expected a certificate over 256KiB, got %d bytes", len(cert.Marshal()))
+	}
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		if err := client.Add(agent.AddedKey{PrivateKey: key, Certificate: cert, Comment: "teleport"}); err != nil {
+			t.Fatalf("Expected adding the certificate through the proxy to succeed, got %v", err)
+		}
+	})
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	var found bool
+	for _, id := range identities {
+		found = found || bytes.Equal(id.Blob, cert.Marshal())
+	}
+	if !found {
+		t.Error("Expected the certificate in the identities listed through the proxy")
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+// Request is one agent request passing through the proxy.
+type Request struct {
+	// Message is the request's type byte and payload, without the length
+	// prefix. Middleware may replace it before calling the next handler.
+	// Its buffer is reused once the request is answered, so middleware
+	// must copy anything it keeps.
+	Message []byte
+
+	// Session describes the client connection the request arrived on.
+	Session *Session
+}
+
+// Type returns the request's message type, such as SSH_AGENTC_SIGN_REQUEST.
+func (r *Request) Type() byte {
+	return r.Message[0]
+}
+
+// Session is what the proxy knows about one client connection. It lasts
+// for the connection, so middleware can remember things across requests.
+type Session struct {
+	// Client identifies the client process on Linux, or its host over
+	// TCP, and is "" when the client can't be told apart from others.
+	Client string
+
+	// Upstream is the address of the agent the connection is proxied to.
+	Upstream string
+
+	// HostKey is the server host key from the client's latest verified
+	// session-bind@openssh.com, when a destination policy is in use.
+	HostKey []byte
+
+	// span is the connection's span when tracing, parent to its requests
+	span *Span
+
+	// rateKey is who the sign rate limit counts the connection's requests
+	// against
+	rateKey string
+
+	// upstreamFailed is set when the upstream agent answered the latest
+	// request it was sent with a failure
+	upstreamFailed bool
+}
+
+// Handler answers an agent request with a response in the same form as
+// Request.Message. An error ends the client's connection; to refuse a
+// request, answer SSH_AGENT_FAILURE instead. Like Request.Message, a
+// response from next is only good until the request is answered.
+type Handler func(req *Request) ([]byte, error)
+
+// Middleware wraps a handler to filter, audit, or rewrite the requests
+// passing through it and the responses coming back. Calling next passes
+// the request on towards the upstream agent; not calling it answers the
+// client directly.
+type Middleware func(next Handler) Handler
+
+// failure is the response for refused requests.
+func failure() []byte {
+	return []byte{SSH_AGENT_FAILURE}
+}
+
+// responseType returns the message type of response, or 0 if it's empty.
+func responseType(response []byte) byte {
+	if len(response) == 0 {
+		return 0
+	}
+	return response[0]
+}
+
+// middleware returns the chain requests pass through, outermost first:
+// tracing, refusal IDs, middleware from WithMiddleware, then the built-in
+// features in the order they must see requests, then packet tracing.
+func (ap *AgentProxy) middleware() []Middleware {
+	var chain []Middleware
+	if ap.tracer != nil {
+		chain = append(chain, ap.traceMiddleware)
+	}
+	// Ahead of every middleware that might refuse a request
+	if ap.failureDetails {
+		chain = append(chain, ap.refusalMiddleware)
+	}
+	chain = append(chain, ap.custom...)
+	if ap.lock != nil {
+		chain = append(chain, ap.lock.middleware(ap.logger))
+	}
+	if ap.signLimiter != nil {
+		chain = append(chain, ap.rateLimitMiddleware)
+	}
+	if ap.extensions.enabled() {
+		chain = append(chain, ap.extensions.middleware(ap.logger))
+	}
+	// Certificates are swapped for their keys before key policy and
+	// destination rules, which name keys, are checked
+	if ap.certs != nil {
+		chain = append(chain, ap.certs.middleware(ap.logger))
+	}
+	if ap.keyPolicy != nil {
+		chain = append(chain, ap.keyPolicy.middleware(ap.logger))
+	}
+	if ap.destinations != nil {
+		chain = append(chain, ap.destinations.middleware(ap.logger))
+	}
+	if ap.addConstraints.enabled() {
+		chain = append(chain, ap.addConstraints.middleware(ap.logger))
+	}
+	if ap.notifier != nil && ap.notifier.kinds[NotifySign] {
+		chain = append(chain, ap.notifier.signMiddleware)
+	}
+	if ap.notifier != nil && ap.notifier.kinds[NotifyTouch] {
+		chain = append(chain, ap.notifier.touchMiddleware(ap.logger))
+	}
+	if ap.originTags {
+		chain = append(chain, originTagMiddleware)
+	}
+	// After origin tags, which name the upstream agent, not the overlay
+	if ap.overlay != nil {
+		chain = append(chain, ap.overlay.middleware(ap.logger))
+	}
+	// Innermost, to show exactly what the upstream agent sees
+	if ap.packetTrace {
+		chain = append(chain, ap.packetTraceMiddleware)
+	}
+	return chain
+}
+
+// chain wraps handler in middleware, the first outermost.
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
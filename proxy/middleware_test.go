@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	named := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(req *Request) ([]byte, error) {
+				order = append(order, name)
+				return next(req)
+			}
+		}
+	}
+	handler := chain(func(req *Request) ([]byte, error) {
+		order = append(order, "upstream")
+		return []byte{SSH_AGENT_SUCCESS}, nil
+	}, []Middleware{named("first"), named("second")})
+
+	if _, err := handler(&Request{Message: []byte{SSH_AGENTC_REQUEST_IDENTITIES}, Session: &Session{}}); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if got := strings.Join(order, ","); got != "first,second,upstream" {
+		t.Errorf("Expected middleware to run in order, got %s", got)
+	}
+}
+
+func TestWithMiddleware(t *testing.T) {
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	var mu sync.Mutex
+	var seen []byte
+	audit := func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			mu.Lock()
+			seen = append(seen, req.Type())
+			mu.Unlock()
+			return next(req)
+		}
+	}
+	denySign := func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			if req.Type() == SSH_AGENTC_SIGN_REQUEST {
+				return []byte{SSH_AGENT_FAILURE}, nil
+			}
+			return next(req)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithMiddleware(audit, denySign),
+		WithOriginTags(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one identity, got %v (%v)", identities, err)
+	}
+	if !strings.HasSuffix(identities[0].Comment, "[local]") {
+		t.Errorf("Expected built-in middleware to still run, got comment %q", identities[0].Comment)
+	}
+	if _, err := Sign(proxySocket, identities[0], []byte("challenge"), 0); err == nil {
+		t.Error("Expected the middleware to refuse signing")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(seen) != string([]byte{SSH_AGENTC_REQUEST_IDENTITIES, SSH_AGENTC_SIGN_REQUEST}) {
+		t.Errorf("Expected the audit middleware to see both requests, got %v", seen)
+	}
+}
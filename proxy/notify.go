@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification kinds for WithNotifier
+const (
+	// NotifyFailover: the proxy switched to a different upstream agent
+	NotifyFailover = "failover"
+	// NotifyNoAgent: clients are being turned away with no upstream
+	NotifyNoAgent = "no-agent"
+	// NotifySign: a sign request went upstream, where a hardware key or
+	// confirming agent may be waiting for the user
+	NotifySign = "sign"
+	// NotifyFailures: several client connections in a row have failed
+	NotifyFailures = "failures"
+	// NotifyTouch: a sign request has gone unanswered for a while, as when
+	// a security key is waiting to be touched
+	NotifyTouch = "touch"
+)
+
+// repeatedFailures is how many failed connections in a row it takes to
+// raise NotifyFailures.
+const repeatedFailures = 3
+
+// touchDelay is how long a sign request may be pending upstream before
+// NotifyTouch assumes the user's attention is needed. Agents that sign
+// on their own answer well within it.
+const touchDelay = 2 * time.Second
+
+// Notification is a significant proxy event worth telling the user about.
+type Notification struct {
+	Kind    string
+	Message string
+}
+
+// notifier turns proxy state changes into notifications, raising each
+// ongoing problem once rather than on every connection.
+type notifier struct {
+	notify     func(Notification)
+	kinds      map[string]bool
+	touchDelay time.Duration
+
+	mu           sync.Mutex
+	lastUpstream string
+	noAgent      bool
+	failures     int
+}
+
+func newNotifier(notify func(Notification), kinds []string) *notifier {
+	if len(kinds) == 0 {
+		kinds = []string{NotifyFailover, NotifyNoAgent, NotifySign, NotifyFailures, NotifyTouch}
+	}
+	n := &notifier{notify: notify, kinds: make(map[string]bool), touchDelay: touchDelay}
+	for _, kind := range kinds {
+		n.kinds[kind] = true
+	}
+	return n
+}
+
+func (n *notifier) emit(kind, format string, args ...any) {
+	if n.kinds[kind] {
+		n.notify(Notification{Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// upstreamFound records the socket discovery picked, noting a failover
+// when it replaces a different one.
+func (n *notifier) upstreamFound(socket string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lastUpstream != "" && socket != n.lastUpstream {
+		n.emit(NotifyFailover, "Switched SSH agent from %s to %s", n.lastUpstream, socket)
+	}
+	n.lastUpstream = socket
+	n.noAgent = false
+}
+
+// upstreamMissing notes that a client was turned away without an agent.
+func (n *notifier) upstreamMissing() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.noAgent {
+		n.emit(NotifyNoAgent, "No SSH agent available; is agent forwarding on?")
+	}
+	n.noAgent = true
+}
+
+// connectionDone tracks consecutive failed connections.
+func (n *notifier) connectionDone(failed bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !failed {
+		n.failures = 0
+		return
+	}
+	n.failures++
+	if n.failures == repeatedFailures {
+		n.emit(NotifyFailures, "%d SSH agent connections in a row have failed", n.failures)
+	}
+}
+
+// signMiddleware announces each sign request as it goes upstream.
+func (n *notifier) signMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		if req.Type() == SSH_AGENTC_SIGN_REQUEST {
+			if blob, _, ok := readWireString(req.Message[1:]); ok {
+				n.emit(NotifySign, "Signing with %s via %s", Identity{Blob: blob}.Fingerprint(), req.Session.Upstream)
+			}
+		}
+		return next(req)
+	}
+}
+
+// touchMiddleware speaks up when a sign request is still pending upstream
+// after touchDelay, rather than leaving the client to block in silence.
+func (n *notifier) touchMiddleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			if req.Type() != SSH_AGENTC_SIGN_REQUEST {
+				return next(req)
+			}
+			blob, _, ok := readWireString(req.Message[1:])
+			if !ok {
+				return next(req)
+			}
+			key, delay := Identity{Blob: blob}, n.touchDelay
+			timer := time.AfterFunc(delay, func() {
+				logger.Info("Sign request waiting on upstream agent",
+					"upstream", req.Session.Upstream,
+					"key", key.Fingerprint(),
+					"waited", delay)
+				if isSecurityKey(key) {
+					n.emit(NotifyTouch, "Waiting for security key touch to sign with %s", key.Fingerprint())
+				} else {
+					n.emit(NotifyTouch, "Waiting for %s to sign with %s; it may need confirmation",
+						req.Session.Upstream, key.Fingerprint())
+				}
+			})
+			defer timer.Stop()
+			return next(req)
+		}
+	}
+}
+
+// isSecurityKey reports whether key lives on a FIDO security key, which
+// only signs once touched.
+func isSecurityKey(key Identity) bool {
+	return strings.HasPrefix(key.Type(), "sk-")
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type notificationRecorder struct {
+	mu   sync.Mutex
+	seen []Notification
+}
+
+func (r *notificationRecorder) notify(n Notification) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = append(r.seen, n)
+}
+
+func (r *notificationRecorder) kinds() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kinds []string
+	for _, n := range r.seen {
+		kinds = append(kinds, n.Kind)
+	}
+	return strings.Join(kinds, ",")
+}
+
+func TestNotifierEvents(t *testing.T) {
+	recorder := &notificationRecorder{}
+	n := newNotifier(recorder.notify, nil)
+
+	n.upstreamFound("/tmp/ssh-a/agent.1")
+	n.upstreamFound("/tmp/ssh-a/agent.1")
+	n.upstreamFound("/tmp/ssh-b/agent.2")
+	for i := 0; i < repeatedFailures+2; i++ {
+		n.upstreamMissing()
+		n.connectionDone(true)
+	}
+	n.upstreamFound("/tmp/ssh-b/agent.2")
+	n.connectionDone(false)
+	n.upstreamMissing()
+
+	if got, want := recorder.kinds(), "failover,no-agent,failures,no-agent"; got != want {
+		t.Errorf("Expected notifications %s, got %s", want, got)
+	}
+}
+
+func TestNotifierKinds(t *testing.T) {
+	recorder := &notificationRecorder{}
+	n := newNotifier(recorder.notify, []string{NotifyNoAgent})
+
+	n.upstreamFound("/tmp/ssh-a/agent.1")
+	n.upstreamFound("/tmp/ssh-b/agent.2")
+	n.upstreamMissing()
+
+	if got := recorder.kinds(); got != NotifyNoAgent {
+		t.Errorf("Expected only the no-agent notification, got %s", got)
+	}
+}
+
+func TestNotifySign(t *testing.T) {
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	recorder := &notificationRecorder{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNotifier(recorder.notify, NotifySign),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one identity, got %v (%v)", identities, err)
+	}
+	if _, err := Sign(proxySocket, identities[0], []byte("challenge"), 0); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.seen) != 1 || !strings.Contains(recorder.seen[0].Message, identities[0].Fingerprint()) {
+		t.Errorf("Expected one sign notification naming the key, got %v", recorder.seen)
+	}
+}
+
+// slowAgent is a keyring that takes delay to sign, like one waiting for
+// a touch.
+type slowAgent struct {
+	agent.Agent
+	delay time.Duration
+}
+
+func (a slowAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	time.Sleep(a.delay)
+	return a.Agent.Sign(key, data)
+}
+
+func TestNotifyTouch(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(slowAgent{Agent: keyring, delay: 300 * time.Millisecond}, conn)
+			}()
+		}
+	}()
+
+	recorder := &notificationRecorder{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNotifier(recorder.notify, NotifyTouch),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	ap.notifier.touchDelay = 100 * time.Millisecond
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Expected one identity, got %v (%v)", identities, err)
+	}
+	if recorder.kinds() != "" {
+		t.Fatalf("Expected no notification for a listing, got %s", recorder.kinds())
+	}
+	if _, err := Sign(proxySocket, identities[0], []byte("challenge"), 0); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if got := recorder.kinds(); got != NotifyTouch {
+		t.Errorf("Expected a touch notification for the slow signature, got %q", got)
+	}
+
+	// A signature answered within the delay raises nothing
+	ap.notifier.touchDelay = time.Second
+	if _, err := Sign(proxySocket, identities[0], []byte("challenge"), 0); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if got := recorder.kinds(); got != NotifyTouch {
+		t.Errorf("Expected no further notification, got %q", got)
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultCacheTTL is how long a discovered upstream socket is reused before
+// discovery runs again.
+const DefaultCacheTTL = 5 * time.Second
+
+// DefaultNegativeCacheTTL is how long a discovery scan that found no agent
+// is trusted before connections trigger another.
+const DefaultNegativeCacheTTL = 2 * time.Second
+
+// Discoverer locates the upstream agent socket the proxy should forward to.
+type Discoverer interface {
+	FindActiveSocket() (string, error)
+}
+
+// DiscovererFunc adapts an ordinary function to the Discoverer interface.
+type DiscovererFunc func() (string, error)
+
+// FindActiveSocket implements Discoverer
+func (f DiscovererFunc) FindActiveSocket() (string, error) {
+	return f()
+}
+
+// ConnDiscoverer is a Discoverer that can also hand over the connection it
+// validated the socket with, still open, so the client that triggered a
+// scan doesn't connect a second time. Discovery implements it.
+type ConnDiscoverer interface {
+	Discoverer
+	FindActiveConn() (string, net.Conn, error)
+}
+
+// Option configures an AgentProxy created with New.
+type Option func(*AgentProxy)
+
+// WithLogger sets the logger used for proxy events. By default the proxy
+// logs through slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(ap *AgentProxy) {
+		ap.logger = logger
+	}
+}
+
+// WithDiscoverer replaces the built-in /tmp socket scan with d.
+func WithDiscoverer(d Discoverer) Option {
+	return func(ap *AgentProxy) {
+		ap.discoverer = d
+	}
+}
+
+// WithCacheTTL sets how long a discovered socket is reused before
+// discovery runs again. Zero runs discovery for every connection.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(ap *AgentProxy) {
+		ap.cacheTTL = ttl
+	}
+}
+
+// WithNegativeCacheTTL sets how long, after discovery finds no agent,
+// connections are answered SSH_AGENT_FAILURE straight away instead of each
+// running a scan of its own. Zero scans for every connection.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(ap *AgentProxy) {
+		ap.negativeTTL = ttl
+	}
+}
+
+// WithValidateCached probes a cached socket before each reuse, running
+// discovery again if it no longer answers. By default a cached socket is
+// trusted until connecting to it fails, since some forwarding
+// implementations (e.g., Blink) can't accept a new connection right after
+// a probe's closes.
+func WithValidateCached(enabled bool) Option {
+	return func(ap *AgentProxy) {
+		ap.validateCached = enabled
+	}
+}
+
+// WithProbeTimeout sets how long an upstream has to answer when the proxy
+// validates it itself: cached sockets under WithValidateCached, Pin, and
+// WithHotStandby's connections. Discovery has its own ProbeTimeout. Zero
+// means DefaultProbeTimeout.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(ap *AgentProxy) {
+		ap.probeTimeout = DefaultProbeTimeout
+		if timeout > 0 {
+			ap.probeTimeout = timeout
+		}
+	}
+}
+
+// WithStateFile remembers the last upstream that worked in path. On
+// startup the proxy tries it before running discovery, so a restart
+// mid-session serves its first client without a full scan. The remembered
+// socket is checked as a discovered one would be if the discoverer is a
+// SocketValidator, and probed otherwise.
+func WithStateFile(path string) Option {
+	return func(ap *AgentProxy) {
+		ap.stateFile = path
+	}
+}
+
+// WithHotStandby keeps idle, validated connections to the active upstream
+// and to the next-best one, which the discoverer reports if it's a
+// StandbyDiscoverer. Clients are handed a ready connection instead of
+// waiting for a dial, and when the active agent goes away the standby
+// takes over for the next request while discovery reruns in the
+// background, rather than the client waiting for a full rescan.
+func WithHotStandby(enabled bool) Option {
+	return func(ap *AgentProxy) {
+		ap.standby = nil
+		if enabled {
+			ap.standby = &hotStandby{ap: ap}
+		}
+	}
+}
+
+// WithMaxConnections limits how many client connections are served at
+// once. A connection over the limit waits up to wait for a free slot and
+// is then answered with SSH_AGENT_FAILURE and closed; with a zero wait, or
+// when max connections are already waiting, it is rejected immediately. A max of zero or less means no limit.
+func WithMaxConnections(max int, wait time.Duration) Option {
+	return func(ap *AgentProxy) {
+		ap.slots = nil
+		if max > 0 {
+			ap.slots = make(chan struct{}, max)
+		}
+		ap.overloadWait = wait
+	}
+}
+
+// WithResourceWarnings sets the counts of handler goroutines, upstream
+// connections, and open files past which the proxy logs a warning that
+// connections may be leaking. New proxies warn at DefaultHandlerWarning
+// handlers and DefaultUpstreamConnWarning upstream connections, and don't
+// watch open files.
+func WithResourceWarnings(warnings ResourceWarnings) Option {
+	return func(ap *AgentProxy) {
+		ap.resources.warnings = warnings
+	}
+}
+
+// WithCertificateFiles pairs the SSH certificates in paths (*-cert.pub
+// files) with the upstream keys they certify, listing each certificate
+// alongside its key so clients can authenticate with it. Files are re-read
+// when they change, and expired certificates are left out.
+func WithCertificateFiles(paths ...string) Option {
+	return func(ap *AgentProxy) {
+		ap.certs = nil
+		if len(paths) > 0 {
+			ap.certs = newCertStore(paths)
+		}
+	}
+}
+
+// WithOverlayAgent lists a's keys after the upstream agent's, and has a
+// sign when clients use them, as with the keys in a kms.Agent. Key
+// policies and destination rules apply to them as to any other key.
+func WithOverlayAgent(a agent.ExtendedAgent) Option {
+	return func(ap *AgentProxy) {
+		ap.overlay = nil
+		if a != nil {
+			ap.overlay = &overlay{agent: a}
+		}
+	}
+}
+
+// WithAddConstraints applies c to every key clients add through the proxy,
+// such as with ssh-add, before the upstream agent sees it.
+func WithAddConstraints(c AddConstraints) Option {
+	return func(ap *AgentProxy) {
+		ap.addConstraints = c
+	}
+}
+
+// WithOriginTags appends the upstream each key comes from to its comment
+// in identity listings, such as "[1password]" or
+// "[forwarded:/tmp/ssh-abc/agent.1]", so ssh-add -l shows where keys live.
+func WithOriginTags(enabled bool) Option {
+	return func(ap *AgentProxy) {
+		ap.originTags = enabled
+	}
+}
+
+// WithFailureDetails gives each request the proxy refuses itself, by
+// policy, for its size, or for want of an upstream agent, a refusal ID
+// that is logged with the refusal. Refused extension requests get
+// SSH_AGENT_EXTENSION_FAILURE with a message naming the ID rather than a
+// bare SSH_AGENT_FAILURE, so the client's error can be matched to the log.
+func WithFailureDetails(enabled bool) Option {
+	return func(ap *AgentProxy) {
+		ap.failureDetails = enabled
+	}
+}
+
+// WithPacketTrace logs each message exchanged with the upstream agent at
+// debug level: its type, length, and a preview with key material redacted.
+func WithPacketTrace(enabled bool) Option {
+	return func(ap *AgentProxy) {
+		ap.packetTrace = enabled
+	}
+}
+
+// WithUpstreamTimeout gives the upstream agent d to answer each request.
+// A request it doesn't answer in time gets SSH_AGENT_FAILURE, the client's
+// connection is closed, since a late answer would be taken for the next
+// one, and the next connection rediscovers. Zero, the default, waits
+// forever, which a hardware key waiting for touch may need.
+func WithUpstreamTimeout(d time.Duration) Option {
+	return func(ap *AgentProxy) {
+		ap.upstreamTimeout = d
+	}
+}
+
+// WithMaxMessageSize refuses client requests longer than size bytes,
+// answering SSH_AGENT_FAILURE and closing the connection instead of
+// passing them upstream. Sizes over 16MiB, the most the proxy ever reads,
+// are lowered to it.
+func WithMaxMessageSize(size int) Option {
+	return func(ap *AgentProxy) {
+		ap.maxMessageSize = size
+	}
+}
+
+// WithSignRateLimit allows each client rate sign requests per second on
+// average, in bursts of up to burst, and answers the rest with
+// SSH_AGENT_FAILURE. Clients are told apart by user and executable on
+// Linux, so each new ssh process doesn't start with a full bucket, and by
+// host over TCP; elsewhere all local clients share one bucket. A rate of zero or less means no limit.
+func WithSignRateLimit(rate float64, burst int) Option {
+	return func(ap *AgentProxy) {
+		ap.signLimiter = nil
+		if rate > 0 {
+			ap.signLimiter = newSignLimiter(rate, burst)
+		}
+	}
+}
+
+// WithLockMode sets how agent locks (ssh-add -x) are handled: LockUpstream
+// (the default) passes them to the active upstream only, LockFollow also
+// locks each upstream the proxy switches to while locked, and LockLocal
+// locks the proxy itself. Validate mode with ValidateLockMode.
+func WithLockMode(mode string) Option {
+	return func(ap *AgentProxy) {
+		ap.lock = nil
+		if mode == LockFollow || mode == LockLocal {
+			ap.lock = newLockState(mode)
+		}
+	}
+}
+
+// WithExtensionPolicy sets which agent extension requests are forwarded
+// upstream. Extensions known to be safe, such as session-bind@openssh.com,
+// are always forwarded.
+func WithExtensionPolicy(p ExtensionPolicy) Option {
+	return func(ap *AgentProxy) {
+		ap.extensions = p
+	}
+}
+
+// WithDestinationPolicy refuses sign requests that p doesn't allow for the
+// host the client is connected to.
+func WithDestinationPolicy(p *DestinationPolicy) Option {
+	return func(ap *AgentProxy) {
+		ap.destinations = p
+	}
+}
+
+// WithKeyPolicy limits clients to the keys p allows, optionally asking
+// for confirmation before each signature. To give sockets different
+// policies, serve each with its own proxy.
+func WithKeyPolicy(p *KeyPolicy) Option {
+	return func(ap *AgentProxy) {
+		ap.keyPolicy = p
+	}
+}
+
+// WithUpstreamOwner makes the proxy connect only to agents run by uid,
+// checked against the peer's credentials on every connection. A proxy
+// running as root on a user's behalf needs this, since the user controls
+// their socket paths. Peer credentials are only available on Linux;
+// elsewhere every upstream is refused.
+func WithUpstreamOwner(uid int) Option {
+	return func(ap *AgentProxy) {
+		ap.upstreamUID = uid
+		ap.checkUpstreamUID = true
+	}
+}
+
+// WithMiddleware adds middleware that every request passes through, for
+// filtering, auditing, or rewriting agent messages. Middleware added first
+// sees requests first, and all of it runs before the proxy's built-in
+// features, seeing requests as the client sent them.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(ap *AgentProxy) {
+		ap.custom = append(ap.custom, mw...)
+	}
+}
+
+// WithTracing reports a span to e for every client connection, each
+// request within it, and each discovery scan. Use NewOTLPExporter to send
+// them to an OpenTelemetry collector.
+func WithTracing(e SpanExporter) Option {
+	return func(ap *AgentProxy) {
+		ap.tracer = e
+	}
+}
+
+// WithNotifier calls notify for significant events of the given kinds
+// (NotifyFailover, NotifyNoAgent, NotifySign, NotifyFailures,
+// NotifyTouch), or of every kind if none are given. Ongoing problems are
+// reported once, not on every connection. notify is called on the request
+// path, so it must not block. A nil notify turns notifications off.
+func WithNotifier(notify func(Notification), kinds ...string) Option {
+	return func(ap *AgentProxy) {
+		ap.notifier = nil
+		if notify != nil {
+			ap.notifier = newNotifier(notify, kinds)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// socketClass works out the upstream class of an active socket, as
+// discovery would have classified it.
+func socketClass(path string) string {
+	// Adapter addresses such as LocalAgentAddress double as class names
+	if _, ok := adapter(path); ok {
+		return path
+	}
+	if ok, _ := filepath.Match("/tmp/ssh-*/agent.*", path); ok {
+		return classifyTmpSocket(path)
+	}
+	if currentUser, err := user.Current(); err == nil {
+		home, _ := os.UserHomeDir()
+		if class, ok := knownLocationMatches(currentUser.Uid, home)[path]; ok {
+			return class
+		}
+	}
+	return ClassCustom
+}
+
+// originTag names where upstream's keys live, such as "[1password]".
+// Classes that can have many sockets also carry the path, as in
+// "[forwarded:/tmp/ssh-abc/agent.1]".
+func originTag(upstream string) string {
+	switch class := socketClass(upstream); class {
+	case ClassForwarded, ClassSSHAgent, ClassCustom:
+		return "[" + class + ":" + upstream + "]"
+	default:
+		return "[" + class + "]"
+	}
+}
+
+// originTagMiddleware tags identity listings with the session's upstream.
+func originTagMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		response, err := next(req)
+		if err != nil || req.Type() != SSH_AGENTC_REQUEST_IDENTITIES ||
+			responseType(response) != SSH_AGENT_IDENTITIES_ANSWER {
+			return response, err
+		}
+		return tagIdentities(response, originTag(req.Session.Upstream)), nil
+	}
+}
+
+// tagIdentities appends tag to every comment in an identities answer.
+// Only comments change: clients name keys by blob in sign and remove
+// requests, so those reach the upstream untouched.
+func tagIdentities(answer []byte, tag string) []byte {
+	identities, err := parseIdentities(answer)
+	if err != nil {
+		return answer
+	}
+	for i, id := range identities {
+		if id.Comment == "" {
+			identities[i].Comment = tag
+		} else {
+			identities[i].Comment = id.Comment + " " + tag
+		}
+	}
+	return marshalIdentities(identities)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestOriginTag(t *testing.T) {
+	UseLocalAgent(NewLocalAgent())
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	tests := []struct {
+		upstream string
+		want     string
+	}{
+		{LocalAgentAddress, "[local]"},
+		// No such process, so it's assumed to be forwarded
+		{"/tmp/ssh-abc/agent.999999999", "[forwarded:/tmp/ssh-abc/agent.999999999]"},
+		{"/var/run/agent.sock", "[custom:/var/run/agent.sock]"},
+	}
+	for _, tt := range tests {
+		if got := originTag(tt.upstream); got != tt.want {
+			t.Errorf("originTag(%q) = %q, want %q", tt.upstream, got, tt.want)
+		}
+	}
+}
+
+func TestOriginTagsInListing(t *testing.T) {
+	keyPath := writeTestKey(t, "")
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(keyPath, nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithOriginTags(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("Expected 1 identity, got %d", len(identities))
+	}
+	if !strings.HasSuffix(identities[0].Comment, " [local]") {
+		t.Errorf("Expected the comment to end with the origin, got %q", identities[0].Comment)
+	}
+
+	// The tagged identity still names the key the upstream holds
+	if _, err := Sign(proxySocket, identities[0], []byte("challenge"), 0); err != nil {
+		t.Errorf("Expected signing with a tagged identity to succeed, got %v", err)
+	}
+}
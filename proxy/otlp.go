@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpBatchSize and otlpFlushInterval bound how long spans wait before
+	// they're sent to the collector
+	otlpBatchSize     = 256
+	otlpFlushInterval = 5 * time.Second
+
+	// otlpQueueSize is how many spans may wait to be sent; more are
+	// dropped rather than slowing the proxy down
+	otlpQueueSize = 4096
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over
+// HTTP, JSON encoded. Spans are batched and sent in the background.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+	logger   *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	spans  chan Span
+	done   chan struct{}
+}
+
+// NewOTLPExporter starts an exporter posting to endpoint, the collector's
+// traces URL (e.g. http://localhost:4318/v1/traces).
+func NewOTLPExporter(endpoint string, logger *slog.Logger) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		spans:    make(chan Span, otlpQueueSize),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpan implements SpanExporter, dropping the span if the queue is
+// full.
+func (e *OTLPExporter) ExportSpan(span Span) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Shutdown sends the spans still queued and stops the exporter.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []Span
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		e.logger.Debug("Failed to encode spans", "error", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.logger.Debug("Failed to export spans", "endpoint", e.endpoint, "error", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.logger.Debug("Collector rejected spans", "endpoint", e.endpoint, "status", resp.Status)
+	}
+}
+
+// OTLP JSON encoding, following opentelemetry-proto's
+// ExportTraceServiceRequest.
+type (
+	otlpAttribute struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 1 is OK, 2 is ERROR
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+)
+
+// otlpSpanKindInternal is SPAN_KIND_INTERNAL
+const otlpSpanKindInternal = 1
+
+func otlpRequest(spans []Span) map[string]any {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if span.ParentID != ([8]byte{}) {
+			s.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+		}
+		if span.Err != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.Err}
+		}
+		encoded = append(encoded, s)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]string{"service.name": "double-agent"}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/phinze/double-agent/proxy"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var encoded []otlpAttribute
+	for _, key := range slices.Sorted(maps.Keys(attrs)) {
+		a := otlpAttribute{Key: key}
+		a.Value.StringValue = attrs[key]
+		encoded = append(encoded, a)
+	}
+	return encoded
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// overlay serves the keys of an agent held in the proxy, such as one a
+// cloud KMS signs for, alongside the upstream agent's. Only listing and
+// signing reach it; everything else goes upstream as usual.
+type overlay struct {
+	agent agent.ExtendedAgent
+}
+
+// holds reports whether blob is one of the overlay agent's keys.
+func (o *overlay) holds(blob []byte) (ssh.PublicKey, bool) {
+	keys, err := o.agent.List()
+	if err != nil {
+		return nil, false
+	}
+	for _, key := range keys {
+		if bytes.Equal(key.Blob, blob) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// middleware lists the overlay agent's keys after the upstream agent's and
+// has it answer sign requests for them.
+func (o *overlay) middleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) ([]byte, error) {
+			switch req.Type() {
+			case SSH_AGENTC_SIGN_REQUEST:
+				sr, ok := parseSignRequest(req.Message)
+				if !ok {
+					break
+				}
+				key, ok := o.holds(sr.Blob)
+				if !ok {
+					break
+				}
+				return o.sign(key, sr, logger), nil
+			case SSH_AGENTC_REQUEST_IDENTITIES:
+				response, err := next(req)
+				if err != nil || responseType(response) != SSH_AGENT_IDENTITIES_ANSWER {
+					return response, err
+				}
+				return o.addToIdentities(response), nil
+			}
+			return next(req)
+		}
+	}
+}
+
+// sign answers sr, a sign request for key.
+func (o *overlay) sign(key ssh.PublicKey, sr signRequest, logger *slog.Logger) []byte {
+	signature, err := o.agent.SignWithFlags(key, sr.Data, agent.SignatureFlags(sr.Flags))
+	if err != nil {
+		logger.Warn("Overlay agent failed to sign", "fingerprint", ssh.FingerprintSHA256(key), "error", err)
+		return failure()
+	}
+	return appendWireString([]byte{SSH_AGENT_SIGN_RESPONSE}, ssh.Marshal(signature))
+}
+
+// addToIdentities appends the overlay keys the upstream doesn't already
+// list.
+func (o *overlay) addToIdentities(answer []byte) []byte {
+	identities, err := parseIdentities(answer)
+	if err != nil {
+		return answer
+	}
+	keys, err := o.agent.List()
+	if err != nil || len(keys) == 0 {
+		return answer
+	}
+	for _, key := range keys {
+		if !containsIdentity(identities, key.Blob) {
+			identities = append(identities, Identity{Blob: key.Blob, Comment: key.Comment})
+		}
+	}
+	return marshalIdentities(identities)
+}
+
+func containsIdentity(identities []Identity, blob []byte) bool {
+	for _, id := range identities {
+		if bytes.Equal(id.Blob, blob) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestOverlayAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "overlay"}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	agentSocket, _ := startKeyringAgent(t, "upstream")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithOverlayAgent(keyring.(agent.ExtendedAgent)),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	identities, err := ListIdentities(proxySocket)
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 2 || identities[0].Comment != "upstream" || identities[1].Comment != "overlay" {
+		t.Fatalf("Expected the upstream key followed by the overlay key, got %+v", identities)
+	}
+	if err := SignTest(proxySocket, identities[1]); err != nil {
+		t.Errorf("Expected the overlay agent's signature to verify, got %v", err)
+	}
+	if err := SignTest(proxySocket, identities[0]); err != nil {
+		t.Errorf("Expected the upstream key to keep signing, got %v", err)
+	}
+}
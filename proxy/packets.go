@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// packetPreviewBytes is how much of a message with no known layout a
+// packet trace shows.
+const packetPreviewBytes = 16
+
+// packetTraceMiddleware logs every request passed to the upstream agent and
+// every response it sends back, at debug level. Each message gets its type,
+// length, and a preview with key blobs hashed, signatures truncated, and
+// secrets such as private keys and lock passphrases left out.
+func (ap *AgentProxy) packetTraceMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		if !ap.logger.Enabled(context.Background(), slog.LevelDebug) {
+			return next(req)
+		}
+		ap.logPacket("request", req.Session, req.Message)
+		response, err := next(req)
+		if err != nil {
+			ap.logger.Debug("Packet", "direction", "response", "upstream", req.Session.Upstream, "error", err)
+			return response, err
+		}
+		ap.logPacket("response", req.Session, response)
+		return response, nil
+	}
+}
+
+func (ap *AgentProxy) logPacket(direction string, session *Session, message []byte) {
+	ap.logger.Debug("Packet",
+		"direction", direction,
+		"upstream", session.Upstream,
+		"client", session.Client,
+		"type", messageTypeName(responseType(message)),
+		"length", len(message),
+		"preview", describePacket(message))
+}
+
+// describePacket summarizes an agent message for a packet trace without
+// revealing key material.
+func describePacket(message []byte) string {
+	if len(message) == 0 {
+		return "empty"
+	}
+	body := message[1:]
+	switch message[0] {
+	case SSH_AGENTC_REQUEST_IDENTITIES, SSH_AGENTC_REMOVE_ALL_IDENTITIES,
+		SSH_AGENT_SUCCESS, SSH_AGENT_FAILURE, SSH_AGENT_EXTENSION_FAILURE:
+		if len(body) == 0 {
+			return "no payload"
+		}
+	case SSH_AGENT_IDENTITIES_ANSWER:
+		identities, err := parseIdentities(message)
+		if err != nil {
+			break
+		}
+		parts := []string{fmt.Sprintf("%d keys", len(identities))}
+		for _, id := range identities {
+			parts = append(parts, fmt.Sprintf("[%s %q]", describeKey(id.Blob), id.Comment))
+		}
+		return strings.Join(parts, " ")
+	case SSH_AGENTC_SIGN_REQUEST:
+		sr, ok := parseSignRequest(message)
+		if !ok {
+			break
+		}
+		return fmt.Sprintf("key=%s data=%d bytes flags=%#x",
+			describeKey(sr.Blob), len(sr.Data), sr.Flags)
+	case SSH_AGENT_SIGN_RESPONSE:
+		signature, _, ok := readWireString(body)
+		if !ok {
+			break
+		}
+		format, sig, trailer, ok := parseSignature(signature)
+		if !ok {
+			break
+		}
+		description := fmt.Sprintf("signature=%s %d bytes %s", format, len(sig), hexPreview(sig, 4))
+		if flags, counter, ok := securityKeyCounter(format, trailer); ok {
+			description += fmt.Sprintf(" authenticator flags=%#x counter=%d", flags, counter)
+		}
+		return description
+	case SSH_AGENTC_REMOVE_IDENTITY:
+		if blob, _, ok := readWireString(body); ok {
+			return "key=" + describeKey(blob)
+		}
+	case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED:
+		if keyType, _, ok := readWireString(body); ok {
+			return fmt.Sprintf("key type=%s, private key not shown", keyType)
+		}
+		return "private key not shown"
+	case SSH_AGENTC_ADD_SMARTCARD_KEY, SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED:
+		return "PIN not shown"
+	case SSH_AGENTC_LOCK, SSH_AGENTC_UNLOCK:
+		return "passphrase not shown"
+	case SSH_AGENTC_EXTENSION:
+		// Extension payloads are opaque and may hold anything
+		if name, ok := extensionName(message); ok {
+			return fmt.Sprintf("name=%s payload=%d bytes", name, len(body)-4-len(name))
+		}
+	default:
+		return hexPreview(body, packetPreviewBytes)
+	}
+	return "malformed: " + hexPreview(body, packetPreviewBytes)
+}
+
+// describeKey names a key blob's type and hash.
+func describeKey(blob []byte) string {
+	return Identity{Blob: blob}.Type() + " " + redactedBlob(blob)
+}
+
+// hexPreview renders up to n bytes of b in hex, marking truncation.
+func hexPreview(b []byte, n int) string {
+	if len(b) <= n {
+		return fmt.Sprintf("% x", b)
+	}
+	return fmt.Sprintf("% x …", b[:n])
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// logBuffer collects log output written from the proxy's goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPacketTrace(t *testing.T) {
+	upstream, kill := startKeyringAgent(t, "traced")
+	defer kill()
+
+	var logs logBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithPacketTrace(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	var blob []byte
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		keys, err := client.List()
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("List failed: %v (%d keys)", err, len(keys))
+		}
+		blob = keys[0].Blob
+		if _, err := client.Sign(keys[0], []byte("challenge")); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+	})
+
+	out := logs.String()
+	for _, want := range []string{
+		"type=REQUEST_IDENTITIES",
+		`preview="1 keys [ssh-ed25519 ` + redactedBlob(blob),
+		"type=SIGN_REQUEST",
+		"data=9 bytes",
+		"type=SIGN_RESPONSE",
+		"signature=ssh-ed25519 64 bytes",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in the packet trace:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, base64.StdEncoding.EncodeToString(blob)) {
+		t.Error("Key blob logged unredacted")
+	}
+}
+
+func TestDescribePacketSecrets(t *testing.T) {
+	secret := "hunter2hunter2"
+	tests := []struct {
+		name    string
+		message []byte
+		want    string
+	}{
+		{"add", appendWireString([]byte{SSH_AGENTC_ADD_IDENTITY}, []byte("ssh-ed25519")), "key type=ssh-ed25519, private key not shown"},
+		{"lock", appendWireString([]byte{SSH_AGENTC_LOCK}, []byte(secret)), "passphrase not shown"},
+		{"extension", appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte("query")), "name=query payload=0 bytes"},
+		{"unknown", append([]byte{200}, bytes.Repeat([]byte{0xab}, 20)...), strings.Repeat("ab ", 15) + "ab …"},
+		{"malformed", []byte{SSH_AGENTC_SIGN_REQUEST, 0, 0}, "malformed: 00 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describePacket(tt.message)
+			if got != tt.want {
+				t.Errorf("describePacket = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, secret) {
+				t.Errorf("Secret leaked: %q", got)
+			}
+		})
+	}
+}
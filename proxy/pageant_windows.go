@@ -0,0 +1,123 @@
+//go:build windows
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// PageantAddress is the upstream address that routes requests to a running
+// PuTTY Pageant instance instead of a unix socket.
+const PageantAddress = "pageant"
+
+const (
+	// pageantCopyDataID marks WM_COPYDATA messages as agent requests
+	pageantCopyDataID = 0x804e50ba
+	// pageantMaxMessage is the size of the shared memory Pageant reads
+	// requests from and writes responses to
+	pageantMaxMessage = 8192
+	wmCopyData        = 0x004a
+)
+
+var (
+	user32          = syscall.NewLazyDLL("user32.dll")
+	procFindWindowW = user32.NewProc("FindWindowW")
+	procSendMessage = user32.NewProc("SendMessageW")
+	kernel32        = syscall.NewLazyDLL("kernel32.dll")
+	procMoveMemory  = kernel32.NewProc("RtlMoveMemory")
+
+	// pageantMu serializes queries; Pageant handles one message at a time
+	pageantMu  sync.Mutex
+	pageantSeq atomic.Uint32
+)
+
+type copyDataStruct struct {
+	dwData uintptr
+	cbData uint32
+	lpData uintptr
+}
+
+func init() {
+	registerAdapter(PageantAddress, dialPageant)
+}
+
+func dialPageant() (net.Conn, error) {
+	if !pageantRunning() {
+		return nil, fmt.Errorf("pageant is not running")
+	}
+	return messageConn(queryPageant), nil
+}
+
+func pageantWindow() uintptr {
+	name, _ := syscall.UTF16PtrFromString("Pageant")
+	hwnd, _, _ := procFindWindowW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)))
+	return hwnd
+}
+
+func pageantRunning() bool {
+	return pageantWindow() != 0
+}
+
+// queryPageant sends one framed agent request to Pageant over the
+// WM_COPYDATA shared memory protocol and returns the framed response.
+func queryPageant(request []byte) ([]byte, error) {
+	if len(request) > pageantMaxMessage {
+		return nil, fmt.Errorf("request too large for pageant: %d bytes", len(request))
+	}
+
+	pageantMu.Lock()
+	defer pageantMu.Unlock()
+
+	hwnd := pageantWindow()
+	if hwnd == 0 {
+		return nil, fmt.Errorf("pageant is not running")
+	}
+
+	mapName := fmt.Sprintf("PageantRequest%08x%08x", syscall.Getpid(), pageantSeq.Add(1))
+	mapNamePtr, err := syscall.UTF16PtrFromString(mapName)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := syscall.CreateFileMapping(syscall.InvalidHandle, nil, syscall.PAGE_READWRITE, 0, pageantMaxMessage, mapNamePtr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shared memory: %w", err)
+	}
+	defer func() { _ = syscall.CloseHandle(mapping) }()
+
+	view, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map shared memory: %w", err)
+	}
+	defer func() { _ = syscall.UnmapViewOfFile(view) }()
+
+	procMoveMemory.Call(view, uintptr(unsafe.Pointer(&request[0])), uintptr(len(request)))
+
+	// Pageant expects the mapping name as a NUL-terminated ANSI string
+	name := append([]byte(mapName), 0)
+	cds := copyDataStruct{
+		dwData: pageantCopyDataID,
+		cbData: uint32(len(name)),
+		lpData: uintptr(unsafe.Pointer(&name[0])),
+	}
+	ret, _, _ := procSendMessage.Call(hwnd, wmCopyData, 0, uintptr(unsafe.Pointer(&cds)))
+	if ret == 0 {
+		return nil, fmt.Errorf("pageant rejected the request")
+	}
+
+	header := make([]byte, 4)
+	procMoveMemory.Call(uintptr(unsafe.Pointer(&header[0])), view, 4)
+	length := binary.BigEndian.Uint32(header)
+	if length+4 > pageantMaxMessage {
+		return nil, fmt.Errorf("invalid pageant response length: %d", length)
+	}
+	response := make([]byte, 4+length)
+	procMoveMemory.Call(uintptr(unsafe.Pointer(&response[0])), view, uintptr(len(response)))
+	return response, nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCred returns the credentials of the process on the other end of a
+// unix socket connection, or nil if they can't be determined.
+func peerCred(conn net.Conn) *syscall.Ucred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	_ = raw.Control(func(fd uintptr) {
+		cred, _ = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	return cred
+}
+
+// peerPID returns the PID of the process serving the other end of a unix
+// socket connection, or 0 if it can't be determined.
+func peerPID(conn net.Conn) int {
+	cred := peerCred(conn)
+	if cred == nil {
+		return 0
+	}
+	return int(cred.Pid)
+}
+
+// peerUID returns the UID of the process on the other end of a unix
+// socket connection.
+func peerUID(conn net.Conn) (int, bool) {
+	cred := peerCred(conn)
+	if cred == nil {
+		return 0, false
+	}
+	return int(cred.Uid), true
+}
+
+// processExe returns the executable of the process with pid, or "" if it
+// can't be read, as for another user's process.
+func processExe(pid int) string {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return ""
+	}
+	return exe
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// peerPID is only implemented on Linux; elsewhere loop detection relies on
+// Discovery.Exclude.
+func peerPID(conn net.Conn) int {
+	return 0
+}
+
+// peerUID is only implemented on Linux, the only platform with abstract
+// sockets that need it.
+func peerUID(conn net.Conn) (int, bool) {
+	return 0, false
+}
+
+// processExe is only implemented on Linux, where peerPID can find a PID.
+func processExe(pid int) string {
+	return ""
+}
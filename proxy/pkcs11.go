@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	// pkcs11CheckInterval is how often the private agent is checked for
+	// the token's keys
+	pkcs11CheckInterval = 5 * time.Second
+	// pkcs11LoadTimeout bounds loading the provider, which includes the
+	// token's PIN check
+	pkcs11LoadTimeout = 30 * time.Second
+
+	pkcs11MinBackoff = time.Second
+	pkcs11MaxBackoff = time.Minute
+	// pkcs11StableAfter is how long ssh-agent must run before its exit
+	// resets the restart backoff
+	pkcs11StableAfter = time.Minute
+)
+
+// PKCS11Agent serves the keys on a PKCS#11 token, such as a YubiKey's PIV
+// applet or a smartcard, from a private ssh-agent that it runs, as
+// ssh-agent plus ssh-add -s would. ssh-agent's helper does the PKCS#11
+// work, so the module is never loaded into the proxy. Unlike a hand-run
+// agent, this one is restarted when it exits, and the provider is loaded
+// again when its keys disappear, as they do when the token is unplugged.
+// List Socket in Discovery.PKCS11 to serve its keys.
+type PKCS11Agent struct {
+	// Provider is the path of the PKCS#11 module, such as
+	// /usr/lib/libykcs11.so
+	Provider string
+
+	// Socket is where the private ssh-agent listens
+	Socket string
+
+	// PIN returns the token's PIN, and is called each time the provider
+	// is loaded. A PIN the token rejects counts against its retry limit,
+	// so failed loads are retried with growing delays.
+	PIN PassphraseFunc
+
+	// Program is the ssh-agent to run, found in $PATH if empty
+	Program string
+
+	Logger *slog.Logger
+}
+
+// Run starts the private agent and keeps it serving the provider's keys
+// until ctx is done, then stops it and removes its socket.
+func (pa *PKCS11Agent) Run(ctx context.Context) {
+	defer func() { _ = os.Remove(pa.Socket) }()
+	backoff := pkcs11MinBackoff
+	for {
+		started := time.Now()
+		err := pa.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > pkcs11StableAfter {
+			backoff = pkcs11MinBackoff
+		}
+		pa.logger().Warn("PKCS#11 agent stopped, restarting", "provider", pa.Provider, "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, pkcs11MaxBackoff)
+	}
+}
+
+func (pa *PKCS11Agent) logger() *slog.Logger {
+	if pa.Logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return pa.Logger
+}
+
+// serve runs ssh-agent once, loading the provider into it and reloading
+// it whenever its keys are gone, until the agent exits or ctx is done.
+func (pa *PKCS11Agent) serve(ctx context.Context) error {
+	program := pa.Program
+	if program == "" {
+		program = "ssh-agent"
+	}
+	_ = os.Remove(pa.Socket)
+	// -P allows only this provider, where ssh-agent's default allows any
+	// library under /usr/lib
+	cmd := exec.Command(program, "-D", "-a", pa.Socket, "-P", pa.Provider)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ssh-agent: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	defer func() {
+		_ = cmd.Process.Kill()
+		<-done
+	}()
+
+	check := time.NewTicker(pkcs11CheckInterval)
+	defer check.Stop()
+	loaded := false
+	retry := time.Now()
+	loadBackoff := pkcs11CheckInterval
+	for {
+		if !loaded && !time.Now().Before(retry) {
+			keys, err := pa.load()
+			if err != nil {
+				pa.logger().Warn("Failed to load PKCS#11 provider", "provider", pa.Provider, "error", err, "retry", loadBackoff)
+				retry = time.Now().Add(loadBackoff)
+				loadBackoff = min(loadBackoff*2, 5*time.Minute)
+			} else {
+				pa.logger().Info("Loaded PKCS#11 provider", "provider", pa.Provider, "keys", keys, "socket", pa.Socket)
+				loaded = true
+				loadBackoff = pkcs11CheckInterval
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			done <- err
+			return fmt.Errorf("ssh-agent exited: %w", err)
+		case <-check.C:
+		}
+
+		if loaded {
+			if keys, err := pa.keyCount(); err == nil && keys == 0 {
+				pa.logger().Info("PKCS#11 token keys gone, reloading provider", "provider", pa.Provider)
+				loaded = false
+			}
+		}
+	}
+}
+
+// load adds the provider's keys to the private agent, dropping any it
+// held from an earlier load, and returns how many there are.
+func (pa *PKCS11Agent) load() (int, error) {
+	conn, err := pa.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	remove := appendWireString([]byte{SSH_AGENTC_REMOVE_SMARTCARD_KEY}, []byte(pa.Provider))
+	remove = appendWireString(remove, nil)
+	if _, err := agentRequest(conn, remove, pkcs11LoadTimeout); err != nil {
+		return 0, err
+	}
+
+	var pin []byte
+	if pa.PIN != nil {
+		if pin, err = pa.PIN(pa.Provider); err != nil {
+			return 0, fmt.Errorf("failed to read PIN: %w", err)
+		}
+	}
+	add := appendWireString([]byte{SSH_AGENTC_ADD_SMARTCARD_KEY}, []byte(pa.Provider))
+	add = appendWireString(add, pin)
+	response, err := agentRequest(conn, add, pkcs11LoadTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if response[0] != SSH_AGENT_SUCCESS {
+		return 0, errors.New("ssh-agent refused the provider: is the token present and the PIN right?")
+	}
+
+	_, keys, err := requestIdentities(conn, pkcs11LoadTimeout)
+	return keys, err
+}
+
+// keyCount returns how many keys the private agent holds.
+func (pa *PKCS11Agent) keyCount() (int, error) {
+	conn, err := pa.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	_, keys, err := requestIdentities(conn, DefaultProbeTimeout)
+	return keys, err
+}
+
+// dial connects to the private agent, waiting briefly for a freshly
+// started one to create its socket.
+func (pa *PKCS11Agent) dial() (net.Conn, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", pa.Socket)
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
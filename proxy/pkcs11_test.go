@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testPIN = "123456"
+
+// TestHelperPKCS11Agent stands in for ssh-agent when run by a script from
+// fakeSSHAgent. It answers identity requests, loads one key when given
+// the right PIN for a smartcard, and exits on SSH_AGENTC_REMOVE_ALL_IDENTITIES
+// so tests can kill it.
+func TestHelperPKCS11Agent(t *testing.T) {
+	if os.Getenv("PKCS11_TEST_AGENT") == "" {
+		return
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	socket := args[slices.Index(args, "-a")+1]
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.Exit(2)
+	}
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+
+	var mu sync.Mutex
+	var keys []Identity
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				message, err := readMessage(conn, maxAgentMessage)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				response := failure()
+				switch message[0] {
+				case SSH_AGENTC_REQUEST_IDENTITIES:
+					response = marshalIdentities(keys)
+				case SSH_AGENTC_ADD_SMARTCARD_KEY:
+					_, rest, _ := readWireString(message[1:])
+					if pin, _, _ := readWireString(rest); string(pin) == testPIN {
+						keys = []Identity{{Blob: signer.PublicKey().Marshal(), Comment: "token"}}
+						response = []byte{SSH_AGENT_SUCCESS}
+					}
+				case SSH_AGENTC_REMOVE_SMARTCARD_KEY:
+					keys = nil
+					response = []byte{SSH_AGENT_SUCCESS}
+				case SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+					os.Exit(0)
+				}
+				mu.Unlock()
+				_ = writeMessage(conn, response)
+			}
+		}()
+	}
+}
+
+// fakeSSHAgent writes a script that runs TestHelperPKCS11Agent with the
+// arguments ssh-agent would get.
+func fakeSSHAgent(t *testing.T) string {
+	script := filepath.Join(t.TempDir(), "ssh-agent")
+	writeFile(t, script, fmt.Sprintf("#!/bin/sh\nPKCS11_TEST_AGENT=1 exec %q -test.run='^TestHelperPKCS11Agent$' -- \"$@\"\n", os.Args[0]))
+	if err := os.Chmod(script, 0700); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	return script
+}
+
+func TestPKCS11Agent(t *testing.T) {
+	var mu sync.Mutex
+	pins := 0
+	pa := &PKCS11Agent{
+		Provider: "/usr/lib/test-pkcs11.so",
+		Socket:   filepath.Join(t.TempDir(), "pkcs11.sock"),
+		Program:  fakeSSHAgent(t),
+		PIN: func(string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			pins++
+			return []byte(testPIN), nil
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		pa.Run(ctx)
+	}()
+
+	d := &Discovery{PKCS11: []string{pa.Socket}}
+	tokenKeys := func() bool {
+		sockets, err := d.DiscoverSockets()
+		if err != nil {
+			return false
+		}
+		for _, socket := range sockets {
+			if socket.Path == pa.Socket && socket.Class == ClassPKCS11 && socket.Valid && socket.Keys == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(t, "the token's key to be served", tokenKeys)
+
+	// Kill the private agent; it should come back with the key reloaded
+	conn, err := net.Dial("unix", pa.Socket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	_ = writeMessage(conn, []byte{SSH_AGENTC_REMOVE_ALL_IDENTITIES})
+	_, err = readMessage(conn, maxAgentMessage)
+	conn.Close()
+	if err == nil {
+		t.Fatalf("Expected the agent to exit, got %v", err)
+	}
+	waitFor(t, "the PIN to be asked again", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pins == 2
+	})
+	waitFor(t, "the restarted agent to serve the key", tokenKeys)
+
+	cancel()
+	<-stopped
+	if _, err := os.Stat(pa.Socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed once stopped, got %v", err)
+	}
+}
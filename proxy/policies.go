@@ -0,0 +1,58 @@
+package proxy
+
+import "time"
+
+// Policies summarizes the restrictions a proxy enforces on its clients, so
+// an audit of a running proxy can tell what it guards against.
+type Policies struct {
+	// KeyFilter and HostRules count the entries of the KeyPolicy's Keys
+	// and Hosts, and ConfirmSign reports it asks before each signature
+	KeyFilter   int  `json:"key_filter,omitempty"`
+	HostRules   int  `json:"host_rules,omitempty"`
+	ConfirmSign bool `json:"confirm_sign,omitempty"`
+
+	// DestinationRules counts the keys with a DestinationPolicy rule
+	DestinationRules int `json:"destination_rules,omitempty"`
+
+	// BlockExtensions reports unknown agent extensions are refused
+	BlockExtensions bool `json:"block_unknown_extensions,omitempty"`
+
+	// SignRate is the per-client sign requests allowed per second, zero
+	// if unlimited
+	SignRate float64 `json:"sign_rate,omitempty"`
+
+	// MaxConnections is the connection limit, zero if unlimited
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// AddMaxLifetime and AddConfirm are the constraints forced on keys
+	// clients add
+	AddMaxLifetime time.Duration `json:"add_max_lifetime,omitempty"`
+	AddConfirm     bool          `json:"add_confirm,omitempty"`
+
+	// UpstreamOwnerChecked reports upstream agents must belong to a
+	// particular user
+	UpstreamOwnerChecked bool `json:"upstream_owner_checked,omitempty"`
+}
+
+// policies reports the restrictions ap was configured with.
+func (ap *AgentProxy) policies() Policies {
+	p := Policies{
+		BlockExtensions:      ap.extensions.BlockUnknown,
+		MaxConnections:       cap(ap.slots),
+		AddMaxLifetime:       ap.addConstraints.MaxLifetime,
+		AddConfirm:           ap.addConstraints.Confirm,
+		UpstreamOwnerChecked: ap.checkUpstreamUID,
+	}
+	if ap.keyPolicy != nil {
+		p.KeyFilter = len(ap.keyPolicy.Keys)
+		p.HostRules = len(ap.keyPolicy.Hosts)
+		p.ConfirmSign = ap.keyPolicy.Confirm != nil
+	}
+	if ap.destinations != nil {
+		p.DestinationRules = len(ap.destinations.Rules)
+	}
+	if ap.signLimiter != nil {
+		p.SignRate = ap.signLimiter.rate
+	}
+	return p
+}
@@ -1,79 +1,542 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// AgentProxy forwards SSH agent connections to whichever upstream agent
+// its Discoverer currently reports as active.
 type AgentProxy struct {
 	proxySocket  string
 	mu           sync.RWMutex
 	lastCheck    time.Time
 	activeSocket string
 	logger       *slog.Logger
+	discoverer   Discoverer
+	cacheTTL     time.Duration
+	pinned       string
+
+	// lastProbe is when the active socket last answered a readiness
+	// probe; lastCheck covers the probes discovery and Pin make
+	lastProbe time.Time
+
+	// lastMiss is when discovery last found no agent, reused as the
+	// answer for negativeTTL
+	lastMiss    time.Time
+	negativeTTL time.Duration
+
+	// generation counts changes to the cached socket, pin, and miss.
+	// Probes and scans run without ap.mu, and only commit what they
+	// found if nothing changed meanwhile.
+	generation uint64
+
+	// validateCached probes a cached socket before reusing it, with
+	// probeTimeout bounding the proxy's own probes
+	validateCached bool
+	probeTimeout   time.Duration
+	started        time.Time
+
+	// standby, when set, keeps warm connections for WithHotStandby
+	standby *hotStandby
+
+	// scanning is the discovery scan in progress, which callers that miss
+	// the cache meanwhile wait for rather than starting their own
+	scanning *scan
+
+	// stateFile, when set, remembers the last working upstream across
+	// restarts; restoreTried and savedSocket track its use
+	stateFile    string
+	restoreTried bool
+	savedSocket  string
+
+	// Listeners and client connections being served, for Shutdown
+	serveMu   sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	shutdown  bool
+	metrics   Metrics
+
+	// stopping is closed by Shutdown, releasing connections queued for a
+	// slot
+	stopping chan struct{}
+
+	// recent keeps the latest failovers and connection errors for Status
+	recent recentEvents
+
+	// Connection limit: slots has one entry per connection being served,
+	// and nil means unlimited. overloadWait is how long an accepted
+	// connection may queue for a slot before it's rejected; waiting counts
+	// the queued connections, which are capped at the limit itself.
+	slots            chan struct{}
+	overloadWait     time.Duration
+	waiting          atomic.Int64
+	lastOverloadWarn time.Time
+
+	// resources counts handler goroutines and upstream connections, and
+	// warns when they pass the WithResourceWarnings thresholds
+	resources resourceTracker
+
+	// certs, when set, are added to identity listings
+	certs *certStore
+
+	// overlay, when set, holds keys listed and signed with alongside the
+	// upstream agent's
+	overlay *overlay
+
+	// addConstraints is applied to keys clients add through the proxy
+	addConstraints AddConstraints
+
+	// originTags appends each key's upstream to its comment
+	originTags bool
+
+	// failureDetails logs a refusal ID for each request the proxy refuses
+	// itself, and tells extension clients the ID
+	failureDetails bool
+
+	// packetTrace logs upstream messages at debug level
+	packetTrace bool
+
+	// upstreamTimeout, when positive, is how long the upstream agent has
+	// to answer each request
+	upstreamTimeout time.Duration
+
+	// maxMessageSize, when positive, caps client requests; signLimiter,
+	// when set, rate limits sign requests per client.
+	maxMessageSize int
+	signLimiter    *signLimiter
+
+	// lock tracks ssh-add -x locks under LockFollow and LockLocal
+	lock *lockState
+
+	// extensions decides which agent extensions are forwarded
+	extensions ExtensionPolicy
+
+	// destinations, when set, limits which hosts keys sign for
+	destinations *DestinationPolicy
+
+	// keyPolicy, when set, limits which keys clients see and use
+	keyPolicy *KeyPolicy
+
+	// upstreamUID, when checkUpstreamUID is set, is the only user whose
+	// agents the proxy will connect to
+	upstreamUID      int
+	checkUpstreamUID bool
+
+	// custom is middleware added with WithMiddleware
+	custom []Middleware
+
+	// tracer, when set, receives spans for requests and discovery
+	tracer SpanExporter
+
+	// notifier, when set, reports significant events to the user
+	notifier *notifier
+}
+
+// New creates a proxy for proxySocket configured by opts.
+func New(proxySocket string, opts ...Option) *AgentProxy {
+	ap := &AgentProxy{
+		proxySocket:  proxySocket,
+		logger:       slog.Default(),
+		discoverer:   &Discovery{},
+		cacheTTL:     DefaultCacheTTL,
+		negativeTTL:  DefaultNegativeCacheTTL,
+		probeTimeout: DefaultProbeTimeout,
+		started:      time.Now(),
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		stopping:     make(chan struct{}),
+	}
+	ap.resources.warnings = ResourceWarnings{
+		Handlers:      DefaultHandlerWarning,
+		UpstreamConns: DefaultUpstreamConnWarning,
+	}
+	for _, opt := range opts {
+		opt(ap)
+	}
+	return ap
 }
 
+// NewAgentProxy creates a proxy with default options and the given logger.
 func NewAgentProxy(proxySocket string, logger *slog.Logger) *AgentProxy {
-	return &AgentProxy{
-		proxySocket: proxySocket,
-		logger:      logger,
+	return New(proxySocket, WithLogger(logger))
+}
+
+// ActiveSocket returns the currently cached upstream socket, or "" if none
+// has been discovered yet.
+func (ap *AgentProxy) ActiveSocket() string {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	return ap.activeSocket
+}
+
+// Pin forces the proxy to use socketPath regardless of discovery until
+// Unpin is called or the socket can no longer be connected to. The socket
+// must currently answer as an agent.
+func (ap *AgentProxy) Pin(socketPath string) error {
+	if valid, _, reason := probeAgent(socketPath, ap.upstreamOwner(), ap.probeTimeout, nil); !valid {
+		return fmt.Errorf("cannot pin %s: %s", socketPath, reason)
 	}
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.pinned = socketPath
+	ap.activeSocket = socketPath
+	ap.lastCheck = time.Now()
+	ap.generation++
+	ap.logger.Info("Pinned upstream socket", "socket", socketPath)
+	return nil
 }
 
-func (ap *AgentProxy) InvalidateCache() {
+// Unpin returns the proxy to discovery-based socket selection.
+func (ap *AgentProxy) Unpin() {
 	ap.mu.Lock()
 	defer ap.mu.Unlock()
+	if ap.pinned != "" {
+		ap.logger.Info("Unpinned upstream socket", "socket", ap.pinned)
+	}
+	ap.pinned = ""
 	ap.activeSocket = ""
 	ap.lastCheck = time.Time{}
+	ap.lastMiss = time.Time{}
+	ap.generation++
 }
 
-func (ap *AgentProxy) FindActiveSocketCached() string {
+// unpinGone returns to discovery if socket is pinned, after connecting to
+// it failed.
+func (ap *AgentProxy) unpinGone(socket string) {
 	ap.mu.Lock()
 	defer ap.mu.Unlock()
+	if ap.pinned == "" || ap.pinned != socket {
+		return
+	}
+	ap.logger.Warn("Pinned upstream socket is gone, returning to discovery", "socket", socket)
+	ap.pinned = ""
+	ap.activeSocket = ""
+	ap.lastCheck = time.Time{}
+	ap.generation++
+}
+
+// Status is a point-in-time snapshot of the proxy's state.
+type Status struct {
+	ProxySocket       string    `json:"proxy_socket"`
+	ActiveSocket      string    `json:"active_socket"`
+	Pinned            string    `json:"pinned,omitempty"`
+	Standby           string    `json:"standby,omitempty"`
+	Locked            bool      `json:"locked,omitempty"`
+	LastCheck         time.Time `json:"last_check"`
+	Started           time.Time `json:"started"`
+	ActiveConnections int       `json:"active_connections"`
+	Metrics           Metrics   `json:"metrics"`
+	Resources         Resources `json:"resources"`
+
+	// The most recent failovers and failed connections, oldest first
+	RecentFailovers []Failover  `json:"recent_failovers,omitempty"`
+	RecentErrors    []ConnError `json:"recent_errors,omitempty"`
+
+	// Policies are the restrictions the proxy enforces
+	Policies Policies `json:"policies"`
+}
+
+// Status reports the proxy's current state.
+func (ap *AgentProxy) Status() Status {
+	ap.mu.RLock()
+	status := Status{
+		ProxySocket:  ap.proxySocket,
+		ActiveSocket: ap.activeSocket,
+		Pinned:       ap.pinned,
+		LastCheck:    ap.lastCheck,
+		Started:      ap.started,
+		Policies:     ap.policies(),
+	}
+	ap.mu.RUnlock()
+	if ap.lock != nil {
+		status.Locked = ap.lock.isLocked()
+	}
+	if ap.standby != nil {
+		status.Standby = ap.standby.standbySocket()
+	}
+
+	ap.serveMu.Lock()
+	status.ActiveConnections = len(ap.conns)
+	status.Metrics = ap.metrics.clone()
+	ap.serveMu.Unlock()
+	status.Resources = ap.resources.snapshot()
+	status.RecentFailovers, status.RecentErrors = ap.recent.snapshot()
+	return status
+}
+
+func (ap *AgentProxy) InvalidateCache() {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	// A pinned socket isn't discovered, so there is nothing to invalidate
+	ap.activeSocket = ap.pinned
+	ap.lastCheck = time.Time{}
+	ap.lastMiss = time.Time{}
+	ap.generation++
+}
+
+func (ap *AgentProxy) FindActiveSocketCached() string {
+	socket, conn := ap.findActiveSocket()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	return socket
+}
+
+// findActiveSocket is FindActiveSocketCached that, when it connected to
+// the cached socket to validate it, also returns that connection, still
+// open and ready for a client's requests.
+func (ap *AgentProxy) findActiveSocket() (string, net.Conn) {
+	ap.mu.Lock()
+	if socket, conn, ok := ap.cachedSocketLocked(); ok {
+		ap.mu.Unlock()
+		return socket, conn
+	}
+	return ap.scanOnce()
+}
+
+// cachedSocketLocked returns the socket to use without a scan, reporting
+// false if one is needed. Called with ap.mu held, which it releases while
+// validating a cached socket for WithValidateCached. Validation connects
+// once and, when the socket answers, returns that connection for use, so
+// there's no window between checking the socket and using it.
+func (ap *AgentProxy) cachedSocketLocked() (string, net.Conn, bool) {
+	if ap.pinned != "" {
+		return ap.pinned, nil, true
+	}
 
 	// Return cached socket if still within TTL. HandleConnection's retry
 	// logic will invalidate the cache if the socket turns out to be stale.
-	// We intentionally avoid re-validating with TestSocket here because
-	// some SSH agent forwarding implementations (e.g., Blink) cannot
-	// accept a new connection immediately after one closes.
-	if time.Since(ap.lastCheck) < 5*time.Second && ap.activeSocket != "" {
-		return ap.activeSocket
+	// Unless asked to, we avoid re-validating here because some SSH agent
+	// forwarding implementations (e.g., Blink) cannot accept a new
+	// connection immediately after one closes.
+	if time.Since(ap.lastCheck) < ap.cacheTTL && ap.activeSocket != "" {
+		if !ap.validateCached {
+			return ap.activeSocket, nil, true
+		}
+		socket, generation := ap.activeSocket, ap.generation
+		ap.mu.Unlock()
+		conn, reason := ap.validatedConn(socket)
+		ap.mu.Lock()
+		if ap.generation != generation {
+			// Pinned, invalidated, or rediscovered while probing
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return ap.cachedSocketLocked()
+		}
+		if conn != nil {
+			return socket, conn, true
+		}
+		ap.logger.Debug("Cached socket failed validation, rediscovering",
+			"socket", socket, "reason", reason)
 	}
 
-	// Find a new active socket (TestSocket is called during discovery)
-	activeSocket, err := FindActiveSocket()
+	// A scan that just found nothing is the answer for a while, so a burst
+	// of clients with no agent around don't each run one
+	if !ap.lastMiss.IsZero() && time.Since(ap.lastMiss) < ap.negativeTTL {
+		ap.logger.Debug("No agent found moments ago, skipping discovery",
+			"retry_in", (ap.negativeTTL - time.Since(ap.lastMiss)).Round(time.Millisecond))
+		return "", nil, true
+	}
+	return "", nil, false
+}
+
+// validatedConn connects to socket and checks it answers as an agent,
+// returning the open connection, or nil and the reason it failed.
+func (ap *AgentProxy) validatedConn(socket string) (net.Conn, string) {
+	conn, err := ap.dialUpstream(socket)
 	if err != nil {
+		return nil, describeProbeError("connect", err, ap.probeTimeout)
+	}
+	if valid, _, reason := probeConn(conn, socket, ap.upstreamOwner(), ap.probeTimeout, nil); !valid {
+		_ = conn.Close()
+		return nil, reason
+	}
+	return conn, ""
+}
+
+// scan is a discovery scan in progress; socket is its result once done
+// is closed.
+type scan struct {
+	done   chan struct{}
+	socket string
+}
+
+// scanOnce finds the active socket, joining the scan in progress if there
+// is one, so that a burst of connections missing the cache together cost
+// a single scan. The caller that ran the scan also gets the connection
+// discovery validated the socket with, when the discoverer keeps it.
+// Called with ap.mu held, which it releases.
+func (ap *AgentProxy) scanOnce() (string, net.Conn) {
+	if s := ap.scanning; s != nil {
+		ap.mu.Unlock()
+		<-s.done
+		return s.socket, nil
+	}
+	s := &scan{done: make(chan struct{})}
+	ap.scanning = s
+	restore := ap.stateFile != "" && !ap.restoreTried
+	ap.restoreTried = true
+	generation := ap.generation
+	ap.mu.Unlock()
+
+	defer close(s.done)
+
+	// On startup, the upstream that worked last time skips a full scan
+	if restore {
+		if socket := ap.restoreState(); socket != "" {
+			ap.mu.Lock()
+			ap.scanning = nil
+			if ap.pinned != "" {
+				socket = ap.pinned
+			} else if ap.generation == generation {
+				ap.setActiveSocketLocked(socket)
+			}
+			ap.mu.Unlock()
+			s.socket = socket
+			return socket, nil
+		}
+	}
+
+	// Find a new active socket (TestSocket is called during discovery)
+	activeSocket, conn, err := ap.discover()
+	found := activeSocket
+
+	ap.mu.Lock()
+	ap.scanning = nil
+	switch {
+	case ap.pinned != "":
+		// Pinned while the scan ran, which the pin overrides
+		activeSocket = ap.pinned
+	case ap.generation != generation:
+		// Invalidated while the scan ran: its result still answers the
+		// callers waiting for it, but isn't cached, so the next caller
+		// scans again rather than trust what may already be stale
+		ap.logger.Debug("Cache invalidated during discovery, not caching its result",
+			"socket", activeSocket, "error", err)
+		if err != nil || sameSocket(activeSocket, ap.proxySocket) {
+			activeSocket = ""
+		}
+	case err != nil:
 		ap.logger.Error("Failed to find active socket", "error", err)
 		ap.activeSocket = ""
-		return ""
+		ap.lastMiss = time.Now()
+		activeSocket = ""
+	case sameSocket(activeSocket, ap.proxySocket):
+		ap.logger.Error("Discovery returned the proxy's own socket, refusing to loop",
+			"socket", activeSocket)
+		ap.activeSocket = ""
+		ap.lastMiss = time.Now()
+		activeSocket = ""
+	default:
+		ap.setActiveSocketLocked(activeSocket)
 	}
+	ap.mu.Unlock()
 
-	if ap.activeSocket != activeSocket {
+	if conn != nil {
+		if activeSocket == "" || activeSocket != found {
+			_ = conn.Close()
+			conn = nil
+		} else if conn, err = ap.adoptUpstream(activeSocket, conn); err != nil {
+			conn = nil
+		}
+	}
+	if activeSocket != "" && conn == nil {
+		// Brief pause after discovery, before anyone connects, to allow
+		// agent forwarding implementations to recover from the TestSocket
+		// validation connection.
+		time.Sleep(15 * time.Millisecond)
+	}
+	s.socket = activeSocket
+	return activeSocket, conn
+}
+
+// setActiveSocket records socket as the upstream found by discovery,
+// unless one is pinned.
+func (ap *AgentProxy) setActiveSocket(socket string) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	if ap.pinned == "" {
+		ap.setActiveSocketLocked(socket)
+	}
+}
+
+func (ap *AgentProxy) setActiveSocketLocked(socket string) {
+	if ap.activeSocket != socket {
 		ap.logger.Info("Active socket changed",
 			"from", ap.activeSocket,
-			"to", activeSocket)
+			"to", socket)
 	}
 
-	ap.activeSocket = activeSocket
+	ap.activeSocket = socket
 	ap.lastCheck = time.Now()
+	ap.lastMiss = time.Time{}
+	ap.generation++
+	ap.recent.upstreamFound(socket)
+	if ap.notifier != nil {
+		ap.notifier.upstreamFound(socket)
+	}
+	if ap.stateFile != "" && socket != ap.savedSocket {
+		if err := ap.saveState(socket); err != nil {
+			ap.logger.Debug("Failed to save upstream state", "file", ap.stateFile, "error", err)
+		} else {
+			ap.savedSocket = socket
+		}
+	}
+}
 
-	// Brief pause after discovery to allow agent forwarding implementations
-	// to recover from the TestSocket validation connection.
-	time.Sleep(15 * time.Millisecond)
+// discover asks the discoverer for the active socket, and from a
+// ConnDiscoverer the connection that validated it, reporting a span for
+// the scan when tracing.
+func (ap *AgentProxy) discover() (string, net.Conn, error) {
+	if ap.tracer == nil {
+		return ap.findActiveConn()
+	}
+	span := newSpan("agent discovery", nil)
+	socket, conn, err := ap.findActiveConn()
+	span.End = time.Now()
+	span.Attributes["agent.socket"] = socket
+	if err != nil {
+		span.Err = err.Error()
+	}
+	ap.tracer.ExportSpan(span)
+	return socket, conn, err
+}
 
-	return activeSocket
+func (ap *AgentProxy) findActiveConn() (string, net.Conn, error) {
+	if d, ok := ap.discoverer.(ConnDiscoverer); ok {
+		return d.FindActiveConn()
+	}
+	socket, err := ap.discoverer.FindActiveSocket()
+	return socket, nil, err
 }
 
 func (ap *AgentProxy) HandleConnection(clientConn net.Conn) {
 	defer func() { _ = clientConn.Close() }()
 
+	stats := newConnStats(clientConn)
+	defer ap.finishConn(stats)
+
+	if ap.standby != nil {
+		if agentConn, socket := ap.standby.connect(); agentConn != nil {
+			defer func() { _ = agentConn.Close() }()
+			ap.serveUpstream(clientConn, agentConn, socket, stats)
+			return
+		}
+	}
+
 	// Try up to 2 times (once with cached, once with fresh discovery)
 	for attempt := 0; attempt < 2; attempt++ {
-		activeSocket := ap.FindActiveSocketCached()
+		activeSocket, agentConn := ap.findActiveSocket()
 		if activeSocket == "" {
 			if attempt == 0 {
 				ap.logger.Debug("No active SSH agent socket found, retrying discovery",
@@ -82,9 +545,13 @@ func (ap *AgentProxy) HandleConnection(clientConn net.Conn) {
 				// Final attempt failed - log prominently
 				ap.logger.Warn("No active SSH agent socket available",
 					"hint", "Run 'double-agent --test-discovery' to diagnose. Common causes: stale forwarded socket, agent timeout on slow connection, or no SSH agent forwarding.")
+				stats.err = ErrNoActiveAgent
+				if ap.notifier != nil {
+					ap.notifier.upstreamMissing()
+					ap.notifier.connectionDone(true)
+				}
 				// Send SSH_AGENT_FAILURE response after final attempt
-				failureMsg := []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}
-				if _, err := clientConn.Write(failureMsg); err != nil {
+				if err := ap.refuseUnserved(clientConn, stats, "no upstream agent"); err != nil {
 					ap.logger.Debug("Failed to send agent failure response to client",
 						"error", err)
 				}
@@ -92,18 +559,25 @@ func (ap *AgentProxy) HandleConnection(clientConn net.Conn) {
 			continue
 		}
 
-		agentConn, err := net.Dial("unix", activeSocket)
+		var err error
+		if agentConn == nil {
+			agentConn, err = ap.dialUpstream(activeSocket)
+		}
 		if err != nil {
 			ap.logger.Debug("Failed to connect to agent socket",
 				"socket", activeSocket,
 				"error", err,
 				"attempt", attempt+1)
 			// Invalidate cache so next attempt finds a fresh socket
+			ap.unpinGone(activeSocket)
 			ap.InvalidateCache()
 			if attempt == 1 {
+				stats.err = err
+				if ap.notifier != nil {
+					ap.notifier.connectionDone(true)
+				}
 				// Send SSH_AGENT_FAILURE response after final attempt
-				failureMsg := []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}
-				if _, err := clientConn.Write(failureMsg); err != nil {
+				if err := ap.refuseUnserved(clientConn, stats, "upstream agent unreachable"); err != nil {
 					ap.logger.Debug("Failed to send agent failure response to client",
 						"error", err)
 				}
@@ -113,54 +587,309 @@ func (ap *AgentProxy) HandleConnection(clientConn net.Conn) {
 		defer func() { _ = agentConn.Close() }()
 
 		// Successfully connected, proceed with proxy
-		done := make(chan error, 2)
-
-		// Copy from client to agent
-		go func() {
-			_, err := io.Copy(agentConn, clientConn)
-			done <- err
-		}()
-
-		// Copy from agent to client
-		go func() {
-			_, err := io.Copy(clientConn, agentConn)
-			done <- err
-		}()
-
-		// Wait for one side to finish
-		err = <-done
-
-		// If we had an error during communication, invalidate cache
-		if err != nil && err != io.EOF {
-			ap.logger.Debug("Connection error", "error", err)
-			ap.InvalidateCache()
-		}
-
-		// Connection handled successfully
+		ap.serveUpstream(clientConn, agentConn, activeSocket, stats)
 		return
 	}
 }
 
+// serveUpstream proxies the client's requests to a connected upstream.
+func (ap *AgentProxy) serveUpstream(clientConn, agentConn net.Conn, activeSocket string, stats *connStats) {
+	stats.upstream = activeSocket
+	stats.in = newCountingWriter(agentConn)
+	if ap.notifier != nil {
+		ap.notifier.connectionDone(false)
+	}
+
+	var err error
+	if ap.messageMode() {
+		err = ap.proxyMessages(clientConn, agentConn, stats)
+	} else {
+		err = ap.proxyBytes(clientConn, agentConn, stats)
+	}
+
+	// If we had an error during communication, invalidate cache
+	if err != nil && err != io.EOF {
+		stats.err = err
+		ap.InvalidateCache()
+	}
+}
+
+// proxyBytes copies raw bytes in both directions until either side closes,
+// for when nothing needs to see individual messages.
+func (ap *AgentProxy) proxyBytes(clientConn, agentConn net.Conn, stats *connStats) error {
+	done := make(chan error, 2)
+
+	// Copy from client to agent
+	ap.goHandler(func() {
+		_, err := copyPooled(stats.in, clientConn)
+		done <- err
+	})
+
+	// Copy from agent to client
+	ap.goHandler(func() {
+		_, err := copyPooled(stats.out, agentConn)
+		done <- err
+	})
+
+	// Wait for one side to finish
+	err := <-done
+
+	// Close both ends so the other copy stops, and wait for it so the
+	// connection's stats are complete
+	_ = agentConn.Close()
+	_ = clientConn.Close()
+	<-done
+	return err
+}
+
+// Start listens on the proxy socket path and serves connections until the
+// listener is closed.
 func (ap *AgentProxy) Start() error {
 	listener, err := net.Listen("unix", ap.proxySocket)
 	if err != nil {
-		return fmt.Errorf("failed to create proxy socket: %v", err)
+		return fmt.Errorf("failed to create proxy socket: %w", err)
+	}
+	return ap.Serve(context.Background(), listener)
+}
+
+// Serve accepts client connections on an existing listener, such as one
+// inherited through systemd socket activation. It returns nil once ctx is
+// cancelled or Shutdown is called; the listener is closed when Serve
+// returns.
+func (ap *AgentProxy) Serve(ctx context.Context, listener net.Listener) error {
+	if !ap.trackListener(listener, true) {
+		_ = listener.Close()
+		return nil
 	}
+	defer ap.trackListener(listener, false)
 	defer func() { _ = listener.Close() }()
 
-	ap.logger.Info("SSH Agent proxy listening", "socket", ap.proxySocket)
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+
+	ap.logger.Info("SSH Agent proxy listening", "socket", listener.Addr().String())
+	if ap.standby != nil {
+		ap.standby.warm()
+	}
 
+	var backoff acceptBackoff
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			// Check if error is due to closed listener
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
+			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			ap.logger.Error("Accept error", "error", err)
+			delay := backoff.next()
+			ap.acceptFailed(err, delay)
+			if !backoff.wait(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+		backoff.reset()
+
+		// A connection over the limit waits for a slot in its own
+		// goroutine, so the ones behind it are still accepted and each
+		// waits no longer than overloadWait
+		queued := false
+		if !ap.trySlot() {
+			if !ap.queueForSlot() {
+				ap.rejectConn(conn)
+				continue
+			}
+			queued = true
+		}
+		if !ap.trackConn(conn, true) {
+			if queued {
+				ap.waiting.Add(-1)
+			} else {
+				ap.releaseSlot()
+			}
+			_ = conn.Close()
 			continue
 		}
+		ap.goHandler(func() {
+			defer ap.trackConn(conn, false)
+			if queued {
+				acquired := ap.acquireSlot(ctx)
+				ap.waiting.Add(-1)
+				if !acquired {
+					ap.rejectConn(conn)
+					return
+				}
+			}
+			defer ap.releaseSlot()
+			ap.HandleConnection(conn)
+		})
+	}
+}
+
+// Shutdown stops all listeners and waits for in-flight connections to
+// finish. If ctx expires first, remaining connections are closed and the
+// context's error is returned.
+func (ap *AgentProxy) Shutdown(ctx context.Context) error {
+	ap.serveMu.Lock()
+	if !ap.shutdown {
+		close(ap.stopping)
+	}
+	ap.shutdown = true
+	for listener := range ap.listeners {
+		_ = listener.Close()
+	}
+	ap.serveMu.Unlock()
+	if ap.standby != nil {
+		ap.standby.stop()
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ap.serveMu.Lock()
+		remaining := len(ap.conns)
+		ap.serveMu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			ap.serveMu.Lock()
+			for conn := range ap.conns {
+				_ = conn.Close()
+			}
+			ap.serveMu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackListener registers or forgets a listener, reporting false if the
+// proxy is already shutting down.
+func (ap *AgentProxy) trackListener(listener net.Listener, add bool) bool {
+	ap.serveMu.Lock()
+	defer ap.serveMu.Unlock()
+	if !add {
+		delete(ap.listeners, listener)
+		return true
+	}
+	if ap.shutdown {
+		return false
+	}
+	ap.listeners[listener] = struct{}{}
+	return true
+}
+
+// trackConn registers or forgets a client connection, reporting false if
+// the proxy is already shutting down.
+func (ap *AgentProxy) trackConn(conn net.Conn, add bool) bool {
+	ap.serveMu.Lock()
+	defer ap.serveMu.Unlock()
+	if !add {
+		delete(ap.conns, conn)
+		return true
+	}
+	if ap.shutdown {
+		return false
+	}
+	ap.conns[conn] = struct{}{}
+	return true
+}
+
+// trySlot reserves room for one more connection under the limit if
+// there's any free.
+func (ap *AgentProxy) trySlot() bool {
+	if ap.slots == nil {
+		return true
+	}
+	select {
+	case ap.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueForSlot counts a connection as waiting for a slot, reporting false
+// if connections may not wait or the queue is already full.
+func (ap *AgentProxy) queueForSlot() bool {
+	if ap.overloadWait <= 0 {
+		return false
+	}
+	if ap.waiting.Add(1) > int64(cap(ap.slots)) {
+		ap.waiting.Add(-1)
+		return false
+	}
+	return true
+}
+
+// acquireSlot reserves room for one more connection under the limit,
+// waiting up to overloadWait for one to free up, and giving up early if
+// ctx is done or the proxy shuts down.
+func (ap *AgentProxy) acquireSlot(ctx context.Context) bool {
+	if ap.trySlot() {
+		return true
+	}
+	if ap.overloadWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(ap.overloadWait)
+	defer timer.Stop()
+	select {
+	case ap.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-ap.stopping:
+	}
+	return false
+}
+
+func (ap *AgentProxy) releaseSlot() {
+	if ap.slots != nil {
+		<-ap.slots
+	}
+}
+
+// acceptFailed counts and logs a failed Accept that will be retried after
+// delay.
+func (ap *AgentProxy) acceptFailed(err error, delay time.Duration) {
+	ap.serveMu.Lock()
+	ap.metrics.AcceptErrors++
+	failures := ap.metrics.AcceptErrors
+	ap.serveMu.Unlock()
+
+	args := []any{"error", err, "retry_in", delay, "accept_errors_total", failures}
+	if hint := acceptErrorHint(err); hint != "" {
+		args = append(args, "hint", hint)
+	}
+	ap.logger.Warn("Accept error", args...)
+}
+
+// rejectConn answers a connection over the limit with SSH_AGENT_FAILURE
+// and closes it.
+func (ap *AgentProxy) rejectConn(conn net.Conn) {
+	ap.serveMu.Lock()
+	ap.metrics.Rejected++
+	rejected := ap.metrics.Rejected
+	// A runaway client can trip this thousands of times a second
+	warn := time.Since(ap.lastOverloadWarn) >= 10*time.Second
+	if warn {
+		ap.lastOverloadWarn = time.Now()
+	}
+	ap.serveMu.Unlock()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _ = conn.Write([]byte{0, 0, 0, 1, SSH_AGENT_FAILURE})
+	_ = conn.Close()
 
-		go ap.HandleConnection(conn)
+	if warn {
+		ap.logger.Warn("Connection limit reached, rejecting connections",
+			"max_connections", cap(ap.slots),
+			"rejected_total", rejected)
+	} else {
+		ap.logger.Debug("Rejected connection over limit", "rejected_total", rejected)
 	}
 }
@@ -2,14 +2,18 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestNewAgentProxy(t *testing.T) {
@@ -400,11 +404,564 @@ func TestSanitizingHandler(t *testing.T) {
 	
 	// Test fingerprint sanitization
 	buf.Reset()
-	logger.Info("test", "fingerprint", "SHA256:abc123def456")
+	logger.Info("test", "fingerprint", "SHA256:abc123def456abc123def456abc123def456abcdefg")
 	if bytes.Contains(buf.Bytes(), []byte("abc123def456")) {
 		t.Error("Fingerprint not sanitized")
 	}
 	if !bytes.Contains(buf.Bytes(), []byte("SHA256:<redacted>")) {
 		t.Error("Fingerprint not properly sanitized")
 	}
-}
\ No newline at end of file
+}
+
+func TestNewWithOptions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := createMockAgent(t)
+
+	calls := 0
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCacheTTL(time.Minute),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			calls++
+			return agentSocket, nil
+		})))
+
+	if ap.ActiveSocket() != "" {
+		t.Error("Expected no active socket before discovery")
+	}
+	if got := ap.FindActiveSocketCached(); got != agentSocket {
+		t.Errorf("Expected discoverer result %s, got %s", agentSocket, got)
+	}
+	_ = ap.FindActiveSocketCached()
+	if calls != 1 {
+		t.Errorf("Expected cached result within TTL, discoverer called %d times", calls)
+	}
+	if ap.ActiveSocket() != agentSocket {
+		t.Errorf("Expected ActiveSocket to report %s", agentSocket)
+	}
+}
+
+func TestServeAndShutdown(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := createMockAgent(t)
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+
+	proxySocket := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ap.Serve(context.Background(), listener)
+	}()
+
+	// Hold a connection open across Shutdown
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ap.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to time out on the open connection, got %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected Serve to return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+
+	if _, err := net.Dial("unix", proxySocket); err == nil {
+		t.Error("Expected listener to be closed after Shutdown")
+	}
+}
+
+func TestServeContextCancel(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", WithLogger(logger))
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "proxy.sock"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ap.Serve(ctx, listener)
+	}()
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected nil after cancel, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after context cancel")
+	}
+}
+
+func TestFindActiveSocketCachedRefusesOwnSocket(t *testing.T) {
+	proxySocket := createMockAgent(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New(proxySocket,
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return proxySocket, nil
+		})))
+
+	if got := ap.FindActiveSocketCached(); got != "" {
+		t.Errorf("Expected the proxy's own socket to be refused, got %s", got)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := ""
+	calls := 0
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNegativeCacheTTL(time.Minute),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			calls++
+			if agentSocket == "" {
+				return "", ErrNoActiveAgent
+			}
+			return agentSocket, nil
+		})))
+
+	for range 3 {
+		if got := ap.FindActiveSocketCached(); got != "" {
+			t.Fatalf("Expected no socket, got %s", got)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected one scan for a burst of misses, discoverer called %d times", calls)
+	}
+
+	// Asking to rediscover doesn't wait out the miss
+	agentSocket = createMockAgent(t)
+	ap.InvalidateCache()
+	if got := ap.FindActiveSocketCached(); got != agentSocket {
+		t.Errorf("Expected rediscovery to find %s, got %q", agentSocket, got)
+	}
+	if calls != 2 {
+		t.Errorf("Expected a second scan after invalidation, discoverer called %d times", calls)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	calls := 0
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithNegativeCacheTTL(0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			calls++
+			return "", ErrNoActiveAgent
+		})))
+
+	for range 3 {
+		_ = ap.FindActiveSocketCached()
+	}
+	if calls != 3 {
+		t.Errorf("Expected a scan per call without a negative cache, discoverer called %d times", calls)
+	}
+}
+
+func TestConcurrentDiscoveryDeduplicated(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := createMockAgent(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	// No cache at all, so only joining the scan in progress saves one
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCacheTTL(0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			calls.Add(1)
+			<-release
+			return agentSocket, nil
+		})))
+
+	const clients = 20
+	results := make(chan string, clients)
+	for range clients {
+		go func() { results <- ap.FindActiveSocketCached() }()
+	}
+	waitFor(t, "the scan to start", func() bool { return calls.Load() == 1 })
+	time.Sleep(100 * time.Millisecond) // for the rest to join it
+	close(release)
+
+	for range clients {
+		if got := <-results; got != agentSocket {
+			t.Errorf("Expected every client to get %s, got %q", agentSocket, got)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected one scan for %d concurrent misses, discoverer called %d times", clients, got)
+	}
+}
+
+func TestDiscoveryDoesNotHoldLock(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := createMockAgent(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCacheTTL(time.Minute),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			if calls.Add(1) == 1 {
+				<-release
+			}
+			return agentSocket, nil
+		})))
+
+	found := make(chan string, 1)
+	go func() { found <- ap.FindActiveSocketCached() }()
+	waitFor(t, "the scan to start", func() bool { return calls.Load() == 1 })
+
+	// Status and invalidation go ahead while the scan runs
+	done := make(chan struct{})
+	go func() {
+		_ = ap.Status()
+		ap.InvalidateCache()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the proxy state to be usable during a scan")
+	}
+
+	close(release)
+	if got := <-found; got != agentSocket {
+		t.Errorf("Expected the scan's result for its caller, got %q", got)
+	}
+	// The scan began before the invalidation, so its result isn't cached
+	if got := ap.ActiveSocket(); got != "" {
+		t.Errorf("Expected nothing cached from a scan overtaken by invalidation, got %s", got)
+	}
+	if got := ap.FindActiveSocketCached(); got != agentSocket || calls.Load() != 2 {
+		t.Errorf("Expected a fresh scan to find %s, got %q after %d scans", agentSocket, got, calls.Load())
+	}
+	if got := ap.ActiveSocket(); got != agentSocket {
+		t.Errorf("Expected the fresh scan's result cached, got %q", got)
+	}
+}
+
+func TestValidateCachedDoesNotHoldLock(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hanging := createSilentSocket(t)
+	fresh := createMockAgent(t)
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCacheTTL(time.Minute),
+		WithValidateCached(true),
+		WithProbeTimeout(500*time.Millisecond),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return fresh, nil
+		})))
+	ap.setActiveSocket(hanging)
+
+	found := make(chan string, 1)
+	go func() { found <- ap.FindActiveSocketCached() }()
+
+	start := time.Now()
+	time.Sleep(50 * time.Millisecond) // for the probe to start
+	_ = ap.Status()
+	if waited := time.Since(start); waited > 400*time.Millisecond {
+		t.Errorf("Expected Status not to wait for the probe, took %s", waited)
+	}
+	if got := <-found; got != fresh {
+		t.Errorf("Expected the unanswering socket to be replaced by %s, got %q", fresh, got)
+	}
+}
+
+func TestValidateCached(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	stale := filepath.Join(t.TempDir(), "gone.sock")
+	fresh := createMockAgent(t)
+
+	for _, validate := range []bool{false, true} {
+		calls := 0
+		ap := New("/tmp/test.sock",
+			WithLogger(logger),
+			WithCacheTTL(time.Minute),
+			WithValidateCached(validate),
+			WithProbeTimeout(time.Second),
+			WithDiscoverer(DiscovererFunc(func() (string, error) {
+				calls++
+				return fresh, nil
+			})))
+		ap.activeSocket = stale
+		ap.lastCheck = time.Now()
+
+		want := stale
+		if validate {
+			want = fresh
+		}
+		if got := ap.FindActiveSocketCached(); got != want {
+			t.Errorf("validate=%v: expected %s, got %s", validate, want, got)
+		}
+		if validate && calls != 1 {
+			t.Errorf("Expected a stale cached socket to be rediscovered, discoverer called %d times", calls)
+		}
+		if validate {
+			// A cached socket that still answers is reused
+			_ = ap.FindActiveSocketCached()
+			if calls != 1 {
+				t.Errorf("Expected a valid cached socket to be reused, discoverer called %d times", calls)
+			}
+		}
+	}
+}
+
+func TestValidateCachedReusesProbeConnection(t *testing.T) {
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int32
+	go func() {
+		keyring := agent.NewKeyring()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithCacheTTL(time.Minute),
+		WithValidateCached(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	ap.setActiveSocket(agentSocket)
+	proxySocket := serveProxy(t, ap)
+
+	// The client's request goes over the connection that validated the
+	// socket, rather than a second one dialed after the probe
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if got := accepted.Load(); got != 1 {
+		t.Errorf("Expected one upstream connection per client, got %d", got)
+	}
+}
+
+func TestScanReusesProbeConnection(t *testing.T) {
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int32
+	go func() {
+		keyring := agent.NewKeyring()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(&Discovery{Command: "echo " + agentSocket, Only: []string{agentSocket}}))
+	proxySocket := serveProxy(t, ap)
+
+	// The client that triggers the scan is served over the connection
+	// discovery validated the socket with, rather than a second one
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if got := accepted.Load(); got != 1 {
+		t.Errorf("Expected the scan's probe connection to serve the client, got %d upstream connections", got)
+	}
+}
+
+func TestPinnedSocketGone(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	pinned, kill := startKeyringAgent(t, "pinned")
+	discovered := createMockAgent(t)
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return discovered, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	if err := ap.Pin(pinned); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Fatalf("ListIdentities through the pinned socket failed: %v", err)
+	}
+
+	kill()
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Errorf("Expected discovery to take over from a dead pinned socket: %v", err)
+	}
+	if status := ap.Status(); status.Pinned != "" || status.ActiveSocket != discovered {
+		t.Errorf("Expected to be unpinned and using %s, got pinned %q active %q",
+			discovered, status.Pinned, status.ActiveSocket)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	agentSocket := createMockAgent(t)
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithMaxConnections(1, 0),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+
+	proxySocket := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ap.Serve(ctx, listener) }()
+
+	// Occupy the only slot
+	first, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer first.Close()
+	_, _ = first.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(first, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	second, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	rejected := make([]byte, 5)
+	if _, err := io.ReadFull(second, rejected); err != nil {
+		t.Fatalf("Failed to read rejection: %v", err)
+	}
+	if rejected[4] != SSH_AGENT_FAILURE {
+		t.Errorf("Expected SSH_AGENT_FAILURE, got %d", rejected[4])
+	}
+	if got := ap.Metrics().Rejected; got != 1 {
+		t.Errorf("Expected 1 rejected connection, got %d", got)
+	}
+}
+
+func TestMaxConnectionsWaitersDontQueue(t *testing.T) {
+	const wait = 300 * time.Millisecond
+	upstream := createSilentSocket(t)
+	ap := New("/tmp/test.sock",
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithMaxConnections(2, wait),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	// Fill both slots with connections whose requests never get answers
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	}
+	waitFor(t, "both slots to fill", func() bool {
+		return ap.Status().ActiveConnections == 2
+	})
+
+	// Two more arrive together; each should be turned away after its own
+	// wait, not one after the other
+	start := time.Now()
+	waited := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := net.Dial("unix", proxySocket)
+			if err != nil {
+				waited <- -1
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * wait))
+			response := make([]byte, 5)
+			if _, err := io.ReadFull(conn, response); err != nil || response[4] != SSH_AGENT_FAILURE {
+				waited <- -1
+				return
+			}
+			waited <- time.Since(start)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		d := <-waited
+		if d < 0 {
+			t.Fatal("Expected a waiting client to be rejected with SSH_AGENT_FAILURE")
+		}
+		if d > wait+wait/2 {
+			t.Errorf("Expected each waiting client to be rejected after about %s, one took %s", wait, d)
+		}
+	}
+}
+
+func TestMaxConnectionsQueue(t *testing.T) {
+	ap := New("/tmp/test.sock", WithMaxConnections(1, time.Second))
+	if !ap.acquireSlot(context.Background()) {
+		t.Fatal("Expected a free slot")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ap.releaseSlot()
+	}()
+	if !ap.acquireSlot(context.Background()) {
+		t.Error("Expected a queued connection to get the released slot")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package proxy
+
+// raceEnabled is set when testing with the race detector, which makes
+// sync.Pool drop items at random, so pooled code can't be allocation free.
+const raceEnabled = true
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+)
+
+// refusalReadTimeout is how long a client turned away before being served
+// has to send its request, so the refusal can answer in the request's
+// form.
+const refusalReadTimeout = time.Second
+
+// newRefusalID returns a short random ID tying a refusal the client sees
+// to the proxy's log.
+func newRefusalID() string {
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// refusal logs that the proxy refused a request of type msgType on
+// session, or of unknown type if msgType is 0, and returns the response
+// to send. Extension requests get
+// SSH_AGENT_EXTENSION_FAILURE carrying a message with the refusal's ID,
+// which protocol allows extension responses to; other requests get a
+// plain SSH_AGENT_FAILURE, since clients reject anything after its type.
+func (ap *AgentProxy) refusal(msgType byte, extension string, session *Session, reason string) []byte {
+	id := newRefusalID()
+	attrs := []any{"refusal_id", id, "client", session.Client, "upstream", session.Upstream}
+	if msgType != 0 {
+		attrs = append(attrs, "type", messageTypeName(msgType))
+	}
+	if extension != "" {
+		attrs = append(attrs, "extension", extension)
+	}
+	ap.logger.Info("Refused request", append(attrs, "reason", reason)...)
+
+	if msgType != SSH_AGENTC_EXTENSION {
+		return failure()
+	}
+	return appendWireString([]byte{SSH_AGENT_EXTENSION_FAILURE},
+		[]byte("refused by double-agent: "+reason+" (refusal "+id+")"))
+}
+
+// refusalMiddleware gives a refusal ID to each request refused by the
+// middleware after it, telling those apart from failures the upstream
+// agent answered by the upstreamFailed mark forwarding leaves on the
+// session.
+func (ap *AgentProxy) refusalMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		msgType := req.Type()
+		var extension string
+		if msgType == SSH_AGENTC_EXTENSION {
+			extension, _ = extensionName(req.Message)
+		}
+		req.Session.upstreamFailed = false
+		response, err := next(req)
+		if err != nil || responseType(response) != SSH_AGENT_FAILURE || req.Session.upstreamFailed {
+			return response, err
+		}
+		return ap.refusal(msgType, extension, req.Session, "not allowed by the proxy"), nil
+	}
+}
+
+// refuseUnserved answers a client the proxy can't serve at all, such as
+// when there's no upstream agent. With failure details it waits briefly
+// for the client's request so the refusal can answer in its form;
+// otherwise it answers SSH_AGENT_FAILURE at once.
+func (ap *AgentProxy) refuseUnserved(clientConn net.Conn, stats *connStats, reason string) error {
+	response := failure()
+	if ap.failureDetails {
+		session := &Session{Client: stats.client}
+		_ = clientConn.SetReadDeadline(time.Now().Add(refusalReadTimeout))
+		message, err := readMessage(clientConn, maxAgentMessage)
+		_ = clientConn.SetReadDeadline(time.Time{})
+		var msgType byte
+		var extension string
+		if err == nil {
+			msgType = message[0]
+			if msgType == SSH_AGENTC_EXTENSION {
+				extension, _ = extensionName(message)
+			}
+		}
+		response = ap.refusal(msgType, extension, session, reason)
+	}
+	return writeMessage(stats.out, response)
+}
+
+// oversizedType reads the type of a request refused for its size, which
+// follows the length prefix readMessage stopped at, or returns 0 if the
+// client doesn't send it promptly.
+func oversizedType(clientConn net.Conn) byte {
+	var msgType [1]byte
+	_ = clientConn.SetReadDeadline(time.Now().Add(refusalReadTimeout))
+	defer func() { _ = clientConn.SetReadDeadline(time.Time{}) }()
+	if _, err := io.ReadFull(clientConn, msgType[:]); err != nil {
+		return 0
+	}
+	return msgType[0]
+}
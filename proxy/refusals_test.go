@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refusalExchange sends request to the proxy at proxySocket on a new
+// connection and returns the response.
+func refusalExchange(t *testing.T, proxySocket string, request []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := writeMessage(conn, request); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	response, err := readMessage(conn, maxAgentMessage)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return response
+}
+
+var refusalIDPattern = regexp.MustCompile(`refusal ([0-9a-f]{8})\)`)
+
+// refusalLogged reports whether logs hold a "Refused request" record
+// with the refusal ID id.
+func refusalLogged(logs *logBuffer, id string) bool {
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `msg="Refused request"`) && strings.Contains(line, "refusal_id="+id) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFailureDetailsExtension(t *testing.T) {
+	agentSocket := createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_SUCCESS})
+	var logs logBuffer
+	ap := New("/tmp/test.sock",
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithExtensionPolicy(ExtensionPolicy{BlockUnknown: true}),
+		WithFailureDetails(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	response := refusalExchange(t, proxySocket, appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte("custom@example.com")))
+	if response[0] != SSH_AGENT_EXTENSION_FAILURE {
+		t.Fatalf("Expected SSH_AGENT_EXTENSION_FAILURE, got response type %d", response[0])
+	}
+	message, _, ok := readWireString(response[1:])
+	if !ok {
+		t.Fatalf("Expected the failure to carry a message, got %q", response)
+	}
+	match := refusalIDPattern.FindSubmatch(message)
+	if match == nil {
+		t.Fatalf("Expected the message to name a refusal ID, got %q", message)
+	}
+	if !refusalLogged(&logs, string(match[1])) {
+		t.Errorf("Expected refusal %s in the log, got:\n%s", match[1], logs.String())
+	}
+
+	// Allowed extensions still reach the upstream
+	response = refusalExchange(t, proxySocket, appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte(ExtensionSessionBind)))
+	if !bytes.Equal(response, []byte{SSH_AGENT_SUCCESS}) {
+		t.Errorf("Expected the upstream's answer, got %v", response)
+	}
+}
+
+func TestFailureDetailsUpstreamFailure(t *testing.T) {
+	agentSocket := createRespondingAgent(t, []byte{0, 0, 0, 1, SSH_AGENT_FAILURE})
+	var logs logBuffer
+	ap := New("/tmp/test.sock",
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithFailureDetails(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return agentSocket, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	response := refusalExchange(t, proxySocket, appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte("custom@example.com")))
+	if !bytes.Equal(response, []byte{SSH_AGENT_FAILURE}) {
+		t.Errorf("Expected the upstream's failure unchanged, got %v", response)
+	}
+	if strings.Contains(logs.String(), "Refused request") {
+		t.Errorf("Expected no refusal for the upstream's own failure, got:\n%s", logs.String())
+	}
+}
+
+func TestFailureDetailsNoUpstream(t *testing.T) {
+	var logs logBuffer
+	ap := New("/tmp/test.sock",
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithFailureDetails(true),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return "", errors.New("no agent")
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	response := refusalExchange(t, proxySocket, []byte{SSH_AGENTC_REQUEST_IDENTITIES})
+	if !bytes.Equal(response, []byte{SSH_AGENT_FAILURE}) {
+		t.Errorf("Expected a bare SSH_AGENT_FAILURE for a non-extension request, got %v", response)
+	}
+
+	response = refusalExchange(t, proxySocket, appendWireString([]byte{SSH_AGENTC_EXTENSION}, []byte(ExtensionQuery)))
+	message, _, _ := readWireString(response[1:])
+	match := refusalIDPattern.FindSubmatch(message)
+	if response[0] != SSH_AGENT_EXTENSION_FAILURE || match == nil {
+		t.Fatalf("Expected an extension failure naming a refusal, got %q", response)
+	}
+	if !refusalLogged(&logs, string(match[1])) || !strings.Contains(logs.String(), `reason="no upstream agent"`) {
+		t.Errorf("Expected refusal %s for want of an upstream in the log, got:\n%s", match[1], logs.String())
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import "maps"
+
+// maxRequestClients is how many clients Metrics.RequestsByClient breaks
+// requests down by. Later clients are counted together under
+// otherClients, so a long-running proxy's status stays a readable size.
+const maxRequestClients = 256
+
+const otherClients = "other"
+
+// RequestCounts counts requests by kind: identities, sign, add, remove,
+// lock, extension and other.
+type RequestCounts map[string]int64
+
+// requestKind groups agent request types into the kinds RequestCounts
+// reports. Locking and unlocking are both "lock", and the constrained and
+// smartcard variants of adding and removing keys count as "add" and
+// "remove".
+func requestKind(t byte) string {
+	switch t {
+	case SSH_AGENTC_REQUEST_IDENTITIES:
+		return "identities"
+	case SSH_AGENTC_SIGN_REQUEST:
+		return "sign"
+	case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED,
+		SSH_AGENTC_ADD_SMARTCARD_KEY, SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED:
+		return "add"
+	case SSH_AGENTC_REMOVE_IDENTITY, SSH_AGENTC_REMOVE_ALL_IDENTITIES,
+		SSH_AGENTC_REMOVE_SMARTCARD_KEY:
+		return "remove"
+	case SSH_AGENTC_LOCK, SSH_AGENTC_UNLOCK:
+		return "lock"
+	case SSH_AGENTC_EXTENSION:
+		return "extension"
+	}
+	return "other"
+}
+
+// requestClient is who a connection's requests are counted against: the
+// client's executable where known, since process IDs change with every
+// ssh invocation, or else the client as clientKey reports it.
+func requestClient(stats *connStats) string {
+	if stats.exe != "" {
+		return stats.exe
+	}
+	return stats.client
+}
+
+// countRequests adds a closed connection's requests, counted by message
+// type, to m. The caller holds serveMu.
+func (m *Metrics) countRequests(stats *connStats, types map[byte]int64) {
+	if len(types) == 0 {
+		return
+	}
+	if m.RequestsByUpstream == nil {
+		m.Requests = make(RequestCounts)
+		m.RequestsByUpstream = make(map[string]RequestCounts)
+		m.RequestsByClient = make(map[string]RequestCounts)
+	}
+	byUpstream := m.RequestsByUpstream[stats.upstream]
+	if byUpstream == nil {
+		byUpstream = make(RequestCounts)
+		m.RequestsByUpstream[stats.upstream] = byUpstream
+	}
+	client := requestClient(stats)
+	if _, ok := m.RequestsByClient[client]; !ok && len(m.RequestsByClient) >= maxRequestClients {
+		client = otherClients
+	}
+	byClient := m.RequestsByClient[client]
+	if byClient == nil {
+		byClient = make(RequestCounts)
+		m.RequestsByClient[client] = byClient
+	}
+	for t, n := range types {
+		kind := requestKind(t)
+		m.Requests[kind] += n
+		byUpstream[kind] += n
+		byClient[kind] += n
+	}
+}
+
+// clone copies m, so the copy can be read while the proxy goes on
+// counting.
+func (m Metrics) clone() Metrics {
+	m.Requests = maps.Clone(m.Requests)
+	m.RequestsByUpstream = cloneRequestCounts(m.RequestsByUpstream)
+	m.RequestsByClient = cloneRequestCounts(m.RequestsByClient)
+	return m
+}
+
+func cloneRequestCounts(counts map[string]RequestCounts) map[string]RequestCounts {
+	if counts == nil {
+		return nil
+	}
+	copied := make(map[string]RequestCounts, len(counts))
+	for key, c := range counts {
+		copied[key] = maps.Clone(c)
+	}
+	return copied
+}
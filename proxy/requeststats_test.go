@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestRequestCounts(t *testing.T) {
+	upstream, kill := startKeyringAgent(t, "counted")
+	defer kill()
+	ap := New("/tmp/test.sock",
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for _, request := range [][]byte{
+		{SSH_AGENTC_REQUEST_IDENTITIES},
+		{SSH_AGENTC_REQUEST_IDENTITIES},
+		{SSH_AGENTC_REMOVE_ALL_IDENTITIES},
+	} {
+		if err := writeMessage(conn, request); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		if _, err := readMessage(conn, maxAgentMessage); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+	conn.Close()
+	waitFor(t, "the connection to be counted", func() bool {
+		return ap.Metrics().Connections == 1
+	})
+
+	metrics := ap.Status().Metrics
+	want := RequestCounts{"identities": 2, "remove": 1}
+	if !equalCounts(metrics.Requests, want) {
+		t.Errorf("Expected requests %v, got %v", want, metrics.Requests)
+	}
+	if got := metrics.RequestsByUpstream[upstream]; !equalCounts(got, want) {
+		t.Errorf("Expected requests to %s of %v, got %v", upstream, want, metrics.RequestsByUpstream)
+	}
+	if len(metrics.RequestsByClient) != 1 {
+		t.Fatalf("Expected requests from one client, got %v", metrics.RequestsByClient)
+	}
+	for _, got := range metrics.RequestsByClient {
+		if !equalCounts(got, want) {
+			t.Errorf("Expected the client's requests to be %v, got %v", want, got)
+		}
+	}
+
+	// The status is a copy, not a view of counts still changing
+	metrics.Requests["sign"] = 1
+	if _, ok := ap.Metrics().Requests["sign"]; ok {
+		t.Error("Expected changing a status to leave the proxy's counts alone")
+	}
+}
+
+func TestRequestCountsClientLimit(t *testing.T) {
+	var m Metrics
+	types := map[byte]int64{SSH_AGENTC_SIGN_REQUEST: 1}
+	for i := 0; i < maxRequestClients+10; i++ {
+		m.countRequests(&connStats{client: fmt.Sprintf("pid:%d", i), upstream: "up"}, types)
+	}
+	if len(m.RequestsByClient) > maxRequestClients+1 {
+		t.Errorf("Expected at most %d clients, got %d", maxRequestClients+1, len(m.RequestsByClient))
+	}
+	if got := m.RequestsByClient[otherClients]["sign"]; got != 10 {
+		t.Errorf("Expected 10 requests from clients over the limit, got %d", got)
+	}
+	if got := m.Requests["sign"]; got != int64(maxRequestClients+10) {
+		t.Errorf("Expected every request in the total, got %d", got)
+	}
+}
+
+func equalCounts(a, b RequestCounts) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kind, n := range b {
+		if a[kind] != n {
+			return false
+		}
+	}
+	return true
+}
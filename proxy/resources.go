@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default thresholds for WithResourceWarnings. A busy workstation proxy
+// serves a handful of connections at once, so reaching these means
+// connections are piling up rather than finishing.
+const (
+	DefaultHandlerWarning      = 1000
+	DefaultUpstreamConnWarning = 256
+)
+
+// resourceWarnInterval is how often a threshold that stays exceeded is
+// warned about again.
+const resourceWarnInterval = time.Minute
+
+// openFilesInterval is how often the process's open files are counted
+// when checking thresholds, since counting means reading a directory.
+const openFilesInterval = 10 * time.Second
+
+// ResourceWarnings are the counts past which the proxy warns that it may
+// be leaking. Zero turns a warning off.
+type ResourceWarnings struct {
+	// Handlers is goroutines serving client connections
+	Handlers int
+
+	// UpstreamConns is connections open to upstream agents
+	UpstreamConns int
+
+	// OpenFiles is file descriptors open in the whole process
+	OpenFiles int
+}
+
+// Resources counts what the proxy holds open. Each connection being
+// served normally accounts for one or three handlers (two copy goroutines
+// when no middleware needs to see messages) and one upstream connection,
+// so counts that keep climbing while ActiveConnections doesn't point at
+// a handler stuck in a read or copy that will never finish.
+type Resources struct {
+	Handlers      int64 `json:"handlers"`
+	UpstreamConns int64 `json:"upstream_conns"`
+
+	// Goroutines and OpenFiles cover the whole process. OpenFiles is
+	// left out where the OS doesn't list a process's descriptors.
+	Goroutines int `json:"goroutines"`
+	OpenFiles  int `json:"open_files,omitempty"`
+}
+
+// resourceTracker keeps the counts behind Resources and warns when they
+// pass their thresholds.
+type resourceTracker struct {
+	handlers      atomic.Int64
+	upstreamConns atomic.Int64
+
+	mu        sync.Mutex
+	warnings  ResourceWarnings
+	lastWarn  map[string]time.Time
+	openFiles int
+	counted   time.Time
+}
+
+// goHandler runs f in a goroutine counted as a handler.
+func (ap *AgentProxy) goHandler(f func()) {
+	n := ap.resources.handlers.Add(1)
+	ap.checkResource("handlers", n, ap.resources.warnings.Handlers)
+	go func() {
+		defer ap.resources.handlers.Add(-1)
+		f()
+	}()
+}
+
+// trackUpstream counts conn as an open upstream connection until it's
+// closed.
+func (ap *AgentProxy) trackUpstream(conn net.Conn) net.Conn {
+	n := ap.resources.upstreamConns.Add(1)
+	ap.checkResource("upstream_conns", n, ap.resources.warnings.UpstreamConns)
+	return &trackedConn{Conn: conn, count: &ap.resources.upstreamConns}
+}
+
+// trackedConn decrements count when first closed.
+type trackedConn struct {
+	net.Conn
+	count *atomic.Int64
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.count.Add(-1) })
+	return c.Conn.Close()
+}
+
+// checkResource warns when n, the current count of what, has passed
+// limit, and checks the process's open files while it's at it.
+func (ap *AgentProxy) checkResource(what string, n int64, limit int) {
+	if limit > 0 && n > int64(limit) {
+		ap.warnResource(what, n, limit)
+	}
+	if limit := ap.resources.warnings.OpenFiles; limit > 0 {
+		if open := ap.resources.countOpenFiles(); open > limit {
+			ap.warnResource("open_files", int64(open), limit)
+		}
+	}
+}
+
+// warnResource logs that a count is over its threshold, at most once per
+// resourceWarnInterval for each count.
+func (ap *AgentProxy) warnResource(what string, n int64, limit int) {
+	rt := &ap.resources
+	rt.mu.Lock()
+	if time.Since(rt.lastWarn[what]) < resourceWarnInterval {
+		rt.mu.Unlock()
+		return
+	}
+	if rt.lastWarn == nil {
+		rt.lastWarn = make(map[string]time.Time)
+	}
+	rt.lastWarn[what] = time.Now()
+	rt.mu.Unlock()
+
+	ap.serveMu.Lock()
+	active := len(ap.conns)
+	ap.serveMu.Unlock()
+	ap.logger.Warn("Resource count over its warning threshold; connections may be stuck rather than finishing",
+		"resource", what,
+		"count", n,
+		"threshold", limit,
+		"active_connections", active,
+		"hint", "Check 'double-agent ctl status' for resources and recent errors, and consider --upstream-timeout")
+}
+
+// countOpenFiles returns the process's open file descriptors, as of at
+// most openFilesInterval ago. It returns 0 where the OS doesn't list them.
+func (rt *resourceTracker) countOpenFiles() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if time.Since(rt.counted) < openFilesInterval {
+		return rt.openFiles
+	}
+	rt.counted = time.Now()
+	rt.openFiles = 0
+	// Linux and macOS both list a process's descriptors here; reading
+	// the directory holds one open itself
+	if entries, err := os.ReadDir("/dev/fd"); err == nil && len(entries) > 0 {
+		rt.openFiles = len(entries) - 1
+	}
+	return rt.openFiles
+}
+
+// snapshot returns the current counts.
+func (rt *resourceTracker) snapshot() Resources {
+	return Resources{
+		Handlers:      rt.handlers.Load(),
+		UpstreamConns: rt.upstreamConns.Load(),
+		Goroutines:    runtime.NumGoroutine(),
+		OpenFiles:     rt.countOpenFiles(),
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestResourceAccounting(t *testing.T) {
+	upstream, kill := startKeyringAgent(t, "counted")
+	defer kill()
+	ap := New("/tmp/test.sock",
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		if err := writeMessage(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		if _, err := readMessage(conn, maxAgentMessage); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		clients = append(clients, conn)
+	}
+
+	resources := ap.Status().Resources
+	if resources.UpstreamConns != 2 || resources.Handlers < 2 {
+		t.Errorf("Expected 2 upstream connections and at least 2 handlers, got %+v", resources)
+	}
+	if resources.Goroutines == 0 {
+		t.Error("Expected the process's goroutines to be counted")
+	}
+
+	for _, conn := range clients {
+		conn.Close()
+	}
+	waitFor(t, "handlers and upstream connections to be released", func() bool {
+		r := ap.Status().Resources
+		return r.Handlers == 0 && r.UpstreamConns == 0
+	})
+}
+
+func TestResourceWarnings(t *testing.T) {
+	upstream := createSilentSocket(t)
+	var logs logBuffer
+	ap := New("/tmp/test.sock",
+		WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+		WithResourceWarnings(ResourceWarnings{UpstreamConns: 1}),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		if err := writeMessage(conn, []byte{SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+	}
+	waitFor(t, "the stuck connections", func() bool {
+		return ap.Status().Resources.UpstreamConns == 3
+	})
+
+	var warnings []map[string]any
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) == nil && strings.HasPrefix(record["msg"].(string), "Resource count over") {
+			warnings = append(warnings, record)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected one warning however often the threshold is passed, got %d:\n%s", len(warnings), logs.String())
+	}
+	if warnings[0]["resource"] != "upstream_conns" || warnings[0]["count"] != float64(2) {
+		t.Errorf("Expected a warning for the second upstream connection, got %v", warnings[0])
+	}
+}
@@ -2,18 +2,213 @@ package proxy
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"log/slog"
+	"regexp"
 	"strings"
+	"sync"
 )
 
+// SanitizeRule replaces every match of Pattern in logged strings with
+// Replacement, which may refer to submatches as regexp.ReplaceAllString
+// allows (e.g., ${1}).
+type SanitizeRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+
+	replace  func(string) string // used instead of Replacement when set
+	mayMatch func(string) bool   // cheaply rules out strings Pattern can't match
+}
+
+// withLiteralPrefix sets mayMatch from the literal text every match of the
+// rule's pattern starts with, if there is any.
+func (r SanitizeRule) withLiteralPrefix() SanitizeRule {
+	if prefix, _ := r.Pattern.LiteralPrefix(); prefix != "" {
+		r.mayMatch = func(s string) bool { return strings.Contains(s, prefix) }
+	}
+	return r
+}
+
+func (r SanitizeRule) apply(s string) string {
+	if r.mayMatch != nil && !r.mayMatch(s) {
+		return s
+	}
+	if r.replace != nil {
+		return r.Pattern.ReplaceAllStringFunc(s, r.replace)
+	}
+	return r.Pattern.ReplaceAllString(s, r.Replacement)
+}
+
+// ParseSanitizeRule parses a rule written as REGEX=>REPLACEMENT. The last
+// "=>" separates the two, so the pattern may contain one.
+func ParseSanitizeRule(s string) (SanitizeRule, error) {
+	idx := strings.LastIndex(s, "=>")
+	if idx < 0 {
+		return SanitizeRule{}, fmt.Errorf("rule %q is not REGEX=>REPLACEMENT", s)
+	}
+	pattern, err := regexp.Compile(s[:idx])
+	if err != nil {
+		return SanitizeRule{}, fmt.Errorf("rule %q: %w", s, err)
+	}
+	return SanitizeRule{Pattern: pattern, Replacement: s[idx+2:]}.withLiteralPrefix(), nil
+}
+
+var (
+	// homePathRule hides the user name in home directory paths on Linux
+	// (/home), FreeBSD (/usr/home), macOS (/Users), and Windows
+	homePathRule = SanitizeRule{
+		Pattern:     regexp.MustCompile(`(/usr/home/|/home/|/Users/|(?i:[a-z]:\\Users\\))[^/\\\s"']+`),
+		Replacement: "${1}<user>",
+		mayMatch: func(s string) bool {
+			return strings.Contains(s, "/home/") || strings.Contains(s, "/Users/") || strings.Contains(s, `:\`)
+		},
+	}
+
+	// homeEnvRule hides $HOME in env-style HOME=... strings, which may
+	// point anywhere rather than under one of the roots above
+	homeEnvRule = SanitizeRule{
+		Pattern:     regexp.MustCompile(`(^|[^A-Za-z0-9_])HOME=("[^"]*"|'[^']*'|[^\s"',;]+)`),
+		Replacement: "${1}HOME=<home>",
+		mayMatch:    func(s string) bool { return strings.Contains(s, "HOME=") },
+	}
+
+	// fingerprintRule hides the hash in SSH key fingerprints as ssh-keygen
+	// prints them, leaving other SHA256: strings alone
+	fingerprintRule = SanitizeRule{
+		Pattern:     regexp.MustCompile(`SHA256:[A-Za-z0-9+/]{43}=?`),
+		Replacement: "SHA256:<redacted>",
+	}.withLiteralPrefix()
+
+	// keyMaterialRule hides long base64 or hex runs, the shape key blobs
+	// and signatures take in logs
+	keyMaterialRule = SanitizeRule{
+		Pattern: regexp.MustCompile(`[A-Za-z0-9+/]{64,}={0,2}`),
+		replace: func(s string) string {
+			// Long paths can match too; base64 rarely has this many slashes
+			if strings.Count(s, "/") > len(s)/16 {
+				return s
+			}
+			return redactedBlob([]byte(s))
+		},
+		mayMatch: func(s string) bool { return len(s) >= 64 },
+	}
+)
+
+// redactedBlob stands in for key material: its length and a short hash,
+// enough to tell whether two log lines saw the same bytes.
+func redactedBlob(b []byte) string {
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("<redacted %d bytes sha256:%x>", len(b), sum[:4])
+}
+
+// SanitizeOptions chooses what a SanitizingHandler redacts.
+type SanitizeOptions struct {
+	// HomePaths replaces the user name in /home/NAME, /usr/home/NAME,
+	// /Users/NAME, and C:\Users\NAME paths with <user>, and the value in
+	// HOME=... strings with <home>
+	HomePaths bool
+
+	// Fingerprints replaces the hash in SHA256 key fingerprints with
+	// <redacted>
+	Fingerprints bool
+
+	// KeyMaterial replaces long base64 or hex strings, []byte values, and
+	// public keys with their length and a short hash
+	KeyMaterial bool
+
+	// Rules run after the built-in redactions, in order
+	Rules []SanitizeRule
+}
+
+// DefaultSanitizeOptions redacts home directory user names, key
+// fingerprints, and key material, with no extra rules.
+func DefaultSanitizeOptions() SanitizeOptions {
+	return SanitizeOptions{HomePaths: true, Fingerprints: true, KeyMaterial: true}
+}
+
+func (o SanitizeOptions) rules() []SanitizeRule {
+	var rules []SanitizeRule
+	if o.HomePaths {
+		rules = append(rules, homeEnvRule, homePathRule)
+	}
+	if o.Fingerprints {
+		rules = append(rules, fingerprintRule)
+	}
+	if o.KeyMaterial {
+		rules = append(rules, keyMaterialRule)
+	}
+	return append(rules, o.Rules...)
+}
+
+// sanitizeCacheSize bounds how many results a sanitizer remembers, and
+// sanitizeCacheMaxLen how long a value may be to be remembered. Most log
+// values are short and repeat: socket paths, key comments, error text.
+const (
+	sanitizeCacheSize   = 512
+	sanitizeCacheMaxLen = 256
+)
+
+// sanitizer applies rules to strings, remembering recent results. It's
+// shared by a SanitizingHandler and the handlers derived from it.
+type sanitizer struct {
+	rules       []SanitizeRule
+	keyMaterial bool
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func (z *sanitizer) sanitize(s string) string {
+	if len(z.rules) == 0 || s == "" {
+		return s
+	}
+	cacheable := len(s) <= sanitizeCacheMaxLen
+	if cacheable {
+		z.mu.Lock()
+		out, ok := z.cache[s]
+		z.mu.Unlock()
+		if ok {
+			return out
+		}
+	}
+
+	out := s
+	for _, rule := range z.rules {
+		out = rule.apply(out)
+	}
+
+	if cacheable {
+		z.mu.Lock()
+		if len(z.cache) >= sanitizeCacheSize {
+			clear(z.cache)
+		}
+		z.cache[s] = out
+		z.mu.Unlock()
+	}
+	return out
+}
+
 // SanitizingHandler wraps another handler and sanitizes sensitive information
 type SanitizingHandler struct {
 	wrapped slog.Handler
+	z       *sanitizer
 }
 
-// NewSanitizingHandler creates a new sanitizing handler
+// NewSanitizingHandler creates a new sanitizing handler with the default
+// redactions
 func NewSanitizingHandler(wrapped slog.Handler) *SanitizingHandler {
-	return &SanitizingHandler{wrapped: wrapped}
+	return NewSanitizingHandlerWithOptions(wrapped, DefaultSanitizeOptions())
+}
+
+// NewSanitizingHandlerWithOptions creates a sanitizing handler that
+// redacts what opts asks for
+func NewSanitizingHandlerWithOptions(wrapped slog.Handler, opts SanitizeOptions) *SanitizingHandler {
+	return &SanitizingHandler{wrapped: wrapped, z: &sanitizer{
+		rules:       opts.rules(),
+		keyMaterial: opts.KeyMaterial,
+		cache:       make(map[string]string),
+	}}
 }
 
 // Enabled implements slog.Handler
@@ -24,14 +219,14 @@ func (h *SanitizingHandler) Enabled(ctx context.Context, level slog.Level) bool
 // Handle implements slog.Handler
 func (h *SanitizingHandler) Handle(ctx context.Context, r slog.Record) error {
 	// Sanitize the message
-	r.Message = sanitizeString(r.Message)
+	r.Message = h.z.sanitize(r.Message)
 
 	// Create a new record with sanitized attributes
 	sanitized := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
 
 	// Sanitize each attribute
 	r.Attrs(func(a slog.Attr) bool {
-		sanitized.AddAttrs(sanitizeAttr(a))
+		sanitized.AddAttrs(h.sanitizeAttr(a))
 		return true
 	})
 
@@ -42,65 +237,59 @@ func (h *SanitizingHandler) Handle(ctx context.Context, r slog.Record) error {
 func (h *SanitizingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	sanitized := make([]slog.Attr, len(attrs))
 	for i, attr := range attrs {
-		sanitized[i] = sanitizeAttr(attr)
+		sanitized[i] = h.sanitizeAttr(attr)
 	}
-	return &SanitizingHandler{wrapped: h.wrapped.WithAttrs(sanitized)}
+	return &SanitizingHandler{wrapped: h.wrapped.WithAttrs(sanitized), z: h.z}
 }
 
 // WithGroup implements slog.Handler
 func (h *SanitizingHandler) WithGroup(name string) slog.Handler {
-	return &SanitizingHandler{wrapped: h.wrapped.WithGroup(name)}
+	return &SanitizingHandler{wrapped: h.wrapped.WithGroup(name), z: h.z}
 }
 
 // sanitizeAttr sanitizes a single attribute
-func sanitizeAttr(a slog.Attr) slog.Attr {
+func (h *SanitizingHandler) sanitizeAttr(a slog.Attr) slog.Attr {
+	if len(h.z.rules) == 0 {
+		return a
+	}
 	switch a.Value.Kind() {
 	case slog.KindString:
-		return slog.Attr{
-			Key:   a.Key,
-			Value: slog.StringValue(sanitizeString(a.Value.String())),
+		value := a.Value.String()
+		if out := h.z.sanitize(value); out != value {
+			return slog.String(a.Key, out)
 		}
+		return a
 	case slog.KindGroup:
 		// Recursively sanitize group attributes
 		group := a.Value.Group()
 		sanitized := make([]any, len(group))
 		for i, attr := range group {
-			sanitized[i] = sanitizeAttr(attr)
+			sanitized[i] = h.sanitizeAttr(attr)
 		}
 		return slog.Group(a.Key, sanitized...)
-	default:
-		return a
-	}
-}
-
-// sanitizeString removes potentially sensitive information from strings
-func sanitizeString(s string) string {
-	// Remove full paths that might contain usernames after /home/
-	if strings.Contains(s, "/home/") {
-		parts := strings.Split(s, "/home/")
-		for i := 1; i < len(parts); i++ {
-			subParts := strings.SplitN(parts[i], "/", 2)
-			if len(subParts) > 1 {
-				// Replace username with <user>
-				parts[i] = "<user>/" + subParts[1]
+	case slog.KindLogValuer:
+		// Sanitize what the value resolves to, which may be any kind
+		return h.sanitizeAttr(slog.Attr{Key: a.Key, Value: a.Value.Resolve()})
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			// Errors often carry paths, e.g. from a failed dial
+			return slog.String(a.Key, h.z.sanitize(v.Error()))
+		case []byte:
+			if h.z.keyMaterial {
+				return slog.String(a.Key, redactedBlob(v))
 			}
-		}
-		s = strings.Join(parts, "/home/")
-	}
-
-	// Remove potential SSH key fingerprints (they look like SHA256:...)
-	if strings.Contains(s, "SHA256:") {
-		// Find and replace the fingerprint part
-		idx := strings.Index(s, "SHA256:")
-		if idx >= 0 {
-			endIdx := idx + 7 // Length of "SHA256:"
-			// Find the end of the fingerprint (usually ends with space or end of string)
-			for endIdx < len(s) && s[endIdx] != ' ' && s[endIdx] != '\n' {
-				endIdx++
+		case interface{ Marshal() []byte }:
+			// ssh.PublicKey and friends
+			if h.z.keyMaterial {
+				return slog.String(a.Key, redactedBlob(v.Marshal()))
 			}
-			s = s[:idx+7] + "<redacted>" + s[endIdx:]
+		case fmt.Stringer:
+			// Addresses and other values that print as paths
+			return slog.String(a.Key, h.z.sanitize(v.String()))
 		}
+		return a
+	default:
+		return a
 	}
-
-	return s
 }
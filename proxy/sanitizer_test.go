@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeOptions(t *testing.T) {
+	const fingerprint = "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"
+
+	tests := []struct {
+		name string
+		opts SanitizeOptions
+		in   string
+		want string
+	}{
+		{"linux home", DefaultSanitizeOptions(), "/home/alice/.ssh/agent", "/home/<user>/.ssh/agent"},
+		{"macos home", DefaultSanitizeOptions(), "dial unix /Users/alice/.ssh/agent: refused", "dial unix /Users/<user>/.ssh/agent: refused"},
+		{"freebsd home", DefaultSanitizeOptions(), "/usr/home/alice/.ssh/agent", "/usr/home/<user>/.ssh/agent"},
+		{"bare home", DefaultSanitizeOptions(), "socket in /Users/alice", "socket in /Users/<user>"},
+		{"home env", DefaultSanitizeOptions(), "env HOME=/var/lib/alice SHELL=/bin/sh", "env HOME=<home> SHELL=/bin/sh"},
+		{"quoted home env", DefaultSanitizeOptions(), `HOME="/srv/alice smith"`, "HOME=<home>"},
+		{"other env", DefaultSanitizeOptions(), "XDG_HOME=/srv/x", "XDG_HOME=/srv/x"},
+		{"windows home", DefaultSanitizeOptions(), `C:\Users\alice\.ssh`, `C:\Users\<user>\.ssh`},
+		{"every fingerprint", DefaultSanitizeOptions(), fingerprint + " and " + fingerprint, "SHA256:<redacted> and SHA256:<redacted>"},
+		{"other sha256", DefaultSanitizeOptions(), "digest SHA256:abc123", "digest SHA256:abc123"},
+		{"paths off", SanitizeOptions{Fingerprints: true}, "/home/alice/x", "/home/alice/x"},
+		{"fingerprints off", SanitizeOptions{HomePaths: true}, fingerprint, fingerprint},
+		{"base64 blob", DefaultSanitizeOptions(), "blob AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl end", "blob <redacted 68 bytes sha256:"},
+		{"hex blob", DefaultSanitizeOptions(), strings.Repeat("0123456789abcdef", 5), "<redacted 80 bytes sha256:"},
+		{"long path", DefaultSanitizeOptions(), "/nix/store/abcdefghijklmnopqrstuvwxyz/lib/libexec/bin/abcdefghijklmnopqrstuvwxyz", "/nix/store/abcdefghijklmnopqrstuvwxyz/lib"},
+		{"key material off", SanitizeOptions{}, strings.Repeat("A", 80), strings.Repeat("A", 80)},
+		{"custom rule", SanitizeOptions{Rules: []SanitizeRule{mustParseRule(t, `host=(\w+)=>host=<${1}>`)}}, "host=build1", "host=<build1>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(NewSanitizingHandlerWithOptions(slog.NewTextHandler(&buf, nil), tt.opts))
+			logger.Info(tt.in)
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("Expected %q in %q", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestSanitizeErrors(t *testing.T) {
+	_, statErr := os.Stat("/home/alice/.ssh/missing")
+	tests := []struct {
+		name string
+		attr slog.Attr
+	}{
+		{"error", slog.Any("error", errors.New("dial unix /home/alice/.ssh/agent: refused"))},
+		{"wrapped error", slog.Any("error", fmt.Errorf("probe: %w", statErr))},
+		{"grouped error", slog.Group("upstream", slog.Any("error", statErr))},
+		{"log valuer", slog.Any("socket", pathValuer("/Users/alice/agent"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(NewSanitizingHandler(slog.NewTextHandler(&buf, nil)))
+			logger.Info("failed", tt.attr)
+			if strings.Contains(buf.String(), "alice") {
+				t.Errorf("Username not sanitized: %s", buf.String())
+			}
+			if !strings.Contains(buf.String(), "<user>") {
+				t.Errorf("Expected the path kept with <user>: %s", buf.String())
+			}
+		})
+	}
+}
+
+type pathValuer string
+
+func (p pathValuer) LogValue() slog.Value { return slog.StringValue(string(p)) }
+
+func TestSanitizeKeyBytes(t *testing.T) {
+	signer := newHostKey(t)
+	blob := signer.PublicKey().Marshal()
+
+	var buf bytes.Buffer
+	logger := slog.New(NewSanitizingHandler(slog.NewTextHandler(&buf, nil)))
+	logger.Info("key", "blob", blob, "key", signer.PublicKey())
+	if strings.Count(buf.String(), redactedBlob(blob)) != 2 {
+		t.Errorf("Expected both the bytes and the key replaced by %s, got %s", redactedBlob(blob), buf.String())
+	}
+
+	buf.Reset()
+	logger = slog.New(NewSanitizingHandlerWithOptions(slog.NewTextHandler(&buf, nil), SanitizeOptions{}))
+	logger.Info("key", "blob", []byte{1, 2, 3})
+	if strings.Contains(buf.String(), "redacted") {
+		t.Errorf("Expected bytes logged as-is without KeyMaterial, got %s", buf.String())
+	}
+}
+
+func TestParseSanitizeRule(t *testing.T) {
+	rule := mustParseRule(t, `a=>b=>c`)
+	if rule.Pattern.String() != "a=>b" || rule.Replacement != "c" {
+		t.Errorf("Expected the last => to split the rule, got %q and %q", rule.Pattern, rule.Replacement)
+	}
+	for _, bad := range []string{"no separator", "(=>x"} {
+		if _, err := ParseSanitizeRule(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func mustParseRule(t *testing.T, s string) SanitizeRule {
+	t.Helper()
+	rule, err := ParseSanitizeRule(s)
+	if err != nil {
+		t.Fatalf("Failed to parse rule: %v", err)
+	}
+	return rule
+}
+
+func TestSanitizeCache(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewSanitizingHandler(slog.NewTextHandler(&buf, nil)))
+	for i := 0; i < sanitizeCacheSize+10; i++ {
+		logger.Info("connect", "socket", "/home/alice/.ssh/agent."+strings.Repeat("x", i%300))
+	}
+	if strings.Contains(buf.String(), "alice") {
+		t.Error("Username leaked once the cache filled")
+	}
+
+	buf.Reset()
+	logger.Info("connect", "addr", stringer("/Users/alice/agent.sock"))
+	if strings.Contains(buf.String(), "alice") {
+		t.Errorf("Username not sanitized from a Stringer: %s", buf.String())
+	}
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SessionSockets returns the agent sockets sshd forwarded into the SSH
+// login this process runs in, or nil outside one. sshd names a session's
+// socket agent.<pid> after the sshd process serving it, an ancestor of
+// every process in the session; $SSH_AUTH_SOCK names it too, unless it
+// has been pointed elsewhere, such as at the proxy.
+func SessionSockets() []string {
+	if os.Getenv("SSH_CONNECTION") == "" {
+		return nil
+	}
+
+	var sockets []string
+	if authSock := os.Getenv("SSH_AUTH_SOCK"); authSock != "" {
+		if ok, _ := filepath.Match("/tmp/ssh-*/agent.*", filepath.Clean(authSock)); ok {
+			sockets = append(sockets, filepath.Clean(authSock))
+		}
+	}
+	for _, pid := range sshdAncestors() {
+		matches, _ := filepath.Glob("/tmp/ssh-*/agent." + pid)
+		for _, match := range matches {
+			if !containsPath(sockets, match) {
+				sockets = append(sockets, match)
+			}
+		}
+	}
+	return sockets
+}
+
+// sshdAncestors returns the PIDs of the sshd processes this process
+// descends from, found through /proc. Where there's no /proc, there are
+// none.
+func sshdAncestors() []string {
+	var pids []string
+	pid := os.Getppid()
+	for depth := 0; pid > 1 && depth < 64; depth++ {
+		id := strconv.Itoa(pid)
+		if comm, err := os.ReadFile(filepath.Join("/proc", id, "comm")); err == nil &&
+			strings.HasPrefix(strings.TrimSpace(string(comm)), "sshd") {
+			pids = append(pids, id)
+		}
+		var ok bool
+		if pid, ok = parentPID(id); !ok {
+			break
+		}
+	}
+	return pids
+}
+
+// parentPID reads a process's parent from /proc/<pid>/stat, whose second
+// field, the command name, may itself contain spaces and parentheses.
+func parentPID(pid string) (int, bool) {
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return 0, false
+	}
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return ppid, err == nil
+}
+
+// containsPath reports whether paths holds path, comparing cleaned forms.
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if filepath.Clean(p) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionSockets(t *testing.T) {
+	t.Setenv("SSH_CONNECTION", "")
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-test/agent.1234")
+	if sockets := SessionSockets(); sockets != nil {
+		t.Errorf("Expected no session sockets outside an SSH login, got %v", sockets)
+	}
+
+	t.Setenv("SSH_CONNECTION", "10.0.0.1 50000 10.0.0.2 22")
+	if sockets := SessionSockets(); len(sockets) == 0 || sockets[0] != "/tmp/ssh-test/agent.1234" {
+		t.Errorf("Expected $SSH_AUTH_SOCK to be a session socket, got %v", sockets)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "/home/me/.ssh/agent")
+	for _, socket := range SessionSockets() {
+		if socket == "/home/me/.ssh/agent" {
+			t.Error("Expected a non-forwarded $SSH_AUTH_SOCK to be ignored")
+		}
+	}
+}
+
+func TestParentPID(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	ppid, ok := parentPID(strconv.Itoa(os.Getpid()))
+	if !ok || ppid != os.Getppid() {
+		t.Errorf("Expected parent %d, got %d (%v)", os.Getppid(), ppid, ok)
+	}
+}
+
+func TestDiscoverySession(t *testing.T) {
+	session := createMockAgent(t)
+	time.Sleep(10 * time.Millisecond)
+	newer := createMockAgent(t)
+
+	d := &Discovery{
+		Command: "echo " + session + "; echo " + newer,
+		Only:    []string{session, newer},
+	}
+	if active, err := d.FindActiveSocket(); err != nil || active != newer {
+		t.Fatalf("Expected the newest socket %s without a session, got %s (%v)", newer, active, err)
+	}
+
+	d.Session = []string{session}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("DiscoverSockets failed: %v", err)
+	}
+	if len(sockets) == 0 || sockets[0].Path != session || !sockets[0].Session {
+		t.Fatalf("Expected the session's socket first, got %+v", sockets)
+	}
+	if active, err := d.FindActiveSocket(); err != nil || active != session {
+		t.Errorf("Expected the session's socket %s, got %s (%v)", session, active, err)
+	}
+}
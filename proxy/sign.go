@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Sign asks the agent at socketPath to sign data with the given identity
+// and returns the signature blob.
+func Sign(socketPath string, id Identity, data []byte, flags uint32) ([]byte, error) {
+	conn, err := dialUpstream(socketPath)
+	if err != nil {
+		return nil, errorOfKind(ErrUpstreamDial, "failed to connect to %s: %w", socketPath, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	request := signRequest{Blob: id.Blob, Data: data, Flags: flags}.marshal()
+
+	response, err := agentRequest(conn, request, signRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	switch response[0] {
+	case SSH_AGENT_SIGN_RESPONSE:
+	case SSH_AGENT_FAILURE:
+		return nil, errors.New("agent refused to sign")
+	default:
+		return nil, errorOfKind(ErrProtocol, "unexpected response type: %d", response[0])
+	}
+
+	signature, _, ok := readWireString(response[1:])
+	if !ok {
+		return nil, errorOfKind(ErrProtocol, "truncated sign response")
+	}
+	return signature, nil
+}
+
+// SignTest signs a random challenge with id through the agent at socketPath
+// and verifies the signature locally, exercising the full signing path.
+func SignTest(socketPath string, id Identity) error {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	var flags uint32
+	if id.Type() == "ssh-rsa" {
+		flags = SSH_AGENT_RSA_SHA2_256
+	}
+	signature, err := Sign(socketPath, id, challenge, flags)
+	if err != nil {
+		return err
+	}
+	if err := VerifySignature(id, challenge, signature); err != nil {
+		return fmt.Errorf("signature did not verify: %w", err)
+	}
+	return nil
+}
+
+// VerifySignature checks an SSH signature blob over data against the
+// identity's public key.
+func VerifySignature(id Identity, data, signature []byte) error {
+	keyType, key, ok := readWireString(id.Blob)
+	if !ok {
+		return errors.New("malformed public key")
+	}
+	sigType, sig, rest, ok := parseSignature(signature)
+	if !ok {
+		return errors.New("malformed signature")
+	}
+
+	switch kt := string(keyType); {
+	case kt == "ssh-ed25519":
+		return verifyEd25519(key, data, sig)
+	case kt == "ssh-rsa":
+		return verifyRSA(key, sigType, data, sig)
+	case strings.HasPrefix(kt, "ecdsa-sha2-"):
+		return verifyECDSA(key, data, sig)
+	case kt == "sk-ssh-ed25519@openssh.com", strings.HasPrefix(kt, "sk-ecdsa-sha2-"):
+		return verifySecurityKey(kt, key, data, sig, rest)
+	default:
+		return fmt.Errorf("verifying %s signatures is not supported", kt)
+	}
+}
+
+func verifyEd25519(key, data, sig []byte) error {
+	pub, _, ok := readWireString(key)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return errors.New("malformed ed25519 key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return errors.New("invalid ed25519 signature")
+	}
+	return nil
+}
+
+func verifyRSA(key []byte, sigType string, data, sig []byte) error {
+	e, rest, ok := readWireString(key)
+	if !ok {
+		return errors.New("malformed RSA key")
+	}
+	n, _, ok := readWireString(rest)
+	if !ok {
+		return errors.New("malformed RSA key")
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return errors.New("unsupported RSA exponent")
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+
+	var hash crypto.Hash
+	switch sigType {
+	case "rsa-sha2-256":
+		hash = crypto.SHA256
+	case "rsa-sha2-512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported RSA signature type %s", sigType)
+	}
+	h := hash.New()
+	h.Write(data)
+	return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig)
+}
+
+// parseECDSAKey reads the curve and point that follow the key type in an
+// ecdsa or sk-ecdsa public key blob.
+func parseECDSAKey(key []byte) (*ecdsa.PublicKey, []byte, error) {
+	curveName, rest, ok := readWireString(key)
+	if !ok {
+		return nil, nil, errors.New("malformed ECDSA key")
+	}
+	point, rest, ok := readWireString(rest)
+	if !ok {
+		return nil, nil, errors.New("malformed ECDSA key")
+	}
+
+	var curve elliptic.Curve
+	switch string(curveName) {
+	case "nistp256":
+		curve = elliptic.P256()
+	case "nistp384":
+		curve = elliptic.P384()
+	case "nistp521":
+		curve = elliptic.P521()
+	default:
+		return nil, nil, fmt.Errorf("unsupported curve %s", curveName)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(point) != 1+2*size || point[0] != 4 {
+		return nil, nil, errors.New("malformed ECDSA point")
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(point[1 : 1+size]),
+		Y:     new(big.Int).SetBytes(point[1+size:]),
+	}
+	return pub, rest, nil
+}
+
+// ecdsaDigest hashes data with the hash SSH pairs with the key's curve.
+func ecdsaDigest(pub *ecdsa.PublicKey, data []byte) []byte {
+	switch pub.Curve.Params().BitSize {
+	case 384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case 521:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func verifyECDSASig(pub *ecdsa.PublicKey, digest, sig []byte) error {
+	r, rest, ok := readWireString(sig)
+	if !ok {
+		return errors.New("malformed ECDSA signature")
+	}
+	s, _, ok := readWireString(rest)
+	if !ok {
+		return errors.New("malformed ECDSA signature")
+	}
+	if !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+		return errors.New("invalid ECDSA signature")
+	}
+	return nil
+}
+
+func verifyECDSA(key, data, sig []byte) error {
+	pub, _, err := parseECDSAKey(key)
+	if err != nil {
+		return err
+	}
+	return verifyECDSASig(pub, ecdsaDigest(pub, data), sig)
+}
+
+// verifySecurityKey checks a FIDO (sk-*) signature, which covers the
+// application, the authenticator flags and counter, and a hash of data.
+func verifySecurityKey(keyType string, key, data, sig, trailer []byte) error {
+	if len(trailer) < 5 {
+		return errors.New("malformed security key signature")
+	}
+	flags, counter := trailer[0], trailer[1:5]
+
+	var application []byte
+	var verify func(signed []byte) error
+	if keyType == "sk-ssh-ed25519@openssh.com" {
+		pub, rest, ok := readWireString(key)
+		if !ok || len(pub) != ed25519.PublicKeySize {
+			return errors.New("malformed ed25519-sk key")
+		}
+		if application, _, ok = readWireString(rest); !ok {
+			return errors.New("malformed ed25519-sk key")
+		}
+		verify = func(signed []byte) error {
+			if !ed25519.Verify(ed25519.PublicKey(pub), signed, sig) {
+				return errors.New("invalid ed25519-sk signature")
+			}
+			return nil
+		}
+	} else {
+		pub, rest, err := parseECDSAKey(key)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if application, _, ok = readWireString(rest); !ok {
+			return errors.New("malformed ecdsa-sk key")
+		}
+		verify = func(signed []byte) error {
+			return verifyECDSASig(pub, ecdsaDigest(pub, signed), sig)
+		}
+	}
+
+	appHash := sha256.Sum256(application)
+	dataHash := sha256.Sum256(data)
+	signed := append(appHash[:], flags)
+	signed = append(signed, counter...)
+	signed = append(signed, dataHash[:]...)
+	return verify(signed)
+}
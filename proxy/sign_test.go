@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// testSigner is a key a mock agent can sign with.
+type testSigner struct {
+	blob []byte
+	sign func(data []byte) []byte
+}
+
+func newEd25519Signer(t *testing.T) testSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	blob := appendWireString(appendWireString(nil, []byte("ssh-ed25519")), pub)
+	return testSigner{blob: blob, sign: func(data []byte) []byte {
+		sig := appendWireString(nil, []byte("ssh-ed25519"))
+		return appendWireString(sig, ed25519.Sign(priv, data))
+	}}
+}
+
+func newECDSASigner(t *testing.T) testSigner {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	point := append([]byte{4}, priv.X.FillBytes(make([]byte, 32))...)
+	point = append(point, priv.Y.FillBytes(make([]byte, 32))...)
+	blob := appendWireString(nil, []byte("ecdsa-sha2-nistp256"))
+	blob = appendWireString(blob, []byte("nistp256"))
+	blob = appendWireString(blob, point)
+	return testSigner{blob: blob, sign: func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Errorf("Failed to sign: %v", err)
+		}
+		inner := appendWireString(appendWireString(nil, r.Bytes()), s.Bytes())
+		return appendWireString(appendWireString(nil, []byte("ecdsa-sha2-nistp256")), inner)
+	}}
+}
+
+func newRSASigner(t *testing.T) testSigner {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	blob := appendWireString(nil, []byte("ssh-rsa"))
+	blob = appendWireString(blob, big.NewInt(int64(priv.E)).Bytes())
+	blob = appendWireString(blob, priv.N.Bytes())
+	return testSigner{blob: blob, sign: func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Errorf("Failed to sign: %v", err)
+		}
+		return appendWireString(appendWireString(nil, []byte("rsa-sha2-256")), sig)
+	}}
+}
+
+// securityKeySigned is what a FIDO authenticator signs for OpenSSH: hashes
+// of the application and data around its flags and counter.
+func securityKeySigned(application []byte, flags byte, counter uint32, data []byte) []byte {
+	appHash := sha256.Sum256(application)
+	dataHash := sha256.Sum256(data)
+	signed := append(appHash[:], flags)
+	signed = binary.BigEndian.AppendUint32(signed, counter)
+	return append(signed, dataHash[:]...)
+}
+
+// newSKEd25519Signer returns an sk-ssh-ed25519@openssh.com key whose
+// signatures carry the user-presence flag and a rising counter, as a
+// security key's would.
+func newSKEd25519Signer(t *testing.T) testSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	const keyType = "sk-ssh-ed25519@openssh.com"
+	application := []byte("ssh:")
+	blob := appendWireString(appendWireString(nil, []byte(keyType)), pub)
+	blob = appendWireString(blob, application)
+	var counter uint32
+	return testSigner{blob: blob, sign: func(data []byte) []byte {
+		counter++
+		sig := appendWireString(nil, []byte(keyType))
+		sig = appendWireString(sig, ed25519.Sign(priv, securityKeySigned(application, 0x01, counter, data)))
+		return binary.BigEndian.AppendUint32(append(sig, 0x01), counter)
+	}}
+}
+
+// newSKECDSASigner returns an sk-ecdsa-sha2-nistp256@openssh.com key, as
+// newSKEd25519Signer does.
+func newSKECDSASigner(t *testing.T) testSigner {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	const keyType = "sk-ecdsa-sha2-nistp256@openssh.com"
+	application := []byte("ssh:")
+	point := append([]byte{4}, priv.X.FillBytes(make([]byte, 32))...)
+	point = append(point, priv.Y.FillBytes(make([]byte, 32))...)
+	blob := appendWireString(nil, []byte(keyType))
+	blob = appendWireString(blob, []byte("nistp256"))
+	blob = appendWireString(blob, point)
+	blob = appendWireString(blob, application)
+	var counter uint32
+	return testSigner{blob: blob, sign: func(data []byte) []byte {
+		counter++
+		digest := sha256.Sum256(securityKeySigned(application, 0x01, counter, data))
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Errorf("Failed to sign: %v", err)
+		}
+		inner := appendWireString(appendWireString(nil, r.Bytes()), s.Bytes())
+		sig := appendWireString(appendWireString(nil, []byte(keyType)), inner)
+		return binary.BigEndian.AppendUint32(append(sig, 0x01), counter)
+	}}
+}
+
+// createSigningMockAgent serves sign requests for signer, optionally
+// corrupting the signatures it returns. Unless requests is nil, each
+// request it receives is sent on it.
+func createSigningMockAgent(t *testing.T, signer testSigner, corrupt bool, requests chan<- []byte) string {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create mock agent: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					request, err := readMessage(c, maxAgentMessage)
+					if err != nil {
+						return
+					}
+					if requests != nil {
+						requests <- request
+					}
+					sr, ok := parseSignRequest(request)
+					if !ok {
+						_ = writeMessage(c, failure())
+						continue
+					}
+					data := sr.Data
+					if corrupt {
+						data = append([]byte("tampered"), data...)
+					}
+					_ = writeMessage(c, appendWireString([]byte{SSH_AGENT_SIGN_RESPONSE}, signer.sign(data)))
+				}
+			}(conn)
+		}
+	}()
+	return socketPath
+}
+
+func TestSignTest(t *testing.T) {
+	signers := map[string]testSigner{
+		"ed25519":    newEd25519Signer(t),
+		"ecdsa":      newECDSASigner(t),
+		"rsa":        newRSASigner(t),
+		"ed25519-sk": newSKEd25519Signer(t),
+		"ecdsa-sk":   newSKECDSASigner(t),
+	}
+	for name, signer := range signers {
+		t.Run(name, func(t *testing.T) {
+			id := Identity{Blob: signer.blob}
+
+			good := createSigningMockAgent(t, signer, false, nil)
+			if err := SignTest(good, id); err != nil {
+				t.Errorf("Expected signature to verify: %v", err)
+			}
+
+			bad := createSigningMockAgent(t, signer, true, nil)
+			if err := SignTest(bad, id); err == nil {
+				t.Error("Expected signature over the wrong data to fail")
+			}
+		})
+	}
+}
+
+func TestSignRefused(t *testing.T) {
+	socket := createMockAgentWithKeys(t, 1)
+	signer := newEd25519Signer(t)
+
+	if err := SignTest(socket, Identity{Blob: signer.blob}); err == nil {
+		t.Error("Expected sign test against a non-signing agent to fail")
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// signRequest is a parsed SSH_AGENTC_SIGN_REQUEST. Middleware that
+// rewrites sign requests goes through it so that nothing after the key
+// blob is lost: flags are kept whole rather than masked to the RSA bits,
+// and anything after them, which no client sends today, is carried along
+// in Extra.
+type signRequest struct {
+	Blob  []byte
+	Data  []byte
+	Flags uint32
+	Extra []byte
+}
+
+// parseSignRequest parses message, a sign request including its type
+// byte.
+func parseSignRequest(message []byte) (signRequest, bool) {
+	if len(message) == 0 || message[0] != SSH_AGENTC_SIGN_REQUEST {
+		return signRequest{}, false
+	}
+	blob, rest, ok := readWireString(message[1:])
+	if !ok {
+		return signRequest{}, false
+	}
+	data, rest, ok := readWireString(rest)
+	if !ok || len(rest) < 4 {
+		return signRequest{}, false
+	}
+	return signRequest{
+		Blob:  blob,
+		Data:  data,
+		Flags: binary.BigEndian.Uint32(rest),
+		Extra: rest[4:],
+	}, true
+}
+
+// marshal encodes the request as a message, type byte first.
+func (sr signRequest) marshal() []byte {
+	message := appendWireString([]byte{SSH_AGENTC_SIGN_REQUEST}, sr.Blob)
+	message = appendWireString(message, sr.Data)
+	message = binary.BigEndian.AppendUint32(message, sr.Flags)
+	return append(message, sr.Extra...)
+}
+
+// parseSignature splits a signature blob into its format, the signature
+// proper, and what follows it. Security key (sk-*) signatures follow it
+// with the authenticator's flags byte and counter, and webauthn ones with
+// the origin and client data too; every other format has nothing there.
+func parseSignature(signature []byte) (format string, sig, trailer []byte, ok bool) {
+	formatBytes, rest, ok := readWireString(signature)
+	if !ok {
+		return "", nil, nil, false
+	}
+	sig, trailer, ok = readWireString(rest)
+	if !ok {
+		return "", nil, nil, false
+	}
+	return string(formatBytes), sig, trailer, true
+}
+
+// securityKeyCounter returns the authenticator flags and signature
+// counter from a security key signature's trailer.
+func securityKeyCounter(format string, trailer []byte) (flags byte, counter uint32, ok bool) {
+	if !isSecurityKeyFormat(format) || len(trailer) < 5 {
+		return 0, 0, false
+	}
+	return trailer[0], binary.BigEndian.Uint32(trailer[1:5]), true
+}
+
+// isSecurityKeyFormat reports whether format, a key type or signature
+// format, is one of OpenSSH's FIDO ones.
+func isSecurityKeyFormat(format string) bool {
+	return strings.HasPrefix(format, "sk-") || strings.HasPrefix(format, "webauthn-sk-")
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSignRequest(t *testing.T) {
+	signer := newSKEd25519Signer(t)
+	message := signRequest{Blob: signer.blob, Data: []byte("session"), Flags: 0xffffffff}.marshal()
+	message = append(message, "future"...)
+
+	sr, ok := parseSignRequest(message)
+	if !ok {
+		t.Fatal("Expected the request to parse")
+	}
+	if sr.Flags != 0xffffffff || string(sr.Extra) != "future" {
+		t.Errorf("Expected every flag bit and the trailing bytes, got flags=%#x extra=%q", sr.Flags, sr.Extra)
+	}
+	if !bytes.Equal(sr.marshal(), message) {
+		t.Error("Expected marshal to reproduce the request byte for byte")
+	}
+
+	if _, ok := parseSignRequest(message[:len(message)-len("future")-1]); ok {
+		t.Error("Expected a request cut off in its flags to be rejected")
+	}
+}
+
+// TestSecurityKeyPassthrough signs with sk keys through a proxy whose
+// middleware parses and rewrites sign requests, and checks the upstream
+// sees the client's request unchanged and the client gets the
+// authenticator's flags and counter back.
+func TestSecurityKeyPassthrough(t *testing.T) {
+	signers := map[string]testSigner{
+		"ed25519-sk": newSKEd25519Signer(t),
+		"ecdsa-sk":   newSKECDSASigner(t),
+	}
+	for name, signer := range signers {
+		t.Run(name, func(t *testing.T) {
+			requests := make(chan []byte, 10)
+			agentSocket := createSigningMockAgent(t, signer, false, requests)
+			// A certificate for another key puts the rewriting in the path
+			certPath, _ := writeTestCert(t, writeTestKey(t, ""), time.Now().Add(time.Hour))
+			var trace strings.Builder
+			ap := New("/tmp/test.sock",
+				WithLogger(slog.New(slog.NewTextHandler(&trace, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+				WithCertificateFiles(certPath),
+				WithPacketTrace(true),
+				WithDiscoverer(DiscovererFunc(func() (string, error) {
+					return agentSocket, nil
+				})))
+			proxySocket := serveProxy(t, ap)
+
+			conn, err := net.Dial("unix", proxySocket)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			id := Identity{Blob: signer.blob}
+			for counter := uint32(1); counter <= 2; counter++ {
+				data := []byte("session data")
+				request := signRequest{Blob: id.Blob, Data: data}.marshal()
+				if err := writeMessage(conn, request); err != nil {
+					t.Fatalf("Failed to send sign request: %v", err)
+				}
+				response, err := readMessage(conn, maxAgentMessage)
+				if err != nil {
+					t.Fatalf("Failed to read sign response: %v", err)
+				}
+				if forwarded := <-requests; !bytes.Equal(forwarded, request) {
+					t.Errorf("Expected the request to reach the upstream unchanged\nsent      % x\nforwarded % x", request, forwarded)
+				}
+				if response[0] != SSH_AGENT_SIGN_RESPONSE {
+					t.Fatalf("Expected a sign response, got type %d", response[0])
+				}
+
+				signature, _, _ := readWireString(response[1:])
+				if err := VerifySignature(id, data, signature); err != nil {
+					t.Errorf("Expected the signature to verify, got %v", err)
+				}
+				format, _, trailer, _ := parseSignature(signature)
+				flags, got, ok := securityKeyCounter(format, trailer)
+				if !ok || flags != 0x01 || got != counter {
+					t.Errorf("Expected flags 0x01 and counter %d, got %#x %d", counter, flags, got)
+				}
+			}
+
+			if !strings.Contains(trace.String(), "authenticator flags=0x1 counter=2") {
+				t.Errorf("Expected the packet trace to show the counter, got:\n%s", trace.String())
+			}
+		})
+	}
+}
+
+func TestSecurityKeyCounter(t *testing.T) {
+	trailer := binary.BigEndian.AppendUint32([]byte{0x05}, 42)
+	if flags, counter, ok := securityKeyCounter("sk-ssh-ed25519@openssh.com", trailer); !ok || flags != 0x05 || counter != 42 {
+		t.Errorf("Expected flags 0x05 and counter 42, got %#x %d %v", flags, counter, ok)
+	}
+	if _, _, ok := securityKeyCounter("ssh-ed25519", trailer); ok {
+		t.Error("Expected plain ed25519 signatures to carry no counter")
+	}
+	if _, _, ok := securityKeyCounter("sk-ssh-ed25519@openssh.com", trailer[:3]); ok {
+		t.Error("Expected a truncated trailer to be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// sourcePollInterval is how often upstream source files are reread where
+// changes to them can't be watched.
+const sourcePollInterval = 2 * time.Second
+
+// WatchUpstreamSources rediscovers whenever a file named by sources comes
+// to name a different socket, until ctx is done, so a tool that tracks the
+// current agent in a file switches the proxy as soon as it rewrites it,
+// rather than when the cached upstream fails or expires. Files are watched
+// where the platform supports it, and polled otherwise.
+func (ap *AgentProxy) WatchUpstreamSources(ctx context.Context, sources []UpstreamSource) {
+	var paths []string
+	for _, source := range sources {
+		if source.File != "" {
+			paths = append(paths, source.File)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	resolved := make(map[UpstreamSource]string)
+	for _, source := range sources {
+		resolved[source], _ = source.Resolve()
+	}
+	check := func() {
+		changed := false
+		for _, source := range sources {
+			socket, _ := source.Resolve()
+			if socket != resolved[source] {
+				ap.logger.Info("Upstream source changed", "source", source.String(), "socket", socket)
+				resolved[source] = socket
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+		ap.InvalidateCache()
+		if socket := ap.FindActiveSocketCached(); socket != "" {
+			ap.logger.Info("Rediscovered upstream", "socket", socket)
+		}
+	}
+
+	// Rechecking once watching starts catches a change made before then
+	ready := func() {
+		ap.logger.Debug("Watching upstream source files", "files", paths)
+		check()
+	}
+	err := watchFiles(ctx, paths, ready, check)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	ap.logger.Debug("Can't watch upstream source files, polling them", "error", err,
+		"interval", sourcePollInterval)
+	ticker := time.NewTicker(sourcePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// sourceWatchDirFlags catches an entry being created, removed, or renamed
+// in a watched directory, and sourceWatchFileFlags a watched file being
+// written in place or going away.
+const (
+	sourceWatchDirFlags  = syscall.NOTE_WRITE
+	sourceWatchFileFlags = syscall.NOTE_WRITE | syscall.NOTE_EXTEND | syscall.NOTE_ATTRIB |
+		syscall.NOTE_DELETE | syscall.NOTE_RENAME
+)
+
+// watchFiles calls ready once paths are watched, then changed after any of
+// them changes, until ctx is done. kqueue watches open files rather than
+// names, so it watches their directories, to see files that don't exist
+// yet or are replaced by a rename, and opens each file that exists, to see
+// it rewritten in place. Files are reopened after every change. Any change
+// in a directory counts, which at worst rereads the files for nothing.
+func watchFiles(ctx context.Context, paths []string, ready, changed func()) error {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return os.NewSyscallError("kqueue", err)
+	}
+	syscall.CloseOnExec(kq)
+	defer func() { _ = syscall.Close(kq) }()
+
+	// Closing a kqueue doesn't wake a pending kevent, so cancellation
+	// writes to a pipe the queue also watches
+	var wake [2]int
+	if err := syscall.Pipe(wake[:]); err != nil {
+		return os.NewSyscallError("pipe", err)
+	}
+	for _, fd := range wake {
+		syscall.CloseOnExec(fd)
+		defer func() { _ = syscall.Close(fd) }()
+	}
+	var cancelEvent syscall.Kevent_t
+	syscall.SetKevent(&cancelEvent, wake[0], syscall.EVFILT_READ, syscall.EV_ADD)
+	changes := []syscall.Kevent_t{cancelEvent}
+
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		dirs[filepath.Dir(filepath.Clean(path))] = true
+	}
+	for dir := range dirs {
+		fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: dir, Err: err}
+		}
+		defer func() { _ = syscall.Close(fd) }()
+		changes = append(changes, vnodeEvent(fd, sourceWatchDirFlags))
+	}
+	if err := kevent(kq, changes); err != nil {
+		return err
+	}
+
+	// Closing a file removes its watch, so reopening is all it takes to
+	// follow a file that was replaced
+	var files []int
+	closeFiles := func() {
+		for _, fd := range files {
+			_ = syscall.Close(fd)
+		}
+		files = files[:0]
+	}
+	defer closeFiles()
+	openFiles := func() error {
+		closeFiles()
+		var changes []syscall.Kevent_t
+		for _, path := range paths {
+			fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+			if err != nil {
+				// Not there yet; its directory's watch sees it arrive
+				continue
+			}
+			files = append(files, fd)
+			changes = append(changes, vnodeEvent(fd, sourceWatchFileFlags))
+		}
+		return kevent(kq, changes)
+	}
+	if err := openFiles(); err != nil {
+		return err
+	}
+
+	woken := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(woken)
+		_, _ = syscall.Write(wake[1], []byte{0})
+	})
+	// The pipe mustn't be closed under a wake-up still writing to it
+	defer func() {
+		if !stop() {
+			<-woken
+		}
+	}()
+
+	ready()
+	events := make([]syscall.Kevent_t, 16)
+	for {
+		n, err := syscall.Kevent(kq, nil, events, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return os.NewSyscallError("kevent", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := openFiles(); err != nil {
+			return err
+		}
+		changed()
+	}
+}
+
+// vnodeEvent registers a clearing watch for fflags on fd.
+func vnodeEvent(fd int, fflags uint32) syscall.Kevent_t {
+	var event syscall.Kevent_t
+	syscall.SetKevent(&event, fd, syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	event.Fflags = fflags
+	return event
+}
+
+// kevent applies changes to kq without waiting for events.
+func kevent(kq int, changes []syscall.Kevent_t) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	for {
+		_, err := syscall.Kevent(kq, changes, nil, &syscall.Timespec{})
+		if err != syscall.EINTR {
+			return os.NewSyscallError("kevent", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// sourceWatchMask catches a file being written, replaced by a rename (as
+// editors and ln -sf do), created, or removed.
+const sourceWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// watchFiles calls ready once paths are watched, then changed after any of
+// them changes, until ctx is done. It watches their directories with
+// inotify, so files that don't exist yet or are replaced rather than
+// rewritten are still seen.
+func watchFiles(ctx context.Context, paths []string, ready, changed func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking descriptor goes through the runtime poller, so
+	// closing the file ends a pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer func() { _ = file.Close() }()
+
+	names := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		dir, name := filepath.Split(filepath.Clean(path))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, sourceWatchMask)
+		if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = make(map[string]bool)
+		}
+		names[int32(wd)][name] = true
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = file.Close() })
+	defer stop()
+
+	ready()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		relevant := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were dropped, so any of the files may have changed
+				relevant = true
+				continue
+			}
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if names[event.Wd][name] {
+				relevant = true
+			}
+		}
+		if relevant {
+			changed()
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package proxy
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFiles is only implemented with inotify and kqueue; elsewhere
+// upstream source files are polled.
+func watchFiles(ctx context.Context, paths []string, ready, changed func()) error {
+	return errors.New("file watching is not supported on this platform")
+}
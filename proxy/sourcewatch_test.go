@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchUpstreamSources(t *testing.T) {
+	first, second := createMockAgent(t), createMockAgent(t)
+	current := filepath.Join(t.TempDir(), "current-agent")
+	writeFile(t, current, first+"\n")
+
+	d := &Discovery{
+		Upstreams: []UpstreamSource{{File: current}},
+		Only:      []string{ClassCustom},
+	}
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ap := New("/tmp/test.sock", WithLogger(logger), WithDiscoverer(d), WithCacheTTL(time.Hour))
+	if got := ap.FindActiveSocketCached(); got != first {
+		t.Fatalf("Expected %s from the file, got %q", first, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ap.WatchUpstreamSources(ctx, d.Upstreams)
+	}()
+	waitFor(t, "the watcher to start", func() bool {
+		return strings.Contains(logs.String(), "Watching upstream source files")
+	})
+
+	// Replace the file as tools do. The hour-long cache means only the
+	// watcher can switch the upstream.
+	tmp := current + ".tmp"
+	writeFile(t, tmp, second+"\n")
+	if err := os.Rename(tmp, current); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	waitFor(t, "switch to the rewritten socket", func() bool {
+		return ap.ActiveSocket() == second
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WatchUpstreamSources didn't return after cancellation")
+	}
+}
+
+func TestWatchFilesRewrittenInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current-agent")
+	writeFile(t, path, "/tmp/first.sock\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	changed := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- watchFiles(ctx, []string{path}, func() { close(ready) }, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}()
+	select {
+	case <-ready:
+	case err := <-result:
+		t.Skipf("File watching unavailable: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watcher to start")
+	}
+
+	writeFile(t, path, "/tmp/second.sock\n")
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rewriting the file in place wasn't seen")
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("watchFiles returned %v after cancellation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchFiles didn't return after cancellation")
+	}
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// StandbyDiscoverer is a Discoverer that can also name the next-best
+// upstream, so WithHotStandby can keep it ready. Discovery implements it.
+type StandbyDiscoverer interface {
+	Discoverer
+	FindUpstreams() (primary, standby string, err error)
+}
+
+// warmConn is an idle connection to an upstream that has answered an
+// identities request. While it waits for a client it's watched, so the
+// proxy learns that the agent went away as soon as its socket closes.
+type warmConn struct {
+	socket string
+	conn   net.Conn
+
+	mu    sync.Mutex
+	taken bool
+	done  chan struct{} // closed when the watcher has stopped reading
+	err   error         // why the watcher's read returned
+}
+
+// dialWarm connects to socket and validates it with an identities request.
+func (ap *AgentProxy) dialWarm(socket string) (*warmConn, error) {
+	conn, err := ap.dialUpstream(socket)
+	if err != nil {
+		return nil, err
+	}
+	responseType, _, err := requestIdentities(conn, ap.probeTimeout)
+	if err == nil && responseType != SSH_AGENT_IDENTITIES_ANSWER && responseType != SSH_AGENT_FAILURE {
+		err = errorOfKind(ErrProtocol, "bad response type %d", responseType)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &warmConn{socket: socket, conn: conn, done: make(chan struct{})}, nil
+}
+
+// watch blocks reading the idle connection. Agents never send unprompted,
+// so the read only returns when the agent closes the connection or take
+// interrupts it; closed is called in the first case.
+func (w *warmConn) watch(closed func(*warmConn)) {
+	var buf [1]byte
+	_, err := w.conn.Read(buf[:])
+	if err == nil {
+		err = errorOfKind(ErrProtocol, "unexpected data from idle agent connection")
+	}
+	w.mu.Lock()
+	w.err = err
+	taken := w.taken
+	w.mu.Unlock()
+	close(w.done)
+	if !taken {
+		_ = w.conn.Close()
+		closed(w)
+	}
+}
+
+// take stops watching the connection and returns it for a client, or nil
+// if the agent has closed it.
+func (w *warmConn) take() net.Conn {
+	w.mu.Lock()
+	w.taken = true
+	w.mu.Unlock()
+	_ = w.conn.SetReadDeadline(time.Now())
+	<-w.done
+	if !errors.Is(w.err, os.ErrDeadlineExceeded) {
+		_ = w.conn.Close()
+		return nil
+	}
+	_ = w.conn.SetReadDeadline(time.Time{})
+	return w.conn
+}
+
+// discard stops watching the connection and closes it.
+func (w *warmConn) discard() {
+	if conn := w.take(); conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// hotStandby keeps warm connections to the active upstream and the
+// next-best one. A client takes the primary connection without dialing,
+// and when the primary agent goes away the standby takes over at once
+// while discovery runs again in the background.
+type hotStandby struct {
+	ap *AgentProxy
+
+	mu         sync.Mutex
+	primary    *warmConn
+	standby    *warmConn
+	sockets    [2]string // primary and standby from the last discovery
+	lastScan   time.Time
+	refreshing bool
+	again      bool // another refresh was asked for during this one
+	stopped    bool
+}
+
+// warm readies connections before the first client arrives.
+func (h *hotStandby) warm() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refreshLocked()
+}
+
+// connect returns a ready connection to the active upstream and its
+// address, or nil when there is none warm and the caller should dial.
+func (h *hotStandby) connect() (net.Conn, string) {
+	h.ap.mu.RLock()
+	pinned := h.ap.pinned != ""
+	h.ap.mu.RUnlock()
+	if pinned {
+		return nil, ""
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer h.refreshLocked()
+
+	for h.primary != nil {
+		w := h.primary
+		h.primary = nil
+		if conn := w.take(); conn != nil {
+			return conn, w.socket
+		}
+		h.failoverLocked(w.socket)
+	}
+	return nil, ""
+}
+
+// upstreamClosed handles an idle connection closed by its agent.
+func (h *hotStandby) upstreamClosed(w *warmConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch w {
+	case h.primary:
+		h.primary = nil
+		h.failoverLocked(w.socket)
+	case h.standby:
+		h.ap.logger.Info("Standby upstream went away", "socket", w.socket)
+		h.standby = nil
+		h.lastScan = time.Time{}
+	}
+	h.refreshLocked()
+}
+
+// failoverLocked promotes the standby after the agent at socket went away,
+// and makes the next refresh rediscover.
+func (h *hotStandby) failoverLocked(socket string) {
+	h.lastScan = time.Time{}
+	h.sockets = [2]string{}
+	if h.standby == nil {
+		h.ap.logger.Warn("Upstream agent went away with no standby ready", "socket", socket)
+		h.ap.InvalidateCache()
+		return
+	}
+	h.ap.logger.Warn("Upstream agent went away, switching to standby",
+		"from", socket, "to", h.standby.socket)
+	h.primary, h.standby = h.standby, nil
+	h.sockets[0] = h.primary.socket
+	h.ap.setActiveSocket(h.primary.socket)
+}
+
+// refreshLocked starts a background refresh, or another one after the
+// refresh that's running.
+func (h *hotStandby) refreshLocked() {
+	if h.stopped {
+		return
+	}
+	if h.refreshing {
+		h.again = true
+		return
+	}
+	h.refreshing = true
+	go h.refresh()
+}
+
+// refresh rediscovers the upstreams once the cache TTL has passed, then
+// replaces any warm connection that's missing or leads elsewhere.
+func (h *hotStandby) refresh() {
+	defer func() {
+		h.mu.Lock()
+		h.refreshing = false
+		if h.again {
+			h.again = false
+			h.refreshLocked()
+		}
+		h.mu.Unlock()
+	}()
+
+	h.mu.Lock()
+	sockets := h.sockets
+	scan := time.Since(h.lastScan) >= h.ap.cacheTTL || sockets[0] == ""
+	h.mu.Unlock()
+
+	if scan {
+		primary, standby, err := h.ap.findUpstreams()
+		if err != nil {
+			h.ap.logger.Debug("Hot standby discovery failed", "error", err)
+			return
+		}
+		sockets = [2]string{primary, standby}
+		h.ap.setActiveSocket(primary)
+		h.mu.Lock()
+		h.sockets = sockets
+		h.lastScan = time.Now()
+		h.mu.Unlock()
+	}
+
+	for slot, socket := range sockets {
+		h.mu.Lock()
+		current := *h.slot(slot)
+		h.mu.Unlock()
+		if socket == "" || (current != nil && current.socket == socket) {
+			continue
+		}
+		w, err := h.ap.dialWarm(socket)
+		if err != nil {
+			h.ap.logger.Debug("Failed to ready upstream connection", "socket", socket, "error", err)
+			continue
+		}
+		h.mu.Lock()
+		if h.stopped || h.sockets != sockets {
+			h.mu.Unlock()
+			_ = w.conn.Close()
+			return
+		}
+		if old := *h.slot(slot); old != nil {
+			go old.discard()
+		}
+		*h.slot(slot) = w
+		h.mu.Unlock()
+		go w.watch(h.upstreamClosed)
+	}
+}
+
+// slot returns the primary (0) or standby (1) connection field.
+func (h *hotStandby) slot(i int) **warmConn {
+	if i == 0 {
+		return &h.primary
+	}
+	return &h.standby
+}
+
+// standbySocket returns the upstream kept ready to take over, if any.
+func (h *hotStandby) standbySocket() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.standby == nil {
+		return ""
+	}
+	return h.standby.socket
+}
+
+// stop closes the warm connections and prevents new ones.
+func (h *hotStandby) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	for _, w := range []*warmConn{h.primary, h.standby} {
+		if w != nil {
+			_ = w.conn.Close()
+		}
+	}
+	h.primary, h.standby = nil, nil
+}
+
+// findUpstreams asks the discoverer for the active upstream and, if it's a
+// StandbyDiscoverer, the next-best one. The proxy's own socket is never
+// returned.
+func (ap *AgentProxy) findUpstreams() (string, string, error) {
+	var primary, standby string
+	var err error
+	if d, ok := ap.discoverer.(StandbyDiscoverer); ok {
+		primary, standby, err = d.FindUpstreams()
+	} else {
+		var conn net.Conn
+		primary, conn, err = ap.discover()
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if sameSocket(standby, ap.proxySocket) {
+		standby = ""
+	}
+	if sameSocket(primary, ap.proxySocket) {
+		return "", "", errorOfKind(ErrNoActiveAgent, "discovery returned the proxy's own socket")
+	}
+	return primary, standby, nil
+}
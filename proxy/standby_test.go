@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// standbyDiscoverer is a StandbyDiscoverer backed by a function.
+type standbyDiscoverer func() (string, string, error)
+
+func (f standbyDiscoverer) FindActiveSocket() (string, error) {
+	primary, _, err := f()
+	return primary, err
+}
+
+func (f standbyDiscoverer) FindUpstreams() (string, string, error) {
+	return f()
+}
+
+// startKeyringAgent serves an agent holding one new key, returning its
+// socket and a function that kills the agent and
+// every connection to it.
+func startKeyringAgent(t *testing.T, comment string) (string, func()) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+
+	var once sync.Once
+	kill := func() {
+		once.Do(func() {
+			_ = listener.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		})
+	}
+	t.Cleanup(kill)
+	return socket, kill
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHotStandbyFailover(t *testing.T) {
+	primary, killPrimary := startKeyringAgent(t, "primary")
+	standby, _ := startKeyringAgent(t, "standby")
+
+	// Rediscovery after the primary dies blocks until the test ends, so
+	// the failover can't be waiting on it
+	var scans sync.Mutex
+	scanned := false
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	discoverer := standbyDiscoverer(func() (string, string, error) {
+		scans.Lock()
+		first := !scanned
+		scanned = true
+		scans.Unlock()
+		if first {
+			return primary, standby, nil
+		}
+		<-release
+		return standby, "", nil
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock", WithLogger(logger), WithDiscoverer(discoverer), WithHotStandby(true))
+	proxySocket := serveProxy(t, ap)
+
+	waitFor(t, "standby to be ready", func() bool { return ap.Status().Standby == standby })
+	comments := func() []string {
+		t.Helper()
+		identities, err := ListIdentities(proxySocket)
+		if err != nil {
+			t.Fatalf("ListIdentities failed: %v", err)
+		}
+		var comments []string
+		for _, id := range identities {
+			comments = append(comments, id.Comment)
+		}
+		return comments
+	}
+	if got := comments(); len(got) != 1 || got[0] != "primary" {
+		t.Fatalf("Expected the primary's key, got %v", got)
+	}
+
+	killPrimary()
+	waitFor(t, "failover", func() bool { return ap.ActiveSocket() == standby })
+	if got := comments(); len(got) != 1 || got[0] != "standby" {
+		t.Errorf("Expected the standby's key after failover, got %v", got)
+	}
+}
+
+func TestDiscoveryFindUpstreams(t *testing.T) {
+	first := createMockAgent(t)
+	time.Sleep(10 * time.Millisecond)
+	second := createMockAgent(t)
+
+	d := &Discovery{Command: "printf '%s\\n%s\\n' " + first + " " + second, Only: []string{first, second}}
+	primary, standby, err := d.FindUpstreams()
+	if err != nil {
+		t.Fatalf("FindUpstreams failed: %v", err)
+	}
+	if primary == standby || (primary != first && primary != second) || (standby != first && standby != second) {
+		t.Errorf("Expected both agents, got primary %q and standby %q", primary, standby)
+	}
+
+	d.Only = []string{first}
+	if _, standby, err := d.FindUpstreams(); err != nil || standby != "" {
+		t.Errorf("Expected no standby with one agent, got %q (%v)", standby, err)
+	}
+}
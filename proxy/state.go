@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SocketValidator is a Discoverer that can check a single socket the way
+// it checks its candidates, so an upstream remembered by WithStateFile
+// gets the same scrutiny as a discovered one. Discovery implements it.
+type SocketValidator interface {
+	ValidateSocket(path string) (bool, string)
+}
+
+// upstreamState is the last upstream that worked, saved across restarts.
+type upstreamState struct {
+	Socket    string    `json:"socket"`
+	Validated time.Time `json:"validated"`
+}
+
+// restoreState returns the upstream saved in the state file if it's still
+// valid, or "" if there is none or it has gone away.
+func (ap *AgentProxy) restoreState() string {
+	data, err := os.ReadFile(ap.stateFile)
+	if err != nil {
+		return ""
+	}
+	var state upstreamState
+	if err := json.Unmarshal(data, &state); err != nil || state.Socket == "" {
+		ap.logger.Debug("Ignoring unreadable upstream state", "file", ap.stateFile, "error", err)
+		return ""
+	}
+	if sameSocket(state.Socket, ap.proxySocket) {
+		return ""
+	}
+
+	var valid bool
+	var reason string
+	if v, ok := ap.discoverer.(SocketValidator); ok {
+		valid, reason = v.ValidateSocket(state.Socket)
+	} else {
+		valid, _, reason = probeAgent(state.Socket, ap.upstreamOwner(), ap.probeTimeout, nil)
+	}
+	if !valid {
+		ap.logger.Debug("Last known upstream is no longer usable",
+			"socket", state.Socket, "validated", state.Validated, "reason", reason)
+		return ""
+	}
+	ap.logger.Info("Restored last known upstream", "socket", state.Socket, "validated", state.Validated)
+	return state.Socket
+}
+
+// saveState records socket as the last upstream that worked, replacing
+// the state file atomically so a crash mid-write can't corrupt it.
+func (ap *AgentProxy) saveState(socket string) error {
+	data, err := json.Marshal(upstreamState{Socket: socket, Validated: time.Now()})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(ap.stateFile)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".upstream-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), ap.stateFile)
+}
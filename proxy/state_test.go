@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	stateFile := filepath.Join(t.TempDir(), "state", "upstream.json")
+	remembered := createMockAgent(t)
+	discovered := createMockAgent(t)
+
+	first := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithStateFile(stateFile),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return remembered, nil
+		})))
+	if got := first.FindActiveSocketCached(); got != remembered {
+		t.Fatalf("Expected %s, got %s", remembered, got)
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("Expected the upstream to be saved: %v", err)
+	}
+	var state upstreamState
+	if err := json.Unmarshal(data, &state); err != nil || state.Socket != remembered || state.Validated.IsZero() {
+		t.Errorf("Unexpected state %s (%v)", data, err)
+	}
+
+	calls := 0
+	restarted := func() *AgentProxy {
+		calls = 0
+		return New("/tmp/test.sock",
+			WithLogger(logger),
+			WithStateFile(stateFile),
+			WithDiscoverer(DiscovererFunc(func() (string, error) {
+				calls++
+				return discovered, nil
+			})))
+	}
+	if got := restarted().FindActiveSocketCached(); got != remembered || calls != 0 {
+		t.Errorf("Expected the remembered upstream without discovery, got %s after %d scans", got, calls)
+	}
+
+	// A remembered upstream that's gone falls back to discovery
+	if err := os.WriteFile(stateFile, []byte(`{"socket":"/nonexistent/agent.sock"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted().FindActiveSocketCached(); got != discovered || calls != 1 {
+		t.Errorf("Expected discovery to replace a dead upstream, got %s after %d scans", got, calls)
+	}
+}
+
+func TestDiscoveryValidateSocket(t *testing.T) {
+	agentSocket := createMockAgent(t)
+
+	d := &Discovery{}
+	if valid, reason := d.ValidateSocket(agentSocket); !valid {
+		t.Errorf("Expected %s to be valid: %s", agentSocket, reason)
+	}
+
+	d.Ignore = []string{filepath.Dir(agentSocket)}
+	if valid, reason := d.ValidateSocket(agentSocket); valid || !strings.HasPrefix(reason, "ignored") {
+		t.Errorf("Expected an ignored socket to be refused, got %v (%s)", valid, reason)
+	}
+
+	if valid, _ := d.ValidateSocket(filepath.Join(t.TempDir(), "missing.sock")); valid {
+		t.Error("Expected a missing socket to be invalid")
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics aggregates traffic across every connection the proxy has
+// finished serving. "In" is client-to-agent traffic (requests) and "Out"
+// is agent-to-client traffic (responses).
+type Metrics struct {
+	Connections int64         `json:"connections"`
+	BytesIn     int64         `json:"bytes_in"`
+	BytesOut    int64         `json:"bytes_out"`
+	MessagesIn  int64         `json:"messages_in"`
+	MessagesOut int64         `json:"messages_out"`
+	Duration    time.Duration `json:"duration_ns"`
+
+	// Rejected counts connections turned away by the connection limit
+	Rejected int64 `json:"rejected"`
+
+	// RateLimited counts sign requests refused by the sign rate limit
+	RateLimited int64 `json:"rate_limited"`
+
+	// UpstreamTimeouts counts requests the upstream agent didn't answer
+	// within the WithUpstreamTimeout deadline
+	UpstreamTimeouts int64 `json:"upstream_timeouts"`
+
+	// AcceptErrors counts failed Accept calls on the proxy's listeners,
+	// e.g. from running out of file descriptors
+	AcceptErrors int64 `json:"accept_errors"`
+
+	// Requests counts requests passed to upstream agents by kind, in
+	// total and broken down by upstream and by client
+	Requests           RequestCounts            `json:"requests,omitempty"`
+	RequestsByUpstream map[string]RequestCounts `json:"requests_by_upstream,omitempty"`
+	RequestsByClient   map[string]RequestCounts `json:"requests_by_client,omitempty"`
+}
+
+// countingWriter passes writes through to w while counting the bytes and
+// SSH agent messages written. Messages are counted by following their
+// uint32 length prefixes, so partial writes are handled.
+type countingWriter struct {
+	w        io.Writer
+	bytes    atomic.Int64
+	messages atomic.Int64
+
+	// Framing state, only touched by the goroutine calling Write
+	header    [4]byte
+	headerLen int
+	remaining uint32
+	needType  bool
+
+	// types counts messages by type. Like the framing state it belongs to
+	// the writing goroutine, and is read once writing has finished.
+	types map[byte]int64
+}
+
+func newCountingWriter(w io.Writer) *countingWriter {
+	return &countingWriter{w: w}
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.bytes.Add(int64(n))
+	cw.observe(p[:n])
+	return n, err
+}
+
+func (cw *countingWriter) observe(p []byte) {
+	for len(p) > 0 {
+		if cw.remaining > 0 {
+			if cw.needType {
+				cw.needType = false
+				if cw.types == nil {
+					cw.types = make(map[byte]int64)
+				}
+				cw.types[p[0]]++
+			}
+			n := min(uint32(len(p)), cw.remaining)
+			cw.remaining -= n
+			p = p[n:]
+			continue
+		}
+		cw.header[cw.headerLen] = p[0]
+		cw.headerLen++
+		p = p[1:]
+		if cw.headerLen == len(cw.header) {
+			cw.headerLen = 0
+			cw.remaining = binary.BigEndian.Uint32(cw.header[:])
+			cw.needType = cw.remaining > 0
+			cw.messages.Add(1)
+		}
+	}
+}
+
+// connStats tracks one client connection from accept to close.
+type connStats struct {
+	start    time.Time
+	client   string // as clientKey reports it
+	pid      int    // the client's PID, or 0 if unknown
+	exe      string // the client's executable, or "" if unknown
+	upstream string
+	in       *countingWriter // client to agent
+	out      *countingWriter // agent to client
+	err      error           // why the connection failed, if it did
+}
+
+// newConnStats starts tracking a connection accepted from clientConn,
+// identifying the client process while it's sure to still be running.
+func newConnStats(clientConn net.Conn) *connStats {
+	stats := &connStats{
+		start:  time.Now(),
+		client: clientKey(clientConn),
+		pid:    peerPID(clientConn),
+		out:    newCountingWriter(clientConn),
+	}
+	if stats.pid > 0 {
+		stats.exe = processExe(stats.pid)
+	}
+	return stats
+}
+
+// finishConn folds a closed connection's counters into the proxy's
+// metrics and logs one record describing the connection, for analyzing
+// agent usage from the logs.
+func (ap *AgentProxy) finishConn(stats *connStats) {
+	duration := time.Since(stats.start)
+	var bytesIn, messagesIn int64
+	if stats.in != nil {
+		bytesIn, messagesIn = stats.in.bytes.Load(), stats.in.messages.Load()
+	}
+	bytesOut, messagesOut := stats.out.bytes.Load(), stats.out.messages.Load()
+
+	ap.serveMu.Lock()
+	ap.metrics.Connections++
+	ap.metrics.BytesIn += bytesIn
+	ap.metrics.BytesOut += bytesOut
+	ap.metrics.MessagesIn += messagesIn
+	ap.metrics.MessagesOut += messagesOut
+	ap.metrics.Duration += duration
+	if stats.in != nil {
+		ap.metrics.countRequests(stats, stats.in.types)
+	}
+	ap.serveMu.Unlock()
+
+	attrs := []any{"client", stats.client}
+	if stats.pid > 0 {
+		attrs = append(attrs, "pid", stats.pid)
+	}
+	if stats.exe != "" {
+		attrs = append(attrs, "exe", stats.exe)
+	}
+	attrs = append(attrs,
+		"upstream", stats.upstream,
+		"duration", duration,
+		"bytes_in", bytesIn,
+		"bytes_out", bytesOut,
+		"requests", messagesIn,
+		"responses", messagesOut)
+	if stats.in != nil && len(stats.in.types) > 0 {
+		attrs = append(attrs, requestTypes(stats.in.types))
+	}
+	if stats.err != nil {
+		attrs = append(attrs, "error", stats.err)
+		ap.recent.connFailed(stats)
+	}
+	ap.logger.Info("Connection closed", attrs...)
+}
+
+// requestTypes renders per-type request counts as a log group, such as
+// request_types.SIGN_REQUEST=2.
+func requestTypes(types map[byte]int64) slog.Attr {
+	names := make([]string, 0, len(types))
+	counts := make(map[string]int64, len(types))
+	for t, n := range types {
+		name := messageTypeName(t)
+		names = append(names, name)
+		counts[name] = n
+	}
+	sort.Strings(names)
+	attrs := make([]any, len(names))
+	for i, name := range names {
+		attrs[i] = slog.Int64(name, counts[name])
+	}
+	return slog.Group("request_types", attrs...)
+}
+
+// Metrics returns traffic totals for all connections closed so far.
+func (ap *AgentProxy) Metrics() Metrics {
+	ap.serveMu.Lock()
+	defer ap.serveMu.Unlock()
+	return ap.metrics.clone()
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestCountingWriterMessages(t *testing.T) {
+	var buf bytes.Buffer
+	cw := newCountingWriter(&buf)
+
+	stream := []byte{
+		0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES,
+		0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	// Split writes across message and header boundaries
+	for _, chunk := range [][]byte{stream[:2], stream[2:7], stream[7:12], stream[12:]} {
+		if _, err := cw.Write(chunk); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if got := cw.bytes.Load(); got != int64(len(stream)) {
+		t.Errorf("Expected %d bytes, got %d", len(stream), got)
+	}
+	if got := cw.messages.Load(); got != 3 {
+		t.Errorf("Expected 3 messages, got %d", got)
+	}
+	if !bytes.Equal(buf.Bytes(), stream) {
+		t.Error("Expected writes to pass through unchanged")
+	}
+}
+
+func TestHandleConnectionMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	agentSocket := createMockAgent(t)
+	defer os.Remove(agentSocket)
+
+	ap := NewAgentProxy("/tmp/test.sock", logger)
+	ap.activeSocket = agentSocket
+	ap.lastCheck = time.Now()
+
+	client, proxyEnd := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		ap.HandleConnection(proxyEnd)
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(client, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not finish in time")
+	}
+
+	metrics := ap.Metrics()
+	if metrics.Connections != 1 {
+		t.Errorf("Expected 1 connection, got %d", metrics.Connections)
+	}
+	if metrics.BytesIn != 5 || metrics.MessagesIn != 1 {
+		t.Errorf("Expected 5 bytes in 1 request, got %d bytes in %d", metrics.BytesIn, metrics.MessagesIn)
+	}
+	if metrics.BytesOut != 9 || metrics.MessagesOut != 1 {
+		t.Errorf("Expected 9 bytes in 1 response, got %d bytes in %d", metrics.BytesOut, metrics.MessagesOut)
+	}
+	if !reflect.DeepEqual(ap.Status().Metrics, metrics) {
+		t.Error("Expected Status to include metrics")
+	}
+}
+
+func TestConnectionLog(t *testing.T) {
+	upstream, kill := startKeyringAgent(t, "logged")
+	defer kill()
+
+	var logs logBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return upstream, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	withAgentClient(t, proxySocket, func(client agent.ExtendedAgent) {
+		keys, err := client.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := client.Sign(keys[0], []byte("challenge")); err != nil {
+				t.Fatalf("Sign failed: %v", err)
+			}
+		}
+	})
+
+	var record struct {
+		Msg          string           `json:"msg"`
+		Client       string           `json:"client"`
+		PID          int              `json:"pid"`
+		Exe          string           `json:"exe"`
+		Upstream     string           `json:"upstream"`
+		Requests     int64            `json:"requests"`
+		RequestTypes map[string]int64 `json:"request_types"`
+		Error        string           `json:"error"`
+	}
+	waitFor(t, "connection record", func() bool {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, `"msg":"Connection closed"`) {
+				return json.Unmarshal([]byte(line), &record) == nil
+			}
+		}
+		return false
+	})
+
+	if record.Upstream != upstream || record.Requests != 3 || record.Error != "" {
+		t.Errorf("Unexpected connection record: %+v", record)
+	}
+	if record.RequestTypes["REQUEST_IDENTITIES"] != 1 || record.RequestTypes["SIGN_REQUEST"] != 2 {
+		t.Errorf("Expected per-type request counts, got %v", record.RequestTypes)
+	}
+	if runtime.GOOS == "linux" {
+		exe, _ := os.Executable()
+		if record.PID != os.Getpid() || record.Exe != exe {
+			t.Errorf("Expected client pid %d and exe %s, got %d and %s", os.Getpid(), exe, record.PID, record.Exe)
+		}
+	}
+}
+
+func TestConnectionLogNoAgent(t *testing.T) {
+	var logs logBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return "", ErrNoActiveAgent
+		})))
+
+	client, proxyEnd := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	ap.HandleConnection(proxyEnd)
+	client.Close()
+
+	if !strings.Contains(logs.String(), `msg="Connection closed"`) ||
+		!strings.Contains(logs.String(), `error="no active SSH agent socket found"`) {
+		t.Errorf("Expected the connection record to carry the error:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTokenLength bounds the authentication line a TCP client may send
+	maxTokenLength = 256
+	// authTimeout is how long a TCP client has to authenticate
+	authTimeout = 5 * time.Second
+)
+
+// tokenListener wraps a listener and only hands out connections whose first
+// line matches the shared token. Authentication runs off the accept loop so
+// a slow or silent client can't stall other connections.
+type tokenListener struct {
+	net.Listener
+	token  []byte
+	logger *slog.Logger
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	acceptErr error
+}
+
+// NewTokenListener wraps l so that clients must send token followed by a
+// newline before speaking the agent protocol. Connections that fail to
+// authenticate are logged and closed.
+func NewTokenListener(l net.Listener, token string, logger *slog.Logger) net.Listener {
+	tl := &tokenListener{
+		Listener: l,
+		token:    []byte(token),
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go tl.acceptLoop()
+	return tl
+}
+
+func (tl *tokenListener) acceptLoop() {
+	for {
+		conn, err := tl.Listener.Accept()
+		if err != nil {
+			_ = tl.closeWith(err)
+			return
+		}
+		go tl.authenticate(conn)
+	}
+}
+
+func (tl *tokenListener) authenticate(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(authTimeout))
+	line, err := readLine(conn, maxTokenLength)
+	if err != nil || subtle.ConstantTimeCompare(line, tl.token) != 1 {
+		tl.logger.Warn("Rejected unauthenticated TCP client", "remote", conn.RemoteAddr().String())
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	tl.logger.Info("Accepted TCP client", "remote", conn.RemoteAddr().String())
+	select {
+	case tl.conns <- conn:
+	case <-tl.done:
+		_ = conn.Close()
+	}
+}
+
+// Accept implements net.Listener
+func (tl *tokenListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-tl.conns:
+		return conn, nil
+	case <-tl.done:
+		if tl.acceptErr != nil {
+			return nil, tl.acceptErr
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (tl *tokenListener) Close() error {
+	return tl.closeWith(nil)
+}
+
+// closeWith shuts the listener down, recording acceptErr (if any) as the
+// error later Accept calls report.
+func (tl *tokenListener) closeWith(acceptErr error) error {
+	var err error
+	tl.closeOnce.Do(func() {
+		tl.acceptErr = acceptErr
+		err = tl.Listener.Close()
+		close(tl.done)
+	})
+	return err
+}
+
+// readLine reads a single newline-terminated line one byte at a time, so no
+// agent protocol bytes that follow it are consumed.
+func readLine(conn net.Conn, limit int) ([]byte, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) <= limit {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("authentication line too long")
+}
+
+// NewMTLSListener wraps l in TLS, requiring clients to present a certificate
+// signed by the CA in clientCAFile.
+func NewMTLSListener(l net.Listener, certFile, keyFile, clientCAFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+	return tls.NewListener(l, config), nil
+}
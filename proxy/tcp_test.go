@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenListener(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := NewTokenListener(raw, "s3cret", logger)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// Wrong token is dropped without reaching Accept
+	bad, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer bad.Close()
+	_, _ = bad.Write([]byte("wrong\n"))
+	_ = bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected connection with wrong token to be closed")
+	}
+
+	// Correct token passes, and the agent bytes that follow are preserved
+	good, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer good.Close()
+	_, _ = good.Write([]byte("s3cret\n\x00\x00\x00\x01\x0b"))
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		msg := make([]byte, 5)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			t.Fatalf("Failed to read agent message: %v", err)
+		}
+		if msg[4] != SSH_AGENTC_REQUEST_IDENTITIES {
+			t.Errorf("Expected agent request after token, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Authenticated connection was not accepted")
+	}
+}
+
+func TestTokenListenerClose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := NewTokenListener(raw, "s3cret", logger)
+	_ = listener.Close()
+
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Span is one timed operation reported to a SpanExporter: a client
+// connection, an agent request within it, or a discovery scan.
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for a trace's root span
+	Name     string
+	Start    time.Time
+	End      time.Time
+
+	Attributes map[string]string
+
+	// Err describes why the operation failed, and is "" if it succeeded
+	Err string
+}
+
+// SpanExporter receives spans as they finish. ExportSpan is called on the
+// request path, so it must not block.
+type SpanExporter interface {
+	ExportSpan(span Span)
+}
+
+// newSpan starts a span, in a new trace unless parent is given.
+func newSpan(name string, parent *Span) Span {
+	span := Span{Name: name, Start: time.Now(), Attributes: make(map[string]string)}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.TraceID[:])
+	}
+	_, _ = rand.Read(span.SpanID[:])
+	return span
+}
+
+var messageTypeNames = map[byte]string{
+	SSH_AGENT_FAILURE:                        "FAILURE",
+	SSH_AGENT_SUCCESS:                        "SUCCESS",
+	SSH_AGENTC_REQUEST_IDENTITIES:            "REQUEST_IDENTITIES",
+	SSH_AGENT_IDENTITIES_ANSWER:              "IDENTITIES_ANSWER",
+	SSH_AGENTC_SIGN_REQUEST:                  "SIGN_REQUEST",
+	SSH_AGENT_SIGN_RESPONSE:                  "SIGN_RESPONSE",
+	SSH_AGENTC_ADD_IDENTITY:                  "ADD_IDENTITY",
+	SSH_AGENTC_ADD_SMARTCARD_KEY:             "ADD_SMARTCARD_KEY",
+	SSH_AGENTC_LOCK:                          "LOCK",
+	SSH_AGENTC_UNLOCK:                        "UNLOCK",
+	SSH_AGENTC_ADD_ID_CONSTRAINED:            "ADD_ID_CONSTRAINED",
+	SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED: "ADD_SMARTCARD_KEY_CONSTRAINED",
+	SSH_AGENTC_EXTENSION:                     "EXTENSION",
+	SSH_AGENT_EXTENSION_FAILURE:              "EXTENSION_FAILURE",
+}
+
+// messageTypeName names an agent message type for spans and logs.
+func messageTypeName(t byte) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", t)
+}
+
+// traceMiddleware reports a span for every request, as a child of the
+// connection's span.
+func (ap *AgentProxy) traceMiddleware(next Handler) Handler {
+	return func(req *Request) ([]byte, error) {
+		span := newSpan("agent "+messageTypeName(req.Type()), req.Session.span)
+		span.Attributes["agent.request"] = messageTypeName(req.Type())
+		span.Attributes["agent.upstream"] = req.Session.Upstream
+		span.Attributes["agent.client"] = req.Session.Client
+
+		response, err := next(req)
+		span.End = time.Now()
+		switch {
+		case err != nil:
+			span.Attributes["agent.outcome"] = "error"
+			span.Err = err.Error()
+		case responseType(response) == SSH_AGENT_FAILURE:
+			span.Attributes["agent.outcome"] = "failure"
+			span.Err = "request refused"
+		default:
+			span.Attributes["agent.outcome"] = "success"
+		}
+		if err == nil {
+			span.Attributes["agent.response"] = messageTypeName(responseType(response))
+		}
+		ap.tracer.ExportSpan(span)
+		return response, err
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (r *spanRecorder) ExportSpan(span Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// find waits briefly for a span called name, since connection spans end
+// after the client has its response.
+func (r *spanRecorder) find(t *testing.T, name string) Span {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		for _, span := range r.spans {
+			if span.Name == name {
+				r.mu.Unlock()
+				return span
+			}
+		}
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No span called %q", name)
+	return Span{}
+}
+
+func TestTracingSpans(t *testing.T) {
+	local := NewLocalAgent()
+	if err := local.LoadKeyFile(writeTestKey(t, ""), nil); err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	UseLocalAgent(local)
+	t.Cleanup(func() { unregisterAdapter(LocalAgentAddress) })
+
+	recorder := &spanRecorder{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := New("/tmp/test.sock",
+		WithLogger(logger),
+		WithTracing(recorder),
+		WithDiscoverer(DiscovererFunc(func() (string, error) {
+			return LocalAgentAddress, nil
+		})))
+	proxySocket := serveProxy(t, ap)
+
+	if _, err := ListIdentities(proxySocket); err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+
+	discovery := recorder.find(t, "agent discovery")
+	if discovery.Attributes["agent.socket"] != LocalAgentAddress {
+		t.Errorf("Expected the discovery span to name the socket, got %v", discovery.Attributes)
+	}
+	request := recorder.find(t, "agent REQUEST_IDENTITIES")
+	connection := recorder.find(t, "agent connection")
+	if request.TraceID != connection.TraceID || request.ParentID != connection.SpanID {
+		t.Error("Expected the request span to be a child of the connection span")
+	}
+	if request.Attributes["agent.outcome"] != "success" || request.Attributes["agent.response"] != "IDENTITIES_ANSWER" {
+		t.Errorf("Unexpected request attributes: %v", request.Attributes)
+	}
+	if request.End.Before(request.Start) {
+		t.Error("Expected the request span to have ended")
+	}
+}
+
+// otlpTestRequest is the part of an OTLP export request the test checks.
+type otlpTestRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID string `json:"traceId"`
+				Name    string `json:"name"`
+				Status  struct {
+					Code int `json:"code"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpTestRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Invalid JSON: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, request)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	exporter := NewOTLPExporter(server.URL+"/v1/traces", logger)
+	span := newSpan("agent SIGN_REQUEST", nil)
+	span.End = span.Start.Add(time.Millisecond)
+	span.Err = "request refused"
+	exporter.ExportSpan(span)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	exporter.ExportSpan(span) // dropped after shutdown
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one export request, got %d", len(requests))
+	}
+	got := requests[0].ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.Name != span.Name || len(got.TraceID) != 32 || got.Status.Code != 2 {
+		t.Errorf("Unexpected span: %+v", got)
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// upstreamAdapters maps special upstream addresses to dialers for agents
+// that aren't reachable as unix sockets, such as Pageant on Windows.
+// Proxies read it from their connection goroutines, so it's only touched
+// through registerAdapter, unregisterAdapter, and adapter.
+var upstreamAdapters = struct {
+	sync.RWMutex
+	dial map[string]func() (net.Conn, error)
+}{dial: map[string]func() (net.Conn, error){}}
+
+// registerAdapter makes dial the way to reach the upstream at address.
+func registerAdapter(address string, dial func() (net.Conn, error)) {
+	upstreamAdapters.Lock()
+	defer upstreamAdapters.Unlock()
+	upstreamAdapters.dial[address] = dial
+}
+
+// unregisterAdapter removes the adapter registered for address.
+func unregisterAdapter(address string) {
+	upstreamAdapters.Lock()
+	defer upstreamAdapters.Unlock()
+	delete(upstreamAdapters.dial, address)
+}
+
+// adapter returns the dialer registered for address, if there is one.
+func adapter(address string) (func() (net.Conn, error), bool) {
+	upstreamAdapters.RLock()
+	defer upstreamAdapters.RUnlock()
+	dial, ok := upstreamAdapters.dial[address]
+	return dial, ok
+}
+
+// dialUpstream connects to the agent at address, which is either a unix
+// socket path or the name of a registered upstream adapter.
+func dialUpstream(address string) (net.Conn, error) {
+	if dial, ok := adapter(address); ok {
+		return dial()
+	}
+	return net.Dial("unix", address)
+}
+
+// dialUpstream connects to the agent at address for a client, refusing
+// agents run by anyone other than the user set with WithUpstreamOwner.
+// Checking the connected peer rather than the socket file means a path
+// swapped after discovery can't lead to another user's agent.
+func (ap *AgentProxy) dialUpstream(address string) (net.Conn, error) {
+	conn, err := dialUpstream(address)
+	if err != nil {
+		return nil, err
+	}
+	return ap.adoptUpstream(address, conn)
+}
+
+// adoptUpstream applies dialUpstream's checks to conn, a connection to
+// address made elsewhere, such as by discovery's probe.
+func (ap *AgentProxy) adoptUpstream(address string, conn net.Conn) (net.Conn, error) {
+	if _, ok := adapter(address); ok || !ap.checkUpstreamUID {
+		return ap.trackUpstream(conn), nil
+	}
+	if uid, ok := peerUID(conn); !ok || uid != ap.upstreamUID {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s is not served by uid %d", address, ap.upstreamUID)
+	}
+	return ap.trackUpstream(conn), nil
+}
+
+// upstreamOwner returns the uid upstream agents must run as: the one set
+// with WithUpstreamOwner, or the proxy's own.
+func (ap *AgentProxy) upstreamOwner() int {
+	if ap.checkUpstreamUID {
+		return ap.upstreamUID
+	}
+	return os.Getuid()
+}
+
+// maxAgentMessage bounds the size of a single agent message the proxy
+// reads. It matches Go's agent package, which Teleport's tsh uses, rather
+// than OpenSSH's 256KiB: identity lists carrying many certificates with
+// long principal and extension lists run past that.
+const maxAgentMessage = 16 << 20
+
+// messageConn adapts a request/response function into a net.Conn that
+// speaks the framed agent protocol, so message-oriented backends can be
+// proxied exactly like a socket. Each framed request (including its length
+// prefix) is passed to query, which returns the framed response.
+func messageConn(query func(request []byte) ([]byte, error)) net.Conn {
+	client, server := net.Pipe()
+
+	go func() {
+		defer func() { _ = server.Close() }()
+
+		header := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(server, header); err != nil {
+				return
+			}
+			length := binary.BigEndian.Uint32(header)
+			if length > maxAgentMessage {
+				return
+			}
+
+			request := make([]byte, 4+length)
+			copy(request, header)
+			if _, err := io.ReadFull(server, request[4:]); err != nil {
+				return
+			}
+
+			response, err := query(request)
+			if err != nil || len(response) < 5 {
+				response = []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}
+			}
+			if _, err := server.Write(response); err != nil {
+				return
+			}
+		}
+	}()
+
+	return client
+}
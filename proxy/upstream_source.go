@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UpstreamSource names somewhere an upstream socket path is published,
+// for tooling that writes the real agent's path to an environment
+// variable or a well-known file rather than leaving it under /tmp. Sources
+// are read again on every discovery scan.
+type UpstreamSource struct {
+	// Env is an environment variable holding the socket path. With File,
+	// it's looked up in File first, then in the proxy's environment.
+	Env string
+
+	// File is read for the path: with Env, as shell-style NAME=value
+	// assignments; alone, as the file's first line that isn't blank or a
+	// # comment.
+	File string
+}
+
+// ParseUpstreamSource parses "env:NAME", "env:NAME@FILE", or "file:PATH".
+func ParseUpstreamSource(s string) (UpstreamSource, error) {
+	kind, rest, ok := strings.Cut(s, ":")
+	if !ok || rest == "" {
+		return UpstreamSource{}, fmt.Errorf("invalid upstream source %q: want env:NAME, env:NAME@FILE, or file:PATH", s)
+	}
+	switch kind {
+	case "env":
+		name, file, _ := strings.Cut(rest, "@")
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return UpstreamSource{}, fmt.Errorf("invalid upstream source %q: bad variable name %q", s, name)
+		}
+		return UpstreamSource{Env: name, File: file}, nil
+	case "file":
+		return UpstreamSource{File: rest}, nil
+	}
+	return UpstreamSource{}, fmt.Errorf("invalid upstream source %q: unknown kind %q", s, kind)
+}
+
+// String returns the source in the form ParseUpstreamSource accepts.
+func (u UpstreamSource) String() string {
+	switch {
+	case u.Env == "":
+		return "file:" + u.File
+	case u.File == "":
+		return "env:" + u.Env
+	}
+	return "env:" + u.Env + "@" + u.File
+}
+
+// Resolve returns the socket path the source currently names.
+func (u UpstreamSource) Resolve() (string, error) {
+	if u.Env == "" {
+		data, err := os.ReadFile(u.File)
+		if err != nil {
+			return "", err
+		}
+		if path := firstLine(data); path != "" {
+			return path, nil
+		}
+		return "", fmt.Errorf("%s names no socket", u.File)
+	}
+
+	if u.File != "" {
+		data, err := os.ReadFile(u.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if value, ok := envFileValue(data, u.Env); ok && value != "" {
+			return value, nil
+		}
+	}
+	if value := os.Getenv(u.Env); value != "" {
+		return value, nil
+	}
+	if u.File != "" {
+		return "", fmt.Errorf("%s is not set in %s or the environment", u.Env, u.File)
+	}
+	return "", fmt.Errorf("%s is not set", u.Env)
+}
+
+// firstLine returns data's first line that isn't blank or a # comment.
+func firstLine(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+// envFileValue finds name's value among shell-style assignments such as
+// "NAME=value", "export NAME='value'", or ssh-agent's
+// "NAME=value; export NAME;". The last assignment wins.
+func envFileValue(data []byte, name string) (string, bool) {
+	var value string
+	var found bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		for _, stmt := range strings.Split(scanner.Text(), ";") {
+			stmt = strings.TrimSpace(stmt)
+			stmt = strings.TrimSpace(strings.TrimPrefix(stmt, "export "))
+			key, v, ok := strings.Cut(stmt, "=")
+			if !ok || key != name {
+				continue
+			}
+			value, found = unquote(strings.TrimSpace(v)), true
+		}
+	}
+	return value, found
+}
+
+// unquote strips one pair of matching single or double quotes.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
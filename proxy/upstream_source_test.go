@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUpstreamSource(t *testing.T) {
+	tests := []struct {
+		in   string
+		want UpstreamSource
+	}{
+		{"env:SSH_AUTH_SOCK_REAL", UpstreamSource{Env: "SSH_AUTH_SOCK_REAL"}},
+		{"env:SSH_AUTH_SOCK_REAL@/run/corp/agent.env", UpstreamSource{Env: "SSH_AUTH_SOCK_REAL", File: "/run/corp/agent.env"}},
+		{"file:/run/corp/agent-path", UpstreamSource{File: "/run/corp/agent-path"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseUpstreamSource(tt.in)
+		if err != nil {
+			t.Errorf("ParseUpstreamSource(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseUpstreamSource(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("String() = %q, want %q", got.String(), tt.in)
+		}
+	}
+
+	for _, bad := range []string{"", "SSH_AUTH_SOCK", "env:", "env:@/tmp/f", "file:", "cmd:foo"} {
+		if _, err := ParseUpstreamSource(bad); err == nil {
+			t.Errorf("Expected ParseUpstreamSource(%q) to fail", bad)
+		}
+	}
+}
+
+func TestUpstreamSourceResolve(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "agent.env")
+	pathFile := filepath.Join(dir, "agent-path")
+	t.Setenv("DA_TEST_SOCK", "/from/environment")
+
+	env := UpstreamSource{Env: "DA_TEST_SOCK"}
+	if got, err := env.Resolve(); err != nil || got != "/from/environment" {
+		t.Errorf("env: got %q, %v", got, err)
+	}
+
+	// The file is preferred, and reread each time
+	fromFile := UpstreamSource{Env: "DA_TEST_SOCK", File: envFile}
+	if got, err := fromFile.Resolve(); err != nil || got != "/from/environment" {
+		t.Errorf("Expected environment fallback without a file, got %q, %v", got, err)
+	}
+	writeFile(t, envFile, "OTHER=x\nexport DA_TEST_SOCK='/from/file'\n")
+	if got, err := fromFile.Resolve(); err != nil || got != "/from/file" {
+		t.Errorf("env file: got %q, %v", got, err)
+	}
+	writeFile(t, envFile, "DA_TEST_SOCK=/from/ssh-agent; export DA_TEST_SOCK;\n")
+	if got, err := fromFile.Resolve(); err != nil || got != "/from/ssh-agent" {
+		t.Errorf("ssh-agent output: got %q, %v", got, err)
+	}
+
+	file := UpstreamSource{File: pathFile}
+	if _, err := file.Resolve(); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+	writeFile(t, pathFile, "# written by corp-agentd\n\n/from/path-file\n")
+	if got, err := file.Resolve(); err != nil || got != "/from/path-file" {
+		t.Errorf("path file: got %q, %v", got, err)
+	}
+
+	if _, err := (UpstreamSource{Env: "DA_TEST_UNSET"}).Resolve(); err == nil {
+		t.Error("Expected error for an unset variable")
+	}
+}
+
+func TestDiscoveryUpstreams(t *testing.T) {
+	agentSocket := createMockAgent(t)
+	t.Setenv("DA_TEST_SOCK", agentSocket)
+
+	d := &Discovery{Upstreams: []UpstreamSource{
+		{Env: "DA_TEST_SOCK"},
+		{Env: "DA_TEST_UNSET"}, // warned about, not fatal
+	}}
+	sockets, err := d.DiscoverSockets()
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	for _, socket := range sockets {
+		if socket.Path == agentSocket {
+			if socket.Class != ClassCustom || !socket.Valid {
+				t.Errorf("Expected a valid %s socket, got class %q: %s", ClassCustom, socket.Class, socket.Reason)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected %s from $DA_TEST_SOCK in results", agentSocket)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageConn(t *testing.T) {
+	var got []byte
+	conn := messageConn(func(request []byte) ([]byte, error) {
+		got = request
+		return []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0}, nil
+	})
+	defer conn.Close()
+
+	// Write the request in two pieces to exercise reassembly
+	go func() {
+		_, _ = conn.Write([]byte{0, 0, 0})
+		_, _ = conn.Write([]byte{1, SSH_AGENTC_REQUEST_IDENTITIES})
+	}()
+
+	response := make([]byte, 9)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response[4] != SSH_AGENT_IDENTITIES_ANSWER {
+		t.Errorf("Expected SSH_AGENT_IDENTITIES_ANSWER, got %d", response[4])
+	}
+	if len(got) != 5 || got[4] != SSH_AGENTC_REQUEST_IDENTITIES {
+		t.Errorf("Expected framed request to reach query, got %v", got)
+	}
+}
+
+func TestMessageConnQueryError(t *testing.T) {
+	conn := messageConn(func(request []byte) ([]byte, error) {
+		return nil, errors.New("backend gone")
+	})
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	}()
+
+	response := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response[4] != SSH_AGENT_FAILURE {
+		t.Errorf("Expected SSH_AGENT_FAILURE, got %d", response[4])
+	}
+}
+
+func TestUpstreamAdapterProxying(t *testing.T) {
+	registerAdapter("test-adapter", func() (net.Conn, error) {
+		return messageConn(func(request []byte) ([]byte, error) {
+			return []byte{0, 0, 0, 5, SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0}, nil
+		}), nil
+	})
+	defer unregisterAdapter("test-adapter")
+
+	if !TestSocket("test-adapter") {
+		t.Error("Expected adapter upstream to pass TestSocket")
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ap := NewAgentProxy("/tmp/test.sock", logger)
+	ap.activeSocket = "test-adapter"
+	ap.lastCheck = time.Now()
+
+	client, proxyEnd := net.Pipe()
+	defer client.Close()
+	go ap.HandleConnection(proxyEnd)
+
+	_, _ = client.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	response := make([]byte, 9)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response[4] != SSH_AGENT_IDENTITIES_ANSWER {
+		t.Errorf("Expected SSH_AGENT_IDENTITIES_ANSWER, got %d", response[4])
+	}
+}
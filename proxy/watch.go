@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Discovery event types reported by Watch
+const (
+	EventAppeared    = "appeared"
+	EventDisappeared = "disappeared"
+	EventChanged     = "changed"
+	EventActive      = "active"
+)
+
+// DiscoveryEvent describes a change between two discovery scans.
+type DiscoveryEvent struct {
+	Type   string
+	Time   time.Time
+	Socket SocketInfo
+
+	// Active is the socket the selection strategy now picks, set on
+	// EventActive; empty means none is usable.
+	Active string
+}
+
+// Watch rescans every interval until ctx is cancelled, calling emit for
+// each socket that appears, disappears, or changes validity, key count, or
+// reason, and whenever the selected socket changes. The first scan reports
+// every socket as appeared.
+func (d *Discovery) Watch(ctx context.Context, interval time.Duration, emit func(DiscoveryEvent)) error {
+	previous := make(map[string]SocketInfo)
+	active := ""
+	first := true
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sockets, err := d.DiscoverSockets()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		current := make(map[string]SocketInfo, len(sockets))
+		for _, socket := range sockets {
+			current[socket.Path] = socket
+			old, seen := previous[socket.Path]
+			switch {
+			case !seen:
+				emit(DiscoveryEvent{Type: EventAppeared, Time: now, Socket: socket})
+			case old.Valid != socket.Valid || old.Keys != socket.Keys || old.Reason != socket.Reason:
+				emit(DiscoveryEvent{Type: EventChanged, Time: now, Socket: socket})
+			}
+		}
+		for path, old := range previous {
+			if _, ok := current[path]; !ok {
+				emit(DiscoveryEvent{Type: EventDisappeared, Time: now, Socket: old})
+			}
+		}
+		previous = current
+
+		selected, _ := d.selectSocket(sockets)
+		if pinned, ok := strings.CutPrefix(d.Strategy, strategyPinnedPrefix); ok {
+			selected = ""
+			if valid, _ := d.testPinned(pinned); valid {
+				selected = pinned
+			}
+		}
+		if first || selected != active {
+			emit(DiscoveryEvent{Type: EventActive, Time: now, Active: selected})
+			active = selected
+		}
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryWatch(t *testing.T) {
+	agentSocket := createMockAgent(t)
+	list := filepath.Join(t.TempDir(), "sockets")
+	if err := os.WriteFile(list, []byte(agentSocket+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write socket list: %v", err)
+	}
+
+	var mu sync.Mutex
+	var events []DiscoveryEvent
+	seen := func(eventType, path string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range events {
+			if e.Type == eventType && (e.Socket.Path == path || (eventType == EventActive && e.Active == path)) {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(eventType, path string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !seen(eventType, path) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s event for %q", eventType, path)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Prefer the command's socket so a real agent on the host can't win
+	d := &Discovery{Command: "cat " + list, Prefer: []string{ClassCustom}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Watch(ctx, 20*time.Millisecond, func(e DiscoveryEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		})
+	}()
+
+	waitFor(EventAppeared, agentSocket)
+	waitFor(EventActive, agentSocket)
+
+	if err := os.WriteFile(list, nil, 0600); err != nil {
+		t.Fatalf("Failed to write socket list: %v", err)
+	}
+	waitFor(EventDisappeared, agentSocket)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Watch returned error: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	remoteMinBackoff = time.Second
+	remoteMaxBackoff = time.Minute
+	// remoteStableAfter is how long a tunnel must stay up before a
+	// disconnect is treated as a fresh failure rather than a flapping one
+	remoteStableAfter = time.Minute
+)
+
+func runRemote(args []string) {
+	fs := flag.NewFlagSet("remote", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		remoteSocket = fs.String("remote-socket", "", "Socket path to create on the remote host (default: ~/.ssh/double-agent.sock there)")
+		sshBinary    = fs.String("ssh", "ssh", "ssh client to run")
+		once         = fs.Bool("once", false, "Don't reconnect when the tunnel drops")
+		verbose      = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s remote [options] <[user@]host> [proxy-socket-path] [-- ssh-options...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Publishes the local proxy socket on a remote host with 'ssh -R', giving\n")
+		fmt.Fprintf(os.Stderr, "the remote side a stable agent socket that is re-established whenever\n")
+		fmt.Fprintf(os.Stderr, "the connection drops. The local proxy is started if it isn't running.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	rest := fs.Args()
+	var sshArgs []string
+	for i, arg := range rest {
+		if arg == "--" {
+			sshArgs = rest[i+1:]
+			rest = rest[:i]
+			break
+		}
+	}
+	if len(rest) < 1 || len(rest) > 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	destination := rest[0]
+	if batchMode {
+		// Nor may ssh ask for a password or to trust a new host key
+		sshArgs = append([]string{"-o", "BatchMode=yes"}, sshArgs...)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if len(rest) == 2 {
+		socketArg = rest[1]
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	if !proxyListening(proxySocket) {
+		var flags []string
+		if *verbose {
+			flags = append(flags, "-v")
+		}
+		flags = append(flags, defaultLogOptions(logger).args()...)
+		pid, err := startDaemon(append(flags, proxySocket))
+		if err != nil {
+			logger.Error("Failed to start local proxy", "error", err)
+			os.Exit(1)
+		}
+		if !waitForListening(proxySocket, 2*time.Second) {
+			logger.Error("Local proxy did not come up", "pid", pid, "socket", proxySocket)
+			os.Exit(1)
+		}
+		logger.Info("Started local proxy", "pid", pid, "socket", proxySocket)
+	}
+
+	tunnel := &remoteTunnel{
+		ssh:          *sshBinary,
+		sshArgs:      sshArgs,
+		destination:  destination,
+		localSocket:  proxySocket,
+		remoteSocket: *remoteSocket,
+		logger:       logger,
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	if err := tunnel.run(*once, sigChan); err != nil {
+		logger.Error("Remote tunnel failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// remoteTunnel keeps an 'ssh -R' forward of the local proxy socket alive.
+type remoteTunnel struct {
+	ssh          string
+	sshArgs      []string
+	destination  string
+	localSocket  string
+	remoteSocket string
+	logger       *slog.Logger
+
+	announced bool
+}
+
+func (t *remoteTunnel) run(once bool, sigChan <-chan os.Signal) error {
+	backoff := remoteMinBackoff
+	for {
+		started := time.Now()
+		err := t.connect(sigChan)
+		if err == errInterrupted {
+			return nil
+		}
+		if once {
+			return err
+		}
+
+		if time.Since(started) > remoteStableAfter {
+			backoff = remoteMinBackoff
+		}
+		t.logger.Warn("Remote tunnel dropped, reconnecting",
+			"destination", t.destination,
+			"error", err,
+			"retry_in", backoff)
+
+		select {
+		case <-sigChan:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, remoteMaxBackoff)
+	}
+}
+
+var errInterrupted = errors.New("interrupted")
+
+// connect prepares the remote socket path and runs one ssh session,
+// returning when it exits or a signal arrives.
+func (t *remoteTunnel) connect(sigChan <-chan os.Signal) error {
+	remoteSocket, err := t.prepareRemote()
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-N",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3",
+		"-R", remoteSocket + ":" + t.localSocket,
+	}
+	args = append(args, t.sshArgs...)
+	args = append(args, t.destination)
+
+	cmd := exec.Command(t.ssh, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %w", t.ssh, err)
+	}
+
+	t.logger.Info("Remote tunnel started",
+		"destination", t.destination,
+		"remote_socket", remoteSocket)
+	if !t.announced {
+		fmt.Fprintf(os.Stderr, "On %s, use: export SSH_AUTH_SOCK=%s\n", t.destination, remoteSocket)
+		t.announced = true
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			return fmt.Errorf("ssh exited")
+		}
+		return err
+	case sig := <-sigChan:
+		t.logger.Info("Received signal, closing tunnel", "signal", sig)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		<-done
+		return errInterrupted
+	}
+}
+
+// prepareRemote resolves the remote socket path and removes any stale
+// socket left by a previous tunnel, since sshd refuses to bind over it
+// unless StreamLocalBindUnlink is enabled server-side.
+func (t *remoteTunnel) prepareRemote() (string, error) {
+	target := t.remoteSocket
+	if target == "" {
+		target = "$HOME/.ssh/double-agent.sock"
+	}
+	script := fmt.Sprintf(`p="%s"; mkdir -p "$(dirname "$p")" && rm -f "$p" && printf '%%s\n' "$p"`,
+		strings.ReplaceAll(target, `"`, `\"`))
+
+	args := append([]string{}, t.sshArgs...)
+	args = append(args, t.destination, script)
+	cmd := exec.Command(t.ssh, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare remote socket path: %w", err)
+	}
+	resolved := strings.TrimSpace(string(out))
+	if resolved == "" {
+		return "", fmt.Errorf("remote host did not report a socket path")
+	}
+	return resolved, nil
+}
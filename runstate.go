@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// runtimeStateInterval is how often a running proxy checks whether its
+// runtime state changed and needs rewriting.
+const runtimeStateInterval = 2 * time.Second
+
+// runtimeState is what a running proxy publishes in its runtime state
+// file, so status --json can report it without the control socket.
+type runtimeState struct {
+	proxy.Status
+	PID       int       `json:"pid"`
+	Listeners []string  `json:"listeners"`
+	Updated   time.Time `json:"updated"`
+}
+
+// runtimeDir holds per-proxy files that don't outlive a reboot, in the
+// runtime dir where there is one.
+func runtimeDir(logger *slog.Logger) string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "double-agent")
+	}
+	return stateDir(logger)
+}
+
+func runtimeStateFile(proxySocket string, logger *slog.Logger) string {
+	return filepath.Join(runtimeDir(logger), "proxy-"+socketKey(proxySocket)+".json")
+}
+
+// publishRuntimeState keeps path up to date with ap's status until ctx is
+// done, then removes it. The file is only rewritten when something other
+// than the timestamp changed.
+func publishRuntimeState(ctx context.Context, ap *proxy.AgentProxy, path string, listeners []string, logger *slog.Logger) {
+	defer func() {
+		// After an upgrade the file is the new proxy's
+		var state runtimeState
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &state) == nil && state.PID != os.Getpid() {
+			return
+		}
+		_ = os.Remove(path)
+	}()
+
+	ticker := time.NewTicker(runtimeStateInterval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		state := runtimeState{Status: ap.Status(), PID: os.Getpid(), Listeners: listeners}
+		current, err := json.Marshal(state)
+		if err == nil && !bytes.Equal(current, last) {
+			state.Updated = time.Now()
+			if err := writeJSONFile(path, state); err != nil {
+				logger.Debug("Failed to write runtime state", "file", path, "error", err)
+			} else {
+				last = current
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readRuntimeState loads the state a proxy published for proxySocket,
+// reporting false if there is none or the process that wrote it is gone.
+func readRuntimeState(proxySocket string, logger *slog.Logger) (runtimeState, bool) {
+	var state runtimeState
+	data, err := os.ReadFile(runtimeStateFile(proxySocket, logger))
+	if err != nil || json.Unmarshal(data, &state) != nil {
+		return state, false
+	}
+	return state, processAlive(state.PID)
+}
+
+// writeJSONFile replaces path with v as JSON atomically, since readers
+// may look at it at any moment.
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// signalAction is what a runtime signal asks the running proxy to do.
+type signalAction int
+
+const (
+	signalStatus       signalAction = iota // log status and statistics
+	signalRediscover                       // drop the cached upstream and rediscover
+	signalDebug                            // log at debug level for signalDebugDuration
+	signalRestoreLevel                     // return to the configured log level
+)
+
+// signalDebugDuration is how long debug logging turned on by signal lasts.
+const signalDebugDuration = 15 * time.Minute
+
+// handleRuntimeSignals acts on the signals in runtimeSignals until ctx is
+// done. They cover what the control socket's status, reload, and
+// set-log-level commands do, for when the control socket is out of reach.
+func handleRuntimeSignals(ctx context.Context, ap *proxy.AgentProxy, logger *slog.Logger) {
+	if len(runtimeSignals) == 0 {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	for sig := range runtimeSignals {
+		signal.Notify(sigChan, sig)
+	}
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigChan:
+			switch runtimeSignals[sig] {
+			case signalStatus:
+				logStatus(ap.Status(), logger)
+			case signalRediscover:
+				logger.Info("Received signal, rediscovering upstream", "signal", sig)
+				ap.InvalidateCache()
+				if socket := ap.FindActiveSocketCached(); socket != "" {
+					logger.Info("Rediscovered upstream", "socket", socket)
+				}
+			case signalDebug:
+				setLogLevel(slog.LevelDebug, signalDebugDuration, logger)
+			case signalRestoreLevel:
+				restoreLogLevel(logger)
+			}
+		}
+	}
+}
+
+// logStatus writes a status snapshot to the log.
+func logStatus(status proxy.Status, logger *slog.Logger) {
+	m := status.Metrics
+	logger.Info("Proxy status",
+		"pid", os.Getpid(),
+		"active_socket", status.ActiveSocket,
+		"pinned", status.Pinned,
+		"standby", status.Standby,
+		"locked", status.Locked,
+		"last_check", status.LastCheck,
+		"uptime", time.Since(status.Started).Round(time.Second),
+		"active_connections", status.ActiveConnections)
+	logger.Info("Proxy statistics",
+		"connections", m.Connections,
+		"bytes_in", m.BytesIn,
+		"bytes_out", m.BytesOut,
+		"messages_in", m.MessagesIn,
+		"messages_out", m.MessagesOut,
+		"duration", m.Duration,
+		"rejected", m.Rejected,
+		"rate_limited", m.RateLimited,
+		"upstream_timeouts", m.UpstreamTimeouts,
+		"accept_errors", m.AcceptErrors,
+		"requests", m.Requests)
+	r := status.Resources
+	logger.Info("Proxy resources",
+		"handlers", r.Handlers,
+		"upstream_conns", r.UpstreamConns,
+		"goroutines", r.Goroutines,
+		"open_files", r.OpenFiles)
+}
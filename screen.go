@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func runScreenSetup(args []string) {
+	fs := flag.NewFlagSet("screen-setup", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		session = fs.String("S", "", "Only update this screen session (default: all of yours)")
+		verbose = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s screen-setup [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Points running GNU screen sessions at the proxy by setting SSH_AUTH_SOCK\n")
+		fmt.Fprintf(os.Stderr, "in each session's environment, so new windows keep working after you\n")
+		fmt.Fprintf(os.Stderr, "reattach from a new SSH connection. Windows already open keep the\n")
+		fmt.Fprintf(os.Stderr, "socket they started with.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	if _, err := exec.LookPath("screen"); err != nil {
+		exitError("screen not found in PATH")
+	}
+
+	sessions := []string{*session}
+	if *session == "" {
+		sessions = screenSessions()
+	}
+	if len(sessions) == 0 {
+		humanf("No screen sessions running; the lines below take effect for new ones.\n")
+	}
+	report := screenReport{Socket: proxySocket, Sessions: []string{}}
+	for _, s := range sessions {
+		if err := screen("-S", s, "-X", "setenv", "SSH_AUTH_SOCK", proxySocket); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to update session %q: %v\n", s, err)
+			continue
+		}
+		report.Sessions = append(report.Sessions, s)
+		humanf("Set SSH_AUTH_SOCK for session %s\n", s)
+	}
+
+	if batchMode {
+		printJSON(report)
+		return
+	}
+	fmt.Println()
+	fmt.Println("To point every new screen session at the proxy, add to ~/.screenrc:")
+	fmt.Printf("  setenv SSH_AUTH_SOCK %s\n", screenQuote(proxySocket))
+	fmt.Println("If your shell profile sets SSH_AUTH_SOCK (e.g., with 'double-agent env'),")
+	fmt.Println("also start windows as login shells so the profile runs in each one:")
+	fmt.Println("  defshell -$SHELL")
+}
+
+// screenReport is what screen-setup prints in batch mode: the sessions it
+// pointed at socket.
+type screenReport struct {
+	Socket   string   `json:"socket"`
+	Sessions []string `json:"sessions"`
+}
+
+// screenSessions lists the current user's screen sessions, as the names
+// screen -S accepts (PID.name).
+func screenSessions() []string {
+	out, err := exec.Command("screen", "-ls").Output()
+	// screen -ls exits non-zero even when it lists sessions
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil
+	}
+	var sessions []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// Sessions are listed as "\tPID.name\t(date)\t(Attached)"
+		if !strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			sessions = append(sessions, fields[0])
+		}
+	}
+	return sessions
+}
+
+// screenQuote quotes s for .screenrc if it has characters screen would
+// otherwise split on or expand.
+func screenQuote(s string) string {
+	switch {
+	case !strings.ContainsAny(s, " \t\"'$\\#"):
+		return s
+	case !strings.Contains(s, "'"):
+		// Nothing is expanded between single quotes
+		return "'" + s + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(s) + `"`
+}
+
+func screen(args ...string) error {
+	out, err := exec.Command("screen", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("screen: %s", msg)
+		}
+		return fmt.Errorf("screen: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+func runSignTest(args []string) {
+	fs := flag.NewFlagSet("sign-test", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		key     = fs.String("key", "", "Key to test, by fingerprint or comment (default: first key)")
+		all     = fs.Bool("all", false, "Test every key the agent holds")
+		verbose = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sign-test [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Signs a random challenge through the proxy and verifies the signature\n")
+		fmt.Fprintf(os.Stderr, "locally, proving the whole path from client to agent (and any hardware\n")
+		fmt.Fprintf(os.Stderr, "token behind it) works. Expect a touch or PIN prompt for such keys.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 || (*all && *key != "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	identities, err := proxy.ListIdentities(proxySocket)
+	if err != nil {
+		exitError("%v", err)
+	}
+	if len(identities) == 0 {
+		exitError("the agent has no identities")
+	}
+
+	targets := identities[:1]
+	switch {
+	case *all:
+		targets = identities
+	case *key != "":
+		targets = nil
+		for _, id := range identities {
+			if id.Fingerprint() == *key || strings.TrimPrefix(id.Fingerprint(), "SHA256:") == *key || id.Comment == *key {
+				targets = append(targets, id)
+			}
+		}
+		if len(targets) == 0 {
+			exitError("no key matches %q; see '%s keys'", *key, os.Args[0])
+		}
+	}
+
+	failed := false
+	var results []signTestResult
+	for _, id := range targets {
+		humanf("Signing with %s %s (%s)... ", id.Fingerprint(), id.Comment, displayKeyType(id.Type()))
+		start := time.Now()
+		result := signTestResult{keyReport: newKeyReport(id)}
+		if err := proxy.SignTest(proxySocket, id); err != nil {
+			humanf("FAILED: %v\n", err)
+			result.Error = err.Error()
+			results = append(results, result)
+			failed = true
+			continue
+		}
+		elapsed := time.Since(start)
+		humanf("OK (%s)\n", elapsed.Round(time.Millisecond))
+		result.OK = true
+		result.LatencyMS = float64(elapsed.Microseconds()) / 1000
+		results = append(results, result)
+	}
+	if batchMode {
+		printJSON(signTestReport{Results: results})
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// signTestReport is what sign-test prints in batch mode.
+type signTestReport struct {
+	Results []signTestResult `json:"results"`
+}
+
+type signTestResult struct {
+	keyReport
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
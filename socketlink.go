@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// socketLinkInterval is how often --socket-link checks that the link still
+// points at this proxy. Another proxy started with the same link takes it
+// over, and takes it back only once this one has exited.
+const socketLinkInterval = 15 * time.Second
+
+// checkSocketLink rejects a --socket-link that can't point at proxySocket.
+func checkSocketLink(link, proxySocket string) error {
+	if proxy.IsAbstractSocket(proxySocket) {
+		return fmt.Errorf("abstract socket %s has no path to link to", proxySocket)
+	}
+	if proxy.IsAbstractSocket(link) {
+		return fmt.Errorf("%s is an abstract socket name, not a path", link)
+	}
+	if filepath.Clean(link) == filepath.Clean(proxySocket) {
+		return fmt.Errorf("%s is the proxy socket itself", link)
+	}
+	return nil
+}
+
+// maintainSocketLink keeps link pointed at proxySocket until ctx is done.
+// The link is left in place at exit: during an upgrade the new proxy has
+// already swapped it to its own socket, and otherwise it dangles only
+// until the next start.
+func maintainSocketLink(ctx context.Context, link, proxySocket string, logger *slog.Logger) {
+	target := linkTarget(proxySocket)
+	ticker := time.NewTicker(socketLinkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if current, err := os.Readlink(link); err == nil && current != target && proxyListening(current) {
+			// A newer proxy owns the link now
+			continue
+		}
+		swapped, err := syncSocketLink(link, proxySocket)
+		if err != nil {
+			logger.Warn("Failed to point socket link at the proxy", "link", link, "error", err)
+			continue
+		}
+		if swapped {
+			logger.Info("Pointed socket link back at the proxy", "link", link)
+		}
+	}
+}
+
+// linkTarget is what the link to proxySocket holds: its absolute path, so
+// the link works from any directory.
+func linkTarget(proxySocket string) string {
+	if abs, err := filepath.Abs(proxySocket); err == nil {
+		return abs
+	}
+	return proxySocket
+}
+
+// syncSocketLink points link at proxySocket unless it already does, reporting
+// whether it changed anything. The new link is made beside the old one
+// and renamed over it, so a client opening link finds either the old
+// socket or the new one, never nothing. Only symlinks, and sockets nothing
+// listens on any more, are replaced.
+func syncSocketLink(link, proxySocket string) (bool, error) {
+	target := linkTarget(proxySocket)
+	if current, err := os.Readlink(link); err == nil && current == target {
+		return false, nil
+	}
+	info, err := os.Lstat(link)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, err
+	case info.Mode()&os.ModeSymlink != 0:
+	case info.Mode()&os.ModeSocket != 0 && !proxyListening(link):
+		// Left by a proxy that served the link's path directly and exited
+	default:
+		return false, fmt.Errorf("%s exists and is not a symlink; remove it to let the proxy manage it", link)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+		return false, fmt.Errorf("failed to create link directory: %w", err)
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", link, os.Getpid())
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
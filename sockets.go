@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// socketSpec is an extra proxy socket from --socket or a profile. When
+// upstreams is set, the socket only serves agents matching those classes
+// or paths, and prefer orders them; keys, hosts, and confirm restrict what
+// its clients may do with them.
+type socketSpec struct {
+	path      string
+	upstreams []string
+	prefer    []string
+	keys      []string
+	hosts     []proxy.HostKeys
+	confirm   bool
+
+	// profile names the profile the socket came from, if any
+	profile string
+}
+
+// ownProxy reports whether the socket needs a proxy of its own rather
+// than sharing the main socket's.
+func (s socketSpec) ownProxy() bool {
+	return len(s.upstreams) > 0 || len(s.prefer) > 0 || len(s.keys) > 0 || len(s.hosts) > 0 || s.confirm
+}
+
+// parseSocketSpec parses PATH[=UPSTREAM[:UPSTREAM...]] followed by any
+// ";key=KEY" and ";confirm" options, expanding tokens in PATH and in
+// upstream paths.
+func parseSocketSpec(spec string, logger *slog.Logger) (socketSpec, error) {
+	options := strings.Split(spec, ";")
+	path, upstreams, bound := strings.Cut(options[0], "=")
+	if path == "" {
+		return socketSpec{}, fmt.Errorf("invalid socket %q: missing path", spec)
+	}
+	expanded, err := expandTokens(path)
+	if err != nil {
+		return socketSpec{}, err
+	}
+	s := socketSpec{path: expanded}
+	if bound {
+		for _, upstream := range strings.Split(upstreams, ":") {
+			if upstream == "" {
+				continue
+			}
+			if upstream, err = expandTokens(upstream); err != nil {
+				return socketSpec{}, err
+			}
+			s.upstreams = append(s.upstreams, upstream)
+		}
+		if len(s.upstreams) == 0 {
+			return socketSpec{}, fmt.Errorf("invalid socket %q: empty upstream set", spec)
+		}
+	}
+	for _, option := range options[1:] {
+		switch key, isKey := strings.CutPrefix(option, "key="); {
+		case isKey && key != "":
+			s.keys = append(s.keys, key)
+		case option == "confirm":
+			s.confirm = true
+		default:
+			return socketSpec{}, fmt.Errorf("invalid socket %q: unknown option %q", spec, option)
+		}
+	}
+	return s, nil
+}
+
+// keyPolicy returns the policy the socket's clients are held to, or nil
+// if they may use every key freely.
+func (s socketSpec) keyPolicy(logger *slog.Logger) *proxy.KeyPolicy {
+	if len(s.keys) == 0 && len(s.hosts) == 0 && !s.confirm {
+		return nil
+	}
+	policy := &proxy.KeyPolicy{Keys: s.keys, Hosts: s.hosts}
+	if len(s.hosts) > 0 {
+		policy.KnownHosts = knownHostsFiles(logger)
+	}
+	if s.confirm {
+		policy.Confirm = askpassConfirm(s.path, logger)
+	}
+	return policy
+}
+
+// askpassConfirm asks through $SSH_ASKPASS before each signature, the way
+// ssh-agent confirms keys added with ssh-add -c. Without SSH_ASKPASS it
+// falls back to the system prompt on macOS (Touch ID where available), and
+// elsewhere nothing can be confirmed, so every signature is refused, as it
+// is in batch mode.
+func askpassConfirm(socket string, logger *slog.Logger) func(proxy.Identity, string) bool {
+	return func(key proxy.Identity, client string) bool {
+		if batchMode {
+			logger.Warn("Refusing signature that needs confirmation in batch mode", "socket", socket, "key", key.Fingerprint())
+			return false
+		}
+		prompt := fmt.Sprintf("Allow use of key %s?\nKey fingerprint %s.", key.Comment, key.Fingerprint())
+		if client != "" {
+			prompt += fmt.Sprintf("\nRequested by %s through %s.", client, socket)
+		}
+		askpass := os.Getenv("SSH_ASKPASS")
+		if askpass == "" {
+			reason := fmt.Sprintf("sign with SSH key %s", key.Comment)
+			if client != "" {
+				reason += " for " + client
+			}
+			if allowed, ok := nativeConfirm(reason, prompt); ok {
+				return allowed
+			}
+			logger.Warn("Can't confirm signature: SSH_ASKPASS is not set", "socket", socket)
+			return false
+		}
+		cmd := exec.Command(askpass, prompt)
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+		return cmd.Run() == nil
+	}
+}
+
+// expandTokens expands a leading ~ or ~user, the ssh_config tokens %d
+// (home), %u (user), %i (uid), %l (hostname), and %%, the systemd-style
+// %h (home) and %t (runtime dir), and ${VAR} and $VAR references to the
+// environment. Tools that hardcode their agent socket often put it under
+// the home or runtime dir, so one flag can follow them across machines.
+// An unset variable is an error rather than an empty string, which would
+// quietly move a path to the root.
+func expandTokens(path string) (string, error) {
+	prefix, rest, err := expandTilde(path)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(rest); i++ {
+		if rest[i] != '%' {
+			b.WriteByte(rest[i])
+			continue
+		}
+		if i+1 == len(rest) {
+			return "", fmt.Errorf("invalid path %q: trailing %%", path)
+		}
+		i++
+		switch rest[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'd', 'h':
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(home)
+		case 'u', 'i':
+			current, err := user.Current()
+			if err != nil {
+				return "", err
+			}
+			if rest[i] == 'u' {
+				b.WriteString(current.Username)
+			} else {
+				b.WriteString(current.Uid)
+			}
+		case 'l':
+			host, err := os.Hostname()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(host)
+		case 't':
+			dir := os.Getenv("XDG_RUNTIME_DIR")
+			if dir == "" {
+				return "", fmt.Errorf("invalid path %q: %%t needs XDG_RUNTIME_DIR, which is not set", path)
+			}
+			b.WriteString(dir)
+		default:
+			return "", fmt.Errorf("invalid path %q: unknown token %%%c", path, rest[i])
+		}
+	}
+
+	var unset []string
+	expanded := os.Expand(b.String(), func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("invalid path %q: $%s is not set", path, strings.Join(unset, ", $"))
+	}
+	if prefix == "" {
+		return expanded, nil
+	}
+	return filepath.Join(prefix, expanded), nil
+}
+
+// expandTilde splits a leading ~ or ~user off path, returning the home
+// directory it names and what follows. Paths without one come back whole.
+func expandTilde(path string) (home, rest string, err error) {
+	if !strings.HasPrefix(path, "~") {
+		return "", path, nil
+	}
+	name, rest, _ := strings.Cut(path[1:], "/")
+	if strings.ContainsRune(name, filepath.Separator) {
+		name, rest, _ = strings.Cut(path[1:], string(filepath.Separator))
+	}
+	if name == "" {
+		home, err = os.UserHomeDir()
+		return home, rest, err
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	return u.HomeDir, rest, nil
+}
+
+// lookupOwner resolves a USER[:GROUP] spec, by name or number, to the IDs
+// to chown the socket to. An empty spec or part means -1, no change.
+func lookupOwner(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if spec == "" {
+		return uid, gid, nil
+	}
+	userName, groupName, _ := strings.Cut(spec, ":")
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return -1, -1, fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, fmt.Errorf("user %q has no numeric UID", userName)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return -1, -1, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return -1, -1, fmt.Errorf("group %q has no numeric GID", groupName)
+		}
+	}
+	return uid, gid, nil
+}
+
+// listenProxySocket replaces any stale socket at path and listens there,
+// applying the ownership and modes from opts, then checks that the socket
+// ended up no more accessible than intended.
+func listenProxySocket(path string, opts runOptions, logger *slog.Logger) (net.Listener, error) {
+	if proxy.IsAbstractSocket(path) {
+		return listenAbstract(path, opts, logger)
+	}
+	if listener := inheritedListener("unix:" + path); listener != nil {
+		// Handed over by the proxy this one replaced, permissions and all
+		return listener, nil
+	}
+
+	// Remove existing socket if it exists
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Debug("Warning: failed to remove existing socket", "error", err)
+	}
+
+	dir := filepath.Dir(path)
+	dirMode := opts.socketDirMode
+	if dirMode == 0 {
+		dirMode = 0700
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if opts.socketDirMode != 0 {
+		if err := setDirMode(dir, opts.socketDirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	mode := opts.socketMode
+	if mode == 0 {
+		mode = 0600
+	}
+	// Create the socket with its final mode, so it's never briefly open
+	// to others, and so nothing ever chmods the path: chmod follows
+	// symlinks, and in a directory another user can write to, the socket
+	// could be swapped for a link to any file by then
+	var listener net.Listener
+	err := withUmask(int(0777&^mode.Perm()), func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.socketUID != -1 || opts.socketGID != -1 {
+		if err := os.Lchown(path, opts.socketUID, opts.socketGID); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to set socket ownership: %w", err)
+		}
+	}
+	if err := verifySocket(path, mode, opts, logger); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	keepTransferable("unix:"+path, listener)
+	return listener, nil
+}
+
+// setDirMode applies --socket-dir-mode to the socket's directory. Shared
+// directories like /tmp are left alone, since changing them would break
+// other users.
+func setDirMode(dir string, mode os.FileMode) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSticky != 0 {
+		return fmt.Errorf("refusing to change permissions of shared directory %s; put the socket in a directory of its own", dir)
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("failed to set socket directory permissions: %w", err)
+	}
+	return nil
+}
+
+// verifySocket checks the socket's final mode and owner, since a
+// filesystem that ignores chmod or a racing process could leave keys open
+// to other users. Group or world access is only accepted when asked for
+// with an explicit mode.
+func verifySocket(path string, mode os.FileMode, opts runOptions, logger *slog.Logger) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to check socket: %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket after listening on it", path)
+	}
+	if perm := info.Mode().Perm(); perm != mode.Perm() {
+		return fmt.Errorf("socket %s has mode %04o, expected %04o", path, perm, mode.Perm())
+	}
+	if mode.Perm()&0077 != 0 {
+		logger.Warn("Proxy socket is accessible to other users", "socket", path, "mode", fmt.Sprintf("%04o", mode.Perm()))
+	}
+	if uid, ok := fileUID(info); ok {
+		want := os.Getuid()
+		if opts.socketUID != -1 {
+			want = opts.socketUID
+		}
+		if uid != want {
+			return fmt.Errorf("socket %s is owned by uid %d, expected %d", path, uid, want)
+		}
+	}
+
+	// Anyone who can write to the directory can replace the socket
+	if dirInfo, err := os.Stat(filepath.Dir(path)); err == nil {
+		dirMode := dirInfo.Mode()
+		if dirMode.Perm()&0022 != 0 && dirMode&os.ModeSticky == 0 {
+			logger.Warn("Socket directory is writable by other users, who could replace the socket",
+				"dir", filepath.Dir(path), "mode", fmt.Sprintf("%04o", dirMode.Perm()))
+		}
+	}
+	return nil
+}
+
+// listenAbstract listens on an abstract socket. There's no file to carry
+// permissions, so the users opts would let open a socket file are checked
+// on each connection instead.
+func listenAbstract(path string, opts runOptions, logger *slog.Logger) (net.Listener, error) {
+	listener := inheritedListener("unix:" + path)
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("unix", path); err != nil {
+			return nil, err
+		}
+		keepTransferable("unix:"+path, listener)
+	}
+	if opts.socketMode&0006 != 0 {
+		logger.Warn("Abstract socket accepts any local user", "socket", path)
+		return listener, nil
+	}
+	uids := []int{os.Getuid()}
+	if opts.socketUID != -1 {
+		uids = append(uids, opts.socketUID)
+	}
+	return proxy.NewPeerUIDListener(listener, logger, uids...), nil
+}
+
+// removeSocket deletes the socket file at path; abstract sockets vanish
+// on their own when closed.
+func removeSocket(path string) {
+	if !proxy.IsAbstractSocket(path) {
+		_ = os.Remove(path)
+	}
+}
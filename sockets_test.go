@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// plantSymlink puts a symlink at path to a file of mode 0644, standing in
+// for a file a user might want root to chmod, and returns the file.
+func plantSymlink(t *testing.T, path string) string {
+	t.Helper()
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(target, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// checkUntouched fails if target no longer has mode 0644.
+func checkUntouched(t *testing.T, target string) {
+	t.Helper()
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0644 {
+		t.Errorf("Expected the symlink's target to keep mode 0644, got %04o", perm)
+	}
+}
+
+func TestListenProxySocketIgnoresSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket modes don't apply on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "agent")
+	target := plantSymlink(t, path)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts := runOptions{socketMode: 0660, socketUID: os.Getuid(), socketGID: -1}
+	listener, err := listenProxySocket(path, opts, logger)
+	if err != nil {
+		t.Fatalf("listenProxySocket failed: %v", err)
+	}
+	defer listener.Close()
+
+	checkUntouched(t, target)
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("Expected a socket of mode 0660 in the symlink's place, got %v", info.Mode())
+	}
+}
+
+func TestPrepareUserDirTakesBackDirectory(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("system mode runs as root")
+	}
+	const nobody = 65534
+	dir := filepath.Join(t.TempDir(), "1000")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	target := plantSymlink(t, filepath.Join(dir, "agent"))
+	if err := os.Chown(dir, nobody, nobody); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := prepareUserDir(dir); err != nil {
+		t.Fatalf("prepareUserDir failed: %v", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, _ := fileUID(info); uid != 0 || info.Mode().Perm() != 0711 {
+		t.Errorf("Expected the directory to be root's with mode 0711, got UID %d and %04o", uid, info.Mode().Perm())
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	socket := filepath.Join(dir, "agent")
+	listener, err := listenProxySocket(socket, runOptions{socketUID: nobody, socketGID: nobody}, logger)
+	if err != nil {
+		t.Fatalf("listenProxySocket failed: %v", err)
+	}
+	defer listener.Close()
+
+	checkUntouched(t, target)
+	if info, err = os.Lstat(socket); err != nil {
+		t.Fatal(err)
+	}
+	if uid, _ := fileUID(info); uid != nobody || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to be the user's with mode 0600, got UID %d and %04o", uid, info.Mode().Perm())
+	}
+}
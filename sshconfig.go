@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigFileName is the file ssh-config --install writes under
+// ~/.ssh/config.d.
+const sshConfigFileName = "double-agent.conf"
+
+func runSSHConfig(args []string) {
+	fs := flag.NewFlagSet("ssh-config", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		hosts   listFlag
+		install = fs.Bool("install", false, "Write the snippet to ~/.ssh/config.d/"+sshConfigFileName+" instead of printing it")
+	)
+	fs.Var(&hosts, "host", "Host pattern the directive applies to (repeatable; default: *)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ssh-config [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints an ssh_config snippet whose IdentityAgent points ssh at the\n")
+		fmt.Fprintf(os.Stderr, "proxy, for setups that leave SSH_AUTH_SOCK alone. The socket path\n")
+		fmt.Fprintf(os.Stderr, "defaults to %s.\n\n", defaultSocketArg())
+		fmt.Fprintf(os.Stderr, "  %s ssh-config --host '*.corp' --host 'git*' --install\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(hosts) == 0 {
+		hosts = listFlag{"*"}
+	}
+	for _, host := range hosts {
+		if strings.ContainsAny(host, " \t\"") {
+			exitError("host pattern %q may not contain spaces or quotes", host)
+		}
+	}
+
+	logger := newLogger(os.Stderr, false)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	snippet := identityAgentSnippet(expandPath(socketArg, logger), hosts)
+
+	if !*install {
+		if batchMode {
+			printJSON(sshConfigReport{Snippet: snippet})
+			return
+		}
+		fmt.Print(snippet)
+		return
+	}
+
+	sshDir := expandPath("~/.ssh", logger)
+	configDir := filepath.Join(sshDir, "config.d")
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		exitError("failed to create %s: %v", configDir, err)
+	}
+	path := filepath.Join(configDir, sshConfigFileName)
+	if err := os.WriteFile(path, []byte(snippet), 0600); err != nil {
+		exitError("failed to write %s: %v", path, err)
+	}
+	// ssh reads nothing from config.d unless the main config includes it
+	mainConfig := filepath.Join(sshDir, "config")
+	included := includesConfigDir(mainConfig)
+	if batchMode {
+		printJSON(sshConfigReport{Snippet: snippet, Path: path, IncludeNeeded: !included})
+		return
+	}
+	fmt.Printf("Wrote %s\n", path)
+	if !included {
+		fmt.Println()
+		fmt.Printf("Add this near the top of %s, before any Host or Match block:\n", mainConfig)
+		fmt.Println("  Include config.d/*")
+	}
+}
+
+// sshConfigReport is what ssh-config prints in batch mode. IncludeNeeded
+// says the main ssh_config must include config.d for the written snippet
+// to take effect.
+type sshConfigReport struct {
+	Snippet       string `json:"snippet"`
+	Path          string `json:"path,omitempty"`
+	IncludeNeeded bool   `json:"include_needed,omitempty"`
+}
+
+// identityAgentSnippet renders a Host block that sends hosts matching any of
+// the patterns to the agent at proxySocket.
+func identityAgentSnippet(proxySocket string, hosts []string) string {
+	// IdentityAgent expands % tokens, so a literal % is written %%
+	path := strings.ReplaceAll(proxySocket, "%", "%%")
+
+	var b strings.Builder
+	b.WriteString("# Written by double-agent ssh-config\n")
+	b.WriteString("Host " + strings.Join(hosts, " ") + "\n")
+	fmt.Fprintf(&b, "    IdentityAgent %q\n", path)
+	return b.String()
+}
+
+// includesConfigDir reports whether the ssh config at path has an Include
+// directive naming config.d. A missing file includes nothing.
+func includesConfigDir(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "Include") {
+			continue
+		}
+		for _, pattern := range fields[1:] {
+			if strings.Contains(pattern, "config.d/") {
+				return true
+			}
+		}
+	}
+	return false
+}
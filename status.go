@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// statusCacheTTL is how long a status check is reused. Prompts and status
+// bars run the command on every render, so most calls should only read the
+// cache file.
+const statusCacheTTL = 5 * time.Second
+
+// proxyStatus is one health check of the proxy, cached on disk between runs.
+type proxyStatus struct {
+	Checked   time.Time `json:"checked"`
+	Listening bool      `json:"listening"`
+	Upstream  bool      `json:"upstream"`
+	Keys      int       `json:"keys"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// short renders the status as a single token for tmux and prompt themes.
+func (s proxyStatus) short() string {
+	switch {
+	case !s.Listening:
+		return "down"
+	case !s.Upstream:
+		return "degraded"
+	}
+	return fmt.Sprintf("ok:%dkeys", s.Keys)
+}
+
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		short   = fs.Bool("short", false, "Print a single status token (ok:<n>keys, degraded, or down)")
+		noCache = fs.Bool("no-cache", false, "Always check the proxy instead of reusing a recent result")
+		jsonOut = fs.Bool("json", false, "Print the state the running proxy publishes, as JSON, without contacting it")
+		verbose = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s status [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reports whether the proxy is up and how many keys it serves. Results are\n")
+		fmt.Fprintf(os.Stderr, "cached for %s so --short is cheap enough for tmux status bars and\n", statusCacheTTL)
+		fmt.Fprintf(os.Stderr, "shell prompts. --json reads the state file the running proxy keeps up to\n")
+		fmt.Fprintf(os.Stderr, "date, which is cheaper still and includes its PID and traffic counters.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	if *jsonOut {
+		printStatusJSON(proxySocket, logger)
+		return
+	}
+
+	status := checkStatus(proxySocket, !*noCache, logger)
+	if batchMode {
+		printJSON(status)
+		return
+	}
+	if *short {
+		fmt.Println(status.short())
+		return
+	}
+
+	fmt.Printf("Proxy:    %s (%s)\n", proxySocket, status.short())
+	if !status.Listening {
+		return
+	}
+	// The control socket is optional, so the upstream path is best-effort
+	if result, err := proxy.ControlRequest(defaultControlSocket(proxySocket), "status"); err == nil {
+		var st proxy.Status
+		if json.Unmarshal(result, &st) == nil && st.ActiveSocket != "" {
+			fmt.Printf("Upstream: %s\n", st.ActiveSocket)
+		}
+	} else {
+		logger.Debug("Control socket unavailable", "error", err)
+	}
+	if status.Error != "" {
+		fmt.Printf("Error:    %s\n", status.Error)
+		return
+	}
+	fmt.Printf("Keys:     %d\n", status.Keys)
+}
+
+// statusJSON is the status --json output: the proxy's published state,
+// or only running=false if no live proxy published any.
+type statusJSON struct {
+	Running bool `json:"running"`
+	*runtimeState
+}
+
+func printStatusJSON(proxySocket string, logger *slog.Logger) {
+	out := statusJSON{}
+	if state, running := readRuntimeState(proxySocket, logger); running {
+		out = statusJSON{Running: true, runtimeState: &state}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		exitError("%v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// checkStatus probes the proxy, or returns a cached result younger than
+// statusCacheTTL when useCache is set.
+func checkStatus(proxySocket string, useCache bool, logger *slog.Logger) proxyStatus {
+	cacheFile := statusCacheFile(proxySocket, logger)
+	if useCache {
+		if status, ok := readStatusCache(cacheFile); ok {
+			return status
+		}
+	}
+
+	status := proxyStatus{Checked: time.Now(), Listening: proxyListening(proxySocket)}
+	if status.Listening {
+		identities, err := proxy.ListIdentities(proxySocket)
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			status.Upstream = true
+			status.Keys = len(identities)
+		}
+	}
+
+	if err := writeStatusCache(cacheFile, status); err != nil {
+		logger.Debug("Failed to cache status", "file", cacheFile, "error", err)
+	}
+	return status
+}
+
+// statusCacheFile names the cache for proxySocket, preferring the runtime
+// dir so the cache lives in memory and is gone after a reboot.
+func statusCacheFile(proxySocket string, logger *slog.Logger) string {
+	return filepath.Join(runtimeDir(logger), "status-"+socketKey(proxySocket)+".json")
+}
+
+// socketKey is a short name for proxySocket, for files kept per proxy.
+func socketKey(proxySocket string) string {
+	sum := sha256.Sum256([]byte(proxySocket))
+	return hex.EncodeToString(sum[:8])
+}
+
+func readStatusCache(path string) (proxyStatus, bool) {
+	var status proxyStatus
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &status) != nil {
+		return status, false
+	}
+	age := time.Since(status.Checked)
+	return status, age >= 0 && age < statusCacheTTL
+}
+
+// writeStatusCache replaces the cache atomically, since several prompts
+// may check the status at once.
+func writeStatusCache(path string, status proxyStatus) error {
+	return writeJSONFile(path, status)
+}
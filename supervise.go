@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	superviseMinBackoff = time.Second
+	superviseMaxBackoff = time.Minute
+	// superviseStableAfter is how long the proxy must run before a crash
+	// resets the restart backoff
+	superviseStableAfter = time.Minute
+)
+
+// supervise runs the proxy as a child process and restarts it with backoff
+// whenever it exits abnormally, for systems without a service manager.
+// The child's output is passed through to logOutput so only the supervisor
+// writes (and rotates) the log file.
+func supervise(proxySocket string, logOutput io.Writer, logger *slog.Logger) {
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("Failed to find executable", "error", err)
+		os.Exit(1)
+	}
+
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "supervise" || f.Name == "d" || f.Name == "daemon" || strings.HasPrefix(f.Name, "log-") {
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	args = append(args, proxySocket)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	logger.Info("Supervising proxy", "socket", proxySocket, "pid", os.Getpid())
+	backoff := superviseMinBackoff
+	for {
+		cmd := exec.Command(executable, args...)
+		cmd.Stdout = logOutput
+		cmd.Stderr = logOutput
+		cmd.Env = append(os.Environ(), supervisedEnv+"=1")
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			logger.Error("Failed to start proxy", "error", err)
+			os.Exit(1)
+		}
+		logger.Debug("Started proxy process", "pid", cmd.Process.Pid)
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		select {
+		case sig := <-sigChan:
+			logger.Info("Received signal, stopping proxy", "signal", sig)
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-done:
+			case <-time.After(shutdownTimeout + time.Second):
+				_ = cmd.Process.Kill()
+				<-done
+			}
+			return
+		case err := <-done:
+			if err == nil {
+				logger.Info("Proxy exited cleanly, stopping supervisor")
+				return
+			}
+			if time.Since(started) > superviseStableAfter {
+				backoff = superviseMinBackoff
+			}
+			logger.Warn("Proxy exited, restarting",
+				"error", err,
+				"uptime", time.Since(started).Round(time.Second),
+				"retry_in", backoff)
+		}
+
+		select {
+		case sig := <-sigChan:
+			logger.Info("Received signal, stopping supervisor", "signal", sig)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, superviseMaxBackoff)
+	}
+}
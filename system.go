@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+const (
+	defaultSystemDir      = "/run/double-agent"
+	defaultSystemInterval = 5 * time.Second
+)
+
+// userProxy is the proxy system mode serves for one logged-in user.
+type userProxy struct {
+	user   *user.User
+	dir    string
+	socket string
+	proxy  *proxy.AgentProxy
+	cancel context.CancelFunc
+}
+
+func runSystem(args []string) {
+	fs := flag.NewFlagSet("system", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		dir      = fs.String("dir", defaultSystemDir, "Directory holding a <uid>/agent socket for each user")
+		interval = fs.Duration("interval", defaultSystemInterval, "How often to check which users are logged in")
+		verbose  = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s system [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Runs as root and serves a proxy socket at <dir>/<uid>/agent for every\n")
+		fmt.Fprintf(os.Stderr, "logged-in user, each using only agents that user owns. Users point\n")
+		fmt.Fprintf(os.Stderr, "SSH_AUTH_SOCK at %s/$(id -u)/agent.\n\n", defaultSystemDir)
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	logger := newLogger(os.Stderr, *verbose)
+	if os.Geteuid() != 0 {
+		logger.Error("System mode must run as root to serve other users")
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		logger.Error("Failed to create system directory", "dir", *dir, "error", err)
+		os.Exit(1)
+	}
+	// Users must not be able to plant their own directories here
+	if err := os.Chmod(*dir, 0755); err != nil {
+		logger.Error("Failed to set system directory permissions", "dir", *dir, "error", err)
+		os.Exit(1)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	logger.Info("Double Agent system mode started", "dir", *dir)
+	proxies := make(map[string]*userProxy)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		syncUserProxies(proxies, *dir, logger)
+		select {
+		case sig := <-sigChan:
+			logger.Info("Received signal, shutting down", "signal", sig)
+			for uid, up := range proxies {
+				up.stop(logger)
+				delete(proxies, uid)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncUserProxies starts proxies for users who have logged in and stops
+// those of users who have left.
+func syncUserProxies(proxies map[string]*userProxy, dir string, logger *slog.Logger) {
+	active := loggedInUsers()
+	for uid, up := range proxies {
+		if !active[uid] {
+			logger.Info("User logged out, stopping proxy", "uid", uid, "user", up.user.Username)
+			up.stop(logger)
+			delete(proxies, uid)
+		}
+	}
+	for uid := range active {
+		if _, ok := proxies[uid]; ok {
+			continue
+		}
+		up, err := startUserProxy(uid, dir, logger)
+		if err != nil {
+			logger.Warn("Failed to start proxy for user", "uid", uid, "error", err)
+			continue
+		}
+		logger.Info("Serving proxy for user", "uid", uid, "user", up.user.Username, "socket", up.socket)
+		proxies[uid] = up
+	}
+}
+
+// loggedInUsers returns the UIDs with a login session, found from logind's
+// per-user runtime dirs and the /tmp/ssh-* dirs sshd creates for forwarded
+// agents. Root is left out, since its agents aren't meant to be shared
+// through a system service.
+func loggedInUsers() map[string]bool {
+	users := make(map[string]bool)
+	if entries, err := os.ReadDir("/run/user"); err == nil {
+		for _, entry := range entries {
+			if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+				users[entry.Name()] = true
+			}
+		}
+	}
+	dirs, _ := filepath.Glob("/tmp/ssh-*")
+	for _, dir := range dirs {
+		if info, err := os.Lstat(dir); err == nil && info.IsDir() {
+			if uid, ok := fileUID(info); ok {
+				users[strconv.Itoa(uid)] = true
+			}
+		}
+	}
+	delete(users, "0")
+	return users
+}
+
+// startUserProxy serves a proxy at dir/<uid>/agent that only the user can
+// reach, discovering only agents the user owns.
+func startUserProxy(uid, dir string, logger *slog.Logger) (*userProxy, error) {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return nil, err
+	}
+	numericUID, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	userDir := filepath.Join(dir, uid)
+	if err := prepareUserDir(userDir); err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(userDir, "agent")
+	userLogger := logger.With("uid", uid)
+	listener, err := listenProxySocket(socket, runOptions{socketUID: numericUID, socketGID: gid}, userLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &proxy.Discovery{User: u, Exclude: []string{socket}, Logger: userLogger}
+	ap := proxy.New(socket,
+		proxy.WithLogger(userLogger),
+		proxy.WithDiscoverer(discovery),
+		proxy.WithUpstreamOwner(numericUID))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := ap.Serve(ctx, listener); err != nil {
+			userLogger.Error("Proxy error", "error", err)
+		}
+	}()
+	return &userProxy{user: u, dir: userDir, socket: socket, proxy: ap, cancel: cancel}, nil
+}
+
+// prepareUserDir creates the user's socket directory. It stays owned by
+// root, and only searchable by others, so the user can reach their socket
+// but can't swap it for a symlink while root is still setting it up; the
+// socket itself is theirs and closed to everyone else. An existing path
+// that isn't a plain directory is replaced rather than followed, and one
+// left owned by the user by an older version is taken back.
+func prepareUserDir(dir string) error {
+	if info, err := os.Lstat(dir); err == nil && !info.IsDir() {
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return err
+	}
+	if err := os.Lchown(dir, os.Getuid(), os.Getgid()); err != nil {
+		return err
+	}
+	// The parent is root's, so dir can't have been swapped since the
+	// Lstat, and chmod can't be led elsewhere
+	return os.Chmod(dir, 0711)
+}
+
+// stop shuts down the user's proxy and removes their socket directory.
+func (up *userProxy) stop(logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := up.proxy.Shutdown(ctx); err != nil {
+		logger.Warn("Closed connections still in flight at shutdown", "uid", up.user.Uid, "error", err)
+	}
+	up.cancel()
+	_ = os.Remove(up.socket)
+	_ = os.Remove(up.dir)
+}
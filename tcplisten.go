@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// tcpTokenEnv names the environment variable that may carry the TCP
+// listener's shared token, for setups where writing a file is awkward.
+const tcpTokenEnv = "DOUBLE_AGENT_TCP_TOKEN"
+
+// tcpOptions configures the optional TCP listener that exposes the proxy
+// to VMs and containers which can't share a unix socket.
+type tcpOptions struct {
+	addr      string
+	tokenFile string
+	tlsCert   string
+	tlsKey    string
+	tlsCA     string
+}
+
+func (o tcpOptions) enabled() bool {
+	return o.addr != ""
+}
+
+func (o tcpOptions) mtls() bool {
+	return o.tlsCert != "" || o.tlsKey != "" || o.tlsCA != ""
+}
+
+// listenTCP opens the TCP listener, refusing to do so without some form of
+// client authentication.
+func listenTCP(opts tcpOptions, logger *slog.Logger) (net.Listener, error) {
+	token := os.Getenv(tcpTokenEnv)
+	if opts.tokenFile != "" {
+		data, err := os.ReadFile(opts.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	if opts.mtls() && (opts.tlsCert == "" || opts.tlsKey == "" || opts.tlsCA == "") {
+		return nil, fmt.Errorf("mTLS requires --tcp-tls-cert, --tcp-tls-key, and --tcp-tls-client-ca")
+	}
+	if token == "" && !opts.mtls() {
+		return nil, fmt.Errorf("TCP listener requires authentication: set --tcp-token-file, %s, or mTLS flags", tcpTokenEnv)
+	}
+
+	addr, host, err := tcpListenAddr(opts.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := inheritedListener("tcp:" + addr)
+	if listener == nil {
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		keepTransferable("tcp:"+addr, listener)
+	}
+
+	authMode := "token"
+	if opts.mtls() {
+		tlsListener, err := proxy.NewMTLSListener(listener, opts.tlsCert, opts.tlsKey, opts.tlsCA)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		listener = tlsListener
+		authMode = "mtls"
+	}
+	if token != "" {
+		listener = proxy.NewTokenListener(listener, token, logger)
+		if opts.mtls() {
+			authMode = "mtls+token"
+		}
+	}
+
+	logger.Warn("TCP agent listener enabled; any authenticated client can use your SSH keys",
+		"address", listener.Addr().String(),
+		"auth", authMode)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		logger.Warn("TCP agent listener is reachable from other hosts", "address", listener.Addr().String())
+	}
+
+	return listener, nil
+}
+
+// tcpListenAddr returns the address to listen on for --tcp-listen addr and
+// its host. A bare port such as ":7777" means loopback only; listening on
+// every interface takes an explicit "0.0.0.0:7777".
+func tcpListenAddr(addr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid TCP address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), host, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// tmuxStatusMarker identifies the status-line snippet we install so that
+// running tmux-setup again doesn't append a second copy.
+const tmuxStatusMarker = "tmux-setup --status"
+
+func runTmuxSetup(args []string) {
+	fs := flag.NewFlagSet("tmux-setup", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		guard      = fs.Bool("guard", false, "Remove SSH_AUTH_SOCK from tmux's update-environment")
+		statusLine = fs.Bool("status-line", false, "Append proxy health to tmux's status-right")
+		status     = fs.Bool("status", false, "Print a one-line proxy health summary for the status line and exit")
+		verbose    = fs.Bool("v", false, "Enable verbose logging")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tmux-setup [options] [proxy-socket-path]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Points the running tmux server at the proxy by setting SSH_AUTH_SOCK in\n")
+		fmt.Fprintf(os.Stderr, "the global and every session's environment, so new panes and windows\n")
+		fmt.Fprintf(os.Stderr, "keep working after you reattach from a new SSH connection.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	socketArg := defaultSocketArg()
+	if fs.NArg() == 1 {
+		socketArg = fs.Arg(0)
+	}
+	proxySocket := expandPath(socketArg, logger)
+
+	if *status {
+		if batchMode {
+			printJSON(tmuxStatusReport{Status: tmuxStatus(proxySocket, logger)})
+			return
+		}
+		fmt.Println(tmuxStatus(proxySocket, logger))
+		return
+	}
+
+	if _, err := exec.LookPath("tmux"); err != nil {
+		exitError("tmux not found in PATH")
+	}
+	if err := tmux("set-environment", "-g", "SSH_AUTH_SOCK", proxySocket); err != nil {
+		exitError("%v (is a tmux server running?)", err)
+	}
+	humanf("Set global SSH_AUTH_SOCK to %s\n", proxySocket)
+
+	// Sessions pick up SSH_AUTH_SOCK from the client on attach, and that
+	// session value shadows the global one for new panes.
+	report := tmuxReport{Socket: proxySocket, Sessions: []string{}, Guarded: *guard, StatusLine: *statusLine}
+	for _, session := range tmuxSessions() {
+		if err := tmux("set-environment", "-t", session, "SSH_AUTH_SOCK", proxySocket); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to update session %q: %v\n", session, err)
+			continue
+		}
+		report.Sessions = append(report.Sessions, session)
+		humanf("Set SSH_AUTH_SOCK for session %s\n", session)
+	}
+
+	if *guard {
+		if err := tmuxGuardUpdateEnvironment(); err != nil {
+			exitError("failed to update update-environment: %v", err)
+		}
+	}
+
+	if *statusLine {
+		if err := tmuxInstallStatusLine(proxySocket); err != nil {
+			exitError("failed to update status-right: %v", err)
+		}
+	}
+
+	if batchMode {
+		printJSON(report)
+		return
+	}
+	fmt.Println()
+	fmt.Println("These changes last until the tmux server exits. To keep them, add to ~/.tmux.conf:")
+	fmt.Printf("  set-environment -g SSH_AUTH_SOCK %s\n", proxySocket)
+	if *guard {
+		fmt.Println("  set-option -g update-environment \"DISPLAY KRB5CCNAME SSH_ASKPASS SSH_AGENT_PID SSH_CONNECTION WINDOWID XAUTHORITY\"")
+	}
+	if *statusLine {
+		fmt.Printf("  set-option -ga status-right \" %s\"\n", tmuxStatusCommand(proxySocket))
+	}
+}
+
+// tmuxReport is what tmux-setup prints in batch mode: the sessions it
+// pointed at socket, and whether it also changed update-environment and
+// status-right.
+type tmuxReport struct {
+	Socket     string   `json:"socket"`
+	Sessions   []string `json:"sessions"`
+	Guarded    bool     `json:"guarded"`
+	StatusLine bool     `json:"status_line"`
+}
+
+// tmuxStatusReport is what tmux-setup --status prints in batch mode.
+type tmuxStatusReport struct {
+	Status string `json:"status"`
+}
+
+// tmuxGuardUpdateEnvironment drops SSH_AUTH_SOCK from update-environment so
+// reattaching doesn't replace the proxy with the new connection's socket.
+func tmuxGuardUpdateEnvironment() error {
+	out, err := tmuxOutput("show-options", "-gv", "update-environment")
+	if err != nil {
+		return err
+	}
+	var kept []string
+	removed := false
+	for _, name := range strings.Fields(out) {
+		if name == "SSH_AUTH_SOCK" {
+			removed = true
+			continue
+		}
+		kept = append(kept, name)
+	}
+	if !removed {
+		humanf("update-environment already leaves SSH_AUTH_SOCK alone\n")
+		return nil
+	}
+	if err := tmux("set-option", "-g", "update-environment", strings.Join(kept, " ")); err != nil {
+		return err
+	}
+	humanf("Removed SSH_AUTH_SOCK from update-environment\n")
+	return nil
+}
+
+func tmuxInstallStatusLine(proxySocket string) error {
+	out, err := tmuxOutput("show-options", "-gv", "status-right")
+	if err != nil {
+		return err
+	}
+	if strings.Contains(out, tmuxStatusMarker) {
+		humanf("status-right already shows proxy health\n")
+		return nil
+	}
+	if err := tmux("set-option", "-ga", "status-right", " "+tmuxStatusCommand(proxySocket)); err != nil {
+		return err
+	}
+	humanf("Added proxy health to status-right\n")
+	return nil
+}
+
+// tmuxStatusCommand is the #() format that runs our status check from tmux.
+func tmuxStatusCommand(proxySocket string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	return fmt.Sprintf("#(%s %s %s)", executable, tmuxStatusMarker, proxySocket)
+}
+
+// tmuxStatus summarizes proxy and upstream health in a few characters,
+// since tmux reruns it every status-interval.
+func tmuxStatus(proxySocket string, logger *slog.Logger) string {
+	status := checkStatus(proxySocket, true, logger)
+	switch {
+	case !status.Listening:
+		return "agent:down"
+	case !status.Upstream:
+		return "agent:no-upstream"
+	case status.Keys == 0:
+		return "agent:no-keys"
+	}
+	return fmt.Sprintf("agent:%d", status.Keys)
+}
+
+// tmuxSessions lists the running tmux server's sessions, or none if no
+// server is running.
+func tmuxSessions() []string {
+	out, err := tmuxOutput("list-sessions", "-F", "#{session_name}")
+	if err != nil {
+		return nil
+	}
+	var sessions []string
+	for _, session := range strings.Split(strings.TrimSpace(out), "\n") {
+		if session != "" {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func tmux(args ...string) error {
+	_, err := tmuxOutput(args...)
+	return err
+}
+
+func tmuxOutput(args ...string) (string, error) {
+	out, err := exec.Command("tmux", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("tmux %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("tmux %s: %w", args[0], err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// tmuxEnvInterval is how often --tmux-env checks that tmux still points at
+// the proxy. Reattaching from a new SSH connection can replace a session's
+// SSH_AUTH_SOCK at any time, so it's rechecked rather than set once.
+const tmuxEnvInterval = 15 * time.Second
+
+// exportToTmux keeps SSH_AUTH_SOCK in the tmux server's global environment,
+// and in every session's, pointed at proxySocket until ctx is done, so new
+// panes use the proxy however the user's shell init sets things up. Having
+// no tmux server running is normal; it's checked for again each interval.
+func exportToTmux(ctx context.Context, proxySocket string, logger *slog.Logger) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		logger.Warn("--tmux-env has no effect: tmux not found in PATH")
+		return
+	}
+
+	ticker := time.NewTicker(tmuxEnvInterval)
+	defer ticker.Stop()
+	for {
+		syncTmuxEnvironment(proxySocket, logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncTmuxEnvironment sets SSH_AUTH_SOCK wherever tmux has it set to
+// something other than proxySocket.
+func syncTmuxEnvironment(proxySocket string, logger *slog.Logger) {
+	global, _, err := tmuxEnvironment("-g")
+	if err != nil {
+		logger.Debug("No tmux server to point at the proxy", "error", err)
+		return
+	}
+	if global != proxySocket {
+		if err := tmux("set-environment", "-g", "SSH_AUTH_SOCK", proxySocket); err != nil {
+			logger.Warn("Failed to set SSH_AUTH_SOCK in tmux", "error", err)
+			return
+		}
+		logger.Info("Pointed tmux's global SSH_AUTH_SOCK at the proxy", "was", global)
+	}
+
+	for _, session := range tmuxSessions() {
+		current, set, err := tmuxEnvironment("-t", session)
+		if err != nil || !set || current == proxySocket {
+			// A session without its own value inherits the global one
+			continue
+		}
+		if err := tmux("set-environment", "-t", session, "SSH_AUTH_SOCK", proxySocket); err != nil {
+			logger.Warn("Failed to set SSH_AUTH_SOCK in tmux session", "session", session, "error", err)
+			continue
+		}
+		logger.Info("Pointed tmux session's SSH_AUTH_SOCK at the proxy", "session", session, "was", current)
+	}
+}
+
+// tmuxEnvironment returns SSH_AUTH_SOCK in the environment scope selects
+// ("-g", or "-t" and a session), reporting whether the scope sets it at
+// all. A session that removes it (tmux's -SSH_AUTH_SOCK, from attaching
+// without one) sets it to "", hiding the global value from new panes.
+func tmuxEnvironment(scope ...string) (string, bool, error) {
+	out, err := tmuxOutput(append(append([]string{"show-environment"}, scope...), "SSH_AUTH_SOCK")...)
+	if err != nil {
+		// tmux fails on a variable the scope has never set
+		if strings.Contains(err.Error(), "unknown variable") {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	value, _ := strings.CutPrefix(strings.TrimSpace(out), "SSH_AUTH_SOCK=")
+	if value == "-SSH_AUTH_SOCK" {
+		return "", true, nil
+	}
+	return value, true, nil
+}
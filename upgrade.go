@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// upgradeReport is what upgrade prints in batch mode.
+type upgradeReport struct {
+	PID       int      `json:"pid"`
+	OldPID    int      `json:"old_pid"`
+	Listeners []string `json:"listeners"`
+}
+
+// runUpgrade replaces a running proxy with this executable without
+// closing its sockets. The proxy hands its listeners over the control
+// socket, the new proxy starts on them with the same arguments, and the
+// old one finishes its in-flight requests and exits.
+func runUpgrade(args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	addBatchFlag(fs)
+	socket := fs.String("socket", "", "Control socket path (default: "+defaultControlSocket(defaultSocketArg())+")")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s upgrade [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Replaces a running proxy with this version of double-agent. The proxy's\n")
+		fmt.Fprintf(os.Stderr, "sockets stay open throughout, and requests it's in the middle of finish\n")
+		fmt.Fprintf(os.Stderr, "before it exits.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, false)
+	ctlSocket := *socket
+	if ctlSocket == "" {
+		ctlSocket = defaultControlSocket(defaultSocketArg())
+	}
+	ctlSocket = expandPath(ctlSocket, logger)
+
+	report, err := upgradeProxy(ctlSocket, logger)
+	if err != nil {
+		exitError("%v", err)
+	}
+	if batchMode {
+		printJSON(report)
+		return
+	}
+	fmt.Printf("Upgraded to v%s: PID %d took over from %d\n", version, report.PID, report.OldPID)
+	fmt.Printf("The old proxy exits once its in-flight requests finish\n")
+}
+
+// upgradeProxy takes the listeners from the proxy behind ctlSocket and
+// starts this executable on them.
+func upgradeProxy(ctlSocket string, logger *slog.Logger) (upgradeReport, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return upgradeReport{}, fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "double-agent-upgrade-")
+	if err != nil {
+		return upgradeReport{}, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "handoff.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return upgradeReport{}, err
+	}
+	defer func() { _ = listener.Close() }()
+	_ = listener.SetDeadline(time.Now().Add(handoffReadyTimeout))
+
+	// The proxy connects back before answering, so its listeners are
+	// waiting to be accepted by the time it has
+	if _, err := proxy.ControlRequest(ctlSocket, "handoff", path); err != nil {
+		return upgradeReport{}, fmt.Errorf("proxy didn't hand over its listeners: %w", err)
+	}
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		return upgradeReport{}, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(handoffReadyTimeout))
+
+	files, err := receiveListeners(conn)
+	if err != nil {
+		return upgradeReport{}, fmt.Errorf("failed to receive listeners: %w", err)
+	}
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	var header handoffHeader
+	if err := json.NewDecoder(conn).Decode(&header); err != nil {
+		return upgradeReport{}, fmt.Errorf("failed to read handoff: %w", err)
+	}
+	if len(header.Listeners) != len(files) {
+		return upgradeReport{}, fmt.Errorf("proxy named %d listeners but sent %d", len(header.Listeners), len(files))
+	}
+	logger.Debug("Received listeners", "pid", header.PID, "listeners", header.Listeners)
+
+	pid, err := startReplacement(executable, header, files)
+	if err != nil {
+		return upgradeReport{}, err
+	}
+	// Tell the old proxy to stop accepting
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return upgradeReport{}, fmt.Errorf("new proxy %d is serving, but the old one didn't hear so and is still running: %w", pid, err)
+	}
+	return upgradeReport{PID: pid, OldPID: header.PID, Listeners: header.Listeners}, nil
+}
+
+// startReplacement starts executable detached as header describes, on
+// files, and waits for it to report serving. One that doesn't is killed,
+// leaving the old proxy to carry on.
+func startReplacement(executable string, header handoffHeader, files []*os.File) (int, error) {
+	names, err := json.Marshal(header.Listeners)
+	if err != nil {
+		return 0, err
+	}
+	env := slices.DeleteFunc(slices.Clone(header.Env), func(v string) bool {
+		return strings.HasPrefix(v, handoffEnv+"=")
+	})
+	env = append(env, handoffEnv+"="+string(names))
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = readyReader.Close() }()
+	procFiles := append([]*os.File{nil, nil, nil}, files...)
+	process, err := os.StartProcess(executable, append([]string{executable}, header.Args...), &os.ProcAttr{
+		Dir:   header.Dir,
+		Env:   env,
+		Files: append(procFiles, readyWriter),
+	})
+	_ = readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start new proxy: %w", err)
+	}
+
+	_ = readyReader.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	var ready [1]byte
+	if _, err := readyReader.Read(ready[:]); err != nil || ready[0] != 1 {
+		_ = process.Kill()
+		_, _ = process.Wait()
+		return 0, fmt.Errorf("new proxy exited or stalled before serving, so the old one is still running; see the log")
+	}
+	pid := process.Pid
+	_ = process.Release()
+	return pid, nil
+}
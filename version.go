@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// versionInfo describes the running build, for --version and bug reports.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// buildVersion combines the version set at build time with what the Go
+// toolchain recorded: the module version for go install builds, and the
+// VCS revision for builds from a checkout.
+func buildVersion() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "dev" && isReleaseVersion(build.Main.Version) {
+		info.Version = strings.TrimPrefix(build.Main.Version, "v")
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.Date = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// pseudoVersion matches the timestamp and revision Go puts in module
+// versions of untagged commits, which the commit line already shows.
+var pseudoVersion = regexp.MustCompile(`\d{14}-[0-9a-f]{12}`)
+
+// isReleaseVersion reports whether a module version names a tagged release.
+func isReleaseVersion(v string) bool {
+	return v != "" && v != "(devel)" && !pseudoVersion.MatchString(v)
+}
+
+func (v versionInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "double-agent version %s\n", v.Version)
+	if v.Commit != "" {
+		commit := v.Commit
+		if v.Modified {
+			commit += " (modified)"
+		}
+		fmt.Fprintf(&b, "commit: %s\n", commit)
+	}
+	if v.Date != "" {
+		fmt.Fprintf(&b, "date:   %s\n", v.Date)
+	}
+	fmt.Fprintf(&b, "go:     %s %s/%s\n", v.GoVersion, v.OS, v.Arch)
+	return b.String()
+}
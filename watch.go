@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/phinze/double-agent/proxy"
+)
+
+// watchEvent is one line of 'watch --json' output.
+type watchEvent struct {
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	Socket *discoveredSocket `json:"socket,omitempty"`
+	Active *string           `json:"active,omitempty"`
+}
+
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	addBatchFlag(fs)
+	var (
+		interval    = fs.Duration("interval", time.Second, "How often to rescan")
+		jsonOutput  = fs.Bool("json", false, "Stream events as JSON, one object per line")
+		discoverCmd = fs.String("discover-cmd", "", "Command that prints extra candidate socket paths")
+		strategy    = fs.String("selection-strategy", proxy.StrategyNewest, "How to choose among valid sockets: newest, most-keys, or pinned:<path>")
+		verbose     = fs.Bool("v", false, "Enable verbose logging")
+	)
+	var prefer listFlag
+	fs.Var(&prefer, "prefer", "Preferred upstream classes or socket paths, most preferred first")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Rescans for agent sockets and prints each one that appears, disappears,\n")
+		fmt.Fprintf(os.Stderr, "or changes validity, along with changes to the socket the proxy would\n")
+		fmt.Fprintf(os.Stderr, "pick. Useful for debugging tmux and ssh reattach behavior.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 || *interval <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := newLogger(os.Stderr, *verbose)
+	for i, entry := range prefer {
+		prefer[i] = expandPath(entry, logger)
+	}
+	if pinned, ok := strings.CutPrefix(*strategy, "pinned:"); ok {
+		*strategy = "pinned:" + expandPath(pinned, logger)
+	}
+	if err := proxy.ValidateStrategy(*strategy); err != nil {
+		exitError("%v", err)
+	}
+	discovery := &proxy.Discovery{
+		Command:  *discoverCmd,
+		Prefer:   prefer,
+		Strategy: *strategy,
+		Logger:   logger,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(event proxy.DiscoveryEvent) {
+		if *jsonOutput || batchMode {
+			out := watchEvent{Type: event.Type, Time: event.Time}
+			if event.Type == proxy.EventActive {
+				out.Active = &event.Active
+			} else {
+				socket := newDiscoveredSocket(event.Socket)
+				out.Socket = &socket
+			}
+			_ = encoder.Encode(out)
+			return
+		}
+		printWatchEvent(event)
+	}
+
+	if err := discovery.Watch(ctx, *interval, emit); err != nil {
+		exitError("%v", err)
+	}
+}
+
+func printWatchEvent(event proxy.DiscoveryEvent) {
+	stamp := event.Time.Format("15:04:05")
+	if event.Type == proxy.EventActive {
+		if event.Active == "" {
+			fmt.Printf("%s active      (none)\n", stamp)
+		} else {
+			fmt.Printf("%s active      %s\n", stamp, event.Active)
+		}
+		return
+	}
+
+	socket := event.Socket
+	status := "STALE"
+	if socket.Valid {
+		status = fmt.Sprintf("VALID, %d keys", socket.Keys)
+	}
+	fmt.Printf("%s %-11s %s [%s] (%s)\n", stamp, event.Type, socket.Path, status, socket.Class)
+	if !socket.Valid && socket.Reason != "" && event.Type != proxy.EventDisappeared {
+		fmt.Printf("         %-11s Reason: %s\n", "", socket.Reason)
+	}
+}